@@ -6,7 +6,7 @@
 
 package auth
 
-import "time"
+import "github.com/SSHcom/privx-sdk-go/common"
 
 // Params query params definition
 type Params struct {
@@ -20,8 +20,8 @@ type Params struct {
 type IDPClient struct {
 	ID                             string            `json:"id"`
 	Name                           string            `json:"name"`
-	Created                        time.Time         `json:"created,omitempty"`
-	Updated                        time.Time         `json:"updated,omitempty"`
+	Created                        common.Time       `json:"created,omitempty"`
+	Updated                        common.Time       `json:"updated,omitempty"`
 	IDPType                        string            `json:"idp_type"`
 	OIDCIssuer                     string            `json:"oidc_issuer,omitempty"`
 	OIDCAudience                   []string          `json:"oidc_audience"`
@@ -62,20 +62,20 @@ type IDstruct struct {
 }
 
 type Session struct {
-	ID           string    `json:"id"`
-	UserID       string    `json:"user_id"`
-	SourceID     string    `json:"source_id"`
-	Domain       string    `json:"domain"`
-	Username     string    `json:"username"`
-	RemoteAddr   string    `json:"remote_addr"`
-	UserAgent    string    `json:"user_agent"`
-	Type         string    `json:"type"`
-	Created      time.Time `json:"created"`
-	Updated      time.Time `json:"updated"`
-	Expires      time.Time `json:"expires"`
-	TokenExpires time.Time `json:"token_expires"`
-	LoggedOut    bool      `json:"logged_out"`
-	Current      bool      `json:"current,omitempty"`
+	ID           string      `json:"id"`
+	UserID       string      `json:"user_id"`
+	SourceID     string      `json:"source_id"`
+	Domain       string      `json:"domain"`
+	Username     string      `json:"username"`
+	RemoteAddr   string      `json:"remote_addr"`
+	UserAgent    string      `json:"user_agent"`
+	Type         string      `json:"type"`
+	Created      common.Time `json:"created"`
+	Updated      common.Time `json:"updated"`
+	Expires      common.Time `json:"expires"`
+	TokenExpires common.Time `json:"token_expires"`
+	LoggedOut    bool        `json:"logged_out"`
+	Current      bool        `json:"current,omitempty"`
 }
 
 type sessionsResult struct {
@@ -7,9 +7,17 @@
 package authorizer
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"net/url"
+	"strings"
+	"time"
 
+	"github.com/SSHcom/privx-sdk-go/api/hoststore"
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
 	"github.com/SSHcom/privx-sdk-go/restapi"
+	"golang.org/x/crypto/ssh"
 )
 
 // Client is a authorizer client instance.
@@ -22,6 +30,11 @@ type templatesResult struct {
 	Items []CertTemplate `json:"items"`
 }
 
+type trustedCAResult struct {
+	Count int         `json:"count"`
+	Items []TrustedCA `json:"items"`
+}
+
 type accessGroupResult struct {
 	Count int           `json:"count"`
 	Items []AccessGroup `json:"items"`
@@ -70,6 +83,40 @@ func (auth *Client) CertificateRevocationList(caID, filename string) error {
 	return err
 }
 
+// TrustedCAs lists external CAs trusted for host and user authentication
+func (auth *Client) TrustedCAs() ([]TrustedCA, error) {
+	result := trustedCAResult{}
+
+	_, err := auth.api.
+		URL("/authorizer/api/v1/trusted-cas").
+		Get(&result)
+
+	return result.Items, err
+}
+
+// AddTrustedCA uploads PEM encoded CA certificate, the certificate is
+// validated by the server
+func (auth *Client) AddTrustedCA(ca *TrustedCA) (string, error) {
+	var object struct {
+		ID string `json:"id"`
+	}
+
+	_, err := auth.api.
+		URL("/authorizer/api/v1/trusted-cas").
+		Post(ca, &object)
+
+	return object.ID, err
+}
+
+// DeleteTrustedCA removes trust of the CA
+func (auth *Client) DeleteTrustedCA(caID string) error {
+	_, err := auth.api.
+		URL("/authorizer/api/v1/trusted-cas/%s", url.PathEscape(caID)).
+		Delete()
+
+	return err
+}
+
 // TargetHostCredentials get target host credentials for the user
 func (auth *Client) TargetHostCredentials(authorizer *AuthorizationRequest) (*ApiIdentitiesResponse, error) {
 	principal := &ApiIdentitiesResponse{}
@@ -81,6 +128,58 @@ func (auth *Client) TargetHostCredentials(authorizer *AuthorizationRequest) (*Ap
 	return principal, err
 }
 
+// CanAccess checks if the user is able to access the host service as
+// the account. The decision is evaluated from user's current roles and
+// host's principal mapping, the same inputs used by authorizer. Denied
+// access is a normal result, the error is returned only on failures.
+func (auth *Client) CanAccess(userID, hostID, service, account string) (*AccessDecision, error) {
+	host, err := hoststore.New(auth.api).Host(hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	hasService := false
+	for _, s := range host.Services {
+		hasService = hasService || strings.EqualFold(string(s.Scheme), service)
+	}
+	if !hasService {
+		return &AccessDecision{
+			Reason: fmt.Sprintf("host does not provide %s service", service),
+		}, nil
+	}
+
+	userRoles, err := rolestore.New(auth.api).UserRoles(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	granted := map[string]bool{}
+	for _, role := range userRoles {
+		granted[role.ID] = true
+	}
+
+	decision := &AccessDecision{}
+	for _, principal := range host.Principals {
+		if principal.ID != account {
+			continue
+		}
+		for _, role := range principal.Roles {
+			if granted[role.ID] {
+				decision.Roles, _ = rolestore.GrantRole(decision.Roles, role)
+			}
+		}
+	}
+
+	if len(decision.Roles) == 0 {
+		decision.Reason = fmt.Sprintf("no role of the user grants account %s", account)
+		return decision, nil
+	}
+
+	decision.Allowed = true
+	decision.Reason = fmt.Sprintf("account %s is granted by role %s", account, decision.Roles[0].Name)
+	return decision, nil
+}
+
 // Principals gets defined principals from the authorizer
 func (auth *Client) Principals() ([]Principal, error) {
 	principals := []Principal{}
@@ -159,6 +258,53 @@ func (auth *Client) SignPrincipalKey(groupID, keyID string, credential *Credenti
 	return signature, err
 }
 
+// SignHostKey issues host certificate of the public key for the principals,
+// i.e. host names. The certificate is valid from now for the validity.
+// Credentials without permission to sign host certificates are rejected
+// with restapi.ErrForbidden.
+func (auth *Client) SignHostKey(publicKey []byte, principals []string, validity time.Duration) (*Certificate, error) {
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errors.New("public key is a certificate")
+	}
+	if len(principals) == 0 {
+		return nil, errors.New("host certificate requires principals")
+	}
+	if validity < time.Second {
+		return nil, errors.New("host certificate requires validity")
+	}
+
+	request := hostSignRequest{
+		PublicKey:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Principals: principals,
+		Validity:   int64(validity / time.Second),
+	}
+	response := hostSignResponse{}
+
+	_, err = auth.api.
+		URL("/authorizer/api/v1/ca/host/sign").
+		Post(&request, &response)
+	if errors.Is(err, restapi.ErrForbidden) {
+		return nil, fmt.Errorf("signing host certificate requires ca-manage permission: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := ParseCertificate([]byte(response.Certificate))
+	if err != nil {
+		return nil, err
+	}
+	if !parsed.IsCertificate || parsed.CertType != "host" {
+		return nil, errors.New("authorizer did not issue host certificate")
+	}
+
+	return &Certificate{Data: response.Certificate, ParsedCert: *parsed}, nil
+}
+
 // ExtenderCACertificates gets authorizer's extender CA certificates
 func (auth *Client) ExtenderCACertificates(accessGroupID string) ([]CA, error) {
 	certificates := []CA{}
@@ -318,6 +464,46 @@ func (auth *Client) DownloadWebProxyConfig(trustedClientID, sessionID, filename
 	return err
 }
 
+// ExtenderConfig generates and returns extender config of the trusted
+// client, callers write it to config dir of the extender
+func (auth *Client) ExtenderConfig(trustedClientID string) ([]byte, error) {
+	return auth.trustedClientConfig("/authorizer/api/v1/extender/conf", trustedClientID)
+}
+
+// CarrierConfig generates and returns carrier config of the trusted client
+func (auth *Client) CarrierConfig(trustedClientID string) ([]byte, error) {
+	return auth.trustedClientConfig("/authorizer/api/v1/carrier/conf", trustedClientID)
+}
+
+// WebProxyConfig generates and returns web proxy config of the trusted
+// client
+func (auth *Client) WebProxyConfig(trustedClientID string) ([]byte, error) {
+	return auth.trustedClientConfig("/authorizer/api/v1/icap/conf", trustedClientID)
+}
+
+// trustedClientConfig requests download handle of the config and reads
+// the config with it
+func (auth *Client) trustedClientConfig(path, trustedClientID string) ([]byte, error) {
+	handle := &DownloadHandle{}
+
+	_, err := auth.api.
+		URL("%s/%s", path, url.PathEscape(trustedClientID)).
+		Post(nil, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &bytes.Buffer{}
+	_, err = auth.api.
+		URL("%s/%s/%s", path, url.PathEscape(trustedClientID), url.PathEscape(handle.SessionID)).
+		DownloadTo(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.Bytes(), nil
+}
+
 // CertTemplates returns the certificate authentication templates for the service
 func (auth *Client) CertTemplates(service string) ([]CertTemplate, error) {
 	result := templatesResult{}
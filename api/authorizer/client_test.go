@@ -0,0 +1,382 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package authorizer_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/authorizer"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+	"golang.org/x/crypto/ssh"
+)
+
+func mockKey(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, signer
+}
+
+func TestParseCertificate(t *testing.T) {
+	key, _ := mockKey(t)
+	_, ca := mockKey(t)
+
+	after := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	before := after.Add(time.Hour)
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "alice@privx",
+		ValidPrincipals: []string{"alice", "root"},
+		ValidAfter:      uint64(after.Unix()),
+		ValidBefore:     uint64(before.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{
+		"authorized":  ssh.MarshalAuthorizedKey(cert),
+		"base64":      []byte(base64.StdEncoding.EncodeToString(cert.Marshal())),
+		"wire format": cert.Marshal(),
+	} {
+		parsed, err := authorizer.ParseCertificate(data)
+		if err != nil {
+			t.Fatalf("%s: parse fails: %v", name, err)
+		}
+
+		expect := &authorizer.ParsedCert{
+			IsCertificate: true,
+			CertType:      "user",
+			KeyType:       ssh.KeyAlgoED25519,
+			Fingerprint:   ssh.FingerprintSHA256(key),
+			KeyID:         "alice@privx",
+			Principals:    []string{"alice", "root"},
+			ValidAfter:    after,
+			ValidBefore:   before,
+		}
+		if !reflect.DeepEqual(parsed, expect) {
+			t.Errorf("%s: unexpected cert: %+v", name, parsed)
+		}
+	}
+
+	parsed, _ := authorizer.ParseCertificate(ssh.MarshalAuthorizedKey(cert))
+	if !parsed.IsValidAt(after) || parsed.IsValidAt(before) {
+		t.Errorf("invalid validity check")
+	}
+}
+
+func TestParseCertificateRawKey(t *testing.T) {
+	key, _ := mockKey(t)
+
+	parsed, err := authorizer.ParseCertificate(ssh.MarshalAuthorizedKey(key))
+	if err != nil {
+		t.Fatalf("parse fails: %v", err)
+	}
+
+	if parsed.IsCertificate || parsed.KeyType != ssh.KeyAlgoED25519 ||
+		parsed.Fingerprint != ssh.FingerprintSHA256(key) ||
+		!parsed.IsValidAt(time.Now()) {
+		t.Errorf("unexpected key: %+v", parsed)
+	}
+
+	if _, err = authorizer.ParseCertificate([]byte("garbage")); err == nil {
+		t.Errorf("invalid data is parsed")
+	}
+}
+
+// mockTrustedCAs keeps trusted CAs in memory, certificates without PEM
+// header are rejected like the server does
+func mockTrustedCAs() *httptest.Server {
+	cas := map[string]authorizer.TrustedCA{}
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := strings.TrimPrefix(r.URL.Path, "/authorizer/api/v1/trusted-cas")
+			id = strings.TrimPrefix(id, "/")
+
+			switch {
+			case r.Method == http.MethodGet && id == "":
+				items := []authorizer.TrustedCA{}
+				for _, ca := range cas {
+					items = append(items, ca)
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"count": len(items),
+					"items": items,
+				})
+			case r.Method == http.MethodPost && id == "":
+				ca := authorizer.TrustedCA{}
+				json.NewDecoder(r.Body).Decode(&ca)
+				if !strings.HasPrefix(ca.Certificate, "-----BEGIN CERTIFICATE-----") {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"error_code": "INVALID_CERTIFICATE", "error_message": "certificate is not valid PEM", "property": "certificate"}`))
+					return
+				}
+				ca.ID = "ca" + strconv.Itoa(len(cas)+1)
+				cas[ca.ID] = ca
+				w.Write([]byte(`{"id": "` + ca.ID + `"}`))
+			case r.Method == http.MethodDelete:
+				if _, ok := cas[id]; !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				delete(cas, id)
+			default:
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		}),
+	)
+}
+
+func TestTrustedCAs(t *testing.T) {
+	ts := mockTrustedCAs()
+	defer ts.Close()
+
+	auth := authorizer.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	id, err := auth.AddTrustedCA(&authorizer.TrustedCA{
+		Name:        "internal",
+		Usage:       authorizer.TrustedCAHost,
+		Certificate: "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+	})
+	if err != nil || id != "ca1" {
+		t.Fatalf("add fails: %s, %v", id, err)
+	}
+
+	cas, err := auth.TrustedCAs()
+	if err != nil || len(cas) != 1 || cas[0].Name != "internal" || cas[0].Usage != authorizer.TrustedCAHost {
+		t.Errorf("unexpected CAs: %+v, %v", cas, err)
+	}
+
+	_, err = auth.AddTrustedCA(&authorizer.TrustedCA{Name: "broken", Certificate: "garbage"})
+	var apiErr *restapi.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode != "INVALID_CERTIFICATE" || apiErr.Property != "certificate" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := auth.DeleteTrustedCA(id); err != nil {
+		t.Errorf("delete fails: %v", err)
+	}
+	if err := auth.DeleteTrustedCA(id); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	cas, err = auth.TrustedCAs()
+	if err != nil || len(cas) != 0 {
+		t.Errorf("unexpected CAs: %+v, %v", cas, err)
+	}
+}
+
+func TestExtenderConfig(t *testing.T) {
+	requested := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = append(requested, r.Method+" "+r.URL.EscapedPath())
+			switch r.URL.EscapedPath() {
+			case "/authorizer/api/v1/extender/conf/tc%2F1":
+				w.Write([]byte(`{"session_id": "s1"}`))
+			case "/authorizer/api/v1/extender/conf/tc%2F1/s1":
+				w.Write([]byte("[extender]\nname = \"tc/1\"\n"))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	auth := authorizer.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	config, err := auth.ExtenderConfig("tc/1")
+	if err != nil || string(config) != "[extender]\nname = \"tc/1\"\n" {
+		t.Errorf("unexpected config: %q, %v", config, err)
+	}
+
+	expect := []string{
+		"POST /authorizer/api/v1/extender/conf/tc%2F1",
+		"GET /authorizer/api/v1/extender/conf/tc%2F1/s1",
+	}
+	if !reflect.DeepEqual(requested, expect) {
+		t.Errorf("unexpected requests: %v", requested)
+	}
+
+	if _, err := auth.CarrierConfig("tc/1"); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// mockAuth provides static access token
+type mockAuth struct{}
+
+func (mockAuth) AccessToken() (string, error) { return "token", nil }
+
+func TestSignHostKey(t *testing.T) {
+	_, ca := mockKey(t)
+	certType := uint32(ssh.HostCert)
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/authorizer/api/v1/ca/host/sign" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			var request struct {
+				PublicKey  string   `json:"public_key"`
+				Principals []string `json:"principals"`
+				Validity   int64    `json:"validity_seconds"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(request.PublicKey))
+			if err != nil {
+				t.Errorf("invalid public key: %v", err)
+			}
+
+			now := time.Now()
+			cert := &ssh.Certificate{
+				Key:             key,
+				CertType:        certType,
+				KeyId:           "host",
+				ValidPrincipals: request.Principals,
+				ValidAfter:      uint64(now.Unix()),
+				ValidBefore:     uint64(now.Unix() + request.Validity),
+			}
+			if err := cert.SignCert(rand.Reader, ca); err != nil {
+				t.Fatal(err)
+			}
+			json.NewEncoder(w).Encode(map[string]string{
+				"certificate": string(ssh.MarshalAuthorizedKey(cert)),
+			})
+		}),
+	)
+	defer ts.Close()
+
+	key, _ := mockKey(t)
+	principals := []string{"db1.example.com", "10.0.0.5"}
+	store := authorizer.New(restapi.New(restapi.BaseURL(ts.URL), restapi.Auth(mockAuth{})))
+
+	cert, err := store.SignHostKey(ssh.MarshalAuthorizedKey(key), principals, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("sign fails: %v", err)
+	}
+	if cert.CertType != "host" || !reflect.DeepEqual(cert.Principals, principals) ||
+		cert.Fingerprint != ssh.FingerprintSHA256(key) ||
+		cert.ValidBefore.Sub(cert.ValidAfter) != 24*time.Hour ||
+		!strings.HasPrefix(cert.Data, "ssh-ed25519-cert-v01@openssh.com ") {
+		t.Errorf("unexpected certificate: %+v", cert)
+	}
+
+	certType = ssh.UserCert
+	if _, err := store.SignHostKey(ssh.MarshalAuthorizedKey(key), principals, time.Hour); err == nil {
+		t.Errorf("user certificate is accepted")
+	}
+
+	anonymous := authorizer.New(restapi.New(restapi.BaseURL(ts.URL)))
+	_, err = anonymous.SignHostKey(ssh.MarshalAuthorizedKey(key), principals, time.Hour)
+	if !errors.Is(err, restapi.ErrForbidden) || !strings.Contains(err.Error(), "ca-manage") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for name, sign := range map[string]func() error{
+		"invalid key": func() error {
+			_, err := store.SignHostKey([]byte("garbage"), principals, time.Hour)
+			return err
+		},
+		"no principals": func() error {
+			_, err := store.SignHostKey(ssh.MarshalAuthorizedKey(key), nil, time.Hour)
+			return err
+		},
+		"no validity": func() error {
+			_, err := store.SignHostKey(ssh.MarshalAuthorizedKey(key), principals, 0)
+			return err
+		},
+	} {
+		if err := sign(); err == nil {
+			t.Errorf("%s is accepted", name)
+		}
+	}
+}
+
+func TestCanAccess(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/host-store/api/v1/hosts/h1":
+				w.Write([]byte(`{
+					"id": "h1",
+					"services": [{"service": "SSH", "address": "h1.example.com", "port": 22}],
+					"principals": [
+						{"principal": "root", "roles": [{"id": "admins", "name": "admins"}]},
+						{"principal": "deploy", "roles": [
+							{"id": "ops", "name": "ops"},
+							{"id": "admins", "name": "admins"}
+						]}
+					]
+				}`))
+			case "/role-store/api/v1/users/alice/roles":
+				w.Write([]byte(`{"count": 1, "items": [{"id": "ops", "name": "ops"}]}`))
+			case "/role-store/api/v1/users/bob/roles":
+				w.Write([]byte(`{"count": 1, "items": [{"id": "devs", "name": "devs"}]}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	auth := authorizer.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	decision, err := auth.CanAccess("alice", "h1", "ssh", "deploy")
+	if err != nil || !decision.Allowed {
+		t.Fatalf("access is denied: %+v, %v", decision, err)
+	}
+	if len(decision.Roles) != 1 || decision.Roles[0].ID != "ops" {
+		t.Errorf("unexpected roles: %+v", decision.Roles)
+	}
+
+	for name, check := range map[string][]string{
+		"no matching role": {"bob", "h1", "SSH", "deploy"},
+		"wrong service":    {"alice", "h1", "RDP", "deploy"},
+		"wrong account":    {"alice", "h1", "SSH", "root"},
+		"unknown account":  {"alice", "h1", "SSH", "nobody"},
+	} {
+		decision, err := auth.CanAccess(check[0], check[1], check[2], check[3])
+		if err != nil || decision.Allowed || decision.Reason == "" || len(decision.Roles) != 0 {
+			t.Errorf("%s: unexpected decision: %+v, %v", name, decision, err)
+		}
+	}
+
+	if _, err := auth.CanAccess("alice", "h2", "SSH", "deploy"); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
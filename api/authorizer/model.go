@@ -6,6 +6,16 @@
 
 package authorizer
 
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"golang.org/x/crypto/ssh"
+)
+
 // Params query params definition
 type Params struct {
 	ResponseType  string `json:"response_type,omitempty"`
@@ -179,5 +189,123 @@ type ApiCertificateObject struct {
 	AuthorityKeyID    string       `json:"authority_key_id,omitempty"`
 	ExpiryStatus      ExpiryStatus `json:"expiry_status,omitempty"`
 }
+
 // ExpiryStatus specifies the certificate expiry status
-type ExpiryStatus string
\ No newline at end of file
+type ExpiryStatus string
+
+// AccessDecision is outcome of the access check, Roles lists roles
+// granting the access
+type AccessDecision struct {
+	Allowed bool
+	Reason  string
+	Roles   []rolestore.RoleRef
+}
+
+// TrustedCAUsage defines what the trusted CA authenticates
+type TrustedCAUsage string
+
+// TrustedCAUsage values
+const (
+	TrustedCAHost = TrustedCAUsage("HOST")
+	TrustedCAUser = TrustedCAUsage("USER")
+)
+
+// TrustedCA is an external CA trusted by PrivX, certificate is PEM encoded.
+// Subject, issuer, fingerprint and validity are set by the server.
+type TrustedCA struct {
+	ID          string         `json:"id,omitempty"`
+	Name        string         `json:"name"`
+	Usage       TrustedCAUsage `json:"usage"`
+	Certificate string         `json:"certificate"`
+	Subject     string         `json:"subject,omitempty"`
+	Issuer      string         `json:"issuer,omitempty"`
+	Fingerprint string         `json:"fingerprint,omitempty"`
+	NotBefore   string         `json:"not_before,omitempty"`
+	NotAfter    string         `json:"not_after,omitempty"`
+}
+
+// ParsedCert is SSH certificate or public key details. Raw public keys
+// have no key id, principals or validity. Zero validity time means
+// unbounded validity.
+type ParsedCert struct {
+	IsCertificate bool
+	CertType      string
+	KeyType       string
+	Fingerprint   string
+	KeyID         string
+	Principals    []string
+	ValidAfter    time.Time
+	ValidBefore   time.Time
+}
+
+// Certificate is SSH certificate issued by PrivX CA. Data is the
+// certificate in authorized_keys format.
+type Certificate struct {
+	Data string
+	ParsedCert
+}
+
+type hostSignRequest struct {
+	PublicKey  string   `json:"public_key"`
+	Principals []string `json:"principals"`
+	Validity   int64    `json:"validity_seconds"`
+}
+
+type hostSignResponse struct {
+	Certificate string `json:"certificate"`
+}
+
+// IsValidAt checks if the certificate is valid at the given time
+func (cert *ParsedCert) IsValidAt(t time.Time) bool {
+	return (cert.ValidAfter.IsZero() || !t.Before(cert.ValidAfter)) &&
+		(cert.ValidBefore.IsZero() || t.Before(cert.ValidBefore))
+}
+
+// ParseCertificate parses OpenSSH certificate or public key. The data is
+// either authorized_keys line, base64 encoded or binary wire format.
+func ParseCertificate(data []byte) (*ParsedCert, error) {
+	key, err := parsePublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh certificate: %w", err)
+	}
+
+	parsed := &ParsedCert{
+		KeyType:     key.Type(),
+		Fingerprint: ssh.FingerprintSHA256(key),
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return parsed, nil
+	}
+
+	parsed.IsCertificate = true
+	parsed.KeyType = cert.Key.Type()
+	parsed.Fingerprint = ssh.FingerprintSHA256(cert.Key)
+	parsed.KeyID = cert.KeyId
+	parsed.Principals = cert.ValidPrincipals
+	parsed.CertType = "user"
+	if cert.CertType == ssh.HostCert {
+		parsed.CertType = "host"
+	}
+	if cert.ValidAfter != 0 {
+		parsed.ValidAfter = time.Unix(int64(cert.ValidAfter), 0).UTC()
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		parsed.ValidBefore = time.Unix(int64(cert.ValidBefore), 0).UTC()
+	}
+
+	return parsed, nil
+}
+
+func parsePublicKey(data []byte) (ssh.PublicKey, error) {
+	if key, _, _, _, err := ssh.ParseAuthorizedKey(data); err == nil {
+		return key, nil
+	}
+
+	if bin, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		data = bin
+	}
+
+	return ssh.ParsePublicKey(data)
+}
@@ -7,16 +7,37 @@
 package connectionmanager
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net/url"
+	"sort"
+	"time"
+	"unicode/utf8"
 
 	"github.com/SSHcom/privx-sdk-go/common"
 	"github.com/SSHcom/privx-sdk-go/restapi"
 )
 
+const (
+	// statsPageSize is number of connections fetched per request while
+	// aggregating
+	statsPageSize = 100
+	// statsTopUsers is number of users reported in ConnectionStats.TopUsers
+	statsTopUsers = 10
+	// followOverlap is how far each poll of FollowConnections reaches
+	// before the newest connection seen, it covers connections indexed late
+	followOverlap = time.Minute
+)
+
 // ConnectionManager is a connection manager client instance.
 type ConnectionManager struct {
-	api restapi.Connector
+	api   restapi.Connector
+	clock common.Clock
 }
 
 type connectionsResult struct {
@@ -32,7 +53,12 @@ type connectionsTagResult struct {
 // New creates a new connection manager client instance, using the
 // argument SDK API client.
 func New(api restapi.Connector) *ConnectionManager {
-	return &ConnectionManager{api: api}
+	return &ConnectionManager{api: api, clock: common.SystemClock{}}
+}
+
+// UseClock replaces the system clock used by polling helpers
+func (store *ConnectionManager) UseClock(clock common.Clock) {
+	store.clock = clock
 }
 
 // Connections get all connections
@@ -100,6 +126,237 @@ func (store *ConnectionManager) SearchConnections(offset, limit int, sortdir, so
 	return result.Items, err
 }
 
+// FindConnections searches connections matching the typed filter
+func (store *ConnectionManager) FindConnections(params ConnectionSearchParams) ([]Connection, error) {
+	result, err := store.findConnections(params)
+
+	return result.Items, err
+}
+
+// ConnectionsIter iterates over connections matching the typed filter,
+// fetching them page by page, 100 connections at once by default. Offset
+// and limit of params are ignored. Sort by connected time descending to
+// get latest connections first.
+func (store *ConnectionManager) ConnectionsIter(params ConnectionSearchParams, pageSize int) *common.Pager[Connection] {
+	if pageSize <= 0 {
+		pageSize = 100
+	}
+
+	return common.NewPager(pageSize, func(offset, limit int) ([]Connection, int, error) {
+		page := params
+		page.Offset = offset
+		page.Limit = limit
+
+		result, err := store.findConnections(page)
+		return result.Items, result.Count, err
+	})
+}
+
+// ExportConnections writes connections matching params as JSON lines and
+// returns number of written connections. Connections are streamed page by
+// page, oldest first unless params define the sorting. Cancellation of the
+// context stops the export, the number of already written connections is
+// returned with the context error.
+func (store *ConnectionManager) ExportConnections(ctx context.Context, params ConnectionSearchParams, w io.Writer) (int, error) {
+	if params.Sortkey == "" {
+		params.Sortkey, params.Sortdir = "connected", "ASC"
+	}
+
+	enc := json.NewEncoder(w)
+	count := 0
+
+	connections := store.ConnectionsIter(params, 100)
+	for connections.Next() {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		if err := enc.Encode(connections.Value()); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, connections.Err()
+}
+
+func (store *ConnectionManager) findConnections(params ConnectionSearchParams) (connectionsResult, error) {
+	result := connectionsResult{}
+	filters := Params{
+		Offset:  params.Offset,
+		Limit:   params.Limit,
+		Sortkey: params.Sortkey,
+		Sortdir: params.Sortdir,
+	}
+
+	header, err := store.api.
+		URL("/connection-manager/api/v1/connections/search").
+		Query(&filters).
+		Post(params.body(), &result)
+	result.Count = restapi.TotalCount(header, result.Count)
+
+	return result, err
+}
+
+// ConnectionStats aggregates connections established within the time
+// range. Connections are streamed page by page and aggregated client side,
+// memory use grows with number of distinct users and hosts, not with
+// number of connections. TopUsers holds users with most connections.
+func (store *ConnectionManager) ConnectionStats(from, to time.Time) (*ConnectionStats, error) {
+	stats := &ConnectionStats{
+		From:       from,
+		To:         to,
+		ByProtocol: map[Protocol]int{},
+	}
+	users := map[string]*UserCount{}
+	hosts := map[string]bool{}
+
+	err := store.eachConnection(from, to, func(conn Connection) {
+		stats.Total++
+		stats.BytesIn += int64(conn.BytesIn)
+		stats.BytesOut += int64(conn.BytesOut)
+		stats.ByProtocol[conn.Type]++
+		hosts[conn.TargetHostData.ID] = true
+
+		user, ok := users[conn.UserData.ID]
+		if !ok {
+			user = &UserCount{User: conn.UserData}
+			users[conn.UserData.ID] = user
+		}
+		user.Count++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats.UniqueUsers = len(users)
+	stats.UniqueHosts = len(hosts)
+
+	stats.TopUsers = make([]UserCount, 0, len(users))
+	for _, user := range users {
+		stats.TopUsers = append(stats.TopUsers, *user)
+	}
+	sort.Slice(stats.TopUsers, func(i, j int) bool {
+		a, b := stats.TopUsers[i], stats.TopUsers[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.User.ID < b.User.ID
+	})
+	if len(stats.TopUsers) > statsTopUsers {
+		stats.TopUsers = stats.TopUsers[:statsTopUsers]
+	}
+
+	return stats, nil
+}
+
+// ConnectionCountsBy counts connections established within the time range
+// by host id, user id or protocol, see GroupBy values. Connections are
+// paged and counted client side.
+func (store *ConnectionManager) ConnectionCountsBy(groupBy string, from, to time.Time) (map[string]int, error) {
+	var key func(Connection) string
+	switch groupBy {
+	case GroupByHost:
+		key = func(conn Connection) string { return conn.TargetHostData.ID }
+	case GroupByUser:
+		key = func(conn Connection) string { return conn.UserData.ID }
+	case GroupByProtocol:
+		key = func(conn Connection) string { return string(conn.Type) }
+	default:
+		return nil, fmt.Errorf("invalid group by %q, expected host, user or protocol", groupBy)
+	}
+
+	counts := map[string]int{}
+	err := store.eachConnection(from, to, func(conn Connection) {
+		counts[key(conn)]++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// FollowConnections calls handler for each connection established since
+// the given time, polling new connections every interval until the context
+// is cancelled. Polls overlap and connections are de-duplicated by id, the
+// poll window follows connected time reported by server so client clock
+// skew does not cause misses. Auth failures stop following, other failures
+// are passed to OnFollowError and retried with exponential backoff.
+func (store *ConnectionManager) FollowConnections(
+	ctx context.Context,
+	interval time.Duration,
+	since time.Time,
+	handler func(Connection),
+	opts ...FollowOption,
+) error {
+	config := followConfig{maxBackoff: 16 * interval}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	return common.Follower[Connection]{
+		Clock:      store.clock,
+		Interval:   interval,
+		MaxBackoff: config.maxBackoff,
+		Overlap:    followOverlap,
+		Poll: func(from time.Time) *common.Pager[Connection] {
+			return store.connectionsIter(from, time.Time{})
+		},
+		Key:  func(conn Connection) string { return conn.ID },
+		Time: func(conn Connection) time.Time { return conn.ConnectedAt() },
+		Fatal: func(err error) bool {
+			return errors.Is(err, restapi.ErrUnauthorized) || errors.Is(err, restapi.ErrForbidden)
+		},
+		OnError: config.onError,
+	}.Run(ctx, since, func(conn Connection) error {
+		handler(conn)
+		return nil
+	})
+}
+
+// ConnectionsByExtender returns connections routed via the extender node,
+// empty node ID returns direct connections. Search API has no extender
+// filter, connections are filtered client side.
+func (store *ConnectionManager) ConnectionsByExtender(nodeID string) ([]Connection, error) {
+	conns := []Connection{}
+	err := store.eachConnection(time.Time{}, time.Time{}, func(conn Connection) {
+		if conn.ExtenderID == nodeID {
+			conns = append(conns, conn)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return conns, nil
+}
+
+// eachConnection pages connections established within the time range
+func (store *ConnectionManager) eachConnection(from, to time.Time, f func(Connection)) error {
+	conns := store.connectionsIter(from, to)
+	for conns.Next() {
+		f(conns.Value())
+	}
+
+	return conns.Err()
+}
+
+// connectionsIter iterates connections established within the time range,
+// oldest first
+func (store *ConnectionManager) connectionsIter(from, to time.Time) *common.Pager[Connection] {
+	return common.NewPager(statsPageSize, func(offset, limit int) ([]Connection, int, error) {
+		items, err := store.FindConnections(ConnectionSearchParams{
+			Start:   from,
+			End:     to,
+			Offset:  offset,
+			Limit:   limit,
+			Sortkey: "connected",
+			Sortdir: "ASC",
+		})
+		return items, 0, err
+	})
+}
+
 // Connection get a single connection
 func (store *ConnectionManager) Connection(connID string) (*Connection, error) {
 	conn := &Connection{}
@@ -111,6 +368,62 @@ func (store *ConnectionManager) Connection(connID string) (*Connection, error) {
 	return conn, err
 }
 
+// ConnectionFileTransfers lists files transferred within the connection,
+// ordered by channel
+func (store *ConnectionManager) ConnectionFileTransfers(connID string) ([]FileTransfer, error) {
+	conn, err := store.Connection(connID)
+	if err != nil {
+		return nil, err
+	}
+
+	transfers := []FileTransfer{}
+	for _, channel := range conn.Channels {
+		for _, file := range channel.Files {
+			transfers = append(transfers, FileTransfer{
+				ConnectionID: conn.ID,
+				ChannelID:    channel.ID,
+				ChannelType:  channel.Type,
+				FileID:       file.ID,
+				Path:         file.Path,
+				RawPath:      file.RawPath,
+				Direction:    file.Direction,
+				Size:         file.Size,
+				Created:      file.Created,
+				Stored:       file.Stored,
+			})
+		}
+	}
+
+	return transfers, nil
+}
+
+// ConnectionLiveStats returns current byte counters and duration of an
+// active connection, ErrConnectionNotActive is returned for closed one
+func (store *ConnectionManager) ConnectionLiveStats(connID string) (*LiveStats, error) {
+	conn, err := store.Connection(connID)
+	if err != nil {
+		return nil, err
+	}
+
+	if conn.Status != StatusConnected {
+		return nil, fmt.Errorf("connection %s: %w", connID, ErrConnectionNotActive)
+	}
+
+	stats := &LiveStats{
+		ConnectionID: conn.ID,
+		BytesIn:      conn.BytesIn,
+		BytesOut:     conn.BytesOut,
+		Duration:     time.Duration(conn.Duration) * time.Second,
+	}
+
+	// duration is updated by server periodically, connected timestamp is exact
+	if connected, err := time.Parse(time.RFC3339, conn.Connected); err == nil {
+		stats.Duration = store.clock.Now().Sub(connected)
+	}
+
+	return stats, nil
+}
+
 // CreateSessionIDFileDownload create session ID for trail stored file download
 func (store *ConnectionManager) CreateSessionIDFileDownload(connID, chanID, fileID string) (string, error) {
 	var object struct {
@@ -165,6 +478,124 @@ func (store *ConnectionManager) DownloadTrailLog(connID, chanID, sessionID, form
 	return err
 }
 
+// StreamTrailLog streams trail log of audited connection channel to w in
+// the given format, the log is not buffered in memory
+func (store *ConnectionManager) StreamTrailLog(connID, chanID, sessionID, format, filter string, w io.Writer) (*TrailDownload, error) {
+	filters := Params{
+		Format: format,
+		Filter: filter,
+	}
+
+	header, err := store.api.
+		URL("/connection-manager/api/v1/connections/%s/channel/%s/log/%s",
+			url.PathEscape(connID), url.PathEscape(chanID), url.PathEscape(sessionID)).
+		Query(&filters).
+		DownloadTo(w)
+	if err != nil {
+		return nil, err
+	}
+
+	trail := &TrailDownload{ContentType: header.Get("Content-Type")}
+	if _, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		trail.Filename = params["filename"]
+	}
+
+	return trail, nil
+}
+
+// DownloadTrailAsciinema writes terminal output of SSH trail to w as
+// asciicast v2, playable with asciinema. The trail is streamed in jsonl
+// format and converted locally, keeping timing of the output. Terminal
+// size comes from pty event preceding the output, 80x24 is used otherwise.
+func (store *ConnectionManager) DownloadTrailAsciinema(connID, chanID, sessionID string, w io.Writer) error {
+	r, pw := io.Pipe()
+
+	go func() {
+		_, err := store.StreamTrailLog(connID, chanID, sessionID, "jsonl", "", pw)
+		pw.CloseWithError(err)
+	}()
+
+	err := toAsciicast(r, w)
+	r.CloseWithError(err)
+
+	return err
+}
+
+// toAsciicast converts jsonl trail to asciicast v2. Output events are
+// split on byte boundaries, incomplete UTF-8 sequence is held back until
+// the next output event.
+func toAsciicast(r io.Reader, w io.Writer) error {
+	var (
+		decoder = json.NewDecoder(r)
+		encoder = json.NewEncoder(w)
+		started time.Time
+		pending []byte
+		width   = 80
+		height  = 24
+	)
+	encoder.SetEscapeHTML(false)
+
+	header := func() error {
+		return encoder.Encode(map[string]interface{}{
+			"version":   2,
+			"width":     width,
+			"height":    height,
+			"timestamp": started.Unix(),
+		})
+	}
+
+	for {
+		event := TrailEvent{}
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch event.Type {
+		case TrailPTY:
+			if started.IsZero() && event.Width > 0 && event.Height > 0 {
+				width, height = event.Width, event.Height
+			}
+		case TrailStdout, TrailStderr:
+			if started.IsZero() {
+				started = event.Timestamp
+				if err := header(); err != nil {
+					return err
+				}
+			}
+
+			data := append(pending, event.Data...)
+			n := len(data)
+			for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+				if utf8.RuneStart(data[i]) {
+					if !utf8.FullRune(data[i:]) {
+						n = i
+					}
+					break
+				}
+			}
+			pending = append([]byte{}, data[n:]...)
+			if n == 0 {
+				continue
+			}
+
+			elapsed := math.Round(event.Timestamp.Sub(started).Seconds()*1e6) / 1e6
+			if err := encoder.Encode([]interface{}{elapsed, "o", string(data[:n])}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if started.IsZero() {
+		return header()
+	}
+
+	return nil
+}
+
 // AccessRoles get saved access roles for a connection
 func (store *ConnectionManager) AccessRoles(connID string) ([]AccessRoles, error) {
 	var result []AccessRoles
@@ -176,13 +607,18 @@ func (store *ConnectionManager) AccessRoles(connID string) ([]AccessRoles, error
 	return result, err
 }
 
-// GrantAccessRoleToConnection grant a role permission for a connection
+// GrantAccessRoleToConnection grant a role permission for a connection,
+// granting already granted role is no-op
 func (store *ConnectionManager) GrantAccessRoleToConnection(connID, roleID string) error {
 	_, err := store.api.
 		URL("/connection-manager/api/v1/connections/%s/access_roles/%s",
 			url.PathEscape(connID), url.PathEscape(roleID)).
 		Post(nil)
 
+	if errors.Is(err, restapi.ErrConflict) {
+		return nil
+	}
+
 	return err
 }
 
@@ -206,31 +642,64 @@ func (store *ConnectionManager) RevokeAccessRoleFromAllConnections(roleID string
 	return err
 }
 
-// TerminateConnection terminate connection by ID.
+// TerminateConnection terminate connection by ID. Connection which is
+// already terminated or gone is reported as success.
 func (store *ConnectionManager) TerminateConnection(connID string) error {
+	return store.TerminateConnectionWithReason(connID, "")
+}
+
+// TerminateConnectionWithReason terminates connection by ID, the reason is
+// recorded to audit event of the termination. Empty reason is not sent.
+func (store *ConnectionManager) TerminateConnectionWithReason(connID, reason string) error {
+	var body interface{}
+	if reason != "" {
+		body = terminateRequest{Reason: reason}
+	}
+
 	_, err := store.api.
 		URL("/connection-manager/api/v1/terminate/connection/%s", url.PathEscape(connID)).
-		Post(nil)
+		Post(body)
+
+	switch {
+	case errors.Is(err, restapi.ErrNotFound), errors.Is(err, restapi.ErrConflict):
+		return nil
+	case errors.Is(err, restapi.ErrForbidden):
+		return fmt.Errorf("terminate connection %s requires connections-manage permission: %w", connID, err)
+	}
 
 	return err
 }
 
+// TerminateConnectionsByHost terminates all connections to the host, it
+// returns number of terminated connections when reported by server
+func (store *ConnectionManager) TerminateConnectionsByHost(hostID string) (int, error) {
+	return store.terminate("/connection-manager/api/v1/terminate/host/%s", hostID)
+}
+
 // TerminateConnectionsByTargetHost terminate connection(s) from host
+//
+// Deprecated: use TerminateConnectionsByHost
 func (store *ConnectionManager) TerminateConnectionsByTargetHost(hostID string) error {
-	_, err := store.api.
-		URL("/connection-manager/api/v1/terminate/host/%s", url.PathEscape(hostID)).
-		Post(nil)
-
+	_, err := store.TerminateConnectionsByHost(hostID)
 	return err
 }
 
-// TerminateConnectionsByUser terminate connection(s) of a user
-func (store *ConnectionManager) TerminateConnectionsByUser(userID string) error {
+// TerminateConnectionsByUser terminates all connections of the user, it
+// returns number of terminated connections when reported by server
+func (store *ConnectionManager) TerminateConnectionsByUser(userID string) (int, error) {
+	return store.terminate("/connection-manager/api/v1/terminate/user/%s", userID)
+}
+
+func (store *ConnectionManager) terminate(path, id string) (int, error) {
+	var result struct {
+		Count int `json:"count"`
+	}
+
 	_, err := store.api.
-		URL("/connection-manager/api/v1/terminate/user/%s", url.PathEscape(userID)).
-		Post(nil)
+		URL(path, url.PathEscape(id)).
+		Post(nil, &result)
 
-	return err
+	return result.Count, err
 }
 
 // UEBA
@@ -274,6 +743,17 @@ func (store *ConnectionManager) CreateAnomalySettings(settings UebaAnomalySettin
 	return err
 }
 
+// SetUebaThreshold changes anomaly threshold, keeping the action
+func (store *ConnectionManager) SetUebaThreshold(threshold float32) error {
+	settings, err := store.UebaAnomalySettings()
+	if err != nil {
+		return err
+	}
+
+	settings.Threshold = threshold
+	return store.CreateAnomalySettings(settings)
+}
+
 // StartAnalyzing start ueba analysis
 func (store *ConnectionManager) StartAnalyzing(datasetID string) error {
 	_, err := store.api.
@@ -385,6 +865,11 @@ func (store *ConnectionManager) TrainUebaDataset(datasetID string, set_active_af
 		Query(&filters).
 		Post(nil, &count)
 
+	var apiErr *restapi.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode == errorUebaInsufficientData {
+		return count, fmt.Errorf("%w: %w", ErrUebaInsufficientData, err)
+	}
+
 	return count, err
 }
 
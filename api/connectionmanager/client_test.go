@@ -0,0 +1,1067 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package connectionmanager_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/connectionmanager"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+func TestConnectionLiveStats(t *testing.T) {
+	connected := "2021-03-01T10:00:00Z"
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/connection-manager/api/v1/connections/active":
+				w.Write([]byte(`{
+					"id": "active",
+					"status": "CONNECTED",
+					"connected": "` + connected + `",
+					"bytes_in": 1024,
+					"bytes_out": 2048,
+					"duration": 3500
+				}`))
+			case "/connection-manager/api/v1/connections/closed":
+				w.Write([]byte(`{"id": "closed", "status": "DISCONNECTED"}`))
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+	store.UseClock(&mockClock{now: time.Date(2021, 3, 1, 11, 0, 5, 0, time.UTC)})
+
+	stats, err := store.ConnectionLiveStats("active")
+	if err != nil {
+		t.Fatalf("live stats fails: %v", err)
+	}
+	if stats.BytesIn != 1024 || stats.BytesOut != 2048 || stats.Duration != time.Hour+5*time.Second {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	connected = "unknown"
+	stats, err = store.ConnectionLiveStats("active")
+	if err != nil || stats.Duration != 3500*time.Second {
+		t.Errorf("server duration is not used: %+v, %v", stats, err)
+	}
+
+	_, err = store.ConnectionLiveStats("closed")
+	if !errors.Is(err, connectionmanager.ErrConnectionNotActive) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConnectionEnumsRoundTrip(t *testing.T) {
+	data := []byte(`{"id":"1","type":"SSH","status":"QUEUED"}`)
+
+	conn := connectionmanager.Connection{}
+	if err := json.Unmarshal(data, &conn); err != nil {
+		t.Fatalf("decode fails: %v", err)
+	}
+	if conn.Type != connectionmanager.ProtocolSSH || conn.Status != "QUEUED" {
+		t.Errorf("unexpected connection: %+v", conn)
+	}
+
+	bin, err := json.Marshal(conn)
+	if err != nil || !bytes.Contains(bin, []byte(`"status":"QUEUED"`)) {
+		t.Errorf("unknown status is not preserved: %s, %v", bin, err)
+	}
+}
+
+func TestConnections(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/connection-manager/api/v1/connections" ||
+				r.URL.Query().Get("sortkey") != "connected" {
+				t.Errorf("unexpected request: %s", r.URL)
+			}
+			w.Write([]byte(`{"count": 2, "items": [
+				{
+					"id": "live",
+					"type": "SSH",
+					"status": "CONNECTED",
+					"connected": "2021-03-01T10:00:00Z",
+					"bytes_in": 10,
+					"audit_enabled": true,
+					"user": {"id": "u1", "display_name": "alice"},
+					"target_host_data": {"id": "h1", "common_name": "db"},
+					"user_roles": [{"id": "r1", "name": "ops"}]
+				},
+				{
+					"id": "ended",
+					"type": "RDP",
+					"status": "DISCONNECTED",
+					"connected": "2021-03-01T10:00:00Z",
+					"disconnected": "2021-03-01T11:30:00Z",
+					"bytes_out": 20
+				}
+			]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	conns, err := store.Connections(0, 10, "connected", "DESC", false)
+	if err != nil || len(conns) != 2 {
+		t.Fatalf("unexpected connections: %v, %v", conns, err)
+	}
+
+	live := conns[0]
+	if live.Type != connectionmanager.ProtocolSSH || live.UserData.Username != "alice" ||
+		live.TargetHostData.CommonName != "db" || len(live.UserRoles) != 1 ||
+		live.BytesIn != 10 || !live.AuditEnabled {
+		t.Errorf("unexpected connection: %+v", live)
+	}
+	if !live.ConnectedAt().Equal(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected connected time: %v", live.ConnectedAt())
+	}
+	if _, ok := live.DisconnectedAt(); ok {
+		t.Errorf("live connection is disconnected")
+	}
+
+	ended := conns[1]
+	disconnected, ok := ended.DisconnectedAt()
+	if !ok || disconnected.Sub(ended.ConnectedAt()) != 90*time.Minute {
+		t.Errorf("unexpected disconnected time: %v", disconnected)
+	}
+	if ended.Type != connectionmanager.ProtocolRDP || ended.BytesOut != 20 {
+		t.Errorf("unexpected connection: %+v", ended)
+	}
+}
+
+func TestFindConnections(t *testing.T) {
+	var body, query string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw, _ := io.ReadAll(r.Body)
+			body = string(bytes.TrimSpace(raw))
+			query = r.URL.RawQuery
+			w.Write([]byte(`{"count": 1, "items": [{"id": "c1", "type": "RDP"}]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+	eet := time.FixedZone("EET", 2*60*60)
+
+	conns, err := store.FindConnections(connectionmanager.ConnectionSearchParams{
+		UserIDs:   []string{"u1"},
+		Protocols: []connectionmanager.Protocol{connectionmanager.ProtocolRDP},
+		Tags:      []string{"prod"},
+		Start:     time.Date(2021, 3, 1, 12, 0, 0, 0, eet),
+		End:       time.Date(2021, 3, 2, 12, 0, 0, 0, eet),
+		Limit:     50,
+		Sortkey:   "connected",
+		Sortdir:   "DESC",
+	})
+	if err != nil || len(conns) != 1 || conns[0].Type != connectionmanager.ProtocolRDP {
+		t.Errorf("unexpected connections: %v, %v", conns, err)
+	}
+
+	expect := `{"user_id":["u1"],"type":["RDP"],"tags":["prod"],"connected":{"start":"2021-03-01T10:00:00Z","end":"2021-03-02T10:00:00Z"}}`
+	if body != expect {
+		t.Errorf("unexpected body: %s", body)
+	}
+	if query != "limit=50&sortdir=DESC&sortkey=connected" {
+		t.Errorf("unexpected query: %s", query)
+	}
+
+	_, err = store.FindConnections(connectionmanager.ConnectionSearchParams{
+		Keywords: "db",
+		HostIDs:  []string{"h1"},
+		Start:    time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("search fails: %v", err)
+	}
+
+	expect = `{"keywords":"db","target_host_id":["h1"],"connected":{"start":"2021-03-01T10:00:00Z"}}`
+	if body != expect {
+		t.Errorf("unexpected body: %s", body)
+	}
+
+	store.FindConnections(connectionmanager.ConnectionSearchParams{})
+	if body != `{}` {
+		t.Errorf("unexpected body: %s", body)
+	}
+}
+
+func TestConnectionChannels(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "connection-ssh-sftp.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/connection-manager/api/v1/connections/c1" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(fixture)
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	conn, err := store.Connection("c1")
+	if err != nil {
+		t.Fatalf("connection fails: %v", err)
+	}
+	if conn.Type != connectionmanager.ProtocolSSH || len(conn.Channels) != 3 {
+		t.Fatalf("unexpected connection: %+v", conn)
+	}
+
+	shell, sftp, forward := conn.Channels[0], conn.Channels[1], conn.Channels[2]
+	if shell.Type != connectionmanager.ChannelShell || !shell.TrailAvailable || len(shell.Files) != 0 {
+		t.Errorf("unexpected shell channel: %+v", shell)
+	}
+
+	expect := []connectionmanager.ChannelFile{
+		{ID: "f1", Path: "/tmp/dump.sql", Direction: "download", Size: 8192, Stored: true},
+		{ID: "f2", Path: "/etc/app.conf", Direction: "upload", Size: 512},
+	}
+	if sftp.Type != connectionmanager.ChannelSFTP || !reflect.DeepEqual(sftp.Files, expect) {
+		t.Errorf("unexpected sftp channel: %+v", sftp)
+	}
+
+	if forward.Type != connectionmanager.ChannelPortForward || forward.TrailAvailable ||
+		!forward.TrailRemoved || forward.ForwardAddress != "127.0.0.1:5432" || forward.Closed != "" {
+		t.Errorf("unexpected forward channel: %+v", forward)
+	}
+}
+
+func TestConnectionsByExtender(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "connections-extender.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/connection-manager/api/v1/connections/search" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(fixture)
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	extended, err := store.ConnectionsByExtender("e1")
+	if err != nil || len(extended) != 2 {
+		t.Fatalf("unexpected extender connections: %+v, %v", extended, err)
+	}
+
+	c3 := extended[1]
+	if c3.ID != "c3" || c3.ProxyID != "p2" || c3.ProxyAddress != "10.0.1.7:22" ||
+		c3.ExtenderName != "branch-office" ||
+		!reflect.DeepEqual(c3.AuthMethod, []string{"password", "keyboard-interactive"}) {
+		t.Errorf("unexpected connection: %+v", c3)
+	}
+
+	direct, err := store.ConnectionsByExtender("")
+	if err != nil || len(direct) != 1 {
+		t.Fatalf("unexpected direct connections: %+v, %v", direct, err)
+	}
+	if c2 := direct[0]; c2.ID != "c2" || c2.ExtenderID != "" || c2.ProxyAddress != "10.0.0.5:3389" {
+		t.Errorf("unexpected connection: %+v", c2)
+	}
+}
+
+func TestConnectionFileTransfers(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "connection-rdp-files.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/connection-manager/api/v1/connections/c2" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(fixture)
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	files, err := store.ConnectionFileTransfers("c2")
+	if err != nil || len(files) != 3 {
+		t.Fatalf("unexpected transfers: %+v, %v", files, err)
+	}
+
+	expect := connectionmanager.FileTransfer{
+		ConnectionID: "c2",
+		ChannelID:    "ch1",
+		ChannelType:  connectionmanager.ChannelType("clipboard"),
+		FileID:       "f1",
+		Path:         `C:\Users\bob\résumé.pdf`,
+		Direction:    "download",
+		Size:         4096,
+		Created:      "2021-03-02T08:01:00Z",
+		Stored:       true,
+	}
+	if !reflect.DeepEqual(files[0], expect) {
+		t.Errorf("unexpected transfer: %+v", files[0])
+	}
+
+	if files[1].Path != "emoji-\U0001F600.txt" || files[1].RawPath != nil {
+		t.Errorf("unexpected path: %q, %q", files[1].Path, files[1].RawPath)
+	}
+
+	latin1 := files[2]
+	if latin1.ChannelID != "ch2" || latin1.Path != "/srv/latin1-na\uFFFDve.txt" ||
+		!bytes.Equal(latin1.RawPath, []byte("/srv/latin1-na\xefve.txt")) {
+		t.Errorf("unexpected path: %q, %q", latin1.Path, latin1.RawPath)
+	}
+
+	if _, err := store.ConnectionFileTransfers("c3"); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestConnectionFileTransfersSCP(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"id": "c4", "type": "SSH", "channels": [
+				{"id": "ch1", "type": "shell"},
+				{"id": "ch2", "type": "exec", "files": [
+					{"id": "f1", "path": "/var/log/app.log", "direction": "download",
+					 "size": 1048576, "created": "2021-03-03T09:00:00Z", "stored": true}
+				]}
+			]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	files, err := store.ConnectionFileTransfers("c4")
+	if err != nil || len(files) != 1 {
+		t.Fatalf("unexpected transfers: %+v, %v", files, err)
+	}
+	if f := files[0]; f.ChannelType != connectionmanager.ChannelExec || f.Size != 1048576 ||
+		f.Direction != "download" || f.Created != "2021-03-03T09:00:00Z" || !f.Stored {
+		t.Errorf("unexpected transfer: %+v", f)
+	}
+}
+
+func TestChannelFilePathBytes(t *testing.T) {
+	for raw, expect := range map[string]string{
+		`"a\"b\\c\/d\te"`:      "a\"b\\c/d\te",
+		"\"caf\xe9\"":          "caf\xe9",
+		`"\u00e9\ud83d\ude00"`: "é\U0001F600",
+	} {
+		file := connectionmanager.ChannelFile{}
+		if err := json.Unmarshal([]byte(`{"path":`+raw+`}`), &file); err != nil {
+			t.Errorf("%s: decode fails: %v", raw, err)
+			continue
+		}
+		if string(file.PathBytes()) != expect {
+			t.Errorf("%s: unexpected path %q", raw, file.PathBytes())
+		}
+	}
+
+	file := connectionmanager.ChannelFile{}
+	if err := json.Unmarshal([]byte(`{"path":"bad\u12"}`), &file); err == nil {
+		t.Errorf("invalid escape is accepted")
+	}
+}
+
+// countingWriter counts bytes, retaining none of them
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestStreamTrailLog(t *testing.T) {
+	const size = 256 << 20
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/connection-manager/api/v1/connections/c1/channel/ch1/log/s1" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if q := r.URL.Query(); q.Get("format") != "jsonl" || q.Get("filter") != "stdin" {
+				t.Errorf("unexpected query: %s", r.URL.RawQuery)
+			}
+
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="c1-ch1.jsonl"`)
+			io.CopyN(w, zeros{}, size)
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	out := &countingWriter{}
+	trail, err := store.StreamTrailLog("c1", "ch1", "s1", "jsonl", "stdin", out)
+	if err != nil {
+		t.Fatalf("stream fails: %v", err)
+	}
+	if out.n != size {
+		t.Errorf("unexpected size: %d", out.n)
+	}
+	if trail.ContentType != "application/x-ndjson" || trail.Filename != "c1-ch1.jsonl" {
+		t.Errorf("unexpected trail: %+v", trail)
+	}
+
+	_, err = store.StreamTrailLog("c1", "ch1", "expired", "jsonl", "", out)
+	if !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestTerminateConnection(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				t.Errorf("unexpected method: %s", r.Method)
+			}
+			switch r.URL.Path {
+			case "/connection-manager/api/v1/terminate/connection/live":
+				w.WriteHeader(http.StatusOK)
+			case "/connection-manager/api/v1/terminate/connection/ended":
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"error_code": "CONNECTION_ALREADY_TERMINATED"}`))
+			case "/connection-manager/api/v1/terminate/connection/protected":
+				w.WriteHeader(http.StatusForbidden)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	for _, id := range []string{"live", "ended", "gone"} {
+		if err := store.TerminateConnection(id); err != nil {
+			t.Errorf("terminate %s fails: %v", id, err)
+		}
+	}
+
+	err := store.TerminateConnection("protected")
+	if !errors.Is(err, restapi.ErrForbidden) || !strings.Contains(err.Error(), "connections-manage") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTerminateConnectionWithReason(t *testing.T) {
+	bodies := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, strings.TrimSpace(string(body)))
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if err := store.TerminateConnectionWithReason("c1", "incident 42"); err != nil {
+		t.Errorf("terminate fails: %v", err)
+	}
+	if err := store.TerminateConnectionWithReason("c2", ""); err != nil {
+		t.Errorf("terminate fails: %v", err)
+	}
+
+	expect := []string{`{"reason":"incident 42"}`, ``}
+	if !reflect.DeepEqual(bodies, expect) {
+		t.Errorf("unexpected requests: %q", bodies)
+	}
+}
+
+func TestTerminateConnectionsBy(t *testing.T) {
+	requested := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = append(requested, r.URL.EscapedPath())
+			switch r.URL.EscapedPath() {
+			case "/connection-manager/api/v1/terminate/host/h%2F1":
+				w.Write([]byte(`{"count": 3}`))
+			case "/connection-manager/api/v1/terminate/host/idle":
+				w.WriteHeader(http.StatusNoContent)
+			case "/connection-manager/api/v1/terminate/user/u%201":
+				w.Write([]byte(`{"count": 1}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if n, err := store.TerminateConnectionsByHost("h/1"); n != 3 || err != nil {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+	if n, err := store.TerminateConnectionsByHost("idle"); n != 0 || err != nil {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+	if n, err := store.TerminateConnectionsByUser("u 1"); n != 1 || err != nil {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+
+	expect := []string{
+		"/connection-manager/api/v1/terminate/host/h%2F1",
+		"/connection-manager/api/v1/terminate/host/idle",
+		"/connection-manager/api/v1/terminate/user/u%201",
+	}
+	if !reflect.DeepEqual(requested, expect) {
+		t.Errorf("unexpected requests: %v", requested)
+	}
+}
+
+// mockAccessRoles keeps access roles of connection c1 in memory, granting
+// granted role is conflict
+func mockAccessRoles() *httptest.Server {
+	roles := []connectionmanager.AccessRoles{}
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := strings.TrimPrefix(r.URL.Path, "/connection-manager/api/v1/connections/c1/access_roles")
+			roleID := strings.TrimPrefix(path, "/")
+
+			index := -1
+			for i, role := range roles {
+				if role.ID == roleID {
+					index = i
+				}
+			}
+
+			switch {
+			case r.Method == http.MethodGet && roleID == "":
+				json.NewEncoder(w).Encode(roles)
+			case r.Method == http.MethodPost && index >= 0:
+				w.WriteHeader(http.StatusConflict)
+			case r.Method == http.MethodPost:
+				roles = append(roles, connectionmanager.AccessRoles{ID: roleID, Name: "auditors"})
+			case r.Method == http.MethodDelete && index >= 0:
+				roles = append(roles[:index], roles[index+1:]...)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+}
+
+func TestConnectionAccessRoles(t *testing.T) {
+	ts := mockAccessRoles()
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	for i := 0; i < 2; i++ {
+		if err := store.GrantAccessRoleToConnection("c1", "r1"); err != nil {
+			t.Errorf("grant fails: %v", err)
+		}
+	}
+
+	roles, err := store.AccessRoles("c1")
+	if err != nil || len(roles) != 1 || roles[0].ID != "r1" || roles[0].Name != "auditors" {
+		t.Errorf("unexpected roles: %+v, %v", roles, err)
+	}
+
+	if err := store.RevokeAccessRoleFromConnection("c1", "r1"); err != nil {
+		t.Errorf("revoke fails: %v", err)
+	}
+
+	roles, err = store.AccessRoles("c1")
+	if err != nil || len(roles) != 0 {
+		t.Errorf("unexpected roles: %+v, %v", roles, err)
+	}
+
+	if err := store.RevokeAccessRoleFromConnection("c1", "r1"); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUeba(t *testing.T) {
+	var settings map[string]interface{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/connection-manager/api/v1/ueba/anomaly-settings":
+				if r.Method == http.MethodPost {
+					json.NewDecoder(r.Body).Decode(&settings)
+					return
+				}
+				w.Write([]byte(`{"action": "TERMINATE", "threshold": 0.5}`))
+			case "/connection-manager/api/v1/ueba/status/internal":
+				w.Write([]byte(`{"training_status": "TRAINING", "training_progress": 42.5, "dataset_id": "d1"}`))
+			case "/connection-manager/api/v1/ueba/train/d1":
+				if r.URL.Query().Get("set_active_after_training") != "true" {
+					t.Errorf("unexpected query: %s", r.URL.RawQuery)
+				}
+				w.Write([]byte(`{"count": 1200}`))
+			case "/connection-manager/api/v1/ueba/train/d2":
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error_code": "UEBA_INSUFFICIENT_DATA", "error_message": "too few connections"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if err := store.SetUebaThreshold(0.75); err != nil {
+		t.Fatalf("set threshold fails: %v", err)
+	}
+	if settings["action"] != "TERMINATE" || settings["threshold"] != 0.75 {
+		t.Errorf("unexpected settings: %v", settings)
+	}
+
+	status, err := store.UebaInternalStatus()
+	if err != nil || status.TrainingStatus != "TRAINING" || status.TrainingProgress != 42.5 {
+		t.Errorf("unexpected status: %+v, %v", status, err)
+	}
+
+	count, err := store.TrainUebaDataset("d1", true)
+	if err != nil || count.Count != 1200 {
+		t.Errorf("unexpected training: %+v, %v", count, err)
+	}
+
+	_, err = store.TrainUebaDataset("d2", true)
+	if !errors.Is(err, connectionmanager.ErrUebaInsufficientData) || !strings.Contains(err.Error(), "too few connections") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// mockConnectionPages serves 250 connections of 12 users to 5 hosts in
+// pages
+func mockConnectionPages(t *testing.T, requests *int) *httptest.Server {
+	protocols := []connectionmanager.Protocol{
+		connectionmanager.ProtocolSSH,
+		connectionmanager.ProtocolSSH,
+		connectionmanager.ProtocolRDP,
+		connectionmanager.ProtocolWEB,
+		connectionmanager.ProtocolSSH,
+	}
+	conns := []connectionmanager.Connection{}
+	for i := 0; i < 250; i++ {
+		conns = append(conns, connectionmanager.Connection{
+			ID:             strconv.Itoa(i),
+			Type:           protocols[i%len(protocols)],
+			BytesIn:        100,
+			BytesOut:       10,
+			UserData:       connectionmanager.UserData{ID: "u" + strconv.Itoa(i%12)},
+			TargetHostData: connectionmanager.ConnectionHost{ID: "h" + strconv.Itoa(i%5)},
+		})
+	}
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+
+			search := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&search)
+			if _, has := search["connected"]; !has {
+				t.Errorf("time range is missing: %v", search)
+			}
+
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			end := offset + limit
+			if end > len(conns) {
+				end = len(conns)
+			}
+			items := conns[offset:end]
+			if r.URL.Query().Get("sortdir") == "DESC" {
+				items = []connectionmanager.Connection{}
+				for i := offset; i < end; i++ {
+					items = append(items, conns[len(conns)-1-i])
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"count": len(conns),
+				"items": items,
+			})
+		}),
+	)
+}
+
+func TestConnectionsIter(t *testing.T) {
+	requests := 0
+	ts := mockConnectionPages(t, &requests)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+	from := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	params := connectionmanager.ConnectionSearchParams{
+		Start:   from,
+		Sortkey: "connected",
+		Sortdir: "DESC",
+	}
+
+	conns := store.ConnectionsIter(params, 40)
+	if _, err := conns.All(); err != nil || requests != 7 || conns.TotalCount() != 250 {
+		t.Errorf("unexpected iteration: %d requests, %d total, %v",
+			requests, conns.TotalCount(), err)
+	}
+
+	requests = 0
+	latest := []string{}
+	conns = store.ConnectionsIter(params, 40)
+	for conns.Next() {
+		latest = append(latest, conns.Value().ID)
+		if len(latest) == 50 {
+			break
+		}
+	}
+	if conns.Err() != nil || requests != 2 || latest[0] != "249" || latest[49] != "200" {
+		t.Errorf("unexpected early break: %d requests, %v", requests, conns.Err())
+	}
+}
+
+// cancelWriter cancels the export once limit lines are written
+type cancelWriter struct {
+	bytes.Buffer
+	limit  int
+	cancel context.CancelFunc
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	n, err := w.Buffer.Write(p)
+	if bytes.Count(w.Bytes(), []byte("\n")) == w.limit {
+		w.cancel()
+	}
+	return n, err
+}
+
+func TestExportConnections(t *testing.T) {
+	requests := 0
+	ts := mockConnectionPages(t, &requests)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+	params := connectionmanager.ConnectionSearchParams{
+		Start: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	var out bytes.Buffer
+	n, err := store.ExportConnections(context.Background(), params, &out)
+	if err != nil || n != 250 || requests != 3 {
+		t.Fatalf("unexpected export: %d, %d requests, %v", n, requests, err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 250 {
+		t.Fatalf("unexpected lines: %d", len(lines))
+	}
+	for i, line := range []string{lines[0], lines[249]} {
+		conn := connectionmanager.Connection{}
+		if err := json.Unmarshal([]byte(line), &conn); err != nil || conn.ID != []string{"0", "249"}[i] {
+			t.Errorf("unexpected line: %s, %v", line, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &cancelWriter{limit: 120, cancel: cancel}
+	n, err = store.ExportConnections(ctx, params, w)
+	if !errors.Is(err, context.Canceled) || n != 120 ||
+		bytes.Count(w.Bytes(), []byte("\n")) != 120 {
+		t.Errorf("unexpected cancelled export: %d, %v", n, err)
+	}
+}
+
+func TestConnectionStats(t *testing.T) {
+	requests := 0
+	ts := mockConnectionPages(t, &requests)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	from := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	stats, err := store.ConnectionStats(from, from.AddDate(0, 0, 7))
+	if err != nil {
+		t.Fatalf("stats fails: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("unexpected number of pages: %d", requests)
+	}
+
+	if stats.Total != 250 || stats.BytesIn != 25000 || stats.BytesOut != 2500 {
+		t.Errorf("unexpected totals: %+v", stats)
+	}
+	expect := map[connectionmanager.Protocol]int{"SSH": 150, "RDP": 50, "WEB": 50}
+	if !reflect.DeepEqual(stats.ByProtocol, expect) {
+		t.Errorf("unexpected protocols: %v", stats.ByProtocol)
+	}
+	if stats.UniqueUsers != 12 || stats.UniqueHosts != 5 {
+		t.Errorf("unexpected unique counts: %d users, %d hosts", stats.UniqueUsers, stats.UniqueHosts)
+	}
+
+	if len(stats.TopUsers) != 10 {
+		t.Fatalf("unexpected top users: %v", stats.TopUsers)
+	}
+	// 250 = 12 * 20 + 10, users u0 ... u9 have 21 connections
+	if top := stats.TopUsers[0]; top.User.ID != "u0" || top.Count != 21 {
+		t.Errorf("unexpected top user: %+v", top)
+	}
+	if last := stats.TopUsers[9]; last.User.ID != "u9" || last.Count != 21 {
+		t.Errorf("unexpected top user: %+v", last)
+	}
+}
+
+func TestConnectionCountsBy(t *testing.T) {
+	requests := 0
+	ts := mockConnectionPages(t, &requests)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+	from := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	hosts, err := store.ConnectionCountsBy(connectionmanager.GroupByHost, from, from.AddDate(0, 0, 7))
+	expect := map[string]int{"h0": 50, "h1": 50, "h2": 50, "h3": 50, "h4": 50}
+	if err != nil || !reflect.DeepEqual(hosts, expect) {
+		t.Errorf("unexpected hosts: %v, %v", hosts, err)
+	}
+
+	protocols, err := store.ConnectionCountsBy(connectionmanager.GroupByProtocol, from, from.AddDate(0, 0, 7))
+	expect = map[string]int{"SSH": 150, "RDP": 50, "WEB": 50}
+	if err != nil || !reflect.DeepEqual(protocols, expect) {
+		t.Errorf("unexpected protocols: %v, %v", protocols, err)
+	}
+
+	users, err := store.ConnectionCountsBy(connectionmanager.GroupByUser, from, from.AddDate(0, 0, 7))
+	if err != nil || len(users) != 12 || users["u11"] != 20 {
+		t.Errorf("unexpected users: %v, %v", users, err)
+	}
+
+	requests = 0
+	if _, err := store.ConnectionCountsBy("account", from, from); err == nil || requests != 0 {
+		t.Errorf("invalid grouping is accepted")
+	}
+}
+
+// mockClock hands requested delays to the test, which fires them.
+// The current time is fixed.
+type mockClock struct {
+	now   time.Time
+	waits chan time.Duration
+	ticks chan time.Time
+}
+
+func (clock *mockClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *mockClock) After(d time.Duration) <-chan time.Time {
+	clock.waits <- d
+	return clock.ticks
+}
+
+func TestFollowConnections(t *testing.T) {
+	polls := [][]string{
+		{"old", "c1", "c2"},
+		{"c2", "c3"},
+		{"c3"},
+	}
+	connected := map[string]string{
+		"old": "2021-03-01T09:59:00Z",
+		"c1":  "2021-03-01T10:00:00Z",
+		"c2":  "2021-03-01T10:05:00Z",
+		"c3":  "2021-03-01T10:04:30Z",
+	}
+
+	var mu sync.Mutex
+	starts := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			search := struct {
+				Connected struct {
+					Start string `json:"start"`
+				} `json:"connected"`
+			}{}
+			json.NewDecoder(r.Body).Decode(&search)
+
+			mu.Lock()
+			poll := polls[len(starts)]
+			starts = append(starts, search.Connected.Start)
+			mu.Unlock()
+
+			items := []connectionmanager.Connection{}
+			for _, id := range poll {
+				items = append(items, connectionmanager.Connection{ID: id, Connected: connected[id]})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+	clock := &mockClock{waits: make(chan time.Duration), ticks: make(chan time.Time)}
+	store.UseClock(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handled := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- store.FollowConnections(ctx, 30*time.Second,
+			time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC),
+			func(conn connectionmanager.Connection) { handled <- conn.ID },
+		)
+	}()
+
+	for i := 0; i < len(polls)-1; i++ {
+		if d := <-clock.waits; d != 30*time.Second {
+			t.Errorf("unexpected interval: %v", d)
+		}
+		clock.ticks <- time.Now()
+	}
+	<-clock.waits
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Errorf("follow fails: %v", err)
+	}
+	close(handled)
+
+	ids := []string{}
+	for id := range handled {
+		ids = append(ids, id)
+	}
+	if !reflect.DeepEqual(ids, []string{"c1", "c2", "c3"}) {
+		t.Errorf("unexpected connections: %v", ids)
+	}
+
+	expect := []string{"2021-03-01T09:59:00Z", "2021-03-01T10:04:00Z", "2021-03-01T10:04:00Z"}
+	if !reflect.DeepEqual(starts, expect) {
+		t.Errorf("unexpected poll windows: %v", starts)
+	}
+}
+
+func TestFollowConnectionsBackoff(t *testing.T) {
+	var polls atomic.Int32
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if polls.Add(1) <= 3 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(`{"items": []}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+	clock := &mockClock{waits: make(chan time.Duration), ticks: make(chan time.Time)}
+	store.UseClock(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	failures := make(chan error, 10)
+	done := make(chan error)
+	go func() {
+		done <- store.FollowConnections(ctx, 30*time.Second, time.Now(),
+			func(conn connectionmanager.Connection) {},
+			connectionmanager.MaxBackoff(2*time.Minute),
+			connectionmanager.OnFollowError(func(err error) { failures <- err }),
+		)
+	}()
+
+	waits := []time.Duration{}
+	for i := 0; i < 4; i++ {
+		waits = append(waits, <-clock.waits)
+		if i < 3 {
+			clock.ticks <- time.Now()
+		}
+	}
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Errorf("follow fails: %v", err)
+	}
+	expect := []time.Duration{time.Minute, 2 * time.Minute, 2 * time.Minute, 30 * time.Second}
+	if !reflect.DeepEqual(waits, expect) {
+		t.Errorf("unexpected backoff: %v", waits)
+	}
+	if len(failures) != 3 {
+		t.Errorf("unexpected failures: %d", len(failures))
+	}
+}
+
+func TestDownloadTrailAsciinema(t *testing.T) {
+	trail, err := os.ReadFile(filepath.Join("testdata", "trail-ssh.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := os.ReadFile(filepath.Join("testdata", "trail-ssh.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/connection-manager/api/v1/connections/c1/channel/ch1/log/s1" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.URL.Query().Get("format") != "jsonl" {
+				t.Errorf("unexpected query: %s", r.URL.RawQuery)
+			}
+			w.Write(trail)
+		}),
+	)
+	defer ts.Close()
+
+	store := connectionmanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	cast := &bytes.Buffer{}
+	if err := store.DownloadTrailAsciinema("c1", "ch1", "s1", cast); err != nil {
+		t.Fatalf("download fails: %v", err)
+	}
+	if cast.String() != string(golden) {
+		t.Errorf("unexpected asciicast:\n%s", cast)
+	}
+
+	err = store.DownloadTrailAsciinema("c1", "ch1", "expired", &bytes.Buffer{})
+	if !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -6,7 +6,49 @@
 
 package connectionmanager
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/SSHcom/privx-sdk-go/common"
+)
+
+// ErrConnectionNotActive is returned when live data is requested for
+// disconnected connection
+var ErrConnectionNotActive = errors.New("connection is not active")
+
+// ErrUebaInsufficientData is returned when dataset has too few connections
+// to train UEBA model
+var ErrUebaInsufficientData = errors.New("not enough connections to train ueba model")
+
+// errorUebaInsufficientData is error code of ErrUebaInsufficientData
+const errorUebaInsufficientData = "UEBA_INSUFFICIENT_DATA"
+
+// ConnectionStatus is status of the connection, values unknown to SDK
+// are preserved as is
+type ConnectionStatus string
+
+// ConnectionStatus values
+const (
+	StatusConnected    = ConnectionStatus("CONNECTED")
+	StatusDisconnected = ConnectionStatus("DISCONNECTED")
+)
+
+// Protocol of the connection, values unknown to SDK are preserved as is
+type Protocol string
+
+// Protocol values
+const (
+	ProtocolSSH = Protocol("SSH")
+	ProtocolRDP = Protocol("RDP")
+	ProtocolVNC = Protocol("VNC")
+	ProtocolWEB = Protocol("WEB")
+	ProtocolDB  = Protocol("DB")
+)
 
 // Params query params definition
 type Params struct {
@@ -49,14 +91,17 @@ type AccessRoles struct {
 type Connection struct {
 	ID                string           `json:"id,omitempty"`
 	ProxyID           string           `json:"proxy_id,omitempty"`
-	Type              string           `json:"type,omitempty"`
+	ProxyAddress      string           `json:"proxy_address,omitempty"`
+	ExtenderID        string           `json:"extender_id,omitempty"`
+	ExtenderName      string           `json:"extender_name,omitempty"`
+	Type              Protocol         `json:"type,omitempty"`
 	UserAgent         string           `json:"user_agent,omitempty"`
 	TargetHostAddress string           `json:"target_host_address,omitempty"`
 	TargetHostAccount string           `json:"target_host_account,omitempty"`
 	RemoteAddress     string           `json:"remote_address,omitempty"`
 	Connected         string           `json:"connected,omitempty"`
 	Disconnected      string           `json:"disconnected,omitempty"`
-	Status            string           `json:"status,omitempty"`
+	Status            ConnectionStatus `json:"status,omitempty"`
 	LastActivity      string           `json:"last_activity,omitempty"`
 	ForceDisconnect   string           `json:"force_disconnect,omitempty"`
 	TerminationReason string           `json:"termination_reason,omitempty"`
@@ -78,12 +123,216 @@ type Connection struct {
 	TargetHostRoles   []ConnectionRole `json:"target_host_roles,omitempty"`
 	AccessRoles       []AccessRoles    `json:"access_roles,omitempty"`
 	Tags              []string         `json:"tags,omitempty"`
+	Channels          []Channel        `json:"channels,omitempty"`
+}
+
+// ChannelType is type of connection channel, values unknown to SDK are
+// preserved as is
+type ChannelType string
+
+// ChannelType values
+const (
+	ChannelShell       = ChannelType("shell")
+	ChannelExec        = ChannelType("exec")
+	ChannelSFTP        = ChannelType("sftp")
+	ChannelPortForward = ChannelType("port_forward")
+)
+
+// Channel is a channel of the connection, channels are included only in
+// single connection details
+type Channel struct {
+	ID             string        `json:"id,omitempty"`
+	Type           ChannelType   `json:"type,omitempty"`
+	Created        string        `json:"created,omitempty"`
+	Closed         string        `json:"closed,omitempty"`
+	ForwardAddress string        `json:"forward_address,omitempty"`
+	TrailAvailable bool          `json:"trail_available,omitempty"`
+	TrailRemoved   bool          `json:"trail_removed,omitempty"`
+	Files          []ChannelFile `json:"files,omitempty"`
+}
+
+// ChannelFile is a file transferred over the channel, the file is
+// downloadable with DownloadStoredFile when stored. Path is valid UTF-8,
+// RawPath retains exact bytes of paths which are not.
+type ChannelFile struct {
+	ID        string `json:"id,omitempty"`
+	Path      string `json:"path,omitempty"`
+	RawPath   []byte `json:"-"`
+	Direction string `json:"direction,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Created   string `json:"created,omitempty"`
+	Stored    bool   `json:"stored,omitempty"`
+}
+
+// UnmarshalJSON decodes the file, retaining invalid UTF-8 of the path
+func (file *ChannelFile) UnmarshalJSON(data []byte) error {
+	type channelFile ChannelFile
+	var raw struct {
+		channelFile
+		Path json.RawMessage `json:"path,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*file = ChannelFile(raw.channelFile)
+	if len(raw.Path) == 0 || string(raw.Path) == "null" {
+		return nil
+	}
+
+	path, err := unquote(raw.Path)
+	if err != nil {
+		return err
+	}
+
+	file.Path = strings.ToValidUTF8(string(path), "\uFFFD")
+	if !utf8.Valid(path) {
+		file.RawPath = path
+	}
+	return nil
+}
+
+// PathBytes returns exact bytes of the path
+func (file *ChannelFile) PathBytes() []byte {
+	if file.RawPath != nil {
+		return file.RawPath
+	}
+	return []byte(file.Path)
+}
+
+// unquote decodes JSON string, unlike encoding/json it keeps bytes of
+// invalid UTF-8 as is
+func unquote(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != '"' || data[len(data)-1] != '"' {
+		return nil, fmt.Errorf("invalid json string %s", data)
+	}
+	data = data[1 : len(data)-1]
+
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\\' {
+			out = append(out, data[i])
+			continue
+		}
+
+		// escape sequence, high surrogate \uD800-\uDBFF is decoded
+		// together with the following low surrogate
+		n := 2
+		if i+1 < len(data) && data[i+1] == 'u' {
+			n = 6
+			if i+12 <= len(data) && strings.ContainsRune("dD", rune(data[i+2])) &&
+				strings.ContainsRune("89abAB", rune(data[i+3])) &&
+				data[i+6] == '\\' && data[i+7] == 'u' {
+				n = 12
+			}
+		}
+		if i+n > len(data) {
+			return nil, fmt.Errorf("invalid json string escape %s", data[i:])
+		}
+
+		var char string
+		if err := json.Unmarshal([]byte(`"`+string(data[i:i+n])+`"`), &char); err != nil {
+			return nil, err
+		}
+		out = append(out, char...)
+		i += n - 1
+	}
+
+	return out, nil
+}
+
+// FileTransfer is a file uploaded or downloaded within the connection
+type FileTransfer struct {
+	ConnectionID string
+	ChannelID    string
+	ChannelType  ChannelType
+	FileID       string
+	Path         string
+	RawPath      []byte
+	Direction    string
+	Size         int64
+	Created      string
+	Stored       bool
+}
+
+// TrailDownload describes streamed trail log
+type TrailDownload struct {
+	ContentType string
+	Filename    string
+}
+
+// TrailEvent is an event of trail log in jsonl format. Data is base64
+// encoded in the log. Terminal size is carried by pty events.
+type TrailEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"`
+	Data      []byte    `json:"data,omitempty"`
+	Width     int       `json:"width,omitempty"`
+	Height    int       `json:"height,omitempty"`
+}
+
+// TrailEvent types
+const (
+	TrailPTY    = "pty"
+	TrailStdin  = "stdin"
+	TrailStdout = "stdout"
+	TrailStderr = "stderr"
+)
+
+// ConnectedAt returns time the connection was established
+func (conn *Connection) ConnectedAt() time.Time {
+	t, _ := time.Parse(time.RFC3339, conn.Connected)
+	return t
+}
+
+// DisconnectedAt returns time the connection was closed, false is returned
+// for live connection
+func (conn *Connection) DisconnectedAt() (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, conn.Disconnected)
+	if err != nil || t.IsZero() {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// LiveStats is current I/O counters of an active connection
+type LiveStats struct {
+	ConnectionID string
+	BytesIn      int
+	BytesOut     int
+	Duration     time.Duration
+}
+
+// ConnectionStats aggregates connections established within time range
+type ConnectionStats struct {
+	From        time.Time
+	To          time.Time
+	Total       int
+	BytesIn     int64
+	BytesOut    int64
+	ByProtocol  map[Protocol]int
+	UniqueUsers int
+	UniqueHosts int
+	TopUsers    []UserCount
+}
+
+// Grouping of ConnectionCountsBy
+const (
+	GroupByHost     = "host"
+	GroupByUser     = "user"
+	GroupByProtocol = "protocol"
+)
+
+// UserCount is number of connections of the user
+type UserCount struct {
+	User  UserData
+	Count int
 }
 
 // TimestampSearch timestamp search struct definition
 type TimestampSearch struct {
-	Start string
-	End   string
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
 }
 
 // ConnectionSearch connection search struct definition
@@ -114,6 +363,67 @@ type ConnectionSearch struct {
 	Tags                 []string        `json:"tags,omitempty"`
 }
 
+// ConnectionSearchParams is typed filter of connection search, empty
+// fields are not used. The time range filters connections by their
+// connected time.
+type ConnectionSearchParams struct {
+	Keywords  string
+	UserIDs   []string
+	HostIDs   []string
+	Protocols []Protocol
+	Tags      []string
+	Start     time.Time
+	End       time.Time
+	Offset    int
+	Limit     int
+	Sortkey   string
+	Sortdir   string
+}
+
+type timeRange struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+type terminateRequest struct {
+	Reason string `json:"reason"`
+}
+
+type connectionSearchBody struct {
+	Keywords   string     `json:"keywords,omitempty"`
+	UserID     []string   `json:"user_id,omitempty"`
+	TargetHost []string   `json:"target_host_id,omitempty"`
+	Type       []Protocol `json:"type,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	Connected  *timeRange `json:"connected,omitempty"`
+}
+
+func (params *ConnectionSearchParams) body() connectionSearchBody {
+	body := connectionSearchBody{
+		Keywords:   params.Keywords,
+		UserID:     params.UserIDs,
+		TargetHost: params.HostIDs,
+		Type:       params.Protocols,
+		Tags:       params.Tags,
+	}
+
+	if !params.Start.IsZero() || !params.End.IsZero() {
+		body.Connected = &timeRange{
+			Start: formatTime(params.Start),
+			End:   formatTime(params.End),
+		}
+	}
+
+	return body
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
 //UEBA
 
 // UebaConfigurations uebaconfigurations struct definition
@@ -184,21 +494,21 @@ type uebaDatasetsResult struct {
 
 // UebaTrainingResult ueba training result struct definition
 type UebaTrainingResult struct {
-	DatasetID                  string    `json:"dataset_id"`
-	Created                    time.Time `json:"created"`
-	FeatureConfigName          string    `json:"feature_config_name"`
-	Status                     string    `json:"status"`
-	ErrorCode                  string    `json:"error_code"`
-	ErrorDetails               string    `json:"error_details"`
-	NumConnections             int       `json:"num_connections"`
-	Mean                       float32   `json:"mean"`
-	Std                        float32   `json:"std"`
-	Quantile99                 float32   `json:"quantile_99"`
-	Quantile999                float32   `json:"quantile_999"`
-	TrainingLog                string    `json:"training_log"`
-	TrainingDatasetLoss        []float32 `json:"training_dataset_loss"`
-	ValidationDatasetLoss      []float32 `json:"validation_dataset_loss"`
-	ValidationDatasetHistogram Histogram `json:"validation_dataset_histogram"`
+	DatasetID                  string      `json:"dataset_id"`
+	Created                    common.Time `json:"created"`
+	FeatureConfigName          string      `json:"feature_config_name"`
+	Status                     string      `json:"status"`
+	ErrorCode                  string      `json:"error_code"`
+	ErrorDetails               string      `json:"error_details"`
+	NumConnections             int         `json:"num_connections"`
+	Mean                       float32     `json:"mean"`
+	Std                        float32     `json:"std"`
+	Quantile99                 float32     `json:"quantile_99"`
+	Quantile999                float32     `json:"quantile_999"`
+	TrainingLog                string      `json:"training_log"`
+	TrainingDatasetLoss        []float32   `json:"training_dataset_loss"`
+	ValidationDatasetLoss      []float32   `json:"validation_dataset_loss"`
+	ValidationDatasetHistogram Histogram   `json:"validation_dataset_histogram"`
 }
 
 type Histogram struct {
@@ -228,7 +538,31 @@ type UebaInternalModelInstance struct {
 
 type UebaInternalStatus struct {
 	TrainingStatus      string                      `json:"training_status"`
+	TrainingProgress    float64                     `json:"training_progress,omitempty"`
 	InferenceStatus     string                      `json:"inference_status"`
 	DatasetID           string                      `json:"dataset_id" validate:"uuid,omitempty"`
 	ModelInstanceStatus []UebaInternalModelInstance `json:"model_instance_status"`
 }
+
+// FollowOption configures FollowConnections
+type FollowOption func(*followConfig)
+
+type followConfig struct {
+	maxBackoff time.Duration
+	onError    func(error)
+}
+
+// MaxBackoff limits the delay between polls after failures, defaults to
+// 16 poll intervals
+func MaxBackoff(d time.Duration) FollowOption {
+	return func(config *followConfig) {
+		config.maxBackoff = d
+	}
+}
+
+// OnFollowError receives failures of polls, which are retried
+func OnFollowError(f func(error)) FollowOption {
+	return func(config *followConfig) {
+		config.onError = f
+	}
+}
@@ -7,11 +7,19 @@
 package hoststore
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
+	"strings"
 
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/common"
 	"github.com/SSHcom/privx-sdk-go/restapi"
 )
 
+// bulkConcurrency limits parallel requests of bulk operations
+const bulkConcurrency = 4
+
 // HostStore is a role-store client instance.
 type HostStore struct {
 	api restapi.Connector
@@ -52,6 +60,39 @@ func (store *HostStore) SearchHost(sortkey, sortdir, filter string, offset, limi
 	return result.Items, err
 }
 
+// HostByExternalID returns the host of cloud instance, the instance id is
+// matched against instance and external id of hosts. Empty provider matches
+// any cloud provider. Unknown instance is reported as restapi.ErrNotFound.
+func (store *HostStore) HostByExternalID(provider, instanceID string) (*Host, error) {
+	if instanceID == "" {
+		return nil, errors.New("instance id is required")
+	}
+
+	var providers []string
+	if provider != "" {
+		providers = []string{provider}
+	}
+
+	for _, search := range []HostSearchObject{
+		{InstanceID: instanceID, CloudProviders: providers},
+		{ExternalID: instanceID, CloudProviders: providers},
+	} {
+		hosts, err := store.SearchHost("", "", "", 0, 100, &search)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, host := range hosts {
+			if (host.InstanceID == instanceID || host.ExternalID == instanceID) &&
+				(provider == "" || strings.EqualFold(host.CloudProvider, provider)) {
+				return &hosts[i], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("host of %s instance %s: %w", provider, instanceID, restapi.ErrNotFound)
+}
+
 // Hosts returns existing hosts
 func (store *HostStore) Hosts(offset, limit int, sortkey, sortdir, filter string) ([]Host, error) {
 	result := hostResult{}
@@ -106,6 +147,77 @@ func (store *HostStore) Host(hostID string) (*Host, error) {
 	return host, err
 }
 
+// HostRoles returns roles granting access to the host via its principals.
+// A role mapped to multiple principals is listed once.
+func (store *HostStore) HostRoles(hostID string) ([]rolestore.RoleRef, error) {
+	return store.principalRoles(hostID, func(Principal) bool { return true })
+}
+
+// AccountRoles returns roles authorizing use of the target account on the
+// host, roles are deduplicated across principals. Principals mapping
+// user's own account (use_user_account) are not matched.
+func (store *HostStore) AccountRoles(hostID, account string) ([]rolestore.RoleRef, error) {
+	return store.principalRoles(hostID, func(principal Principal) bool {
+		return !principal.UseUserAccount && principal.ID == account
+	})
+}
+
+// principalRoles collects roles of matching principals of the host
+func (store *HostStore) principalRoles(hostID string, match func(Principal) bool) ([]rolestore.RoleRef, error) {
+	host, err := store.Host(hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	roles := []rolestore.RoleRef{}
+	for _, principal := range host.Principals {
+		if !match(principal) {
+			continue
+		}
+
+		for _, role := range principal.Roles {
+			if !seen[role.ID] {
+				seen[role.ID] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	return roles, nil
+}
+
+// DeleteHostsByTag deletes all hosts with the tag. It returns the number
+// of deleted hosts and joined errors of failed deletes.
+func (store *HostStore) DeleteHostsByTag(tag string) (int, error) {
+	if tag == "" {
+		return 0, errors.New("tag is required for bulk delete")
+	}
+
+	search := &HostSearchObject{Tags: []string{tag}}
+	hosts, err := common.NewPager(100, func(offset, limit int) ([]Host, int, error) {
+		result := hostResult{}
+		filters := Params{Offset: offset, Limit: limit}
+
+		header, err := store.api.
+			URL("/host-store/api/v1/hosts/search").
+			Query(&filters).
+			Post(search, &result)
+
+		return result.Items, restapi.TotalCount(header, result.Count), err
+	}).All()
+	if err != nil {
+		return 0, err
+	}
+
+	return common.ParallelDo(hosts, bulkConcurrency, func(host Host) error {
+		if err := store.DeleteHost(host.ID); err != nil {
+			return fmt.Errorf("host %s: %w", host.ID, err)
+		}
+		return nil
+	})
+}
+
 // UpdateHost update existing host
 func (store *HostStore) UpdateHost(hostID string, host *Host) error {
 	_, err := store.api.
@@ -118,12 +230,41 @@ func (store *HostStore) UpdateHost(hostID string, host *Host) error {
 // DeleteHost delete a host
 func (store *HostStore) DeleteHost(hostID string) error {
 	_, err := store.api.
-		URL("/host-store/api/v1/hosts/%s", hostID).
+		URL("/host-store/api/v1/hosts/%s", url.PathEscape(hostID)).
 		Delete()
 
 	return err
 }
 
+// HostPublicKeys returns current SSH public keys and fingerprints of the host
+func (store *HostStore) HostPublicKeys(hostID string) ([]SSHPublicKey, error) {
+	host, err := store.Host(hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	return host.PublicKeys, nil
+}
+
+// RotateHostKey triggers rotation of PrivX managed keys of the host. Hosts
+// which are not deployable are rejected with ErrHostNotDeployable.
+func (store *HostStore) RotateHostKey(hostID string) error {
+	host, err := store.Host(hostID)
+	if err != nil {
+		return err
+	}
+
+	if !host.Deployable {
+		return fmt.Errorf("host %s: %w", hostID, ErrHostNotDeployable)
+	}
+
+	_, err = store.api.
+		URL("/host-store/api/v1/hosts/%s/rotate-keys", url.PathEscape(hostID)).
+		Post(nil)
+
+	return err
+}
+
 // UpdateDeployStatus update host to be deployable or undeployable
 func (store *HostStore) UpdateDeployStatus(hostID string, status bool) error {
 	deployStatus := Host{
@@ -155,6 +296,45 @@ func (store *HostStore) HostTags(offset, limit int, sortdir, query string) ([]st
 	return result.Items, err
 }
 
+// HostCountsByTag returns number of hosts bearing each host tag. Host store
+// does not aggregate counts by tag, the count of each tag is looked up by
+// host search limited to single item. The cost is one request per page of
+// tags and one request per tag, hosts themselves are not transferred.
+func (store *HostStore) HostCountsByTag() (map[string]int, error) {
+	tags, err := common.NewPager(100, func(offset, limit int) ([]string, int, error) {
+		result := tagsResult{}
+		filters := Params{Offset: offset, Limit: limit}
+
+		header, err := store.api.
+			URL("/host-store/api/v1/hosts/tags").
+			Query(&filters).
+			Get(&result)
+
+		return result.Items, restapi.TotalCount(header, result.Count), err
+	}).All()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(tags))
+	for _, tag := range tags {
+		result := hostResult{}
+		filters := Params{Limit: 1}
+
+		header, err := store.api.
+			URL("/host-store/api/v1/hosts/search").
+			Query(&filters).
+			Post(&HostSearchObject{Tags: []string{tag}}, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		counts[tag] = restapi.TotalCount(header, result.Count)
+	}
+
+	return counts, nil
+}
+
 // UpdateDisabledHostStatus enable/disable host
 func (store *HostStore) UpdateDisabledHostStatus(hostID string, status bool) error {
 	disabledStatus := HostDisabledRequest{
@@ -178,3 +358,83 @@ func (store *HostStore) ServiceOptions() (*DefaultServiceOptions, error) {
 
 	return options, err
 }
+
+// WebTargets returns hosts published for web access
+func (store *HostStore) WebTargets(offset, limit int) ([]WebTarget, error) {
+	hosts, err := store.SearchHost("", "", "", offset, limit,
+		&HostSearchObject{Service: []string{string(WEB)}})
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []WebTarget{}
+	for _, host := range hosts {
+		targets = append(targets, webTarget(host))
+	}
+
+	return targets, nil
+}
+
+// WebTarget returns existing web access target, hosts without WEB
+// services are rejected with ErrNotWebTarget
+func (store *HostStore) WebTarget(targetID string) (*WebTarget, error) {
+	host, err := store.Host(targetID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isWebTarget(host) {
+		return nil, fmt.Errorf("host %s: %w", targetID, ErrNotWebTarget)
+	}
+
+	target := webTarget(*host)
+	return &target, nil
+}
+
+// CreateWebTarget creates a web access target, it returns the target id
+func (store *HostStore) CreateWebTarget(target WebTarget) (string, error) {
+	host := Host{}
+	if err := target.apply(&host); err != nil {
+		return "", err
+	}
+
+	return store.CreateHost(host)
+}
+
+// UpdateWebTarget updates existing web access target. Host properties
+// not covered by the target definition are preserved.
+func (store *HostStore) UpdateWebTarget(targetID string, target *WebTarget) error {
+	host, err := store.Host(targetID)
+	if err != nil {
+		return err
+	}
+
+	if !isWebTarget(host) {
+		return fmt.Errorf("host %s: %w", targetID, ErrNotWebTarget)
+	}
+
+	if err := target.apply(host); err != nil {
+		return err
+	}
+
+	return store.UpdateHost(targetID, host)
+}
+
+// DeleteWebTarget deletes web access target
+func (store *HostStore) DeleteWebTarget(targetID string) error {
+	host, err := store.Host(targetID)
+	if err != nil {
+		return err
+	}
+
+	if !isWebTarget(host) {
+		return fmt.Errorf("host %s: %w", targetID, ErrNotWebTarget)
+	}
+
+	err = store.DeleteHost(targetID)
+	if errors.Is(err, restapi.ErrConflict) {
+		return fmt.Errorf("web target %s is referenced by other objects: %w", targetID, err)
+	}
+
+	return err
+}
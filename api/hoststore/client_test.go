@@ -0,0 +1,496 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package hoststore_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/SSHcom/privx-sdk-go/api/hoststore"
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+func TestHostCountsByTag(t *testing.T) {
+	counts := map[string]int{"prod": 12, "staging": 3, "dev": 0}
+	tags := []string{"dev", "prod", "staging"}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/host-store/api/v1/hosts/tags":
+				offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"count": len(tags),
+					"items": tags[offset:],
+				})
+			case "/host-store/api/v1/hosts/search":
+				if r.URL.Query().Get("limit") != "1" {
+					t.Errorf("hosts are transferred: %s", r.URL.RawQuery)
+				}
+				search := hoststore.HostSearchObject{}
+				json.NewDecoder(r.Body).Decode(&search)
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"count": counts[search.Tags[0]],
+					"items": []hoststore.Host{{ID: "1"}},
+				})
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	result, err := store.HostCountsByTag()
+	if err != nil {
+		t.Fatalf("host counts fails: %v", err)
+	}
+	if !reflect.DeepEqual(result, counts) {
+		t.Errorf("unexpected counts: %v", result)
+	}
+}
+
+func TestRotateHostKey(t *testing.T) {
+	rotated := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/host-store/api/v1/hosts/managed":
+				w.Write([]byte(`{
+					"id": "managed",
+					"deployable": true,
+					"ssh_host_public_keys": [{"key": "ssh-ed25519 AAAA", "fingerprint": "SHA256:abc"}]
+				}`))
+			case "/host-store/api/v1/hosts/undeployable":
+				w.Write([]byte(`{"id": "undeployable", "deployable": false}`))
+			case "/host-store/api/v1/hosts/managed/rotate-keys":
+				rotated = append(rotated, r.Method)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	keys, err := store.HostPublicKeys("managed")
+	if err != nil || len(keys) != 1 || keys[0].Fingerprint != "SHA256:abc" {
+		t.Errorf("unexpected keys: %+v, %v", keys, err)
+	}
+
+	if err = store.RotateHostKey("managed"); err != nil {
+		t.Errorf("rotate fails: %v", err)
+	}
+	if !reflect.DeepEqual(rotated, []string{http.MethodPost}) {
+		t.Errorf("rotation is not requested: %v", rotated)
+	}
+
+	err = store.RotateHostKey("undeployable")
+	if !errors.Is(err, hoststore.ErrHostNotDeployable) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAccountRoles(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{
+				"id": "1",
+				"principals": [
+					{"principal": "root", "roles": [{"id": "r1", "name": "admins"}, {"id": "r2", "name": "ops"}]},
+					{"principal": "root", "roles": [{"id": "r2", "name": "ops"}, {"id": "r3", "name": "dba"}]},
+					{"principal": "deploy", "roles": [{"id": "r4", "name": "ci"}]},
+					{"principal": "root", "use_user_account": true, "roles": [{"id": "r5", "name": "users"}]}
+				]
+			}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	roles, err := store.AccountRoles("1", "root")
+	if err != nil {
+		t.Fatalf("account roles fails: %v", err)
+	}
+
+	expect := []rolestore.RoleRef{
+		{ID: "r1", Name: "admins"},
+		{ID: "r2", Name: "ops"},
+		{ID: "r3", Name: "dba"},
+	}
+	if !reflect.DeepEqual(roles, expect) {
+		t.Errorf("unexpected roles: %v", roles)
+	}
+
+	roles, err = store.AccountRoles("1", "nobody")
+	if err != nil || len(roles) != 0 {
+		t.Errorf("unexpected roles: %v, %v", roles, err)
+	}
+}
+
+func TestHostRoles(t *testing.T) {
+	requests := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch r.URL.Path {
+			case "/host-store/api/v1/hosts/h1":
+				w.Write([]byte(`{
+					"id": "h1",
+					"principals": [
+						{"principal": "root", "roles": [{"id": "r1", "name": "admins"}, {"id": "r2", "name": "ops"}]},
+						{"principal": "deploy", "roles": [{"id": "r2", "name": "ops"}, {"id": "r9", "name": "gone"}]}
+					]
+				}`))
+			case "/host-store/api/v1/hosts/h2":
+				w.Write([]byte(`{"id": "h2"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	roles, err := store.HostRoles("h1")
+	if err != nil {
+		t.Fatalf("host roles fails: %v", err)
+	}
+
+	expect := []rolestore.RoleRef{
+		{ID: "r1", Name: "admins"},
+		{ID: "r2", Name: "ops"},
+		{ID: "r9", Name: "gone"},
+	}
+	if !reflect.DeepEqual(roles, expect) {
+		t.Errorf("unexpected roles: %+v", roles)
+	}
+	if !reflect.DeepEqual(requests, []string{"GET /host-store/api/v1/hosts/h1"}) {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+
+	requests = nil
+	roles, err = store.HostRoles("h2")
+	if err != nil || len(roles) != 0 || len(requests) != 1 {
+		t.Errorf("unexpected roles: %+v, %v, %v", roles, err, requests)
+	}
+
+	if _, err := store.HostRoles("h3"); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDeleteHostsByTag(t *testing.T) {
+	var mu sync.Mutex
+	deleted := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/host-store/api/v1/hosts/search":
+				search := hoststore.HostSearchObject{}
+				json.NewDecoder(r.Body).Decode(&search)
+				if !reflect.DeepEqual(search.Tags, []string{"stale"}) {
+					t.Errorf("unexpected search: %+v", search)
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"count": 3,
+					"items": []hoststore.Host{{ID: "1"}, {ID: "2"}, {ID: "3"}},
+				})
+			case r.Method == http.MethodDelete && r.URL.Path == "/host-store/api/v1/hosts/2":
+				w.WriteHeader(http.StatusForbidden)
+			case r.Method == http.MethodDelete:
+				mu.Lock()
+				deleted = append(deleted, r.URL.Path)
+				mu.Unlock()
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	n, err := store.DeleteHostsByTag("stale")
+	if n != 2 || !errors.Is(err, restapi.ErrForbidden) {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+
+	sort.Strings(deleted)
+	expect := []string{"/host-store/api/v1/hosts/1", "/host-store/api/v1/hosts/3"}
+	if !reflect.DeepEqual(deleted, expect) {
+		t.Errorf("unexpected deletes: %v", deleted)
+	}
+
+	if _, err := store.DeleteHostsByTag(""); err == nil {
+		t.Errorf("empty tag is accepted")
+	}
+}
+
+func TestHostByExternalID(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			search := hoststore.HostSearchObject{}
+			json.NewDecoder(r.Body).Decode(&search)
+			switch {
+			case search.InstanceID == "i-123":
+				w.Write([]byte(`{"count": 2, "items": [
+					{"id": "h1", "instance_id": "i-1234", "cloud_provider": "AWS"},
+					{"id": "h2", "instance_id": "i-123", "cloud_provider": "AWS"}
+				]}`))
+			case search.ExternalID == "vm-9":
+				w.Write([]byte(`{"count": 1, "items": [
+					{"id": "h3", "external_id": "vm-9", "cloud_provider": "AZURE"}
+				]}`))
+			default:
+				w.Write([]byte(`{"count": 0, "items": []}`))
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	host, err := store.HostByExternalID("aws", "i-123")
+	if err != nil || host.ID != "h2" {
+		t.Errorf("unexpected host: %+v, %v", host, err)
+	}
+
+	host, err = store.HostByExternalID("", "vm-9")
+	if err != nil || host.ID != "h3" {
+		t.Errorf("unexpected host: %+v, %v", host, err)
+	}
+
+	for _, id := range [][]string{{"azure", "i-123"}, {"aws", "i-999"}} {
+		if _, err := store.HostByExternalID(id[0], id[1]); !errors.Is(err, restapi.ErrNotFound) {
+			t.Errorf("unexpected error for %v: %v", id, err)
+		}
+	}
+}
+
+// mockHosts is host store kept by mock server, deletion of referenced
+// hosts is rejected with conflict
+type mockHosts struct {
+	sync.Mutex
+	hosts      map[string]hoststore.Host
+	referenced map[string]bool
+}
+
+func (mock *mockHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.Lock()
+	defer mock.Unlock()
+
+	switch path := strings.TrimPrefix(r.URL.Path, "/host-store/api/v1/hosts"); {
+	case path == "" && r.Method == http.MethodPost:
+		host := hoststore.Host{}
+		json.NewDecoder(r.Body).Decode(&host)
+		host.ID = "w" + strconv.Itoa(len(mock.hosts)+1)
+		mock.hosts[host.ID] = host
+		json.NewEncoder(w).Encode(map[string]string{"id": host.ID})
+	case path == "/search":
+		items := []hoststore.Host{}
+		for _, host := range mock.hosts {
+			for _, service := range host.Services {
+				if service.Scheme == hoststore.WEB {
+					items = append(items, host)
+					break
+				}
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": len(items), "items": items})
+	default:
+		id := strings.TrimPrefix(path, "/")
+		host, exists := mock.hosts[id]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(host)
+		case http.MethodPut:
+			host = hoststore.Host{}
+			json.NewDecoder(r.Body).Decode(&host)
+			mock.hosts[id] = host
+		case http.MethodDelete:
+			if mock.referenced[id] {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			delete(mock.hosts, id)
+		}
+	}
+}
+
+func TestWebTargetRoundTrip(t *testing.T) {
+	mock := &mockHosts{hosts: map[string]hoststore.Host{}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	target := hoststore.WebTarget{
+		Name: "wiki",
+		URLs: []string{
+			"https://wiki.example.com/docs?space=ops",
+			"http://wiki.example.com:8080",
+			"https://wiki.example.com:8443/",
+			"http://legacy.example.com/login",
+		},
+		Roles:    []rolestore.RoleRef{{ID: "r1", Name: "ops"}},
+		Username: "wiki-sso",
+		Password: "secret",
+	}
+
+	id, err := store.CreateWebTarget(target)
+	if err != nil || id == "" {
+		t.Fatalf("create fails: %q, %v", id, err)
+	}
+
+	target.ID = id
+	created, err := store.WebTarget(id)
+	if err != nil {
+		t.Fatalf("web target fails: %v", err)
+	}
+	if !reflect.DeepEqual(*created, target) {
+		t.Errorf("target is changed by round-trip:\n%+v\n%+v", *created, target)
+	}
+
+	targets, err := store.WebTargets(0, 10)
+	if err != nil || len(targets) != 1 || !reflect.DeepEqual(targets[0], target) {
+		t.Errorf("unexpected targets: %+v, %v", targets, err)
+	}
+
+	if _, err := store.CreateWebTarget(hoststore.WebTarget{URLs: []string{"ftp://files.example.com"}}); err == nil {
+		t.Errorf("non-http url is accepted")
+	}
+}
+
+func TestUpdateWebTarget(t *testing.T) {
+	mock := &mockHosts{hosts: map[string]hoststore.Host{
+		"w1": {
+			ID:   "w1",
+			Name: "portal",
+			Services: []hoststore.Service{
+				hoststore.WEB.Service("portal.example.com", 443),
+				hoststore.SSH.Service("portal.example.com", 22),
+			},
+			Principals: []hoststore.Principal{
+				hoststore.NewPrincipal("portal-sso", rolestore.RoleRef{ID: "r1"}),
+				hoststore.NewPrincipal("root", rolestore.RoleRef{ID: "admins"}),
+			},
+		},
+	}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	target, err := store.WebTarget("w1")
+	if err != nil {
+		t.Fatalf("web target fails: %v", err)
+	}
+	if !reflect.DeepEqual(target.URLs, []string{"https://portal.example.com"}) {
+		t.Errorf("unexpected urls: %v", target.URLs)
+	}
+
+	target.URLs = []string{"https://portal.example.com/app"}
+	target.Roles = []rolestore.RoleRef{{ID: "r2"}}
+	if err := store.UpdateWebTarget("w1", target); err != nil {
+		t.Fatalf("update fails: %v", err)
+	}
+
+	host := mock.hosts["w1"]
+	if len(host.Services) != 2 || host.Services[0].Scheme != hoststore.SSH {
+		t.Errorf("non-web services are not preserved: %+v", host.Services)
+	}
+	if len(host.Principals) != 2 || host.Principals[1].ID != "root" {
+		t.Errorf("principals are not preserved: %+v", host.Principals)
+	}
+
+	updated, err := store.WebTarget("w1")
+	if err != nil || !reflect.DeepEqual(updated, target) {
+		t.Errorf("unexpected target: %+v, %v", updated, err)
+	}
+}
+
+func TestDeleteHostEscapesID(t *testing.T) {
+	paths := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.Method+" "+r.URL.EscapedPath())
+			if r.Method == http.MethodGet {
+				w.Write([]byte(`{"id": "a/b", "services": [{"service": "WEB"}]}`))
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if err := store.DeleteHost("a/b"); err != nil {
+		t.Errorf("delete fails: %v", err)
+	}
+	if err := store.DeleteWebTarget("a/b"); err != nil {
+		t.Errorf("delete fails: %v", err)
+	}
+
+	expect := []string{
+		"DELETE /host-store/api/v1/hosts/a%2Fb",
+		"GET /host-store/api/v1/hosts/a%2Fb",
+		"DELETE /host-store/api/v1/hosts/a%2Fb",
+	}
+	if !reflect.DeepEqual(paths, expect) {
+		t.Errorf("unexpected requests: %v", paths)
+	}
+}
+
+func TestDeleteWebTarget(t *testing.T) {
+	mock := &mockHosts{
+		hosts: map[string]hoststore.Host{
+			"w1":  {ID: "w1", Services: []hoststore.Service{hoststore.WEB.Service("a.example.com", 443)}},
+			"w2":  {ID: "w2", Services: []hoststore.Service{hoststore.WEB.Service("b.example.com", 443)}},
+			"ssh": {ID: "ssh", Services: []hoststore.Service{hoststore.SSH.Service("c.example.com", 22)}},
+		},
+		referenced: map[string]bool{"w2": true},
+	}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := hoststore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if err := store.DeleteWebTarget("w1"); err != nil {
+		t.Errorf("delete fails: %v", err)
+	}
+	if _, exists := mock.hosts["w1"]; exists {
+		t.Errorf("target is not deleted")
+	}
+
+	if err := store.DeleteWebTarget("w2"); !errors.Is(err, restapi.ErrConflict) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := store.WebTarget("ssh"); !errors.Is(err, hoststore.ErrNotWebTarget) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := store.DeleteWebTarget("ssh"); !errors.Is(err, hoststore.ErrNotWebTarget) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, exists := mock.hosts["ssh"]; !exists {
+		t.Errorf("non-web host is deleted")
+	}
+}
@@ -6,7 +6,23 @@
 
 package hoststore
 
-import "github.com/SSHcom/privx-sdk-go/api/rolestore"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+)
+
+// ErrHostNotDeployable is returned when key rotation is requested for a
+// host which is not deployable, PrivX does not deploy keys to it
+var ErrHostNotDeployable = errors.New("host is not deployable")
+
+// ErrNotWebTarget is returned when web access target operation is applied
+// to a host without WEB services
+var ErrNotWebTarget = errors.New("host is not web target")
 
 // Source of host objects
 type Source string
@@ -104,11 +120,12 @@ type SessionRecordingOptions struct {
 
 // Service specify the service available on target host
 type Service struct {
-	Scheme  Scheme                  `json:"service"`
-	Address Address                 `json:"address"`
-	Port    int                     `json:"port"`
-	DB      HostServiceDBParameters `json:"db"`
-	Source  Source                  `json:"source"`
+	Scheme  Scheme                    `json:"service"`
+	Address Address                   `json:"address"`
+	Port    int                       `json:"port"`
+	DB      HostServiceDBParameters   `json:"db"`
+	Web     *HostServiceWebParameters `json:"web,omitempty"`
+	Source  Source                    `json:"source"`
 }
 
 // Principal of the target host
@@ -176,6 +193,15 @@ type HostServiceDBParameters struct {
 	AuditSkipBytes             int64                              `json:"audit_skip_bytes"`
 }
 
+// HostServiceWebParameters is the url scheme and path of WEB service
+type HostServiceWebParameters struct {
+	Protocol string `json:"protocol"`
+	Path     string `json:"path,omitempty"`
+}
+
+// defaultWebPort is port of supported web url schemes
+var defaultWebPort = map[string]int{"http": 80, "https": 443}
+
 // SSHService default options
 type SSHService struct {
 	Shell        bool `json:"shell"`
@@ -219,6 +245,20 @@ type DefaultServiceOptions struct {
 	DB  DBService  `json:"db"`
 }
 
+// WebTarget is a web application published through PrivX web access.
+// It is a host with WEB services, one per application URL.
+type WebTarget struct {
+	ID    string
+	Name  string
+	URLs  []string
+	Roles []rolestore.RoleRef
+	// SSO settings, either the user's own account is passed to the target
+	// or the target is signed into using stored credentials
+	UseUserAccount bool
+	Username       string
+	Password       string
+}
+
 // Service creates a corresponding service definition
 //
 //	hosts.SSH.Service(...)
@@ -239,3 +279,104 @@ func NewPrincipal(id string, role ...rolestore.RoleRef) Principal {
 		Source: UI,
 	}
 }
+
+// webTarget builds web access target view of the host. Services created
+// before the scheme and path were stored are assumed https, unless they
+// use port 80.
+func webTarget(host Host) WebTarget {
+	target := WebTarget{
+		ID:   host.ID,
+		Name: host.Name,
+	}
+
+	for _, service := range host.Services {
+		if service.Scheme != WEB {
+			continue
+		}
+
+		web := HostServiceWebParameters{Protocol: "https"}
+		if service.Web != nil {
+			web = *service.Web
+		} else if service.Port == 80 {
+			web.Protocol = "http"
+		}
+
+		hostport := string(service.Address)
+		if service.Port != defaultWebPort[web.Protocol] {
+			hostport = net.JoinHostPort(hostport, strconv.Itoa(service.Port))
+		}
+		target.URLs = append(target.URLs, web.Protocol+"://"+hostport+web.Path)
+	}
+
+	if len(host.Principals) > 0 {
+		principal := host.Principals[0]
+		target.Roles = principal.Roles
+		target.UseUserAccount = principal.UseUserAccount
+		target.Username = principal.ID
+		target.Password = principal.Passphrase
+	}
+
+	return target
+}
+
+// isWebTarget reports if the host has WEB services
+func isWebTarget(host *Host) bool {
+	for _, service := range host.Services {
+		if service.Scheme == WEB {
+			return true
+		}
+	}
+	return false
+}
+
+// apply web access target definition to the host, services other than
+// WEB are preserved. SSO settings of the target are kept by the first
+// principal of the host, other principals are preserved.
+func (target *WebTarget) apply(host *Host) error {
+	services := []Service{}
+	for _, service := range host.Services {
+		if service.Scheme != WEB {
+			services = append(services, service)
+		}
+	}
+
+	for _, addr := range target.URLs {
+		uri, err := url.Parse(addr)
+		if err != nil {
+			return err
+		}
+
+		port, supported := defaultWebPort[uri.Scheme]
+		if !supported || uri.Hostname() == "" {
+			return fmt.Errorf("web target url %s is not http(s)", addr)
+		}
+		if uri.Port() != "" {
+			if port, err = strconv.Atoi(uri.Port()); err != nil {
+				return err
+			}
+		}
+
+		path := uri.EscapedPath()
+		if uri.RawQuery != "" {
+			path += "?" + uri.RawQuery
+		}
+
+		service := WEB.Service(Address(uri.Hostname()), port)
+		service.Web = &HostServiceWebParameters{Protocol: uri.Scheme, Path: path}
+		services = append(services, service)
+	}
+
+	if len(host.Principals) == 0 {
+		host.Principals = []Principal{NewPrincipal(target.Username)}
+	}
+	principal := &host.Principals[0]
+	principal.ID = target.Username
+	principal.Roles = target.Roles
+	principal.UseUserAccount = target.UseUserAccount
+	principal.Passphrase = target.Password
+
+	host.Name = target.Name
+	host.Services = services
+
+	return nil
+}
@@ -73,3 +73,14 @@ func (store *LicenseManager) License() (*License, error) {
 
 	return license, err
 }
+
+// UsageStatistics returns use of licensed resources against the license
+func (store *LicenseManager) UsageStatistics() (*Usage, error) {
+	usage := &Usage{}
+
+	_, err := store.api.
+		URL("/license-manager/api/v1/license").
+		Get(usage)
+
+	return usage, err
+}
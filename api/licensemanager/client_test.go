@@ -0,0 +1,123 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package licensemanager_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/SSHcom/privx-sdk-go/api/licensemanager"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+func mockLicense(t *testing.T, fixture string) *httptest.Server {
+	data, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.URL.Path != "/license-manager/api/v1/license" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}),
+	)
+}
+
+func TestUsageStatistics(t *testing.T) {
+	for _, tc := range []struct {
+		fixture  string
+		usage    licensemanager.Usage
+		headroom map[licensemanager.UsageDimension]int
+	}{
+		{
+			fixture: "license-v1.json",
+			usage: licensemanager.Usage{
+				Users: licensemanager.Counter{Current: 30, Max: 25, Reported: true},
+				Hosts: licensemanager.Counter{Current: 40, Max: 100, Reported: true},
+			},
+			headroom: map[licensemanager.UsageDimension]int{
+				licensemanager.UsageUsers: 0,
+				licensemanager.UsageHosts: 60,
+			},
+		},
+		{
+			fixture: "license-v2.json",
+			usage: licensemanager.Usage{
+				Users:            licensemanager.Counter{Current: 12, Max: 25, Reported: true},
+				Hosts:            licensemanager.Counter{Current: 40, Max: 100, Reported: true},
+				AuditedHosts:     licensemanager.Counter{Current: 4, Max: 10, Reported: true},
+				SSHConnections:   licensemanager.Counter{Current: 7, Max: 50, Reported: true},
+				RDPConnections:   licensemanager.Counter{Current: 0, Max: 20, Reported: true},
+				HTTPSConnections: licensemanager.Counter{Current: 2, Max: 5, Reported: true},
+				VNCConnections:   licensemanager.Counter{Current: 0, Max: 5, Reported: true},
+			},
+			headroom: map[licensemanager.UsageDimension]int{
+				licensemanager.UsageUsers:            13,
+				licensemanager.UsageHosts:            60,
+				licensemanager.UsageAuditedHosts:     6,
+				licensemanager.UsageSSHConnections:   43,
+				licensemanager.UsageRDPConnections:   20,
+				licensemanager.UsageHTTPSConnections: 3,
+				licensemanager.UsageVNCConnections:   5,
+			},
+		},
+		{
+			fixture: "license-nomax.json",
+			usage: licensemanager.Usage{
+				Users:        licensemanager.Counter{Current: 12, Reported: true},
+				Hosts:        licensemanager.Counter{Current: 40, Reported: true},
+				AuditedHosts: licensemanager.Counter{Current: 4, Max: 10, Reported: true},
+			},
+			headroom: map[licensemanager.UsageDimension]int{
+				licensemanager.UsageAuditedHosts: 6,
+			},
+		},
+	} {
+		ts := mockLicense(t, tc.fixture)
+		store := licensemanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+		usage, err := store.UsageStatistics()
+		ts.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.fixture, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(*usage, tc.usage) {
+			t.Errorf("%s: unexpected usage %+v", tc.fixture, *usage)
+		}
+		if headroom := usage.LicenseHeadroom(); !reflect.DeepEqual(headroom, tc.headroom) {
+			t.Errorf("%s: unexpected headroom %v", tc.fixture, headroom)
+		}
+	}
+}
+
+func TestUsageDimensionMissing(t *testing.T) {
+	ts := mockLicense(t, "license-v1.json")
+	defer ts.Close()
+
+	store := licensemanager.New(restapi.New(restapi.BaseURL(ts.URL)))
+	usage, err := store.UsageStatistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c, ok := usage.Dimension(licensemanager.UsageSSHConnections); ok || c != (licensemanager.Counter{}) {
+		t.Errorf("unexpected ssh connections: %+v, %v", c, ok)
+	}
+	if c, ok := usage.Dimension(licensemanager.UsageHosts); !ok || c.Current != 40 {
+		t.Errorf("unexpected hosts: %+v, %v", c, ok)
+	}
+}
@@ -6,6 +6,8 @@
 
 package licensemanager
 
+import "encoding/json"
+
 // License license definition
 type License struct {
 	LicenseStatus           string   `json:"license_status,omitempty"`
@@ -35,3 +37,116 @@ type License struct {
 	AuditHostsInUse         int      `json:"audit_hosts_in_use,omitempty"`
 	UsersInUse              int      `json:"users_in_use,omitempty"`
 }
+
+// UsageDimension is a licensed resource
+type UsageDimension string
+
+// UsageDimension supported values
+const (
+	UsageUsers            = UsageDimension("users")
+	UsageHosts            = UsageDimension("hosts")
+	UsageAuditedHosts     = UsageDimension("audited_hosts")
+	UsageSSHConnections   = UsageDimension("ssh_connections")
+	UsageRDPConnections   = UsageDimension("rdp_connections")
+	UsageHTTPSConnections = UsageDimension("https_connections")
+	UsageVNCConnections   = UsageDimension("vnc_connections")
+)
+
+// Counter is current use of a licensed resource and its licensed maximum.
+// Reported is false if the server does not track the resource. Max is
+// zero if the license does not state maximum of the resource.
+type Counter struct {
+	Current  int
+	Max      int
+	Reported bool
+}
+
+// Usage is use of licensed resources, connections are concurrent ones
+type Usage struct {
+	Users            Counter
+	Hosts            Counter
+	AuditedHosts     Counter
+	SSHConnections   Counter
+	RDPConnections   Counter
+	HTTPSConnections Counter
+	VNCConnections   Counter
+}
+
+// UnmarshalJSON decodes usage counters of the license, counters missing
+// from the response are left unreported
+func (usage *Usage) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		UsersInUse      *int `json:"users_in_use"`
+		MaxUsers        int  `json:"max_users"`
+		HostsInUse      *int `json:"hosts_in_use"`
+		MaxHosts        int  `json:"max_hosts"`
+		AuditHostsInUse *int `json:"audit_hosts_in_use"`
+		MaxAuditedHosts int  `json:"max_audited_hosts"`
+		SSHConnsInUse   *int `json:"ssh_conns_in_use"`
+		MaxSSHConns     int  `json:"max_concurrent_ssh_conns"`
+		RDPConnsInUse   *int `json:"rdp_conns_in_use"`
+		MaxRDPConns     int  `json:"max_concurrent_rdp_conns"`
+		HTTPSConnsInUse *int `json:"https_conns_in_use"`
+		MaxHTTPSConns   int  `json:"max_concurrent_https_conns"`
+		VNCConnsInUse   *int `json:"vnc_conns_in_use"`
+		MaxVNCConns     int  `json:"max_concurrent_vnc_conns"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*usage = Usage{
+		Users:            counter(raw.UsersInUse, raw.MaxUsers),
+		Hosts:            counter(raw.HostsInUse, raw.MaxHosts),
+		AuditedHosts:     counter(raw.AuditHostsInUse, raw.MaxAuditedHosts),
+		SSHConnections:   counter(raw.SSHConnsInUse, raw.MaxSSHConns),
+		RDPConnections:   counter(raw.RDPConnsInUse, raw.MaxRDPConns),
+		HTTPSConnections: counter(raw.HTTPSConnsInUse, raw.MaxHTTPSConns),
+		VNCConnections:   counter(raw.VNCConnsInUse, raw.MaxVNCConns),
+	}
+	return nil
+}
+
+func counter(current *int, max int) Counter {
+	if current == nil {
+		return Counter{}
+	}
+	return Counter{Current: *current, Max: max, Reported: true}
+}
+
+func (usage *Usage) dimensions() map[UsageDimension]Counter {
+	return map[UsageDimension]Counter{
+		UsageUsers:            usage.Users,
+		UsageHosts:            usage.Hosts,
+		UsageAuditedHosts:     usage.AuditedHosts,
+		UsageSSHConnections:   usage.SSHConnections,
+		UsageRDPConnections:   usage.RDPConnections,
+		UsageHTTPSConnections: usage.HTTPSConnections,
+		UsageVNCConnections:   usage.VNCConnections,
+	}
+}
+
+// Dimension returns counter of the resource, it returns zero counter and
+// false if the resource is unknown or not reported by the server
+func (usage *Usage) Dimension(dim UsageDimension) (Counter, bool) {
+	c := usage.dimensions()[dim]
+	return c, c.Reported
+}
+
+// LicenseHeadroom returns remaining capacity of reported resources, the
+// capacity is zero when use meets or exceeds the license. Resources without
+// licensed maximum have unknown capacity, they are omitted.
+func (usage *Usage) LicenseHeadroom() map[UsageDimension]int {
+	headroom := map[UsageDimension]int{}
+	for dim, c := range usage.dimensions() {
+		if !c.Reported || c.Max <= 0 {
+			continue
+		}
+		if c.Current < c.Max {
+			headroom[dim] = c.Max - c.Current
+		} else {
+			headroom[dim] = 0
+		}
+	}
+	return headroom
+}
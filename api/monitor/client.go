@@ -7,15 +7,29 @@
 package monitor
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
+	"github.com/SSHcom/privx-sdk-go/common"
 	"github.com/SSHcom/privx-sdk-go/restapi"
 )
 
+// followOverlap is how far each poll of FollowAuditEvents reaches back
+// before the latest seen event, it tolerates late indexed events
+const followOverlap = time.Minute
+
 // Monitor is a monitor service client instance.
 type Monitor struct {
-	api restapi.Connector
+	api   restapi.Connector
+	clock common.Clock
 }
 
 // EventsResult list of event results
@@ -27,7 +41,12 @@ type EventsResult struct {
 // New creates a new monitor service client instance, using the
 // argument SDK API client.
 func New(api restapi.Connector) *Monitor {
-	return &Monitor{api: api}
+	return &Monitor{api: api, clock: common.SystemClock{}}
+}
+
+// UseClock replaces the system clock used by polling helpers
+func (store *Monitor) UseClock(clock common.Clock) {
+	store.clock = clock
 }
 
 // ComponentsStatus get the status of all deployed privx components
@@ -41,6 +60,17 @@ func (store *Monitor) ComponentsStatus() (*json.RawMessage, error) {
 	return status, err
 }
 
+// Components returns status of deployed PrivX microservices
+func (store *Monitor) Components() ([]ComponentStatus, error) {
+	result := componentsResult{}
+
+	_, err := store.api.
+		URL("/monitor-service/api/v1/components").
+		Get(&result)
+
+	return result, err
+}
+
 // ComponentStatus get component status object by hostname.
 func (store *Monitor) ComponentStatus(hostname string) (*json.RawMessage, error) {
 	status := &json.RawMessage{}
@@ -63,14 +93,192 @@ func (store *Monitor) SearchAuditEvents(offset, limit int, sortkey, sortdir stri
 		FuzzyCount: fuzzycount,
 	}
 
-	_, err := store.api.
+	header, err := store.api.
 		URL("/monitor-service/api/v1/auditevents/search").
 		Query(&filters).
 		Post(&searchObject, &result)
+	result.Count = restapi.TotalCount(header, result.Count)
 
 	return result, err
 }
 
+// FindAuditEvents searches a page of audit events matching the typed
+// filter. Event codes are not supported, the search API cannot filter
+// them and client side filter would break paging, use AuditEventsIter.
+func (store *Monitor) FindAuditEvents(params AuditEventSearchParams) ([]AuditEvent, error) {
+	if len(params.EventCodes) > 0 {
+		return nil, errors.New("event codes filter is supported by AuditEventsIter only")
+	}
+
+	body := params.body()
+	result, err := store.SearchAuditEvents(params.Offset, params.Limit,
+		params.Sortkey, params.Sortdir, false, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Items, nil
+}
+
+// AuditEventsByRequestID returns audit events correlated with the request
+// id, e.g. restapi.APIError's RequestID. Servers, which reject or ignore
+// the request id filter, are searched with the id as keyword and only
+// events containing the id are returned.
+func (store *Monitor) AuditEventsByRequestID(reqID string) (*RequestAuditEvents, error) {
+	if reqID == "" {
+		return nil, errors.New("request id is required")
+	}
+
+	events, indexed, err := store.requestAuditEvents(reqID)
+	var apiError *restapi.APIError
+	switch {
+	case errors.As(err, &apiError) && apiError.StatusCode == http.StatusBadRequest:
+	case err != nil:
+		return nil, err
+	case indexed:
+		return &RequestAuditEvents{Items: events}, nil
+	}
+
+	events, err = store.searchAllAuditEvents(&AuditEventSearchObject{Keywords: reqID})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RequestAuditEvents{Items: []AuditEvent{}, KeywordSearch: true}
+	for _, event := range events {
+		if bytes.Contains(event.raw, []byte(reqID)) {
+			result.Items = append(result.Items, event)
+		}
+	}
+
+	return result, nil
+}
+
+// requestAuditEvents searches events by request id filter, it reports if
+// server has applied the filter. Reading stops at the first event of other
+// request, the server ignores the filter then.
+func (store *Monitor) requestAuditEvents(reqID string) ([]AuditEvent, bool, error) {
+	search := &AuditEventSearchObject{RequestID: reqID}
+	pager := common.NewPager(100, func(offset, limit int) ([]AuditEvent, int, error) {
+		result, err := store.SearchAuditEvents(offset, limit, "created", "ASC", false, search)
+		if err != nil {
+			return nil, 0, err
+		}
+		return result.Items, result.Count, nil
+	})
+
+	events := []AuditEvent{}
+	for pager.Next() {
+		event := pager.Value()
+		if event.Message["request_id"] != reqID {
+			return nil, false, nil
+		}
+		events = append(events, event)
+	}
+
+	return events, true, pager.Err()
+}
+
+func (store *Monitor) searchAllAuditEvents(search *AuditEventSearchObject) ([]AuditEvent, error) {
+	return common.NewPager(100, func(offset, limit int) ([]AuditEvent, int, error) {
+		result, err := store.SearchAuditEvents(offset, limit, "created", "ASC", false, search)
+		if err != nil {
+			return nil, 0, err
+		}
+		return result.Items, result.Count, nil
+	}).All()
+}
+
+// AuditEventsIter iterates over audit events matching the typed filter,
+// oldest first, fetching them page by page, 100 events at once by default.
+// Offset, limit and sorting of params are ignored. Iteration resumes after
+// params.StartAfter cursor, events of the same second as the cursor are
+// re-read and those up to the cursor are skipped. Server does not define
+// order of events created at the same time, if it changes between calls
+// events of the cursor's second may be repeated or skipped. Malformed
+// cursor fails iteration with ErrInvalidCursor.
+func (store *Monitor) AuditEventsIter(params AuditEventSearchParams, pageSize int) *common.Pager[AuditEvent] {
+	if pageSize <= 0 {
+		pageSize = 100
+	}
+
+	var after time.Time
+	var afterKey string
+	skipping := false
+	if params.StartAfter != "" {
+		created, key, _ := strings.Cut(params.StartAfter, "/")
+		t, err := time.Parse(time.RFC3339Nano, created)
+		if err != nil || key == "" {
+			return common.NewPager(pageSize, func(offset, limit int) ([]AuditEvent, int, error) {
+				return nil, 0, fmt.Errorf("%w: %q", ErrInvalidCursor, params.StartAfter)
+			})
+		}
+
+		after, afterKey, skipping = t, key, true
+		if after.After(params.Start) {
+			params.Start = after
+		}
+	}
+
+	pager := common.NewPager(pageSize, func(offset, limit int) ([]AuditEvent, int, error) {
+		body := params.body()
+		result, err := store.SearchAuditEvents(offset, limit, "created", "ASC", false, &body)
+		return result.Items, result.Count, err
+	})
+
+	return pager.Filter(func(event AuditEvent) bool {
+		if skipping {
+			created, _ := event.Time()
+			switch {
+			case created.Before(after):
+				return false
+			case created.Equal(after):
+				skipping = auditEventKey(event) != afterKey
+				return false
+			default:
+				skipping = false
+			}
+		}
+
+		return params.match(event)
+	})
+}
+
+// ExportAuditEvents writes audit events matching params as JSON lines,
+// oldest first, and returns number of written events. Events are written
+// as received from server, only whitespace is removed. Events are
+// streamed page by page.
+func (store *Monitor) ExportAuditEvents(w io.Writer, params AuditEventSearchParams) (int, error) {
+	var line bytes.Buffer
+	count := 0
+
+	events := store.AuditEventsIter(params, 100)
+	for events.Next() {
+		event := events.Value()
+
+		line.Reset()
+		if event.raw != nil {
+			if err := json.Compact(&line, event.raw); err != nil {
+				return count, err
+			}
+		} else {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return count, err
+			}
+			line.Write(data)
+		}
+		line.WriteByte('\n')
+
+		if _, err := w.Write(line.Bytes()); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, events.Err()
+}
+
 // AuditEvents get all audit events
 func (store *Monitor) AuditEvents(offset, limit int, sortkey, sortdir string, fuzzycount bool) (*EventsResult, error) {
 	result := &EventsResult{}
@@ -82,14 +290,160 @@ func (store *Monitor) AuditEvents(offset, limit int, sortkey, sortdir string, fu
 		FuzzyCount: fuzzycount,
 	}
 
-	_, err := store.api.
+	header, err := store.api.
 		URL("/monitor-service/api/v1/auditevents").
 		Query(&filters).
 		Get(&result)
+	result.Count = restapi.TotalCount(header, result.Count)
 
 	return result, err
 }
 
+// StreamAuditEvents delivers audit events matching the filter as they
+// arrive, until the context is cancelled. PrivX does not push audit
+// events, they are polled with FollowAuditEvents starting from
+// filter.StartTime (now if not defined). Transient failures are reported
+// to the error channel, if it is not drained they are dropped, and polling
+// is retried with exponential backoff. Auth failures stop the stream.
+// Both channels are closed when the stream stops.
+func (store *Monitor) StreamAuditEvents(
+	ctx context.Context,
+	filter AuditEventSearchObject,
+	opts ...StreamOption,
+) (<-chan AuditEvent, <-chan error) {
+	config := streamConfig{pollInterval: 5 * time.Second, maxBackoff: time.Minute}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	events := make(chan AuditEvent)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(events)
+		defer close(errs)
+
+		params, err := streamParams(filter)
+		params.EventCodes = config.eventCodes
+		if err == nil {
+			err = store.follow(ctx, params, config.pollInterval, config.maxBackoff,
+				func(event AuditEvent) error {
+					select {
+					case events <- event:
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				},
+				func(err error) {
+					select {
+					case errs <- err:
+					default:
+					}
+				},
+			)
+		}
+
+		if err != nil && ctx.Err() == nil {
+			select {
+			case errs <- err:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return events, errs
+}
+
+// streamParams converts the search filter of StreamAuditEvents
+func streamParams(filter AuditEventSearchObject) (AuditEventSearchParams, error) {
+	params := AuditEventSearchParams{
+		Keywords: filter.Keywords,
+		UserID:   filter.UserID,
+		search:   &filter,
+	}
+
+	for _, at := range []struct {
+		value string
+		time  *time.Time
+	}{
+		{filter.StartTime, &params.Start},
+		{filter.EndTime, &params.End},
+	} {
+		if at.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, at.value)
+		if err != nil {
+			return params, fmt.Errorf("invalid audit event filter: %w", err)
+		}
+		*at.time = t
+	}
+
+	return params, nil
+}
+
+// FollowAuditEvents calls handler for each audit event matching params,
+// created since params.Start (now if not defined), polling new events every
+// interval until the context is cancelled. Polls overlap and events are
+// de-duplicated, the poll window follows time of events reported by server
+// so client clock skew does not cause misses. Handler error and auth
+// failures stop following, other failures are retried with exponential
+// backoff. It returns nil when the context is cancelled.
+func (store *Monitor) FollowAuditEvents(
+	ctx context.Context,
+	params AuditEventSearchParams,
+	interval time.Duration,
+	handler func(AuditEvent) error,
+) error {
+	return store.follow(ctx, params, interval, 16*interval, handler, nil)
+}
+
+// follow implements FollowAuditEvents, transient failures are passed to
+// onError if it is defined
+func (store *Monitor) follow(
+	ctx context.Context,
+	params AuditEventSearchParams,
+	interval, maxBackoff time.Duration,
+	handler func(AuditEvent) error,
+	onError func(error),
+) error {
+	since := params.Start
+	if since.IsZero() {
+		since = store.clock.Now()
+	}
+
+	return common.Follower[AuditEvent]{
+		Clock:      store.clock,
+		Interval:   interval,
+		MaxBackoff: maxBackoff,
+		Overlap:    followOverlap,
+		Poll: func(from time.Time) *common.Pager[AuditEvent] {
+			poll := params
+			poll.Start = from
+			poll.StartAfter = ""
+			return store.AuditEventsIter(poll, 100)
+		},
+		Key: auditEventKey,
+		Time: func(event AuditEvent) time.Time {
+			created, _ := event.Time()
+			return created
+		},
+		Fatal: func(err error) bool {
+			return errors.Is(err, restapi.ErrUnauthorized) || errors.Is(err, restapi.ErrForbidden)
+		},
+		OnError: onError,
+	}.Run(ctx, since, handler)
+}
+
+func auditEventKey(event AuditEvent) string {
+	if event.ID != "" {
+		return event.ID
+	}
+	msg, _ := json.Marshal(event.Message)
+	return fmt.Sprintf("%s/%s/%s", event.ServiceID, event.EventID, msg)
+}
+
 // AuditEventCodes get audit event codes
 func (store *Monitor) AuditEventCodes() (*AuditEventCodes, error) {
 	codes := &AuditEventCodes{}
@@ -112,6 +466,68 @@ func (store *Monitor) InstanceStatus() (*json.RawMessage, error) {
 	return status, err
 }
 
+// Instance returns status of the whole instance
+func (store *Monitor) Instance() (*InstanceStatus, error) {
+	status := &InstanceStatus{}
+
+	_, err := store.api.
+		URL("/monitor-service/api/v1/instance/status").
+		Get(status)
+
+	return status, err
+}
+
+// ServerTime returns current time of PrivX, as given by Date header of the
+// status response. The time has precision of a second.
+func (store *Monitor) ServerTime() (time.Time, error) {
+	header, err := store.api.
+		URL("/monitor-service/api/v1/status").
+		NoRetry().
+		Get(&common.ServiceStatus{})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid server time %q: %w", header.Get("Date"), err)
+	}
+
+	return date, nil
+}
+
+// ClockDrift returns how much PrivX clock is ahead of local clock,
+// negative if it is behind. Server time is read at unknown point within
+// the round trip and it is truncated to a second, the measurement is
+// therefore accurate within half of the round trip plus half a second.
+// The drift is reduced by this bound, it is the smallest drift consistent
+// with the measurement, zero if the clocks may be in sync.
+func (store *Monitor) ClockDrift() (time.Duration, error) {
+	sent := store.clock.Now()
+	server, err := store.ServerTime()
+	if err != nil {
+		return 0, err
+	}
+	rtt := store.clock.Now().Sub(sent)
+
+	return clockDrift(sent, rtt, server), nil
+}
+
+func clockDrift(sent time.Time, rtt time.Duration, server time.Time) time.Duration {
+	local := sent.Add(rtt / 2)
+	drift := server.Add(time.Second / 2).Sub(local)
+	bound := rtt/2 + time.Second/2
+
+	switch {
+	case drift > bound:
+		return drift - bound
+	case drift < -bound:
+		return drift + bound
+	default:
+		return 0
+	}
+}
+
 // TerminateInstances terminate PrivX instances
 func (store *Monitor) TerminateInstances() error {
 	_, err := store.api.
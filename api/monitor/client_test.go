@@ -0,0 +1,930 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package monitor_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/monitor"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+// mockAudit serves events created since start_time, the first poll fails
+type mockAudit struct {
+	sync.Mutex
+	events []monitor.AuditEvent
+	polls  int
+	status int
+}
+
+func (mock *mockAudit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.Lock()
+	defer mock.Unlock()
+
+	mock.polls++
+	if mock.polls == 1 {
+		w.WriteHeader(mock.status)
+		return
+	}
+
+	search := monitor.AuditEventSearchObject{}
+	json.NewDecoder(r.Body).Decode(&search)
+
+	items := []monitor.AuditEvent{}
+	for _, event := range mock.events {
+		if event.Created >= search.StartTime {
+			items = append(items, event)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"count": len(items), "items": items})
+}
+
+func (mock *mockAudit) add(id int) {
+	mock.Lock()
+	defer mock.Unlock()
+
+	mock.events = append(mock.events, monitor.AuditEvent{
+		EventID: fmt.Sprint(id),
+		Created: fmt.Sprintf("2021-03-01T10:00:%02dZ", id/2),
+	})
+}
+
+func TestStreamAuditEvents(t *testing.T) {
+	mock := &mockAudit{status: http.StatusServiceUnavailable}
+	for i := 0; i < 3; i++ {
+		mock.add(i)
+	}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, errs := store.StreamAuditEvents(ctx,
+		monitor.AuditEventSearchObject{StartTime: "2021-03-01T00:00:00Z"},
+		monitor.PollInterval(5*time.Millisecond),
+	)
+
+	seq := []string{}
+	for event := range events {
+		seq = append(seq, event.EventID)
+		if len(seq) == 3 {
+			mock.add(3)
+			mock.add(4)
+		}
+		if len(seq) == 5 {
+			cancel()
+		}
+	}
+
+	if fmt.Sprint(seq) != "[0 1 2 3 4]" {
+		t.Errorf("unexpected events: %v", seq)
+	}
+
+	if err, ok := <-errs; !ok || err == nil {
+		t.Errorf("transient error is not reported: %v", err)
+	}
+}
+
+func TestStreamAuditEventsUnauthorized(t *testing.T) {
+	mock := &mockAudit{status: http.StatusUnauthorized}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	events, errs := store.StreamAuditEvents(context.Background(),
+		monitor.AuditEventSearchObject{},
+		monitor.PollInterval(5*time.Millisecond),
+	)
+
+	if err := <-errs; !errors.Is(err, restapi.ErrUnauthorized) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, ok := <-events; ok {
+		t.Errorf("stream is not stopped")
+	}
+}
+
+func TestFindAuditEvents(t *testing.T) {
+	var search monitor.AuditEventSearchObject
+	var query string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&search)
+			query = r.URL.RawQuery
+			w.Write([]byte(`{"count": 3, "items": [
+				{"id": "e1", "event_id": "1", "event_name": "USER_LOGGED_IN",
+				 "created": "2021-03-01T10:00:00Z",
+				 "message": {"user_id": "u1", "remote_address": "10.0.0.1"}},
+				{"id": "e2", "event_id": "2", "event_name": "CONNECTION_ESTABLISHED",
+				 "created": "2021-03-01T10:01:00.5Z",
+				 "message": {"user_id": "u1", "host_id": "h1", "port": 22, "audit": true}},
+				{"id": "e3", "event_id": "3", "event_name": "ROLE_UPDATED",
+				 "created": "2021-03-01T10:02:00Z",
+				 "message": {"role": {"id": "r1", "permissions": ["users-view"]}}}
+			]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+	eet := time.FixedZone("EET", 2*60*60)
+
+	events, err := store.FindAuditEvents(monitor.AuditEventSearchParams{
+		UserID:  "u1",
+		Start:   time.Date(2021, 3, 1, 12, 0, 0, 0, eet),
+		Limit:   50,
+		Sortkey: "created",
+		Sortdir: "ASC",
+	})
+	if err != nil || len(events) != 3 {
+		t.Fatalf("unexpected events: %+v, %v", events, err)
+	}
+	if search.UserID != "u1" || search.StartTime != "2021-03-01T10:00:00Z" || search.EndTime != "" {
+		t.Errorf("unexpected search: %+v", search)
+	}
+	if query != "limit=50&sortdir=ASC&sortkey=created" {
+		t.Errorf("unexpected query: %s", query)
+	}
+
+	login, conn, role := events[0], events[1], events[2]
+	if login.ID != "e1" || login.Actor() != "u1" || login.Message["remote_address"] != "10.0.0.1" {
+		t.Errorf("unexpected login: %+v", login)
+	}
+
+	at, ok := conn.Time()
+	if !ok || !at.Equal(time.Date(2021, 3, 1, 10, 1, 0, 5e8, time.UTC)) {
+		t.Errorf("unexpected time: %v", at)
+	}
+	if conn.Message["port"] != "22" || conn.Message["audit"] != "true" || conn.Message["host_id"] != "h1" {
+		t.Errorf("unexpected connection: %+v", conn)
+	}
+
+	var payload struct {
+		Role struct {
+			ID          string   `json:"id"`
+			Permissions []string `json:"permissions"`
+		} `json:"role"`
+	}
+	if err := json.Unmarshal(role.RawData, &payload); err != nil || payload.Role.ID != "r1" {
+		t.Errorf("unexpected role payload: %s, %v", role.RawData, err)
+	}
+	if role.Actor() != "" {
+		t.Errorf("unexpected actor: %s", role.Actor())
+	}
+
+	search = monitor.AuditEventSearchObject{}
+	_, err = store.FindAuditEvents(monitor.AuditEventSearchParams{
+		UserID:     "u2",
+		EventCodes: []string{"ROLE_UPDATED", "1"},
+	})
+	if err == nil || search.UserID != "" {
+		t.Errorf("event codes filter is accepted")
+	}
+}
+
+func TestAuditEventCodes(t *testing.T) {
+	for fixture, category := range map[string]string{
+		"codes-flat.json":    "",
+		"codes-grouped.json": "users",
+	} {
+		data, err := os.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ts := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/monitor-service/api/v1/auditevents/codes" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Write(data)
+			}),
+		)
+
+		store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+		codes, err := store.AuditEventCodes()
+		ts.Close()
+		if err != nil {
+			t.Errorf("%s: codes fail: %v", fixture, err)
+			continue
+		}
+
+		expect := map[string]string{
+			"USER_LOGGED_IN":  "User logged in",
+			"USER_LOGGED_OUT": "User logged out",
+			"ROLE_UPDATED":    "Role updated",
+		}
+		if !reflect.DeepEqual(codes.Descriptions(), expect) {
+			t.Errorf("%s: unexpected codes: %v", fixture, codes.Descriptions())
+		}
+
+		info := (*codes)["USER_LOGGED_IN"]
+		if info.EventID != 1 || info.EventName != "USER_LOGGED_IN" || info.Category != category {
+			t.Errorf("%s: unexpected info: %+v", fixture, info)
+		}
+	}
+
+	codes := monitor.AuditEventCodes{}
+	if err := json.Unmarshal([]byte(`{"users": "USER_LOGGED_IN"}`), &codes); err == nil {
+		t.Errorf("invalid codes are accepted")
+	}
+}
+
+type mockToken struct{}
+
+func (mockToken) AccessToken() (string, error) { return "Bearer token", nil }
+
+func TestComponents(t *testing.T) {
+	for fixture, healthy := range map[string]bool{
+		"components-healthy.json":  true,
+		"components-degraded.json": false,
+	} {
+		data, err := os.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var token string
+		ts := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				token = r.Header.Get("Authorization")
+				w.Write(data)
+			}),
+		)
+
+		for auth, expect := range map[restapi.Authorizer]string{nil: "", mockToken{}: "Bearer token"} {
+			store := monitor.New(restapi.New(restapi.BaseURL(ts.URL), restapi.Auth(auth)))
+
+			components, err := store.Components()
+			if err != nil || len(components) != 2 {
+				t.Errorf("%s: unexpected components: %+v, %v", fixture, components, err)
+				continue
+			}
+			if token != expect {
+				t.Errorf("%s: unexpected token: %q", fixture, token)
+			}
+
+			vault := components[1]
+			if vault.Name != "vault" || vault.Version != "21.1" || vault.Updated == "" || vault.Healthy() != healthy {
+				t.Errorf("%s: unexpected component: %+v", fixture, vault)
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestInstance(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/monitor-service/api/v1/instance/status" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"status": "DEGRADED", "version": "21.1", "updated": "2021-03-01T10:00:00Z",
+				"components": [{"name": "vault", "status": "DEGRADED", "status_message": "database connection lost"}]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	status, err := store.Instance()
+	if err != nil || status.Status != "DEGRADED" || status.Version != "21.1" || len(status.Components) != 1 {
+		t.Fatalf("unexpected status: %+v, %v", status, err)
+	}
+	if status.Components[0].Healthy() || status.Components[0].StatusMessage == "" {
+		t.Errorf("unexpected component: %+v", status.Components[0])
+	}
+}
+
+// mockServerTime serves status with Date offset from local time, after
+// the latency
+func mockServerTime(offset, latency time.Duration, date string) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(latency / 2)
+			if date == "" {
+				date = time.Now().Add(offset).UTC().Format(http.TimeFormat)
+			}
+			w.Header().Set("Date", date)
+			w.Write([]byte(`{"status": "ok"}`))
+			time.Sleep(latency / 2)
+		}),
+	)
+}
+
+func TestClockDrift(t *testing.T) {
+	for _, tc := range []struct {
+		offset   time.Duration
+		latency  time.Duration
+		min, max time.Duration
+	}{
+		{offset: time.Hour, latency: 200 * time.Millisecond, min: time.Hour - 1500*time.Millisecond, max: time.Hour},
+		{offset: -10 * time.Second, latency: 400 * time.Millisecond, min: -10 * time.Second, max: -8 * time.Second},
+		{offset: 0, latency: 300 * time.Millisecond},
+		{offset: 700 * time.Millisecond, latency: 100 * time.Millisecond, max: 700 * time.Millisecond},
+	} {
+		ts := mockServerTime(tc.offset, tc.latency, "")
+		store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+		drift, err := store.ClockDrift()
+		ts.Close()
+		if err != nil || drift < tc.min || drift > tc.max {
+			t.Errorf("offset %v: unexpected drift %v, %v", tc.offset, drift, err)
+		}
+	}
+}
+
+func TestClockDriftClock(t *testing.T) {
+	ts := mockServerTime(0, 0, "Mon, 01 Mar 2021 10:00:00 GMT")
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+	store.UseClock(&mockClock{now: time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)})
+
+	drift, err := store.ClockDrift()
+	if err != nil || drift != time.Hour {
+		t.Errorf("unexpected drift: %v, %v", drift, err)
+	}
+}
+
+func TestServerTime(t *testing.T) {
+	ts := mockServerTime(0, 0, "Mon, 01 Mar 2021 10:00:00 GMT")
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	now, err := store.ServerTime()
+	if err != nil || !now.Equal(time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected time: %v, %v", now, err)
+	}
+
+	invalid := mockServerTime(0, 0, "yesterday")
+	defer invalid.Close()
+
+	store = monitor.New(restapi.New(restapi.BaseURL(invalid.URL)))
+	if _, err := store.ClockDrift(); err == nil {
+		t.Errorf("invalid server time is accepted")
+	}
+}
+
+// mockAuditPages serves events created since start_time, oldest first.
+// Every third event has the same timestamp as the previous one.
+func mockAuditPages(requests *int) *httptest.Server {
+	events := []monitor.AuditEvent{}
+	at := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 25; i++ {
+		if i%3 != 2 {
+			at = at.Add(time.Second)
+		}
+		events = append(events, monitor.AuditEvent{
+			ID:        fmt.Sprintf("e%02d", i),
+			EventName: "USER_LOGGED_IN",
+			Created:   at.Format(time.RFC3339Nano),
+		})
+	}
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+
+			var search monitor.AuditEventSearchObject
+			json.NewDecoder(r.Body).Decode(&search)
+			start, _ := time.Parse(time.RFC3339, search.StartTime)
+
+			seq := []monitor.AuditEvent{}
+			for _, event := range events {
+				if created, _ := event.Time(); !created.Before(start) {
+					seq = append(seq, event)
+				}
+			}
+
+			offset, limit := 0, len(seq)
+			fmt.Sscan(r.URL.Query().Get("offset"), &offset)
+			fmt.Sscan(r.URL.Query().Get("limit"), &limit)
+			end := offset + limit
+			if end > len(seq) {
+				end = len(seq)
+			}
+			json.NewEncoder(w).Encode(monitor.EventsResult{Count: len(seq), Items: seq[offset:end]})
+		}),
+	)
+}
+
+func TestAuditEventsIter(t *testing.T) {
+	requests := 0
+	ts := mockAuditPages(&requests)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	ids := func(events []monitor.AuditEvent) []string {
+		seq := []string{}
+		for _, event := range events {
+			seq = append(seq, event.ID)
+		}
+		return seq
+	}
+
+	events, err := store.AuditEventsIter(monitor.AuditEventSearchParams{}, 10).All()
+	if err != nil || len(events) != 25 || requests != 3 {
+		t.Fatalf("unexpected iteration: %d events, %d requests, %v", len(events), requests, err)
+	}
+
+	// export crashes after e14, which has the same timestamp as e13
+	cursor := events[14].Cursor()
+	resumed, err := store.AuditEventsIter(monitor.AuditEventSearchParams{StartAfter: cursor}, 4).All()
+	if err != nil || !reflect.DeepEqual(ids(resumed), ids(events[15:])) {
+		t.Errorf("unexpected resume: %v, %v", ids(resumed), err)
+	}
+
+	// resume at the last event of a page
+	cursor = events[9].Cursor()
+	resumed, err = store.AuditEventsIter(monitor.AuditEventSearchParams{StartAfter: cursor}, 10).All()
+	if err != nil || !reflect.DeepEqual(ids(resumed), ids(events[10:])) {
+		t.Errorf("unexpected resume: %v, %v", ids(resumed), err)
+	}
+
+	filtered, err := store.AuditEventsIter(monitor.AuditEventSearchParams{
+		StartAfter: events[20].Cursor(),
+		EventCodes: []string{"USER_LOGGED_OUT"},
+	}, 10).All()
+	if err != nil || len(filtered) != 0 {
+		t.Errorf("unexpected filtered events: %v, %v", ids(filtered), err)
+	}
+
+	for _, cursor := range []string{"e14", "yesterday/e14", "2021-03-01T10:00:00Z/"} {
+		iter := store.AuditEventsIter(monitor.AuditEventSearchParams{StartAfter: cursor}, 10)
+		if iter.Next() || !errors.Is(iter.Err(), monitor.ErrInvalidCursor) {
+			t.Errorf("cursor %q is accepted: %v", cursor, iter.Err())
+		}
+	}
+}
+
+// mockClock hands requested delays to the test, which fires them.
+// The current time is fixed.
+type mockClock struct {
+	now   time.Time
+	waits chan time.Duration
+	ticks chan time.Time
+}
+
+func (clock *mockClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *mockClock) After(d time.Duration) <-chan time.Time {
+	clock.waits <- d
+	return clock.ticks
+}
+
+func TestFollowAuditEvents(t *testing.T) {
+	polls := [][]string{
+		{"e0", "e1", "e2"},
+		nil,
+		{"e2", "e3"},
+		{"e3", "e4", "e5"},
+	}
+	created := map[string]string{
+		"e0": "2021-03-01T09:59:00Z",
+		"e1": "2021-03-01T10:00:00Z",
+		"e2": "2021-03-01T10:05:00Z",
+		"e3": "2021-03-01T10:04:30Z",
+		"e4": "2021-03-01T10:06:00Z",
+		"e5": "2021-03-01T10:07:00Z",
+	}
+
+	var mu sync.Mutex
+	starts := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var search monitor.AuditEventSearchObject
+			json.NewDecoder(r.Body).Decode(&search)
+
+			mu.Lock()
+			poll := polls[len(starts)]
+			starts = append(starts, search.StartTime)
+			mu.Unlock()
+
+			if poll == nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			items := []monitor.AuditEvent{}
+			for _, id := range poll {
+				items = append(items, monitor.AuditEvent{ID: id, Created: created[id]})
+			}
+			json.NewEncoder(w).Encode(monitor.EventsResult{Count: len(items), Items: items})
+		}),
+	)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+	clock := &mockClock{waits: make(chan time.Duration), ticks: make(chan time.Time)}
+	store.UseClock(clock)
+
+	stop := errors.New("forwarding fails")
+	handled := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- store.FollowAuditEvents(context.Background(),
+			monitor.AuditEventSearchParams{Start: time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)},
+			30*time.Second,
+			func(event monitor.AuditEvent) error {
+				handled <- event.ID
+				if event.ID == "e4" {
+					return stop
+				}
+				return nil
+			},
+		)
+	}()
+
+	for _, expect := range []time.Duration{30 * time.Second, 60 * time.Second, 30 * time.Second} {
+		if d := <-clock.waits; d != expect {
+			t.Errorf("unexpected delay: %v, expected %v", d, expect)
+		}
+		clock.ticks <- time.Now()
+	}
+
+	if err := <-done; !errors.Is(err, stop) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	close(handled)
+
+	ids := []string{}
+	for id := range handled {
+		ids = append(ids, id)
+	}
+	if !reflect.DeepEqual(ids, []string{"e1", "e2", "e3", "e4"}) {
+		t.Errorf("unexpected events: %v", ids)
+	}
+
+	expect := []string{
+		"2021-03-01T09:59:00Z",
+		"2021-03-01T10:04:00Z",
+		"2021-03-01T10:04:00Z",
+		"2021-03-01T10:04:00Z",
+	}
+	if !reflect.DeepEqual(starts, expect) {
+		t.Errorf("unexpected poll windows: %v", starts)
+	}
+}
+
+func TestFollowAuditEventsStops(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"count": 0, "items": []}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+	clock := &mockClock{waits: make(chan time.Duration), ticks: make(chan time.Time)}
+	store.UseClock(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- store.FollowAuditEvents(ctx, monitor.AuditEventSearchParams{}, time.Second,
+			func(monitor.AuditEvent) error { return nil })
+	}()
+
+	<-clock.waits
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("follow does not stop on cancel")
+	}
+
+	status = http.StatusForbidden
+	err := store.FollowAuditEvents(context.Background(), monitor.AuditEventSearchParams{}, time.Second,
+		func(monitor.AuditEvent) error { return nil })
+	if !errors.Is(err, restapi.ErrForbidden) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStreamAuditEventsClock(t *testing.T) {
+	var mu sync.Mutex
+	searches := []monitor.AuditEventSearchObject{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var search monitor.AuditEventSearchObject
+			json.NewDecoder(r.Body).Decode(&search)
+			mu.Lock()
+			searches = append(searches, search)
+			mu.Unlock()
+
+			w.Write([]byte(`{"count": 2, "items": [
+				{"id": "e1", "created": "2021-03-01T10:00:00Z"},
+				{"id": "e2", "created": "2021-03-01T10:01:00Z"}
+			]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+	clock := &mockClock{
+		now:   time.Date(2021, 3, 1, 10, 0, 30, 0, time.UTC),
+		waits: make(chan time.Duration),
+		ticks: make(chan time.Time),
+	}
+	store.UseClock(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, errs := store.StreamAuditEvents(ctx,
+		monitor.AuditEventSearchObject{HostID: "h1"},
+		monitor.PollInterval(time.Hour),
+	)
+
+	// events before the clock's now are not delivered
+	if event := <-events; event.ID != "e2" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+	if d := <-clock.waits; d != time.Hour {
+		t.Errorf("unexpected delay: %v", d)
+	}
+	clock.ticks <- clock.now
+	<-clock.waits
+	cancel()
+
+	for event := range events {
+		t.Errorf("event is repeated: %+v", event)
+	}
+	if err, ok := <-errs; ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(searches) != 2 {
+		t.Fatalf("unexpected polls: %+v", searches)
+	}
+	for i, start := range []string{"2021-03-01T09:59:30Z", "2021-03-01T10:00:00Z"} {
+		if searches[i].HostID != "h1" || searches[i].StartTime != start {
+			t.Errorf("unexpected search: %+v", searches[i])
+		}
+	}
+}
+
+func TestExportAuditEvents(t *testing.T) {
+	raw := []string{}
+	for i := 0; i < 250; i++ {
+		raw = append(raw, fmt.Sprintf(`{
+			"service_id": "s1",
+			"id": "e%03d",
+			"created": "2021-03-01T10:00:%02dZ",
+			"event_name": "CONNECTION_ESTABLISHED",
+			"message": {"port": 22, "user_id": "u%d", "nested": {"b": 1, "a": 2}},
+			"extra": [1.50, "x"]
+		}`, i, i%60, i%7))
+	}
+
+	requests := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			offset, limit := 0, 0
+			fmt.Sscan(r.URL.Query().Get("offset"), &offset)
+			fmt.Sscan(r.URL.Query().Get("limit"), &limit)
+			end := offset + limit
+			if end > len(raw) {
+				end = len(raw)
+			}
+			fmt.Fprintf(w, `{"count": %d, "items": [%s]}`, len(raw), strings.Join(raw[offset:end], ","))
+		}),
+	)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	out := &bytes.Buffer{}
+	n, err := store.ExportAuditEvents(out, monitor.AuditEventSearchParams{})
+	if err != nil || n != 250 || requests != 3 {
+		t.Fatalf("unexpected export: %d events, %d requests, %v", n, requests, err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 250 {
+		t.Fatalf("unexpected lines: %d", len(lines))
+	}
+	for i, line := range lines {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("line %d is not json: %s", i, line)
+		}
+	}
+
+	expect := &bytes.Buffer{}
+	json.Compact(expect, []byte(raw[42]))
+	if lines[42] != expect.String() {
+		t.Errorf("event is modified:\n%s\n%s", lines[42], expect)
+	}
+}
+
+func TestDecodeAuditData(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		message string
+		expect  interface{}
+	}{
+		{
+			name:    monitor.EventUserLoggedIn,
+			message: `{"user_id":"u1","username":"alice","remote_address":"10.0.0.1","authentication_method":"password","new_field":1}`,
+			expect: &monitor.LoginData{
+				UserID: "u1", Username: "alice",
+				RemoteAddress: "10.0.0.1", AuthMethod: "password",
+			},
+		},
+		{
+			name:    monitor.EventUserRoleGranted,
+			message: `{"user_id":"u1","role_id":"r1","role_name":"admins"}`,
+			expect:  &monitor.RoleGrantData{UserID: "u1", RoleID: "r1", RoleName: "admins"},
+		},
+		{
+			name:    monitor.EventUserRoleRevoked,
+			message: `{"user_id":"u1","role_id":"r1"}`,
+			expect:  &monitor.RoleGrantData{UserID: "u1", RoleID: "r1"},
+		},
+		{
+			name:    monitor.EventConnectionEstablished,
+			message: `{"connection_id":"c1","user_id":"u1","host_id":"h1","protocol":"SSH","extra":{"a":"b"}}`,
+			expect: &monitor.ConnectionData{
+				ConnectionID: "c1", UserID: "u1", HostID: "h1", Protocol: "SSH",
+			},
+		},
+		{
+			name:    monitor.EventConnectionDisconnected,
+			message: `{"connection_id":"c1","termination_reason":"user"}`,
+			expect:  &monitor.ConnectionData{ConnectionID: "c1", TerminationReason: "user"},
+		},
+		{
+			name:    monitor.EventSecretRead,
+			message: `{"user_id":"u1","secret_name":"db"}`,
+			expect:  &monitor.SecretReadData{UserID: "u1", SecretName: "db"},
+		},
+		{
+			name:    "SOMETHING_NEW",
+			message: `{"any":["thing"]}`,
+			expect:  json.RawMessage(`{"any":["thing"]}`),
+		},
+	} {
+		var event monitor.AuditEvent
+		data := fmt.Sprintf(`{"event_name":%q,"message":%s}`, tc.name, tc.message)
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+
+		val, err := monitor.DecodeAuditData(event)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(val, tc.expect) {
+			t.Errorf("%s: unexpected payload %#v", tc.name, val)
+		}
+	}
+}
+
+func TestDecodeAuditDataInvalid(t *testing.T) {
+	var event monitor.AuditEvent
+	data := `{"event_name":"USER_LOGGED_IN","message":{"user_id":42}}`
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := monitor.DecodeAuditData(event); err == nil {
+		t.Errorf("expected error for invalid payload")
+	}
+}
+
+// mockRequestEvents serves audit events of request req-1, the server
+// either indexes request id, rejects the filter or ignores it
+func mockRequestEvents(t *testing.T, mode string, filtered *atomic.Int32) *httptest.Server {
+	e1 := `{"id": "e1", "event_name": "USER_CREATED", "created": "2021-03-01T10:00:00Z", "message": {"request_id": "req-1", "user_id": "u1"}}`
+	e2 := `{"id": "e2", "event_name": "USER_LOGGED_IN", "created": "2021-03-01T10:00:01Z", "message": {"user_id": "u1"}}`
+	e3 := `{"id": "e3", "event_name": "ROLE_CREATED", "created": "2021-03-01T10:00:02Z", "message": {"note": "retry of req-1"}}`
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/role-store/api/v1/users" {
+				w.Header().Set("X-Request-ID", "req-1")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if r.URL.Path != "/monitor-service/api/v1/auditevents/search" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			search := monitor.AuditEventSearchObject{}
+			json.NewDecoder(r.Body).Decode(&search)
+			if search.RequestID != "" {
+				filtered.Add(1)
+			}
+			switch {
+			case search.RequestID != "" && mode == "ignored":
+				// whole audit log is returned
+				fmt.Fprintf(w, `{"count": 5000, "items": [%s, %s, %s]}`, e1, e2, e3)
+			case search.RequestID != "" && mode == "indexed":
+				fmt.Fprintf(w, `{"count": 1, "items": [%s]}`, e1)
+			case search.RequestID != "" && mode == "rejected":
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error_code": "INVALID_SEARCH"}`))
+			case search.Keywords == "req-1":
+				fmt.Fprintf(w, `{"count": 3, "items": [%s, %s, %s]}`, e1, e2, e3)
+			default:
+				t.Errorf("unexpected search: %+v", search)
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}),
+	)
+}
+
+func TestAuditEventsByRequestID(t *testing.T) {
+	for mode, expect := range map[string][]string{
+		"indexed":  {"e1"},
+		"rejected": {"e1", "e3"},
+		"ignored":  {"e1", "e3"},
+	} {
+		var filtered atomic.Int32
+		ts := mockRequestEvents(t, mode, &filtered)
+		api := restapi.New(restapi.BaseURL(ts.URL))
+
+		_, err := api.URL("/role-store/api/v1/users").NoRetry().Get(nil)
+		result, err := monitor.New(api).AuditEventsByRequestID(restapi.RequestID(err))
+		ts.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", mode, err)
+			continue
+		}
+
+		ids := []string{}
+		for _, event := range result.Items {
+			ids = append(ids, event.ID)
+		}
+		if !reflect.DeepEqual(ids, expect) {
+			t.Errorf("%s: unexpected events %v", mode, ids)
+		}
+		if result.KeywordSearch != (mode != "indexed") {
+			t.Errorf("%s: unexpected keyword search %v", mode, result.KeywordSearch)
+		}
+		if n := filtered.Load(); n != 1 {
+			t.Errorf("%s: request id search is paged %d times", mode, n)
+		}
+	}
+}
+
+func TestSearchAuditEventsTotalCountHeader(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("offset") == "1" {
+				w.Header().Set("X-Total-Count", "120")
+			}
+			w.Write([]byte(`{"count": 2, "items": [{"id": "e1"}, {"id": "e2"}]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := monitor.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	result, err := store.SearchAuditEvents(0, 2, "", "", false, &monitor.AuditEventSearchObject{})
+	if err != nil || result.Count != 2 {
+		t.Errorf("unexpected count: %+v, %v", result, err)
+	}
+
+	result, err = store.SearchAuditEvents(1, 2, "", "", false, &monitor.AuditEventSearchObject{})
+	if err != nil || result.Count != 120 || len(result.Items) != 2 {
+		t.Errorf("unexpected count: %+v, %v", result, err)
+	}
+}
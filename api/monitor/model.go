@@ -6,6 +6,19 @@
 
 package monitor
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned if AuditEventSearchParams.StartAfter is not
+// a cursor of audit event
+var ErrInvalidCursor = errors.New("invalid audit event cursor")
+
 // Params struct for pagination queries.
 type Params struct {
 	Offset     int    `json:"offset,omitempty"`
@@ -15,6 +28,50 @@ type Params struct {
 	FuzzyCount bool   `json:"fuzzycount,omitempty"`
 }
 
+// ComponentStatus is status of PrivX microservice. Status values unknown
+// to SDK, e.g. of degraded services, are preserved as is.
+type ComponentStatus struct {
+	Name          string `json:"name"`
+	Hostname      string `json:"hostname,omitempty"`
+	Version       string `json:"version,omitempty"`
+	Status        string `json:"status"`
+	StatusMessage string `json:"status_message,omitempty"`
+	Updated       string `json:"updated,omitempty"`
+}
+
+// Healthy checks if the component reports ok status
+func (status *ComponentStatus) Healthy() bool {
+	return strings.EqualFold(status.Status, "ok")
+}
+
+// InstanceStatus is status of the whole PrivX instance
+type InstanceStatus struct {
+	Status     string            `json:"status"`
+	Version    string            `json:"version,omitempty"`
+	Updated    string            `json:"updated,omitempty"`
+	Components []ComponentStatus `json:"components,omitempty"`
+}
+
+// componentsResult is list of components, given either as array or as
+// list result object
+type componentsResult []ComponentStatus
+
+func (seq *componentsResult) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, (*[]ComponentStatus)(seq))
+	}
+
+	var result struct {
+		Items []ComponentStatus `json:"items"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	*seq = result.Items
+	return nil
+}
+
 // AuditEventSearchObject audit event search definitions
 type AuditEventSearchObject struct {
 	Keywords      string `json:"keywords"`
@@ -26,24 +83,296 @@ type AuditEventSearchObject struct {
 	AccessGroupID string `json:"access_group_id"`
 	StartTime     string `json:"start_time"`
 	EndTime       string `json:"end_time"`
+	RequestID     string `json:"request_id,omitempty"`
+}
+
+// RequestAuditEvents are audit events of a request. KeywordSearch tells
+// that server does not index request id, events are found with keyword
+// search of the id instead.
+type RequestAuditEvents struct {
+	Items         []AuditEvent
+	KeywordSearch bool
 }
 
 // AuditEventCodes audit event codes definitions
 type AuditEventCodes map[string]AuditEventInfo
 
-// AuditEventInfo audit event codes value definitions
+// UnmarshalJSON decodes codes listed flat by code, or grouped by category
+// as newer PrivX versions do
+func (codes *AuditEventCodes) UnmarshalJSON(data []byte) error {
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	seq := AuditEventCodes{}
+	for key, entry := range entries {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(entry, &fields); err != nil {
+			return fmt.Errorf("invalid audit event code %s: %w", key, err)
+		}
+
+		if _, isInfo := fields["event_id"]; isInfo {
+			var info AuditEventInfo
+			if err := json.Unmarshal(entry, &info); err != nil {
+				return fmt.Errorf("invalid audit event code %s: %w", key, err)
+			}
+			seq[key] = info
+			continue
+		}
+
+		var group map[string]AuditEventInfo
+		if err := json.Unmarshal(entry, &group); err != nil {
+			return fmt.Errorf("invalid audit event category %s: %w", key, err)
+		}
+		for code, info := range group {
+			info.Category = key
+			seq[code] = info
+		}
+	}
+
+	*codes = seq
+	return nil
+}
+
+// Descriptions returns description of events by code
+func (codes AuditEventCodes) Descriptions() map[string]string {
+	seq := make(map[string]string, len(codes))
+	for code, info := range codes {
+		seq[code] = info.EventDescription
+	}
+
+	return seq
+}
+
+// AuditEventInfo audit event codes value definitions. Category is empty
+// if the server does not group codes.
 type AuditEventInfo struct {
 	EventID          int    `json:"event_id"`
 	EventName        string `json:"event_name"`
 	EventDescription string `json:"event_desc"`
+	Category         string `json:"category,omitempty"`
 }
 
-// AuditEvent audit event definitions
+// AuditEvent audit event definitions. Message holds payload of the event
+// as text, non-string values are kept as JSON. RawData is the payload as is.
 type AuditEvent struct {
+	ID          string            `json:"id,omitempty"`
 	ServiceID   string            `json:"service_id,omitempty"`
 	ServiceName string            `json:"service_name,omitempty"`
 	EventID     string            `json:"event_id,omitempty"`
 	EventName   string            `json:"event_name,omitempty"`
 	Created     string            `json:"created,omitempty"`
 	Message     map[string]string `json:"message,omitempty"`
+	RawData     json.RawMessage   `json:"-"`
+	// raw is the event as received from server
+	raw json.RawMessage
+}
+
+// UnmarshalJSON decodes the event, payload of any shape is accepted
+func (event *AuditEvent) UnmarshalJSON(data []byte) error {
+	type auditEvent AuditEvent
+	var raw struct {
+		auditEvent
+		Message json.RawMessage `json:"message,omitempty"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*event = AuditEvent(raw.auditEvent)
+	event.raw = append(json.RawMessage(nil), data...)
+	if len(raw.Message) == 0 || string(raw.Message) == "null" {
+		return nil
+	}
+	event.RawData = raw.Message
+
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(raw.Message, &message); err != nil {
+		return nil
+	}
+
+	event.Message = map[string]string{}
+	for key, value := range message {
+		var text string
+		if err := json.Unmarshal(value, &text); err != nil {
+			text = string(value)
+		}
+		event.Message[key] = text
+	}
+	return nil
+}
+
+// Time returns time of the event, false if it is not known
+func (event *AuditEvent) Time() (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, event.Created)
+	return t, err == nil
+}
+
+// Cursor returns position of the event for resuming iteration, see
+// AuditEventSearchParams.StartAfter
+func (event *AuditEvent) Cursor() string {
+	return event.Created + "/" + auditEventKey(*event)
+}
+
+// Actor returns ID of the user who caused the event, empty for system
+// events
+func (event *AuditEvent) Actor() string {
+	return event.Message["user_id"]
+}
+
+// Audit event codes with typed payload, see DecodeAuditData
+const (
+	EventUserLoggedIn           = "USER_LOGGED_IN"
+	EventUserRoleGranted        = "USER_ROLE_GRANTED"
+	EventUserRoleRevoked        = "USER_ROLE_REVOKED"
+	EventConnectionEstablished  = "CONNECTION_ESTABLISHED"
+	EventConnectionDisconnected = "CONNECTION_DISCONNECTED"
+	EventSecretRead             = "SECRET_READ"
+)
+
+// LoginData is payload of USER_LOGGED_IN
+type LoginData struct {
+	UserID        string `json:"user_id"`
+	Username      string `json:"username,omitempty"`
+	RemoteAddress string `json:"remote_address,omitempty"`
+	AuthMethod    string `json:"authentication_method,omitempty"`
+}
+
+// RoleGrantData is payload of USER_ROLE_GRANTED and USER_ROLE_REVOKED
+type RoleGrantData struct {
+	UserID   string `json:"user_id"`
+	RoleID   string `json:"role_id"`
+	RoleName string `json:"role_name,omitempty"`
+}
+
+// ConnectionData is payload of CONNECTION_ESTABLISHED and
+// CONNECTION_DISCONNECTED
+type ConnectionData struct {
+	ConnectionID      string `json:"connection_id"`
+	UserID            string `json:"user_id,omitempty"`
+	HostID            string `json:"host_id,omitempty"`
+	TargetHostAddress string `json:"target_host_address,omitempty"`
+	TargetHostAccount string `json:"target_host_account,omitempty"`
+	Protocol          string `json:"protocol,omitempty"`
+	RemoteAddress     string `json:"remote_address,omitempty"`
+	TerminationReason string `json:"termination_reason,omitempty"`
+}
+
+// SecretReadData is payload of SECRET_READ
+type SecretReadData struct {
+	UserID     string `json:"user_id"`
+	SecretName string `json:"secret_name"`
+}
+
+// DecodeAuditData decodes payload of the event into the typed struct of
+// its code, e.g. *LoginData. Payload of unknown codes is returned as
+// json.RawMessage.
+func DecodeAuditData(event AuditEvent) (interface{}, error) {
+	var data interface{}
+	switch event.EventName {
+	case EventUserLoggedIn:
+		data = &LoginData{}
+	case EventUserRoleGranted, EventUserRoleRevoked:
+		data = &RoleGrantData{}
+	case EventConnectionEstablished, EventConnectionDisconnected:
+		data = &ConnectionData{}
+	case EventSecretRead:
+		data = &SecretReadData{}
+	default:
+		return event.RawData, nil
+	}
+
+	if len(event.RawData) == 0 {
+		return data, nil
+	}
+	if err := json.Unmarshal(event.RawData, data); err != nil {
+		return nil, fmt.Errorf("invalid payload of %s: %w", event.EventName, err)
+	}
+
+	return data, nil
+}
+
+// AuditEventSearchParams is typed filter of audit event search, empty
+// fields are not used. Event codes match either event name or ID, they
+// are filtered client side since search API has no such filter, only
+// AuditEventsIter and FollowAuditEvents support them.
+type AuditEventSearchParams struct {
+	Keywords   string
+	EventCodes []string
+	UserID     string
+	Start      time.Time
+	End        time.Time
+	Offset     int
+	Limit      int
+	Sortkey    string
+	Sortdir    string
+	// StartAfter is cursor of the last seen event, iteration resumes after
+	// it. It is used by AuditEventsIter only.
+	StartAfter string
+	// search holds filters of StreamAuditEvents without typed counterpart
+	search *AuditEventSearchObject
+}
+
+func (params *AuditEventSearchParams) body() AuditEventSearchObject {
+	body := AuditEventSearchObject{}
+	if params.search != nil {
+		body = *params.search
+	}
+
+	body.Keywords = params.Keywords
+	body.UserID = params.UserID
+	body.StartTime = formatTime(params.Start)
+	body.EndTime = formatTime(params.End)
+	return body
+}
+
+func (params *AuditEventSearchParams) match(event AuditEvent) bool {
+	if len(params.EventCodes) == 0 {
+		return true
+	}
+	for _, code := range params.EventCodes {
+		if code == event.EventName || code == event.EventID {
+			return true
+		}
+	}
+	return false
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// StreamOption configures streaming of audit events
+type StreamOption func(*streamConfig)
+
+type streamConfig struct {
+	pollInterval time.Duration
+	maxBackoff   time.Duration
+	eventCodes   []string
+}
+
+// PollInterval defines how often new audit events are polled, defaults to 5s
+func PollInterval(d time.Duration) StreamOption {
+	return func(config *streamConfig) {
+		config.pollInterval = d
+	}
+}
+
+// MaxBackoff limits the delay between polls after failures, defaults to 1m
+func MaxBackoff(d time.Duration) StreamOption {
+	return func(config *streamConfig) {
+		config.maxBackoff = d
+	}
+}
+
+// StreamEventCodes limits the stream to events of the codes, matching
+// either event name or ID. They are filtered client side.
+func StreamEventCodes(codes ...string) StreamOption {
+	return func(config *streamConfig) {
+		config.eventCodes = codes
+	}
 }
@@ -0,0 +1,395 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+// Package reports combines data of several PrivX services, e.g. activity
+// of users is read from role store, audit events and connections. Clients
+// of single services do not depend on each other.
+package reports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/connectionmanager"
+	"github.com/SSHcom/privx-sdk-go/api/hoststore"
+	"github.com/SSHcom/privx-sdk-go/api/monitor"
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/common"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+// Reports is a client of cross-service reports
+type Reports struct {
+	roles *rolestore.RoleStore
+	hosts *hoststore.HostStore
+	audit *monitor.Monitor
+	conns *connectionmanager.ConnectionManager
+}
+
+// New creates a new reports client instance, using the argument SDK API
+// client.
+func New(api restapi.Connector) *Reports {
+	return &Reports{
+		roles: rolestore.New(api),
+		hosts: hoststore.New(api),
+		audit: monitor.New(api),
+		conns: connectionmanager.New(api),
+	}
+}
+
+// HostRoles returns roles granting access to the host via its principals.
+// A role mapped to multiple principals is listed once. Roles are resolved
+// from role store, a role unknown to it is returned with id and name only.
+func (reports *Reports) HostRoles(hostID string) ([]rolestore.Role, error) {
+	refs, err := reports.hosts.HostRoles(hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	return reports.resolveRoles(refs)
+}
+
+// AccountRoles returns roles authorizing use of the target account on the
+// host, they are resolved as HostRoles does
+func (reports *Reports) AccountRoles(hostID, account string) ([]rolestore.Role, error) {
+	refs, err := reports.hosts.AccountRoles(hostID, account)
+	if err != nil {
+		return nil, err
+	}
+
+	return reports.resolveRoles(refs)
+}
+
+// resolveRoles looks up role references from role store, if role store
+// does not list roles they are returned with id and name only
+func (reports *Reports) resolveRoles(refs []rolestore.RoleRef) ([]rolestore.Role, error) {
+	if len(refs) == 0 {
+		return []rolestore.Role{}, nil
+	}
+
+	all, err := reports.roles.Roles()
+	if err := restapi.IgnoreNotFound(err); err != nil {
+		return nil, err
+	}
+
+	known := map[string]rolestore.Role{}
+	for _, role := range all {
+		known[role.ID] = role
+	}
+
+	roles := make([]rolestore.Role, 0, len(refs))
+	for _, ref := range refs {
+		role, exists := known[ref.ID]
+		if !exists {
+			role = rolestore.Role{ID: ref.ID, Name: ref.Name}
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+// RoleMembersAsOf returns members of the role at the given time. Role store
+// keeps only current membership, the past one is reconstructed by undoing
+// grant and revoke audit events recorded after the time. Membership
+// gained or lost via source mapping rules is not audited per user, it is
+// not reflected. Users deleted since then are returned with ID only.
+func (reports *Reports) RoleMembersAsOf(roleID string, at time.Time) ([]rolestore.User, error) {
+	members, err := reports.roles.GetRoleMembers(roleID)
+	if err != nil {
+		return nil, err
+	}
+
+	search := &monitor.AuditEventSearchObject{
+		Keywords:  roleID,
+		StartTime: at.UTC().Format(time.RFC3339),
+	}
+	events, err := common.NewPager(100, func(offset, limit int) ([]monitor.AuditEvent, int, error) {
+		result, err := reports.audit.SearchAuditEvents(offset, limit, "created", "DESC", false, search)
+		return result.Items, result.Count, err
+	}).All()
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[string]*rolestore.User{}
+	for i := range members {
+		users[members[i].ID] = &members[i]
+	}
+
+	// events are undone from the newest one
+	for _, event := range events {
+		if event.Message["role_id"] != roleID {
+			continue
+		}
+
+		userID := event.Message["user_id"]
+		switch event.EventName {
+		case rolestore.EventUserRoleGranted:
+			delete(users, userID)
+		case rolestore.EventUserRoleRevoked:
+			users[userID] = nil
+		}
+	}
+
+	seq := []rolestore.User{}
+	for userID, user := range users {
+		if user == nil {
+			user, err = reports.roles.User(userID)
+			switch {
+			case errors.Is(err, restapi.ErrNotFound):
+				user = &rolestore.User{ID: userID}
+			case err != nil:
+				return nil, err
+			}
+		}
+		seq = append(seq, *user)
+	}
+	sort.Slice(seq, func(i, j int) bool { return seq[i].ID < seq[j].ID })
+
+	return seq, nil
+}
+
+// WatchRoles delivers changes of roles read from audit events until the
+// context is cancelled, polling new events every interval. Role is not
+// defined in the changes. Failures are passed to onError, auth failures
+// stop watching. The channel is closed when watching stops. See also
+// rolestore.WatchRoles, which compares the role list between polls.
+func (reports *Reports) WatchRoles(
+	ctx context.Context,
+	interval time.Duration,
+	onError func(error),
+) <-chan rolestore.RoleChangeEvent {
+	events, errs := reports.audit.StreamAuditEvents(ctx,
+		monitor.AuditEventSearchObject{},
+		monitor.PollInterval(interval),
+		monitor.StreamEventCodes(
+			rolestore.EventRoleCreated, rolestore.EventRoleUpdated, rolestore.EventRoleDeleted,
+		),
+	)
+
+	changes := make(chan rolestore.RoleChangeEvent)
+	go func() {
+		defer close(changes)
+
+		for events != nil || errs != nil {
+			select {
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				if onError != nil {
+					onError(err)
+				}
+
+			case event, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+
+				change := rolestore.RoleChangeEvent{RoleID: event.Message["role_id"]}
+				switch event.EventName {
+				case rolestore.EventRoleCreated:
+					change.Type = rolestore.RoleCreated
+				case rolestore.EventRoleUpdated:
+					change.Type = rolestore.RoleUpdated
+				case rolestore.EventRoleDeleted:
+					change.Type = rolestore.RoleDeleted
+				default:
+					continue
+				}
+
+				select {
+				case changes <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return changes
+}
+
+// RoleMembershipChanges returns explicit role grants and revokes since the
+// given time, the oldest first. Changes are read from audit events, which
+// are fetched page by page.
+func (reports *Reports) RoleMembershipChanges(since time.Time) ([]MembershipChange, error) {
+	search := &monitor.AuditEventSearchObject{
+		Keywords:  "USER_ROLE",
+		StartTime: since.UTC().Format(time.RFC3339),
+	}
+	events := common.NewPager(100, func(offset, limit int) ([]monitor.AuditEvent, int, error) {
+		result, err := reports.audit.SearchAuditEvents(offset, limit, "created", "ASC", false, search)
+		return result.Items, result.Count, err
+	})
+
+	changes := []MembershipChange{}
+	for events.Next() {
+		event := events.Value()
+
+		change := MembershipChange{
+			UserID: event.Message["user_id"],
+			RoleID: event.Message["role_id"],
+		}
+		switch event.EventName {
+		case rolestore.EventUserRoleGranted:
+			change.Type = MembershipAdded
+		case rolestore.EventUserRoleRevoked:
+			change.Type = MembershipRemoved
+		default:
+			continue
+		}
+		at, err := parseTime("audit event", event.ID, event.Created)
+		if err != nil {
+			return nil, err
+		}
+		change.Time = at
+
+		changes = append(changes, change)
+	}
+
+	return changes, events.Err()
+}
+
+// UserActivity returns the latest login and connection of the user. Logins
+// are read from audit events, connections from connection manager. Users
+// missing from role store are reported with AccountDeleted status. Audit
+// events and connections are optional, their 404 is reported as no activity.
+func (reports *Reports) UserActivity(userID string) (*UserActivity, error) {
+	activity := &UserActivity{UserID: userID, Status: AccountActive}
+
+	user, err := reports.roles.User(userID)
+	switch {
+	case errors.Is(err, restapi.ErrNotFound):
+		activity.Status = AccountDeleted
+	case err != nil:
+		return nil, err
+	case user.StaleAccessToken:
+		activity.Status = AccountStale
+	}
+
+	search := &monitor.AuditEventSearchObject{
+		Keywords: EventUserLoggedIn,
+		UserID:   userID,
+	}
+	logins := common.NewPager(100, func(offset, limit int) ([]monitor.AuditEvent, int, error) {
+		result, err := reports.audit.SearchAuditEvents(offset, limit, "created", "DESC", false, search)
+		return result.Items, result.Count, err
+	})
+	for logins.Next() {
+		if event := logins.Value(); event.EventName == EventUserLoggedIn {
+			if activity.LastLogin, err = parseTime("audit event", event.ID, event.Created); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if err := restapi.IgnoreNotFound(logins.Err()); err != nil {
+		return nil, err
+	}
+
+	connections, err := reports.conns.SearchConnections(
+		0, 1, "DESC", "connected", false,
+		connectionmanager.ConnectionSearch{UserID: []string{userID}},
+	)
+	if err := restapi.IgnoreNotFound(err); err != nil {
+		return nil, err
+	}
+	if len(connections) > 0 {
+		activity.LastConnection, err = parseTime("connection", connections[0].ID, connections[0].Connected)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return activity, nil
+}
+
+// InactiveUsers returns users who have neither logged in nor connected
+// since the given time. Logins and connections since the time are fetched
+// once and matched against all users, instead of querying each user.
+// Logins and connections before the time are ignored, even if the server
+// returns them.
+func (reports *Reports) InactiveUsers(since time.Time) ([]rolestore.User, error) {
+	active := map[string]bool{}
+
+	search := &monitor.AuditEventSearchObject{
+		Keywords:  EventUserLoggedIn,
+		StartTime: since.UTC().Format(time.RFC3339),
+	}
+	logins := common.NewPager(100, func(offset, limit int) ([]monitor.AuditEvent, int, error) {
+		result, err := reports.audit.SearchAuditEvents(offset, limit, "created", "DESC", false, search)
+		return result.Items, result.Count, err
+	})
+	for logins.Next() {
+		event := logins.Value()
+		if event.EventName != EventUserLoggedIn {
+			continue
+		}
+		at, err := parseTime("audit event", event.ID, event.Created)
+		if err != nil {
+			return nil, err
+		}
+		if !at.Before(since) {
+			active[event.Message["user_id"]] = true
+		}
+	}
+	if err := logins.Err(); err != nil {
+		return nil, err
+	}
+
+	connSearch := connectionmanager.ConnectionSearch{
+		Connected: connectionmanager.TimestampSearch{
+			Start: since.UTC().Format(time.RFC3339),
+		},
+	}
+	connections := common.NewPager(100, func(offset, limit int) ([]connectionmanager.Connection, int, error) {
+		items, err := reports.conns.SearchConnections(offset, limit, "DESC", "connected", false, connSearch)
+		return items, 0, err
+	})
+	for connections.Next() {
+		conn := connections.Value()
+		at, err := parseTime("connection", conn.ID, conn.Connected)
+		if err != nil {
+			return nil, err
+		}
+		if !at.Before(since) {
+			active[conn.UserData.ID] = true
+		}
+	}
+	if err := connections.Err(); err != nil {
+		return nil, err
+	}
+
+	users := common.NewPager(100, func(offset, limit int) ([]rolestore.User, int, error) {
+		items, err := reports.roles.SearchUsers(offset, limit, "", "", rolestore.UserSearchObject{})
+		return items, 0, err
+	})
+	seq := []rolestore.User{}
+	for users.Next() {
+		if user := users.Value(); !active[user.ID] {
+			seq = append(seq, user)
+		}
+	}
+
+	return seq, users.Err()
+}
+
+// parseTime parses RFC3339 timestamp of the object, malformed timestamp
+// is reported as error instead of zero time
+func parseTime(kind, id, value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time of %s %s: %w", kind, id, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,494 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package reports_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/connectionmanager"
+	"github.com/SSHcom/privx-sdk-go/api/monitor"
+	"github.com/SSHcom/privx-sdk-go/api/reports"
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+func TestAccountRoles(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/role-store/api/v1/roles" {
+				w.Write([]byte(`{"count": 2, "items": [
+					{"id": "r1", "name": "admins", "permissions": ["hosts-manage"]},
+					{"id": "r2", "name": "ops", "comment": "operators"}
+				]}`))
+				return
+			}
+			w.Write([]byte(`{
+				"id": "1",
+				"principals": [
+					{"principal": "root", "roles": [{"id": "r1", "name": "admins"}, {"id": "r2", "name": "ops"}]},
+					{"principal": "root", "roles": [{"id": "r2", "name": "ops"}, {"id": "r3", "name": "dba"}]},
+					{"principal": "deploy", "roles": [{"id": "r4", "name": "ci"}]},
+					{"principal": "root", "use_user_account": true, "roles": [{"id": "r5", "name": "users"}]}
+				]
+			}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	roles, err := store.AccountRoles("1", "root")
+	if err != nil {
+		t.Fatalf("account roles fails: %v", err)
+	}
+
+	expect := []rolestore.Role{
+		{ID: "r1", Name: "admins", Permissions: []string{"hosts-manage"}},
+		{ID: "r2", Name: "ops", Comment: "operators"},
+		{ID: "r3", Name: "dba"},
+	}
+	if !reflect.DeepEqual(roles, expect) {
+		t.Errorf("unexpected roles: %v", roles)
+	}
+
+	roles, err = store.AccountRoles("1", "nobody")
+	if err != nil || len(roles) != 0 {
+		t.Errorf("unexpected roles: %v, %v", roles, err)
+	}
+}
+
+func TestHostRoles(t *testing.T) {
+	requests := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch r.URL.Path {
+			case "/host-store/api/v1/hosts/h1":
+				w.Write([]byte(`{
+					"id": "h1",
+					"principals": [
+						{"principal": "root", "roles": [{"id": "r1", "name": "admins"}, {"id": "r2", "name": "ops"}]},
+						{"principal": "deploy", "roles": [{"id": "r2", "name": "ops"}, {"id": "r9", "name": "gone"}]}
+					]
+				}`))
+			case "/host-store/api/v1/hosts/h2":
+				w.Write([]byte(`{"id": "h2"}`))
+			case "/role-store/api/v1/roles":
+				w.Write([]byte(`{"count": 3, "items": [
+					{"id": "r1", "name": "admins", "permissions": ["hosts-manage"], "member_count": 2},
+					{"id": "r2", "name": "ops", "comment": "operators", "member_count": 7},
+					{"id": "r3", "name": "dba"}
+				]}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	roles, err := store.HostRoles("h1")
+	if err != nil {
+		t.Fatalf("host roles fails: %v", err)
+	}
+
+	expect := []rolestore.Role{
+		{ID: "r1", Name: "admins", Permissions: []string{"hosts-manage"}, MemberCount: 2},
+		{ID: "r2", Name: "ops", Comment: "operators", MemberCount: 7},
+		{ID: "r9", Name: "gone"},
+	}
+	if !reflect.DeepEqual(roles, expect) {
+		t.Errorf("unexpected roles: %+v", roles)
+	}
+	if !reflect.DeepEqual(requests, []string{"GET /host-store/api/v1/hosts/h1", "GET /role-store/api/v1/roles"}) {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+
+	requests = nil
+	roles, err = store.HostRoles("h2")
+	if err != nil || len(roles) != 0 || len(requests) != 1 {
+		t.Errorf("unexpected roles: %+v, %v, %v", roles, err, requests)
+	}
+
+	if _, err := store.HostRoles("h3"); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHostRolesWithoutRoleStore(t *testing.T) {
+	status := http.StatusNotFound
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/host-store/api/v1/hosts/h1":
+				w.Write([]byte(`{"id": "h1", "principals": [{"principal": "root", "roles": [{"id": "r1", "name": "admins"}]}]}`))
+			default:
+				w.WriteHeader(status)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	roles, err := store.HostRoles("h1")
+	if err != nil || !reflect.DeepEqual(roles, []rolestore.Role{{ID: "r1", Name: "admins"}}) {
+		t.Errorf("unexpected roles: %+v, %v", roles, err)
+	}
+
+	status = http.StatusInternalServerError
+	if _, err := store.HostRoles("h1"); err == nil {
+		t.Errorf("role store failure is ignored")
+	}
+}
+
+func TestRoleMembersAsOf(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/role-store/api/v1/roles/r1/members":
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"count": 2,
+					"items": []rolestore.User{{ID: "alice"}, {ID: "carol"}},
+				})
+			case "/role-store/api/v1/users/bob":
+				json.NewEncoder(w).Encode(rolestore.User{ID: "bob", Principal: "bob"})
+			case "/role-store/api/v1/users/dave":
+				w.WriteHeader(http.StatusNotFound)
+			case "/monitor-service/api/v1/auditevents/search":
+				search := map[string]string{}
+				json.NewDecoder(r.Body).Decode(&search)
+				if search["start_time"] != "2021-01-01T00:00:00Z" || r.URL.Query().Get("sortdir") != "DESC" {
+					t.Errorf("unexpected search: %v, %s", search, r.URL.RawQuery)
+				}
+				w.Write([]byte(`{"count": 4, "items": [
+					{"event_name": "USER_ROLE_GRANTED", "message": {"user_id": "carol", "role_id": "r1"}},
+					{"event_name": "USER_ROLE_REVOKED", "message": {"user_id": "bob", "role_id": "r1"}},
+					{"event_name": "USER_ROLE_REVOKED", "message": {"user_id": "dave", "role_id": "r1"}},
+					{"event_name": "USER_ROLE_REVOKED", "message": {"user_id": "erin", "role_id": "r2"}}
+				]}`))
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	users, err := store.RoleMembersAsOf("r1", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("role members fails: %v", err)
+	}
+
+	expect := []rolestore.User{{ID: "alice"}, {ID: "bob", Principal: "bob"}, {ID: "dave"}}
+	if !reflect.DeepEqual(users, expect) {
+		t.Errorf("unexpected members: %+v", users)
+	}
+}
+
+func mockActivity(t *testing.T) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/role-store/api/v1/users/alice":
+				w.Write([]byte(`{"id": "alice"}`))
+			case "/role-store/api/v1/users/bob":
+				w.Write([]byte(`{"id": "bob", "stale_access_token": true}`))
+			case "/role-store/api/v1/users/search":
+				if r.URL.Query().Get("offset") != "" {
+					w.Write([]byte(`{"items": []}`))
+					return
+				}
+				w.Write([]byte(`{"items": [{"id": "alice"}, {"id": "bob"}, {"id": "carol"}]}`))
+			case "/monitor-service/api/v1/auditevents/search":
+				search := monitor.AuditEventSearchObject{}
+				json.NewDecoder(r.Body).Decode(&search)
+				if search.Keywords != reports.EventUserLoggedIn {
+					t.Errorf("unexpected search: %+v", search)
+				}
+				if search.UserID != "" && search.UserID != "alice" {
+					w.Write([]byte(`{"count": 0, "items": []}`))
+					return
+				}
+				w.Write([]byte(`{"count": 2, "items": [
+					{"event_name": "USER_LOGGED_IN_FAILED", "created": "2021-03-02T10:00:00Z", "message": {"user_id": "carol"}},
+					{"event_name": "USER_LOGGED_IN", "created": "2021-03-01T10:00:00Z", "message": {"user_id": "alice"}}
+				]}`))
+			case "/connection-manager/api/v1/connections/search":
+				search := connectionmanager.ConnectionSearch{}
+				json.NewDecoder(r.Body).Decode(&search)
+				if len(search.UserID) > 0 && search.UserID[0] != "bob" {
+					w.Write([]byte(`{"count": 0, "items": []}`))
+					return
+				}
+				w.Write([]byte(`{"count": 1, "items": [
+					{"id": "c1", "connected": "2021-03-03T10:00:00Z", "user": {"id": "bob"}}
+				]}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+}
+
+func TestUserActivity(t *testing.T) {
+	ts := mockActivity(t)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	activity, err := store.UserActivity("alice")
+	if err != nil {
+		t.Fatalf("activity fails: %v", err)
+	}
+	expect := &reports.UserActivity{
+		UserID:    "alice",
+		LastLogin: time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC),
+		Status:    reports.AccountActive,
+	}
+	if !reflect.DeepEqual(activity, expect) {
+		t.Errorf("unexpected activity: %+v", activity)
+	}
+
+	activity, err = store.UserActivity("bob")
+	if err != nil || activity.Status != reports.AccountStale ||
+		!activity.LastLogin.IsZero() ||
+		!activity.LastConnection.Equal(time.Date(2021, 3, 3, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected activity: %+v, %v", activity, err)
+	}
+
+	activity, err = store.UserActivity("dave")
+	if err != nil || activity.Status != reports.AccountDeleted {
+		t.Errorf("unexpected activity: %+v, %v", activity, err)
+	}
+}
+
+func TestInactiveUsers(t *testing.T) {
+	ts := mockActivity(t)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	users, err := store.InactiveUsers(time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("inactive users fails: %v", err)
+	}
+	if len(users) != 1 || users[0].ID != "carol" {
+		t.Errorf("unexpected users: %+v", users)
+	}
+}
+
+func TestActivityTimes(t *testing.T) {
+	created := "2021-03-01T10:00:00Z"
+	connected := "2021-01-15T10:00:00Z"
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/role-store/api/v1/users/alice":
+				w.Write([]byte(`{"id": "alice"}`))
+			case "/role-store/api/v1/users/search":
+				if r.URL.Query().Get("offset") != "" {
+					w.Write([]byte(`{"items": []}`))
+					return
+				}
+				w.Write([]byte(`{"items": [{"id": "alice"}, {"id": "bob"}]}`))
+			case "/monitor-service/api/v1/auditevents/search":
+				fmt.Fprintf(w, `{"count": 1, "items": [
+					{"id": "e1", "event_name": "USER_LOGGED_IN", "created": %q, "message": {"user_id": "alice"}}
+				]}`, created)
+			case "/connection-manager/api/v1/connections/search":
+				if r.URL.Query().Get("offset") != "" {
+					w.Write([]byte(`{"items": []}`))
+					return
+				}
+				fmt.Fprintf(w, `{"count": 1, "items": [
+					{"id": "c1", "connected": %q, "user": {"id": "bob"}}
+				]}`, connected)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	// connection before the time is ignored, even if server returns it
+	users, err := store.InactiveUsers(time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(users) != 1 || users[0].ID != "bob" {
+		t.Errorf("unexpected users: %+v, %v", users, err)
+	}
+
+	connected = "yesterday"
+	if _, err := store.UserActivity("alice"); err == nil || !strings.Contains(err.Error(), "c1") {
+		t.Errorf("malformed connection time is ignored: %v", err)
+	}
+	if _, err := store.InactiveUsers(time.Time{}); err == nil {
+		t.Errorf("malformed connection time is ignored")
+	}
+
+	created = "yesterday"
+	if _, err := store.UserActivity("alice"); err == nil || !strings.Contains(err.Error(), "e1") {
+		t.Errorf("malformed login time is ignored: %v", err)
+	}
+	if _, err := store.InactiveUsers(time.Time{}); err == nil {
+		t.Errorf("malformed login time is ignored")
+	}
+}
+
+func TestRoleMembershipChanges(t *testing.T) {
+	events := []monitor.AuditEvent{
+		{EventName: rolestore.EventUserRoleGranted, Created: "2021-03-01T10:00:00Z", Message: map[string]string{"user_id": "u1", "role_id": "r1"}},
+		{EventName: "USER_ROLE_SETTINGS_UPDATED", Created: "2021-03-01T11:00:00Z"},
+	}
+	for i := 0; i < 150; i++ {
+		events = append(events, monitor.AuditEvent{
+			EventName: rolestore.EventUserRoleRevoked,
+			Created:   "2021-03-02T10:00:00Z",
+			Message:   map[string]string{"user_id": "u" + strconv.Itoa(i), "role_id": "r2"},
+		})
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			search := monitor.AuditEventSearchObject{}
+			json.NewDecoder(r.Body).Decode(&search)
+			if search.StartTime != "2021-03-01T00:00:00Z" || r.URL.Query().Get("sortdir") != "ASC" {
+				t.Errorf("unexpected search: %+v, %s", search, r.URL.RawQuery)
+			}
+
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			end := offset + limit
+			if end > len(events) {
+				end = len(events)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"count": len(events),
+				"items": events[offset:end],
+			})
+		}),
+	)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	changes, err := store.RoleMembershipChanges(time.Date(2021, 3, 1, 2, 0, 0, 0, time.FixedZone("EET", 2*60*60)))
+	if err != nil {
+		t.Fatalf("changes fails: %v", err)
+	}
+	if len(changes) != 151 {
+		t.Fatalf("unexpected number of changes: %d", len(changes))
+	}
+
+	expect := reports.MembershipChange{
+		Type:   reports.MembershipAdded,
+		UserID: "u1",
+		RoleID: "r1",
+		Time:   time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(changes[0], expect) {
+		t.Errorf("unexpected change: %+v", changes[0])
+	}
+	if last := changes[150]; last.Type != reports.MembershipRemoved || last.UserID != "u149" {
+		t.Errorf("unexpected change: %+v", last)
+	}
+
+	events[120].ID = "e120"
+	events[120].Created = "2021-03-02 10:00"
+	_, err = store.RoleMembershipChanges(time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC))
+	if err == nil || !strings.Contains(err.Error(), "e120") {
+		t.Errorf("malformed event time is ignored: %v", err)
+	}
+}
+
+func TestWatchRolesAuditEvents(t *testing.T) {
+	// events are created after the watch starts
+	created := func(d time.Duration) string {
+		return time.Now().Add(d).UTC().Format(time.RFC3339)
+	}
+	events := fmt.Sprintf(`{"count": 4, "items": [
+		{"event_name": "ROLE_CREATED", "created": %q, "message": {"role_id": "r3"}},
+		{"event_name": "USER_ROLE_GRANTED", "created": %q, "message": {"role_id": "r3", "user_id": "u1"}},
+		{"event_name": "ROLE_MAPPING_FAILED", "created": %q, "message": {"role_id": "r3"}},
+		{"event_name": "ROLE_DELETED", "created": %q, "message": {"role_id": "r4"}}
+	]}`, created(time.Minute), created(2*time.Minute), created(3*time.Minute), created(4*time.Minute))
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/monitor-service/api/v1/auditevents/search" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			search := monitor.AuditEventSearchObject{}
+			json.NewDecoder(r.Body).Decode(&search)
+			if search.Keywords != "" {
+				t.Errorf("events are searched by keyword: %q", search.Keywords)
+			}
+			w.Write([]byte(events))
+		}),
+	)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := store.WatchRoles(ctx, 10*time.Millisecond, nil)
+
+	expect := []rolestore.RoleChangeEvent{
+		{Type: rolestore.RoleCreated, RoleID: "r3"},
+		{Type: rolestore.RoleDeleted, RoleID: "r4"},
+	}
+	for _, e := range expect {
+		if change := <-changes; !reflect.DeepEqual(change, e) {
+			t.Errorf("unexpected change: %+v", change)
+		}
+	}
+
+	cancel()
+	for range changes {
+	}
+}
+
+func TestUserActivityOptional(t *testing.T) {
+	status := http.StatusNotFound
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/role-store/api/v1/users/alice":
+				w.Write([]byte(`{"id": "alice"}`))
+			default:
+				w.WriteHeader(status)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := reports.New(restapi.New(restapi.BaseURL(ts.URL), restapi.Retry(0)))
+
+	activity, err := store.UserActivity("alice")
+	expect := &reports.UserActivity{UserID: "alice", Status: reports.AccountActive}
+	if err != nil || !reflect.DeepEqual(activity, expect) {
+		t.Errorf("unexpected activity: %+v, %v", activity, err)
+	}
+
+	for _, status = range []int{http.StatusInternalServerError, http.StatusForbidden} {
+		if _, err := store.UserActivity("alice"); err == nil {
+			t.Errorf("status %d is ignored", status)
+		}
+	}
+}
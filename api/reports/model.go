@@ -0,0 +1,49 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package reports
+
+import "time"
+
+// EventUserLoggedIn is audit event of successful login, message of the
+// event carries user_id
+const EventUserLoggedIn = "USER_LOGGED_IN"
+
+// MembershipChangeType is kind of role membership change
+type MembershipChangeType string
+
+// MembershipChangeType values
+const (
+	MembershipAdded   = MembershipChangeType("ADDED")
+	MembershipRemoved = MembershipChangeType("REMOVED")
+)
+
+// MembershipChange is explicit grant or revoke of role to user
+type MembershipChange struct {
+	Type   MembershipChangeType
+	UserID string
+	RoleID string
+	Time   time.Time
+}
+
+// AccountStatus is status of user account in role store
+type AccountStatus string
+
+// AccountStatus values
+const (
+	AccountActive  = AccountStatus("ACTIVE")
+	AccountStale   = AccountStatus("STALE")
+	AccountDeleted = AccountStatus("DELETED")
+)
+
+// UserActivity is the latest activity of user, zero time means no
+// activity is recorded
+type UserActivity struct {
+	UserID         string
+	LastLogin      time.Time
+	LastConnection time.Time
+	Status         AccountStatus
+}
@@ -7,16 +7,80 @@
 package rolestore
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/SSHcom/privx-sdk-go/common"
 	"github.com/SSHcom/privx-sdk-go/restapi"
+	"golang.org/x/crypto/ssh"
 )
 
+// bulkConcurrency limits parallel requests of bulk operations
+const bulkConcurrency = 4
+
+// createAttempts is max number of attempts of retry-safe create
+const createAttempts = 3
+
 // RoleStore is a role-store client instance.
 type RoleStore struct {
-	api restapi.Connector
+	api   restapi.Connector
+	cache *roleCache
+	clock common.Clock
+}
+
+// roleCache keeps resolved roles by name until their TTL expires
+type roleCache struct {
+	sync.Mutex
+	ttl   time.Duration
+	roles map[string]cachedRole
+}
+
+type cachedRole struct {
+	role    RoleRef
+	expires time.Time
+}
+
+func (cache *roleCache) lookup(names []string) (map[string]RoleRef, []string) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+	found := map[string]RoleRef{}
+	missing := []string{}
+	for _, name := range names {
+		if entry, ok := cache.roles[name]; ok && now.Before(entry.expires) {
+			found[name] = entry.role
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	return found, missing
+}
+
+func (cache *roleCache) store(roles []RoleRef) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	expires := time.Now().Add(cache.ttl)
+	for _, role := range roles {
+		cache.roles[role.Name] = cachedRole{role: role, expires: expires}
+	}
+}
+
+func (cache *roleCache) invalidate() {
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.roles = map[string]cachedRole{}
 }
 
 type usersResult struct {
@@ -62,7 +126,12 @@ type collectorsResult struct {
 // New creates a new role-store client instance, using the
 // argument SDK API client.
 func New(api restapi.Connector) *RoleStore {
-	return &RoleStore{api: api}
+	return &RoleStore{api: api, clock: common.SystemClock{}}
+}
+
+// UseClock replaces the system clock used by polling helpers
+func (store *RoleStore) UseClock(clock common.Clock) {
+	store.clock = clock
 }
 
 // Sources get all sources.
@@ -76,6 +145,39 @@ func (store *RoleStore) Sources() ([]Source, error) {
 	return result.Items, err
 }
 
+// SourcesByType returns sources of the connector type (e.g. LDAP, AD, OIDC),
+// the type is matched case-insensitively
+func (store *RoleStore) SourcesByType(connectorType string) ([]Source, error) {
+	sources, err := store.Sources()
+	if err != nil {
+		return nil, err
+	}
+
+	seq := []Source{}
+	for _, source := range sources {
+		if strings.EqualFold(string(source.Connection.Type), connectorType) {
+			seq = append(seq, source)
+		}
+	}
+
+	return seq, nil
+}
+
+// SourceConnectorTypes returns connector types supported by the server
+// and parameters they need
+func (store *RoleStore) SourceConnectorTypes() ([]ConnectorType, error) {
+	var result struct {
+		Count int             `json:"count"`
+		Items []ConnectorType `json:"items"`
+	}
+
+	_, err := store.api.
+		URL("/role-store/api/v1/sources/types").
+		Get(&result)
+
+	return result.Items, err
+}
+
 // CreateSource create a new source
 func (store *RoleStore) CreateSource(source Source) (string, error) {
 	var object struct {
@@ -89,6 +191,74 @@ func (store *RoleStore) CreateSource(source Source) (string, error) {
 	return object.ID, err
 }
 
+// CreateSourceOnce creates a new source, retrying failures which leave
+// it unknown whether the source was created. Before each retry the source
+// is looked up by name, the existing one is adopted instead of creating
+// a duplicate.
+func (store *RoleStore) CreateSourceOnce(source Source) (string, error) {
+	create := func() (string, error) {
+		var object struct {
+			ID string `json:"id"`
+		}
+
+		_, err := store.api.
+			URL("/role-store/api/v1/sources").
+			NoRetry().
+			Post(&source, &object)
+
+		return object.ID, err
+	}
+
+	lookup := func() (string, error) {
+		sources, err := store.Sources()
+		if err != nil {
+			return "", err
+		}
+		for _, existing := range sources {
+			if existing.Name == source.Name {
+				return existing.ID, nil
+			}
+		}
+		return "", nil
+	}
+
+	return createOnce(create, lookup)
+}
+
+// createOnce calls create until it succeeds or fails unambiguously, the
+// object created by an ambiguously failed attempt is found with lookup
+func createOnce(create, lookup func() (string, error)) (string, error) {
+	var err error
+	for i := 0; i < createAttempts; i++ {
+		if i > 0 {
+			id, lookupErr := lookup()
+			if lookupErr != nil {
+				return "", lookupErr
+			}
+			if id != "" {
+				return id, nil
+			}
+		}
+
+		var id string
+		if id, err = create(); !ambiguous(err) {
+			return id, err
+		}
+	}
+
+	return "", err
+}
+
+// ambiguous checks if the request may have been processed despite the
+// failure, i.e. the response is lost or the server failed
+func ambiguous(err error) bool {
+	var netError net.Error
+	var apiError *restapi.APIError
+
+	return errors.As(err, &netError) ||
+		(errors.As(err, &apiError) && apiError.StatusCode >= 500)
+}
+
 // Source returns a source
 func (store *RoleStore) Source(sourceID string) (*Source, error) {
 	source := &Source{}
@@ -109,6 +279,36 @@ func (store *RoleStore) DeleteSource(sourceID string) error {
 	return err
 }
 
+// DeleteSourcesByTag deletes all sources with the tag. It returns the
+// number of deleted sources and joined errors of failed deletes.
+func (store *RoleStore) DeleteSourcesByTag(tag string) (int, error) {
+	if tag == "" {
+		return 0, errors.New("tag is required for bulk delete")
+	}
+
+	sources, err := store.Sources()
+	if err != nil {
+		return 0, err
+	}
+
+	matched := []Source{}
+	for _, source := range sources {
+		for _, t := range source.Tags {
+			if t == tag {
+				matched = append(matched, source)
+				break
+			}
+		}
+	}
+
+	return common.ParallelDo(matched, bulkConcurrency, func(source Source) error {
+		if err := store.DeleteSource(source.ID); err != nil {
+			return fmt.Errorf("source %s: %w", source.ID, err)
+		}
+		return nil
+	})
+}
+
 // UpdateSource update existing source
 func (store *RoleStore) UpdateSource(sourceID string, source *Source) error {
 	_, err := store.api.
@@ -182,6 +382,65 @@ func (store *RoleStore) LinkedRoles(awsroleID string) ([]AWSRoleLink, error) {
 	return result.Items, err
 }
 
+// RoleAWSRoles returns AWS roles granted by PrivX role
+func (store *RoleStore) RoleAWSRoles(roleID string) ([]AWSRoleLink, error) {
+	result := awsrolesResult{}
+
+	_, err := store.api.
+		URL("/role-store/api/v1/roles/%s/awsroles", url.PathEscape(roleID)).
+		Get(&result)
+
+	return result.Items, err
+}
+
+// SetRoleAWSRoles makes PrivX role to grant exactly the given AWS roles.
+// Links of AWS roles which are changed are updated, unknown AWS role
+// fails before any update.
+func (store *RoleStore) SetRoleAWSRoles(roleID string, awsRoleIDs []string) error {
+	links, err := store.AWSRoleLinks(false)
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{}
+	for _, link := range links {
+		known[link.ID] = true
+	}
+
+	wanted := map[string]bool{}
+	for _, id := range awsRoleIDs {
+		if !known[id] {
+			return fmt.Errorf("aws role %s: %w", id, restapi.ErrNotFound)
+		}
+		wanted[id] = true
+	}
+
+	for _, link := range links {
+		roles := []RoleRef{}
+		granted := false
+		for _, role := range link.Roles {
+			if role.ID == roleID {
+				granted = true
+				continue
+			}
+			roles = append(roles, role)
+		}
+
+		if granted == wanted[link.ID] {
+			continue
+		}
+		if wanted[link.ID] {
+			roles = append(roles, RoleRef{ID: roleID})
+		}
+
+		if err := store.UpdateAWSRoleLink(link.ID, roles); err != nil {
+			return fmt.Errorf("aws role %s: %w", link.ID, err)
+		}
+	}
+
+	return nil
+}
+
 // Roles gets all configured roles.
 func (store *RoleStore) Roles() ([]Role, error) {
 	result := rolesResult{}
@@ -193,6 +452,114 @@ func (store *RoleStore) Roles() ([]Role, error) {
 	return result.Items, err
 }
 
+// RoleHierarchy returns graph of roles referencing other roles. References
+// to unknown roles are ignored. Roles are walked in name order, a reference
+// back to a role on the walked path is reported as cycle, it is not followed.
+func (store *RoleStore) RoleHierarchy() (*RoleGraph, error) {
+	roles, err := store.Roles()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		if roles[i].Name != roles[j].Name {
+			return roles[i].Name < roles[j].Name
+		}
+		return roles[i].ID < roles[j].ID
+	})
+
+	graph := &RoleGraph{Nodes: []RoleRef{}, Edges: []RoleEdge{}, Cycles: [][]string{}}
+	refs := map[string][]string{}
+	for _, role := range roles {
+		graph.Nodes = append(graph.Nodes, RoleRef{ID: role.ID, Name: role.Name})
+		refs[role.ID] = nil
+	}
+
+	for _, role := range roles {
+		seen := map[string]bool{}
+		for _, to := range role.SourceRule.roleRefs() {
+			if _, known := refs[to]; !known || seen[to] {
+				continue
+			}
+			seen[to] = true
+			refs[role.ID] = append(refs[role.ID], to)
+			graph.Edges = append(graph.Edges, RoleEdge{From: role.ID, To: to})
+		}
+	}
+
+	// depth first search, a reference to a role on the path closes a cycle
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := map[string]int{}
+	path := []string{}
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = onPath
+		path = append(path, id)
+		for _, to := range refs[id] {
+			switch state[to] {
+			case unvisited:
+				visit(to)
+			case onPath:
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i] == to {
+						graph.Cycles = append(graph.Cycles, append([]string{}, path[i:]...))
+						break
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = done
+	}
+	for _, node := range graph.Nodes {
+		if state[node.ID] == unvisited {
+			visit(node.ID)
+		}
+	}
+
+	return graph, nil
+}
+
+// AllRolePermissions returns permissions of all roles by role id. Roles
+// are read with bounded concurrency, roles failed to read are missing from
+// the result and their errors are joined to the returned error. Roles
+// deleted since listing are missing as well, but they are not errors.
+func (store *RoleStore) AllRolePermissions() (map[string][]Permission, error) {
+	roles, err := store.Roles()
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	permissions := map[string][]Permission{}
+
+	_, err = common.ParallelDo(roles, bulkConcurrency, func(role Role) error {
+		detail, err := store.Role(role.ID)
+		if err != nil {
+			if err = restapi.IgnoreNotFound(err); err != nil {
+				return fmt.Errorf("role %s: %w", role.Name, err)
+			}
+			return nil
+		}
+
+		seq := make([]Permission, len(detail.Permissions))
+		for i, permission := range detail.Permissions {
+			seq[i] = Permission(permission)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		permissions[role.ID] = seq
+
+		return nil
+	})
+
+	return permissions, err
+}
+
 // CreateRole creates new role
 func (store *RoleStore) CreateRole(role Role) (string, error) {
 	var object struct {
@@ -206,8 +573,99 @@ func (store *RoleStore) CreateRole(role Role) (string, error) {
 	return object.ID, err
 }
 
+// CreateRoleOnce creates a new role, retrying failures which leave it
+// unknown whether the role was created. Before each retry the role is
+// looked up by name, bypassing the role cache, the existing one is adopted
+// instead of creating a duplicate.
+func (store *RoleStore) CreateRoleOnce(role Role) (string, error) {
+	create := func() (string, error) {
+		var object struct {
+			ID string `json:"id"`
+		}
+
+		_, err := store.api.
+			URL("/role-store/api/v1/roles").
+			NoRetry().
+			Post(&role, &object)
+
+		return object.ID, err
+	}
+
+	lookup := func() (string, error) {
+		roles, err := store.resolveRoles([]string{role.Name})
+		if err != nil {
+			return "", err
+		}
+		for _, existing := range roles {
+			if existing.Name == role.Name {
+				return existing.ID, nil
+			}
+		}
+		return "", nil
+	}
+
+	return createOnce(create, lookup)
+}
+
+// UseRoleCache enables caching of resolved roles for the given TTL,
+// the cache is shared by ResolveRoles and RoleByName
+func (store *RoleStore) UseRoleCache(ttl time.Duration) {
+	store.cache = &roleCache{ttl: ttl, roles: map[string]cachedRole{}}
+}
+
+// InvalidateRoleCache drops all cached roles
+func (store *RoleStore) InvalidateRoleCache() {
+	if store.cache != nil {
+		store.cache.invalidate()
+	}
+}
+
 // ResolveRoles searches give role name and returns corresponding ids
 func (store *RoleStore) ResolveRoles(names []string) ([]RoleRef, error) {
+	if store.cache == nil {
+		return store.resolveRoles(names)
+	}
+
+	found, missing := store.cache.lookup(names)
+	if len(missing) > 0 {
+		roles, err := store.resolveRoles(missing)
+		if err != nil {
+			return nil, err
+		}
+		store.cache.store(roles)
+
+		for _, role := range roles {
+			found[role.Name] = role
+		}
+	}
+
+	roles := []RoleRef{}
+	for _, name := range names {
+		if role, ok := found[name]; ok {
+			roles = append(roles, role)
+		}
+	}
+
+	return roles, nil
+}
+
+// RoleByName returns the role with given name
+func (store *RoleStore) RoleByName(name string) (*RoleRef, error) {
+	roles, err := store.ResolveRoles([]string{name})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		if role.Name == name {
+			return &role, nil
+		}
+	}
+
+	return nil, fmt.Errorf("role %s: %w", name, restapi.ErrNotFound)
+}
+
+func (store *RoleStore) resolveRoles(names []string) ([]RoleRef, error) {
 	var result struct {
 		Count int       `json:"count"`
 		Items []RoleRef `json:"items"`
@@ -245,6 +703,17 @@ func (store *RoleStore) Role(roleID string) (*Role, error) {
 	return role, err
 }
 
+// RoleSourceMappings returns the membership rules of the role tied
+// to user sources (e.g. directory group mapped to the role).
+func (store *RoleStore) RoleSourceMappings(roleID string) ([]SourceMapping, error) {
+	role, err := store.Role(roleID)
+	if err != nil {
+		return nil, err
+	}
+
+	return role.SourceRule.Mappings(), nil
+}
+
 // DeleteRole delete a role
 func (store *RoleStore) DeleteRole(roleID string) error {
 	_, err := store.api.
@@ -254,6 +723,34 @@ func (store *RoleStore) DeleteRole(roleID string) error {
 	return err
 }
 
+// DeleteRolesByPrefix deletes all non-system roles which name starts with
+// the prefix. It returns the number of deleted roles and joined errors of
+// failed deletes.
+func (store *RoleStore) DeleteRolesByPrefix(prefix string) (int, error) {
+	if prefix == "" {
+		return 0, errors.New("name prefix is required for bulk delete")
+	}
+
+	roles, err := store.Roles()
+	if err != nil {
+		return 0, err
+	}
+
+	matched := []Role{}
+	for _, role := range roles {
+		if !role.System && strings.HasPrefix(role.Name, prefix) {
+			matched = append(matched, role)
+		}
+	}
+
+	return common.ParallelDo(matched, bulkConcurrency, func(role Role) error {
+		if err := store.DeleteRole(role.ID); err != nil {
+			return fmt.Errorf("role %s: %w", role.Name, err)
+		}
+		return nil
+	})
+}
+
 // UpdateRole update existing role
 func (store *RoleStore) UpdateRole(roleID string, role *Role) error {
 	_, err := store.api.
@@ -263,6 +760,26 @@ func (store *RoleStore) UpdateRole(roleID string, role *Role) error {
 	return err
 }
 
+// UpdateRoleWith applies read-modify-write cycle to the role, only fields
+// changed by update are modified
+//
+//	store.UpdateRoleWith(roleID, func(role *rolestore.Role) error {
+//		role.Comment = "managed by automation"
+//		return nil
+//	})
+func (store *RoleStore) UpdateRoleWith(roleID string, update func(role *Role) error) error {
+	role, err := store.Role(roleID)
+	if err != nil {
+		return err
+	}
+
+	if err := update(role); err != nil {
+		return err
+	}
+
+	return store.UpdateRole(roleID, role)
+}
+
 // GetRoleMembers gets all members (users) of the argument role ID.
 func (store *RoleStore) GetRoleMembers(roleID string) ([]User, error) {
 	result := usersResult{}
@@ -274,6 +791,103 @@ func (store *RoleStore) GetRoleMembers(roleID string) ([]User, error) {
 	return result.Items, err
 }
 
+// WatchRoles delivers changes of roles until the context is cancelled.
+// Roles existing when watching starts are not reported. The role list is
+// compared between polls, it fails immediately if roles cannot be read.
+// Auth failures stop watching, the channel is closed when watching stops.
+func (store *RoleStore) WatchRoles(ctx context.Context, opts ...WatchOption) (<-chan RoleChangeEvent, error) {
+	config := watchConfig{
+		interval: 30 * time.Second,
+		onError:  func(error) {},
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	roles, err := store.Roles()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(chan RoleChangeEvent)
+	go func() {
+		defer close(changes)
+
+		known := roleDigests(roles)
+		for {
+			select {
+			case <-store.clock.After(config.interval):
+			case <-ctx.Done():
+				return
+			}
+
+			roles, err := store.Roles()
+			switch {
+			case errors.Is(err, restapi.ErrUnauthorized) || errors.Is(err, restapi.ErrForbidden):
+				config.onError(err)
+				return
+			case err != nil:
+				config.onError(err)
+				continue
+			}
+
+			current := roleDigests(roles)
+			for _, change := range diffRoles(known, current, roles) {
+				select {
+				case changes <- change:
+				case <-ctx.Done():
+					return
+				}
+			}
+			known = current
+		}
+	}()
+
+	return changes, nil
+}
+
+// roleDigests fingerprints roles by id, member count is not a change of
+// the role
+func roleDigests(roles []Role) map[string]string {
+	digests := make(map[string]string, len(roles))
+	for _, role := range roles {
+		role.MemberCount = 0
+		data, _ := json.Marshal(role)
+		digests[role.ID] = string(data)
+	}
+
+	return digests
+}
+
+// diffRoles lists changes between digests, in order of the current roles
+// followed by deleted roles in id order
+func diffRoles(known, current map[string]string, roles []Role) []RoleChangeEvent {
+	changes := []RoleChangeEvent{}
+	for i := range roles {
+		role := &roles[i]
+		digest, exists := known[role.ID]
+		switch {
+		case !exists:
+			changes = append(changes, RoleChangeEvent{Type: RoleCreated, RoleID: role.ID, Role: role})
+		case digest != current[role.ID]:
+			changes = append(changes, RoleChangeEvent{Type: RoleUpdated, RoleID: role.ID, Role: role})
+		}
+	}
+
+	deleted := []string{}
+	for id := range known {
+		if _, exists := current[id]; !exists {
+			deleted = append(deleted, id)
+		}
+	}
+	sort.Strings(deleted)
+	for _, id := range deleted {
+		changes = append(changes, RoleChangeEvent{Type: RoleDeleted, RoleID: id})
+	}
+
+	return changes
+}
+
 // AWSToken returns AWS token for a specified role
 func (store *RoleStore) AWSToken(roleID, tokencode string, ttl int) ([]AWSToken, error) {
 	result := awsTokenResult{}
@@ -396,26 +1010,19 @@ func (store *RoleStore) GrantUserRole(userID, roleID string) error {
 	if err != nil {
 		return err
 	}
-	// Does user already have the specified role?
-	for _, role := range roles {
-		if role.ID == roleID {
-			// Already granted.
-			return nil
-		}
+
+	// Add an explicit role grant request.
+	roles, granted := GrantRole(roles, Role{ID: roleID, Explicit: true})
+	if !granted {
+		// Already granted.
+		return nil
 	}
 
-	// Get new role.
-	role, err := store.Role(roleID)
-	if err != nil {
+	// Check that the role exists.
+	if _, err := store.Role(roleID); err != nil {
 		return err
 	}
 
-	// Add an explicit role grant request.
-	roles = append(roles, Role{
-		ID:       role.ID,
-		Explicit: true,
-	})
-
 	return store.setUserRoles(userID, roles)
 }
 
@@ -427,20 +1034,69 @@ func (store *RoleStore) RevokeUserRole(userID, roleID string) error {
 	if err != nil {
 		return err
 	}
+
 	// Remove role from user's roles.
-	var newRoles []Role
+	roles, revoked := RevokeRole(roles, roleID)
+	if !revoked {
+		// User did not have the specified role.
+		return nil
+	}
+
+	// Set new roles.
+	return store.setUserRoles(userID, roles)
+}
+
+// SetUserExplicitRoles sets explicit roles of the user to exactly the
+// given roles with a single update, implicit roles are not touched. Roles
+// are checked to exist before the update. Nothing is updated if the user
+// already has the roles.
+func (store *RoleStore) SetUserExplicitRoles(userID string, roleIDs []string) error {
+	roles, err := store.UserRoles(userID)
+	if err != nil {
+		return err
+	}
+
+	desired := map[string]bool{}
+	for _, id := range roleIDs {
+		desired[id] = true
+	}
+
+	changed := false
+	seq := []Role{}
 	for _, role := range roles {
-		if role.ID != roleID {
-			newRoles = append(newRoles, role)
+		switch {
+		case desired[role.ID]:
+			changed = changed || !role.Explicit
+			role.Explicit = true
+			delete(desired, role.ID)
+		case !role.Explicit:
+		case role.Implicit:
+			changed = true
+			role.Explicit = false
+		default:
+			changed = true
+			continue
 		}
+		seq = append(seq, role)
 	}
-	if len(newRoles) == len(roles) {
-		// User did not have the specified role.
+
+	for _, id := range roleIDs {
+		if !desired[id] {
+			continue
+		}
+		if _, err := store.Role(id); err != nil {
+			return err
+		}
+		delete(desired, id)
+		seq = append(seq, Role{ID: id, Explicit: true})
+		changed = true
+	}
+
+	if !changed {
 		return nil
 	}
 
-	// Set new roles.
-	return store.setUserRoles(userID, newRoles)
+	return store.setUserRoles(userID, seq)
 }
 
 func (store *RoleStore) setUserRoles(userID string, roles []Role) error {
@@ -451,6 +1107,21 @@ func (store *RoleStore) setUserRoles(userID string, roles []Role) error {
 	return err
 }
 
+// UserMFAStatus returns multifactor authentication status of the user
+func (store *RoleStore) UserMFAStatus(userID string) (*MFAStatus, error) {
+	user, err := store.User(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFAStatus{UserID: userID, Status: user.MFA.Status}, nil
+}
+
+// RequireMFA makes multifactor authentication mandatory for the user
+func (store *RoleStore) RequireMFA(userID string) error {
+	return store.EnableMFA([]string{userID})
+}
+
 // EnableMFA enable multifactor authentication
 func (store *RoleStore) EnableMFA(userIDs []string) error {
 	_, err := store.api.
@@ -531,6 +1202,41 @@ func (store *RoleStore) AuthorizedKeys(userID string) ([]AuthorizedKey, error) {
 	return result.Items, err
 }
 
+// UserKeyFingerprints returns SHA-256 fingerprints of authorized keys of
+// the user, keys are fingerprinted client side. Keys which cannot be
+// parsed are missing from the result and their errors are joined to the
+// returned error.
+func (store *RoleStore) UserKeyFingerprints(userID string) ([]KeyFingerprint, error) {
+	keys, err := store.AuthorizedKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	seq := []KeyFingerprint{}
+	for _, key := range keys {
+		public, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(key.PublicKey))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("authorized key %s: %w", key.ID, err))
+			continue
+		}
+
+		if key.Comment != "" {
+			comment = key.Comment
+		}
+		seq = append(seq, KeyFingerprint{
+			KeyID:       key.ID,
+			Name:        key.Name,
+			Comment:     comment,
+			KeyType:     public.Type(),
+			Fingerprint: ssh.FingerprintSHA256(public),
+			NotAfter:    key.NotAfter,
+		})
+	}
+
+	return seq, errors.Join(errs...)
+}
+
 // CreateAuthorizedKey register an authorized key for user
 func (store *RoleStore) CreateAuthorizedKey(key AuthorizedKey, userID string) (string, error) {
 	var object struct {
@@ -0,0 +1,981 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package rolestore_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+	"golang.org/x/crypto/ssh"
+)
+
+// mockResolve resolves known role names, counting requests and names
+func mockResolve(requests *int32, resolved *[]string) *httptest.Server {
+	known := map[string]string{"admin": "1", "dev": "2", "ops": "3"}
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(requests, 1)
+
+			names := []string{}
+			json.NewDecoder(r.Body).Decode(&names)
+			*resolved = append(*resolved, names...)
+
+			items := []rolestore.RoleRef{}
+			for _, name := range names {
+				if id, ok := known[name]; ok {
+					items = append(items, rolestore.RoleRef{ID: id, Name: name})
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"count": len(items),
+				"items": items,
+			})
+		}),
+	)
+}
+
+func TestResolveRolesCache(t *testing.T) {
+	var requests int32
+	resolved := []string{}
+	ts := mockResolve(&requests, &resolved)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+	store.UseRoleCache(time.Minute)
+
+	roles, err := store.ResolveRoles([]string{"admin", "dev"})
+	if err != nil {
+		t.Fatalf("resolve fails: %v", err)
+	}
+
+	roles, err = store.ResolveRoles([]string{"dev", "ops", "admin"})
+	if err != nil {
+		t.Fatalf("resolve fails: %v", err)
+	}
+	expect := []rolestore.RoleRef{{ID: "2", Name: "dev"}, {ID: "3", Name: "ops"}, {ID: "1", Name: "admin"}}
+	if !reflect.DeepEqual(roles, expect) {
+		t.Errorf("unexpected roles: %v", roles)
+	}
+	if !reflect.DeepEqual(resolved, []string{"admin", "dev", "ops"}) {
+		t.Errorf("cached roles are resolved again: %v", resolved)
+	}
+
+	role, err := store.RoleByName("ops")
+	if err != nil || role.ID != "3" {
+		t.Errorf("unexpected role: %v, %v", role, err)
+	}
+	if requests != 2 {
+		t.Errorf("unexpected number of requests: %d", requests)
+	}
+
+	store.InvalidateRoleCache()
+	if _, err = store.RoleByName("ops"); err != nil {
+		t.Errorf("role by name fails: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("invalidated cache is used: %d", requests)
+	}
+}
+
+func TestResolveRolesCacheExpires(t *testing.T) {
+	var requests int32
+	resolved := []string{}
+	ts := mockResolve(&requests, &resolved)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+	store.UseRoleCache(10 * time.Millisecond)
+
+	store.RoleByName("admin")
+	time.Sleep(20 * time.Millisecond)
+	store.RoleByName("admin")
+
+	if requests != 2 {
+		t.Errorf("expired role is used: %d", requests)
+	}
+}
+
+func TestRoleByNameNotFound(t *testing.T) {
+	var requests int32
+	resolved := []string{}
+	ts := mockResolve(&requests, &resolved)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	_, err := store.RoleByName("unknown")
+	if !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSourcesByType(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"count": 3, "items": [
+				{"id": "1", "name": "corp", "connection": {"type": "LDAP"}},
+				{"id": "2", "name": "sso", "connection": {"type": "OIDC"}},
+				{"id": "3", "name": "partner", "connection": {"type": "OIDC"}}
+			]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	sources, err := store.SourcesByType("oidc")
+	if err != nil {
+		t.Fatalf("sources fails: %v", err)
+	}
+	if len(sources) != 2 || sources[0].ID != "2" || sources[1].ID != "3" {
+		t.Errorf("unexpected sources: %+v", sources)
+	}
+
+	sources, err = store.SourcesByType("AD")
+	if err != nil || sources == nil || len(sources) != 0 {
+		t.Errorf("unexpected sources: %+v, %v", sources, err)
+	}
+}
+
+func TestDeleteByFilter(t *testing.T) {
+	var mu sync.Mutex
+	deleted := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodDelete {
+				mu.Lock()
+				deleted = append(deleted, r.URL.Path)
+				mu.Unlock()
+				return
+			}
+
+			switch r.URL.Path {
+			case "/role-store/api/v1/sources":
+				w.Write([]byte(`{"count": 3, "items": [
+					{"id": "s1", "tags": ["legacy", "ldap"]},
+					{"id": "s2", "tags": ["ldap"]},
+					{"id": "s3", "tags": ["legacy"]}
+				]}`))
+			case "/role-store/api/v1/roles":
+				w.Write([]byte(`{"count": 3, "items": [
+					{"id": "r1", "name": "tmp-ops"},
+					{"id": "r2", "name": "ops"},
+					{"id": "r3", "name": "tmp-system", "system": true}
+				]}`))
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	n, err := store.DeleteSourcesByTag("legacy")
+	if n != 2 || err != nil {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+
+	n, err = store.DeleteRolesByPrefix("tmp-")
+	if n != 1 || err != nil {
+		t.Errorf("unexpected result: %d, %v", n, err)
+	}
+
+	sort.Strings(deleted)
+	expect := []string{
+		"/role-store/api/v1/roles/r1",
+		"/role-store/api/v1/sources/s1",
+		"/role-store/api/v1/sources/s3",
+	}
+	if !reflect.DeepEqual(deleted, expect) {
+		t.Errorf("unexpected deletes: %v", deleted)
+	}
+
+	if _, err := store.DeleteSourcesByTag(""); err == nil {
+		t.Errorf("empty tag is accepted")
+	}
+	if _, err := store.DeleteRolesByPrefix(""); err == nil {
+		t.Errorf("empty prefix is accepted")
+	}
+}
+
+// mockActivity serves users alice, bob and carol, where alice has logged in
+// and bob has connected recently
+func TestUpdateRoleWith(t *testing.T) {
+	var updated map[string]interface{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/role-store/api/v1/roles/r1" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			switch r.Method {
+			case http.MethodGet:
+				w.Write([]byte(`{
+					"id": "r1",
+					"name": "ops",
+					"comment": "old",
+					"permissions": ["users-view", "hosts-view"],
+					"member_count": 12,
+					"system": false
+				}`))
+			case http.MethodPut:
+				json.NewDecoder(r.Body).Decode(&updated)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	err := store.UpdateRoleWith("r1", func(role *rolestore.Role) error {
+		role.Comment = "new"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("update fails: %v", err)
+	}
+
+	if updated["comment"] != "new" || updated["name"] != "ops" {
+		t.Errorf("unexpected update: %v", updated)
+	}
+	if perms, _ := updated["permissions"].([]interface{}); len(perms) != 2 {
+		t.Errorf("permissions are reset: %v", updated["permissions"])
+	}
+	for _, key := range []string{"system", "explicit", "context"} {
+		if _, has := updated[key]; has {
+			t.Errorf("server managed field %s is written", key)
+		}
+	}
+
+	err = store.UpdateRoleWith("missing", func(role *rolestore.Role) error { return nil })
+	if !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRoleAWSRoles(t *testing.T) {
+	var mu sync.Mutex
+	updates := map[string][]rolestore.RoleRef{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/role-store/api/v1/roles/r1/awsroles":
+				w.Write([]byte(`{"count": 1, "items": [{"id": "a1", "arn": "arn:aws:iam::1:role/admin"}]}`))
+			case r.URL.Path == "/role-store/api/v1/awsroles":
+				w.Write([]byte(`{"count": 3, "items": [
+					{"id": "a1", "arn": "arn:aws:iam::1:role/admin", "roles": [{"id": "r1"}, {"id": "r2"}]},
+					{"id": "a2", "arn": "arn:aws:iam::1:role/read", "roles": [{"id": "r2"}]},
+					{"id": "a3", "arn": "arn:aws:iam::1:role/ops", "roles": [{"id": "r1"}]}
+				]}`))
+			case r.Method == http.MethodPut:
+				roles := []rolestore.RoleRef{}
+				json.NewDecoder(r.Body).Decode(&roles)
+				mu.Lock()
+				updates[r.URL.Path] = roles
+				mu.Unlock()
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	links, err := store.RoleAWSRoles("r1")
+	if err != nil || len(links) != 1 || links[0].ARN != "arn:aws:iam::1:role/admin" {
+		t.Errorf("unexpected aws roles: %+v, %v", links, err)
+	}
+
+	if err := store.SetRoleAWSRoles("r1", []string{"a1", "a2"}); err != nil {
+		t.Fatalf("set aws roles fails: %v", err)
+	}
+	expect := map[string][]rolestore.RoleRef{
+		"/role-store/api/v1/awsroles/a2/roles": {{ID: "r2"}, {ID: "r1"}},
+		"/role-store/api/v1/awsroles/a3/roles": {},
+	}
+	if !reflect.DeepEqual(updates, expect) {
+		t.Errorf("unexpected updates: %v", updates)
+	}
+
+	updates = map[string][]rolestore.RoleRef{}
+	err = store.SetRoleAWSRoles("r1", []string{"a1", "a9"})
+	if !errors.Is(err, restapi.ErrNotFound) || len(updates) != 0 {
+		t.Errorf("unexpected result: %v, %v", updates, err)
+	}
+}
+
+func TestAllRolePermissions(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/role-store/api/v1/roles":
+				w.Write([]byte(`{"count": 4, "items": [
+					{"id": "r1", "name": "admins"},
+					{"id": "r2", "name": "auditors"},
+					{"id": "r3", "name": "broken"},
+					{"id": "r4", "name": "deleted"}
+				]}`))
+			case "/role-store/api/v1/roles/r4":
+				w.WriteHeader(http.StatusNotFound)
+			case "/role-store/api/v1/roles/r1":
+				w.Write([]byte(`{"id": "r1", "permissions": ["users-manage", "users-view"]}`))
+			case "/role-store/api/v1/roles/r2":
+				w.Write([]byte(`{"id": "r2", "permissions": []}`))
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	permissions, err := store.AllRolePermissions()
+	if err == nil || !strings.Contains(err.Error(), "role broken") {
+		t.Errorf("failed role is not reported: %v", err)
+	}
+	if strings.Contains(err.Error(), "role deleted") {
+		t.Errorf("deleted role is reported: %v", err)
+	}
+
+	expect := map[string][]rolestore.Permission{
+		"r1": {"users-manage", "users-view"},
+		"r2": {},
+	}
+	if !reflect.DeepEqual(permissions, expect) {
+		t.Errorf("unexpected permissions: %v", permissions)
+	}
+}
+
+func TestUserMFAStatus(t *testing.T) {
+	enabled := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/role-store/api/v1/users/alice":
+				w.Write([]byte(`{"id": "alice", "mfa": {"status": "enabled", "seed": {"seed_string": "SECRET"}}}`))
+			case "/role-store/api/v1/users/bob":
+				w.Write([]byte(`{"id": "bob", "mfa": {"status": "disabled"}}`))
+			case "/role-store/api/v1/users/mfa/enable":
+				json.NewDecoder(r.Body).Decode(&enabled)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	status, err := store.UserMFAStatus("alice")
+	if err != nil || status.Status != rolestore.MFAEnabled || !status.Required() {
+		t.Errorf("unexpected status: %+v, %v", status, err)
+	}
+	if bytes, _ := json.Marshal(status); strings.Contains(string(bytes), "SECRET") {
+		t.Errorf("status carries seed: %s", bytes)
+	}
+
+	status, err = store.UserMFAStatus("bob")
+	if err != nil || status.Required() {
+		t.Errorf("unexpected status: %+v, %v", status, err)
+	}
+
+	if err := store.RequireMFA("bob"); err != nil || !reflect.DeepEqual(enabled, []string{"bob"}) {
+		t.Errorf("unexpected enable: %v, %v", enabled, err)
+	}
+
+	if _, err := store.UserMFAStatus("carol"); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseExport(t *testing.T) {
+	data := []byte(`{
+		"type": "roles",
+		"version": 1,
+		"exported": "2021-05-01T10:00:00Z",
+		"exported_by": "admin",
+		"items": [
+			{"id": "r1", "name": "admins", "grant_type": "STATIC", "permissions": ["users-view"], "member_count": 3},
+			{"id": "r2", "name": "ops", "grant_type": "DYNAMIC", "comment": "on-call"}
+		]
+	}`)
+
+	meta, roles, err := rolestore.ParseExport[rolestore.Role](data)
+	if err != nil {
+		t.Fatalf("parse fails: %v", err)
+	}
+	if meta.ExportedBy != "admin" || meta.Exported != "2021-05-01T10:00:00Z" || len(roles) != 2 {
+		t.Errorf("unexpected export: %+v, %+v", meta, roles)
+	}
+	if roles[0].Name != "admins" || roles[0].MemberCount != 3 ||
+		!reflect.DeepEqual(roles[0].Permissions, []string{"users-view"}) || roles[1].Comment != "on-call" {
+		t.Errorf("unexpected roles: %+v", roles)
+	}
+
+	if _, _, err := rolestore.ParseExport[rolestore.User](data); err == nil {
+		t.Errorf("roles are parsed as users")
+	}
+	if _, _, err := rolestore.ParseExport[rolestore.Role]([]byte(`[{"name": "admins"}]`)); err == nil {
+		t.Errorf("export without envelope is accepted")
+	}
+}
+
+func TestMarshalExport(t *testing.T) {
+	sources := []rolestore.Source{
+		{ID: "s1", Name: "ldap", Enabled: true, Tags: []string{"corp"}},
+	}
+
+	data, err := rolestore.MarshalExport(sources)
+	if err != nil {
+		t.Fatalf("marshal fails: %v", err)
+	}
+
+	meta, parsed, err := rolestore.ParseExport[rolestore.Source](data)
+	if err != nil || meta.Kind != rolestore.ExportSources || meta.Version != 1 || meta.Exported == "" {
+		t.Errorf("unexpected export: %+v, %v", meta, err)
+	}
+	if !reflect.DeepEqual(parsed, sources) {
+		t.Errorf("unexpected sources: %+v", parsed)
+	}
+
+	data, err = rolestore.MarshalExport[rolestore.User](nil)
+	if err != nil || !strings.Contains(string(data), `"items":[]`) {
+		t.Errorf("unexpected empty export: %s, %v", data, err)
+	}
+}
+
+// mockClock hands requested delays to the test, which fires them.
+// The current time is fixed.
+type mockClock struct {
+	now   time.Time
+	waits chan time.Duration
+	ticks chan time.Time
+}
+
+func (clock *mockClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *mockClock) After(d time.Duration) <-chan time.Time {
+	clock.waits <- d
+	return clock.ticks
+}
+
+func TestWatchRoles(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusOK
+	roles := []rolestore.Role{
+		{ID: "r1", Name: "admins", MemberCount: 2},
+		{ID: "r2", Name: "ops", MemberCount: 5},
+		{ID: "r4", Name: "legacy"},
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"count": len(roles), "items": roles})
+		}),
+	)
+	defer ts.Close()
+
+	clock := &mockClock{waits: make(chan time.Duration), ticks: make(chan time.Time)}
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+	store.UseClock(clock)
+
+	failures := make(chan error, 1)
+	changes, err := store.WatchRoles(context.Background(),
+		rolestore.WatchInterval(time.Minute),
+		rolestore.WatchErrors(func(err error) { failures <- err }),
+	)
+	if err != nil {
+		t.Fatalf("watch fails: %v", err)
+	}
+
+	if d := <-clock.waits; d != time.Minute {
+		t.Errorf("unexpected interval: %v", d)
+	}
+
+	mu.Lock()
+	roles = []rolestore.Role{
+		{ID: "r1", Name: "admins", Comment: "updated", MemberCount: 2},
+		{ID: "r2", Name: "ops", MemberCount: 6},
+		{ID: "r3", Name: "auditors"},
+	}
+	mu.Unlock()
+	clock.ticks <- time.Now()
+
+	seq := []string{}
+	for i := 0; i < 3; i++ {
+		change := <-changes
+		seq = append(seq, string(change.Type)+" "+change.RoleID)
+		if change.Type != rolestore.RoleDeleted && (change.Role == nil || change.Role.ID != change.RoleID) {
+			t.Errorf("role is missing: %+v", change)
+		}
+	}
+	if !reflect.DeepEqual(seq, []string{"updated r1", "created r3", "deleted r4"}) {
+		t.Errorf("unexpected changes: %v", seq)
+	}
+
+	<-clock.waits
+	mu.Lock()
+	status = http.StatusUnauthorized
+	mu.Unlock()
+	clock.ticks <- time.Now()
+
+	if _, ok := <-changes; ok {
+		t.Errorf("watch continues after auth failure")
+	}
+	if err := <-failures; !errors.Is(err, restapi.ErrUnauthorized) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := store.WatchRoles(context.Background()); !errors.Is(err, restapi.ErrUnauthorized) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// mockCreate stores roles and sources by name, failing creates as told
+type mockCreate struct {
+	sync.Mutex
+	objects map[string]string
+	posts   int
+	// fail of each post: "drop" stores the object and drops connection,
+	// "error" fails without storing it, "conflict" rejects it
+	fail []string
+}
+
+func (mock *mockCreate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.Lock()
+	defer mock.Unlock()
+
+	switch {
+	case r.URL.Path == "/role-store/api/v1/roles/resolve":
+		names := []string{}
+		json.NewDecoder(r.Body).Decode(&names)
+		items := []rolestore.RoleRef{}
+		for _, name := range names {
+			if id, ok := mock.objects[name]; ok {
+				items = append(items, rolestore.RoleRef{ID: id, Name: name})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": len(items), "items": items})
+
+	case r.URL.Path == "/role-store/api/v1/sources" && r.Method == http.MethodGet:
+		items := []rolestore.Source{}
+		for name, id := range mock.objects {
+			items = append(items, rolestore.Source{ID: id, Name: name})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": len(items), "items": items})
+
+	default:
+		var object struct {
+			Name string `json:"name"`
+		}
+		json.NewDecoder(r.Body).Decode(&object)
+
+		fail := ""
+		if mock.posts < len(mock.fail) {
+			fail = mock.fail[mock.posts]
+		}
+		mock.posts++
+
+		switch fail {
+		case "error":
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		case "conflict":
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		id := "id-" + strconv.Itoa(mock.posts)
+		mock.objects[object.Name] = id
+		if fail == "drop" {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"id": "` + id + `"}`))
+	}
+}
+
+func TestCreateRoleOnce(t *testing.T) {
+	for _, tc := range []struct {
+		fail   []string
+		id     string
+		posts  int
+		failed bool
+	}{
+		{fail: nil, id: "id-1", posts: 1},
+		{fail: []string{"drop"}, id: "id-1", posts: 1},
+		{fail: []string{"error"}, id: "id-2", posts: 2},
+		{fail: []string{"error", "error", "error"}, posts: 3, failed: true},
+		{fail: []string{"conflict"}, posts: 1, failed: true},
+	} {
+		mock := &mockCreate{objects: map[string]string{}, fail: tc.fail}
+		ts := httptest.NewServer(mock)
+
+		store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+		id, err := store.CreateRoleOnce(rolestore.Role{Name: "admins"})
+		ts.Close()
+
+		if tc.failed != (err != nil) || id != tc.id || mock.posts != tc.posts {
+			t.Errorf("%v: unexpected create: %q, %d posts, %v", tc.fail, id, mock.posts, err)
+		}
+		if len(mock.objects) > 1 {
+			t.Errorf("%v: duplicates are created: %v", tc.fail, mock.objects)
+		}
+	}
+}
+
+func TestCreateSourceOnce(t *testing.T) {
+	mock := &mockCreate{objects: map[string]string{}, fail: []string{"drop"}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	id, err := store.CreateSourceOnce(rolestore.Source{Name: "ldap"})
+	if err != nil || id != "id-1" || mock.posts != 1 || len(mock.objects) != 1 {
+		t.Errorf("unexpected create: %q, %d posts, %v", id, mock.posts, err)
+	}
+}
+
+func TestSourceConnectorTypes(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/role-store/api/v1/sources/types" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"count": 2, "items": [
+				{"type": "LDAP", "name": "LDAP directory", "parameters": {
+					"address": {"type": "string", "required": true},
+					"port": {"type": "integer", "default": 389}
+				}},
+				{"type": "SCIM", "parameters": {"endpoint": {"type": "string"}}}
+			]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	types, err := store.SourceConnectorTypes()
+	if err != nil || len(types) != 2 {
+		t.Fatalf("unexpected types: %+v, %v", types, err)
+	}
+
+	var params map[string]struct {
+		Type     string `json:"type"`
+		Required bool   `json:"required"`
+		Default  int    `json:"default"`
+	}
+	if err := json.Unmarshal(types[0].Parameters, &params); err != nil {
+		t.Fatalf("parameters are not kept: %s", types[0].Parameters)
+	}
+	if types[0].Type != rolestore.SourceLDAP || !params["address"].Required || params["port"].Default != 389 {
+		t.Errorf("unexpected type: %+v, %+v", types[0], params)
+	}
+	if types[1].Type != rolestore.SourceType("SCIM") || len(types[1].Parameters) == 0 {
+		t.Errorf("unknown type is not preserved: %+v", types[1])
+	}
+}
+
+func TestSetUserExplicitRoles(t *testing.T) {
+	var puts [][]rolestore.Role
+	current := []rolestore.Role{
+		{ID: "r1", Name: "admins", Explicit: true},
+		{ID: "r2", Name: "staff", Implicit: true},
+		{ID: "r3", Name: "ops", Explicit: true, Implicit: true},
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/role-store/api/v1/users/u1/roles" && r.Method == http.MethodGet:
+				json.NewEncoder(w).Encode(map[string]interface{}{"count": len(current), "items": current})
+			case r.URL.Path == "/role-store/api/v1/users/u1/roles" && r.Method == http.MethodPut:
+				roles := []rolestore.Role{}
+				json.NewDecoder(r.Body).Decode(&roles)
+				puts = append(puts, roles)
+			case strings.HasPrefix(r.URL.Path, "/role-store/api/v1/roles/r"):
+				w.Write([]byte(`{"id": "` + strings.TrimPrefix(r.URL.Path, "/role-store/api/v1/roles/") + `"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	grants := func(roles []rolestore.Role) []string {
+		seq := []string{}
+		for _, role := range roles {
+			seq = append(seq, role.ID+":"+strconv.FormatBool(role.Explicit)+"/"+strconv.FormatBool(role.Implicit))
+		}
+		return seq
+	}
+
+	for _, tc := range []struct {
+		roleIDs []string
+		expect  []string
+	}{
+		{
+			roleIDs: []string{"r1", "r4", "r4"},
+			expect:  []string{"r1:true/false", "r2:false/true", "r3:false/true", "r4:true/false"},
+		},
+		{
+			roleIDs: nil,
+			expect:  []string{"r2:false/true", "r3:false/true"},
+		},
+		{
+			roleIDs: []string{"r2", "r3", "r1"},
+			expect:  []string{"r1:true/false", "r2:true/true", "r3:true/true"},
+		},
+	} {
+		puts = nil
+		if err := store.SetUserExplicitRoles("u1", tc.roleIDs); err != nil {
+			t.Errorf("%v: set fails: %v", tc.roleIDs, err)
+		}
+		if len(puts) != 1 || !reflect.DeepEqual(grants(puts[0]), tc.expect) {
+			t.Errorf("%v: unexpected updates: %v", tc.roleIDs, puts)
+		}
+	}
+
+	puts = nil
+	if err := store.SetUserExplicitRoles("u1", []string{"r3", "r1"}); err != nil || len(puts) != 0 {
+		t.Errorf("unchanged roles are updated: %v, %v", puts, err)
+	}
+
+	if err := store.SetUserExplicitRoles("u1", []string{"missing"}); !errors.Is(err, restapi.ErrNotFound) || len(puts) != 0 {
+		t.Errorf("unknown role is granted: %v, %v", puts, err)
+	}
+}
+
+func TestUserKeyFingerprints(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " alice@laptop"
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/role-store/api/v1/users/u1/authorizedkeys" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"count": 3,
+				"items": []rolestore.AuthorizedKey{
+					{ID: "k1", Name: "laptop", PublicKey: line, NotAfter: "2022-01-01T00:00:00Z"},
+					{ID: "k2", Name: "ci", Comment: "deploy key", PublicKey: line},
+					{ID: "k3", Name: "broken", PublicKey: "ssh-ed25519 AAAA"},
+				},
+			})
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	keys, err := store.UserKeyFingerprints("u1")
+	if err == nil || !strings.Contains(err.Error(), "k3") {
+		t.Errorf("broken key is not reported: %v", err)
+	}
+
+	expect := []rolestore.KeyFingerprint{
+		{
+			KeyID:       "k1",
+			Name:        "laptop",
+			Comment:     "alice@laptop",
+			KeyType:     ssh.KeyAlgoED25519,
+			Fingerprint: ssh.FingerprintSHA256(key),
+			NotAfter:    "2022-01-01T00:00:00Z",
+		},
+		{
+			KeyID:       "k2",
+			Name:        "ci",
+			Comment:     "deploy key",
+			KeyType:     ssh.KeyAlgoED25519,
+			Fingerprint: ssh.FingerprintSHA256(key),
+		},
+	}
+	if !reflect.DeepEqual(keys, expect) {
+		t.Errorf("unexpected fingerprints: %+v", keys)
+	}
+	if !strings.HasPrefix(keys[0].Fingerprint, "SHA256:") {
+		t.Errorf("unexpected fingerprint: %s", keys[0].Fingerprint)
+	}
+}
+
+func TestRoleHierarchy(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"count": 5, "items": [
+				{"id": "o", "name": "ops", "source_rules": {"type": "GROUP", "match": "ANY", "rules": [
+					{"type": "GROUP", "match": "ALL", "rules": [
+						{"type": "ROLE", "search_string": "d"},
+						{"type": "ROLE", "search_string": "d"}
+					]}
+				]}},
+				{"id": "a", "name": "admins", "source_rules": {"type": "GROUP", "match": "ANY", "rules": [
+					{"type": "ROLE", "search_string": "o"},
+					{"type": "ROLE", "search_string": "x"},
+					{"type": "GROUP", "source": "ldap", "search_string": "admins"}
+				]}},
+				{"id": "d", "name": "dba", "source_rules": {"type": "GROUP", "match": "ANY", "rules": [
+					{"type": "ROLE", "search_string": "o"}
+				]}},
+				{"id": "c", "name": "ci", "source_rules": {"type": "GROUP", "match": "ANY"}},
+				{"id": "l", "name": "loop", "source_rules": {"type": "GROUP", "match": "ANY", "rules": [
+					{"type": "ROLE", "search_string": "l"}
+				]}}
+			]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	graph, err := store.RoleHierarchy()
+	if err != nil {
+		t.Fatalf("hierarchy fails: %v", err)
+	}
+
+	expect := &rolestore.RoleGraph{
+		Nodes: []rolestore.RoleRef{
+			{ID: "a", Name: "admins"},
+			{ID: "c", Name: "ci"},
+			{ID: "d", Name: "dba"},
+			{ID: "l", Name: "loop"},
+			{ID: "o", Name: "ops"},
+		},
+		Edges: []rolestore.RoleEdge{
+			{From: "a", To: "o"},
+			{From: "d", To: "o"},
+			{From: "l", To: "l"},
+			{From: "o", To: "d"},
+		},
+		Cycles: [][]string{{"o", "d"}, {"l"}},
+	}
+	if !reflect.DeepEqual(graph, expect) {
+		t.Errorf("unexpected graph: %+v", graph)
+	}
+}
+
+func TestUpdateRolePartial(t *testing.T) {
+	var updated map[string]interface{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&updated)
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	err := store.UpdateRole("r1", &rolestore.Role{ID: "r1", Comment: "new"})
+	if err != nil {
+		t.Fatalf("update fails: %v", err)
+	}
+
+	for _, key := range []string{"permissions", "source_rules"} {
+		if _, has := updated[key]; has {
+			t.Errorf("partial update sends %s: %v", key, updated[key])
+		}
+	}
+}
+
+func TestRoleSourceMappings(t *testing.T) {
+	requests := []string{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.Path)
+			switch r.URL.Path {
+			case "/role-store/api/v1/roles/r1":
+				w.Write([]byte(`{
+					"id": "r1",
+					"name": "ops",
+					"source_rules": {
+						"type": "GROUP",
+						"match": "ANY",
+						"rules": [
+							{"type": "GROUP", "match": "ALL", "rules": [
+								{"type": "GROUP", "source": "ad", "search_string": "CN=ops,DC=example,DC=com", "rules": []},
+								{"type": "USER", "source": "ad", "search_string": "department=it", "rules": []}
+							]},
+							{"type": "ROLE", "search_string": "r2", "rules": []},
+							{"type": "GROUP", "source": "ldap", "search_string": "cn=sre", "rules": []}
+						]
+					}
+				}`))
+			case "/role-store/api/v1/roles/r2":
+				w.Write([]byte(`{"id": "r2", "name": "plain"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := rolestore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	mappings, err := store.RoleSourceMappings("r1")
+	if err != nil {
+		t.Fatalf("mappings fails: %v", err)
+	}
+
+	expect := []rolestore.SourceMapping{
+		{Source: "ad", Type: "GROUP", Pattern: "CN=ops,DC=example,DC=com", Match: "ALL"},
+		{Source: "ad", Type: "USER", Pattern: "department=it", Match: "ALL"},
+		{Source: "ldap", Type: "GROUP", Pattern: "cn=sre", Match: "ANY"},
+	}
+	if !reflect.DeepEqual(mappings, expect) {
+		t.Errorf("unexpected mappings: %+v", mappings)
+	}
+	if !reflect.DeepEqual(requests, []string{"GET /role-store/api/v1/roles/r1"}) {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+
+	mappings, err = store.RoleSourceMappings("r2")
+	if err != nil || mappings == nil || len(mappings) != 0 {
+		t.Errorf("unexpected mappings: %+v, %v", mappings, err)
+	}
+
+	if _, err := store.RoleSourceMappings("r3"); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
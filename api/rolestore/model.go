@@ -6,6 +6,12 @@
 
 package rolestore
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
 // Params struct for pagination queries.
 type Params struct {
 	Sortdir   string `json:"sortdir,omitempty"`
@@ -79,59 +85,84 @@ type AWSRoleLink struct {
 	Roles       []RoleRef `json:"roles,omitempty"`
 }
 
+// SourceType is connector type of the source, values unknown to SDK are
+// preserved as is
+type SourceType string
+
+// SourceType values
+const (
+	SourceLocal     = SourceType("LOCAL")
+	SourceLDAP      = SourceType("LDAP")
+	SourceAD        = SourceType("AD")
+	SourceOIDC      = SourceType("OIDC")
+	SourceAWS       = SourceType("AWS")
+	SourceAzure     = SourceType("AZURE")
+	SourceGCP       = SourceType("GCP")
+	SourceOpenStack = SourceType("OPENSTACK")
+	SourceGSuite    = SourceType("GSUITE")
+)
+
+// ConnectorType is connector type of sources with schema of its connection
+// parameters, the schema is kept verbatim as given by the server
+type ConnectorType struct {
+	Type       SourceType      `json:"type"`
+	Name       string          `json:"name,omitempty"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
 // Connection source connection definition
 type Connection struct {
-	Type                   string   `json:"type,omitempty"`
-	Address                string   `json:"address,omitempty"`
-	AccessKeyID            string   `json:"iam_access_key_id,omitempty"`
-	SecretKey              string   `json:"iam_secret_access_key,omitempty"`
-	SessionToken           string   `json:"iam_session_token,omitempty"`
-	FetchRolePathPrefix    string   `json:"iam_fetch_role_path_prefix,omitempty"`
-	GCConfig               string   `json:"google_cloud_config_json,omitempty"`
-	OpenstackVersion       string   `json:"openstack_version,omitempty"`
-	OpenStackEndpoint      string   `json:"openstack_endpoint,omitempty"`
-	OpenStackUsername      string   `json:"openstack_username,omitempty"`
-	OpenStackUserID        string   `json:"openstack_user_id,omitempty"`
-	OpenStackPassword      string   `json:"openstack_password,omitempty"`
-	OpenStackAPIkey        string   `json:"openstack_apikey,omitempty"`
-	OpenStackDomainName    string   `json:"openstack_domainname,omitempty"`
-	OpenStackDomainID      string   `json:"openstack_domainid,omitempty"`
-	OpenStackTokenID       string   `json:"openstack_token_id,omitempty"`
-	AzureBaseURL           string   `json:"azure_base_url,omitempty"`
-	AzureSubscriptionID    string   `json:"azure_subscription_id,omitempty"`
-	AzureTenantID          string   `json:"azure_tenant_id,omitempty"`
-	AzureClientID          string   `json:"azure_client_id,omitempty"`
-	AzureClientSecret      string   `json:"azure_client_secret,omitempty"`
-	LDAPProtocol           string   `json:"ldap_protocol,omitempty"`
-	LDAPBase               string   `json:"ldap_base,omitempty"`
-	LDAPUserFilter         string   `json:"ldap_user_filter,omitempty"`
-	LDAPBindDN             string   `json:"ldap_bind_dn,omitempty"`
-	LDAPBindPassword       string   `json:"ldap_bind_password,omitempty"`
-	LDAPUserDNPattern      string   `json:"ldap_user_dn_pattern,omitempty"`
-	GoogleGsuiteDomain     string   `json:"google_gsuite_domain,omitempty"`
-	GoogleGsuiteAdminEmail string   `json:"google_gsuite_domain_admin_email,omitempty"`
-	OIDCIssuer             string   `json:"oidc_issuer,omitempty"`
-	OIDCButtonTitle        string   `json:"oidc_button_title,omitempty"`
-	OIDCClientID           string   `json:"oidc_client_id,omitempty"`
-	OIDCClientSecret       string   `json:"oidc_client_secret,omitempty"`
-	OIDCTagsAttributeName  string   `json:"oidc_tags_attribute_name,omitempty"`
-	MFAType                string   `json:"mfa_type,omitempty"`
-	MFAAddress             string   `json:"mfa_address,omitempty"`
-	MFABaseDN              string   `json:"mfa_base_dn,omitempty"`
-	DomainControllerFQDN   string   `json:"domain_controller_fqdn,omitempty"`
-	KerberosTicket         string   `json:"kerberos_ticket,omitempty"`
-	DomainControllerPort   int      `json:"domain_controller_port,omitempty"`
-	MFAPort                int      `json:"mfa_port,omitempty"`
-	Port                   int      `json:"port,omitempty"`
-	EnableMachineAuth      bool     `json:"enable_machine_authentication,omitempty"`
-	EnableUserAuth         bool     `json:"enable_user_authentication,omitempty"`
-	OIDCEnabled            bool     `json:"oidc_enabled,omitempty"`
-	FetchRoles             bool     `json:"iam_fetch_roles,omitempty"`
-	AutoUpdate             bool     `json:"service_address_auto_update,omitempty"`
-	OIDCScopesSecret       []string `json:"oidc_additional_scopes_secret,omitempty"`
-	GCProjectIDs           []string `json:"google_cloud_project_ids,omitempty"`
-	OpenStackTenantIDs     []string `json:"openstack_tenant_ids,omitempty"`
-	OpenStackTenantNames   []string `json:"openstack_tenant_names,omitempty"`
+	Type                   SourceType `json:"type,omitempty"`
+	Address                string     `json:"address,omitempty"`
+	AccessKeyID            string     `json:"iam_access_key_id,omitempty"`
+	SecretKey              string     `json:"iam_secret_access_key,omitempty"`
+	SessionToken           string     `json:"iam_session_token,omitempty"`
+	FetchRolePathPrefix    string     `json:"iam_fetch_role_path_prefix,omitempty"`
+	GCConfig               string     `json:"google_cloud_config_json,omitempty"`
+	OpenstackVersion       string     `json:"openstack_version,omitempty"`
+	OpenStackEndpoint      string     `json:"openstack_endpoint,omitempty"`
+	OpenStackUsername      string     `json:"openstack_username,omitempty"`
+	OpenStackUserID        string     `json:"openstack_user_id,omitempty"`
+	OpenStackPassword      string     `json:"openstack_password,omitempty"`
+	OpenStackAPIkey        string     `json:"openstack_apikey,omitempty"`
+	OpenStackDomainName    string     `json:"openstack_domainname,omitempty"`
+	OpenStackDomainID      string     `json:"openstack_domainid,omitempty"`
+	OpenStackTokenID       string     `json:"openstack_token_id,omitempty"`
+	AzureBaseURL           string     `json:"azure_base_url,omitempty"`
+	AzureSubscriptionID    string     `json:"azure_subscription_id,omitempty"`
+	AzureTenantID          string     `json:"azure_tenant_id,omitempty"`
+	AzureClientID          string     `json:"azure_client_id,omitempty"`
+	AzureClientSecret      string     `json:"azure_client_secret,omitempty"`
+	LDAPProtocol           string     `json:"ldap_protocol,omitempty"`
+	LDAPBase               string     `json:"ldap_base,omitempty"`
+	LDAPUserFilter         string     `json:"ldap_user_filter,omitempty"`
+	LDAPBindDN             string     `json:"ldap_bind_dn,omitempty"`
+	LDAPBindPassword       string     `json:"ldap_bind_password,omitempty"`
+	LDAPUserDNPattern      string     `json:"ldap_user_dn_pattern,omitempty"`
+	GoogleGsuiteDomain     string     `json:"google_gsuite_domain,omitempty"`
+	GoogleGsuiteAdminEmail string     `json:"google_gsuite_domain_admin_email,omitempty"`
+	OIDCIssuer             string     `json:"oidc_issuer,omitempty"`
+	OIDCButtonTitle        string     `json:"oidc_button_title,omitempty"`
+	OIDCClientID           string     `json:"oidc_client_id,omitempty"`
+	OIDCClientSecret       string     `json:"oidc_client_secret,omitempty"`
+	OIDCTagsAttributeName  string     `json:"oidc_tags_attribute_name,omitempty"`
+	MFAType                string     `json:"mfa_type,omitempty"`
+	MFAAddress             string     `json:"mfa_address,omitempty"`
+	MFABaseDN              string     `json:"mfa_base_dn,omitempty"`
+	DomainControllerFQDN   string     `json:"domain_controller_fqdn,omitempty"`
+	KerberosTicket         string     `json:"kerberos_ticket,omitempty"`
+	DomainControllerPort   int        `json:"domain_controller_port,omitempty"`
+	MFAPort                int        `json:"mfa_port,omitempty"`
+	Port                   int        `json:"port,omitempty"`
+	EnableMachineAuth      bool       `json:"enable_machine_authentication,omitempty"`
+	EnableUserAuth         bool       `json:"enable_user_authentication,omitempty"`
+	OIDCEnabled            bool       `json:"oidc_enabled,omitempty"`
+	FetchRoles             bool       `json:"iam_fetch_roles,omitempty"`
+	AutoUpdate             bool       `json:"service_address_auto_update,omitempty"`
+	OIDCScopesSecret       []string   `json:"oidc_additional_scopes_secret,omitempty"`
+	GCProjectIDs           []string   `json:"google_cloud_project_ids,omitempty"`
+	OpenStackTenantIDs     []string   `json:"openstack_tenant_ids,omitempty"`
+	OpenStackTenantNames   []string   `json:"openstack_tenant_names,omitempty"`
 }
 
 // EUM external user mapping definition
@@ -200,6 +231,18 @@ type AuthorizedKey struct {
 	SourceAddress []string `json:"source_address,omitempty"`
 }
 
+// KeyFingerprint identifies authorized key of user without its key
+// material. Expiry is not_after of the key, empty if the key does not
+// expire.
+type KeyFingerprint struct {
+	KeyID       string
+	Name        string
+	Comment     string
+	KeyType     string
+	Fingerprint string
+	NotAfter    string
+}
+
 // MFA multifactor authentication definition
 type MFA struct {
 	Status string `json:"status,omitempty"`
@@ -212,25 +255,104 @@ type Seed struct {
 	SeedQRCode string `json:"seed_qr_code,omitempty"`
 }
 
-// Role contains PrivX role information.
+// MFA status values
+const (
+	MFADisabled      = "disabled"
+	MFASetupRequired = "setup_required"
+	MFAEnabled       = "enabled"
+)
+
+// MFAStatus is multifactor authentication status of user, it never carries
+// the seed
+type MFAStatus struct {
+	UserID string
+	Status string
+}
+
+// Required tells if user must use MFA, either configured or pending setup
+func (status *MFAStatus) Required() bool {
+	return status.Status != "" && status.Status != MFADisabled
+}
+
+// Role contains PrivX role information. Server managed and optional
+// fields are omitted from writes when empty, use UpdateRoleWith to modify
+// role without resetting fields it does not set.
 type Role struct {
-	ID             string     `json:"id"`
-	Name           string     `json:"name"`
-	GrantType      string     `json:"grant_type"`
-	Comment        string     `json:"comment"`
-	AccessGroupID  string     `json:"access_group_id"`
-	GrantStart     string     `json:"grant_start"`
-	GrantEnd       string     `json:"grant_end"`
-	Permissions    []string   `json:"permissions"`
-	PublicKey      []string   `json:"principal_public_key_strings"`
-	MemberCount    int        `json:"member_count"`
-	FloatingLength int        `json:"floating_length"`
-	Explicit       bool       `json:"explicit" tabulate:"@userCtx"`
-	Implicit       bool       `json:"implicit" tabulate:"@userCtx"`
-	System         bool       `json:"system"`
-	PermitAgent    bool       `json:"permit_agent"`
-	Context        *Context   `json:"context"`
-	SourceRule     SourceRule `json:"source_rules"`
+	ID             string      `json:"id,omitempty"`
+	Name           string      `json:"name"`
+	GrantType      string      `json:"grant_type"`
+	Comment        string      `json:"comment"`
+	AccessGroupID  string      `json:"access_group_id,omitempty"`
+	GrantStart     string      `json:"grant_start,omitempty"`
+	GrantEnd       string      `json:"grant_end,omitempty"`
+	Permissions    []string    `json:"permissions,omitempty"`
+	PublicKey      []string    `json:"principal_public_key_strings,omitempty"`
+	MemberCount    int         `json:"member_count,omitempty"`
+	FloatingLength int         `json:"floating_length"`
+	Explicit       bool        `json:"explicit,omitempty" tabulate:"@userCtx"`
+	Implicit       bool        `json:"implicit,omitempty" tabulate:"@userCtx"`
+	System         bool        `json:"system,omitempty"`
+	PermitAgent    bool        `json:"permit_agent"`
+	Context        *Context    `json:"context,omitempty"`
+	SourceRule     *SourceRule `json:"source_rules,omitempty"`
+}
+
+// Permission is name of PrivX permission, e.g. users-view
+type Permission string
+
+// Audit events of explicit role grants, used to reconstruct past role
+// membership. Message of the event carries user_id and role_id.
+const (
+	EventUserRoleGranted = "USER_ROLE_GRANTED"
+	EventUserRoleRevoked = "USER_ROLE_REVOKED"
+)
+
+// Audit events of role changes, message of the event carries role_id
+const (
+	EventRoleCreated = "ROLE_CREATED"
+	EventRoleUpdated = "ROLE_UPDATED"
+	EventRoleDeleted = "ROLE_DELETED"
+)
+
+// RoleChangeType is kind of role change
+type RoleChangeType string
+
+// RoleChangeType values
+const (
+	RoleCreated = RoleChangeType("created")
+	RoleUpdated = RoleChangeType("updated")
+	RoleDeleted = RoleChangeType("deleted")
+)
+
+// RoleChangeEvent is a change of role. Role is the role after the change,
+// it is nil for deleted roles and for changes read from audit events.
+type RoleChangeEvent struct {
+	Type   RoleChangeType
+	RoleID string
+	Role   *Role
+}
+
+// WatchOption configures watching of roles
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	interval time.Duration
+	onError  func(error)
+}
+
+// WatchInterval defines how often changes are polled, defaults to 30s
+func WatchInterval(d time.Duration) WatchOption {
+	return func(config *watchConfig) {
+		config.interval = d
+	}
+}
+
+// WatchErrors receives failures of polling, transient failures are
+// retried on the next poll
+func WatchErrors(onError func(error)) WatchOption {
+	return func(config *watchConfig) {
+		config.onError = onError
+	}
 }
 
 // RoleRef is a reference to role object
@@ -239,6 +361,40 @@ type RoleRef struct {
 	Name string `json:"name"`
 }
 
+func (role Role) roleID() string    { return role.ID }
+func (role RoleRef) roleID() string { return role.ID }
+
+// roleKind is either Role or RoleRef
+type roleKind interface {
+	Role | RoleRef
+	roleID() string
+}
+
+// GrantRole adds the role to the roles unless it is already present.
+// It reports if the roles are changed.
+func GrantRole[T roleKind](roles []T, role T) ([]T, bool) {
+	for _, r := range roles {
+		if r.roleID() == role.roleID() {
+			return roles, false
+		}
+	}
+
+	return append(roles, role), true
+}
+
+// RevokeRole removes the role from the roles. It reports if the roles
+// are changed.
+func RevokeRole[T roleKind](roles []T, roleID string) ([]T, bool) {
+	seq := []T{}
+	for _, r := range roles {
+		if r.roleID() != roleID {
+			seq = append(seq, r)
+		}
+	}
+
+	return seq, len(seq) != len(roles)
+}
+
 // Context defines the context information for a role.
 type Context struct {
 	Enabled   bool   `json:"enabled"`
@@ -257,9 +413,72 @@ type SourceRule struct {
 	Rules   []SourceRule `json:"rules"`
 }
 
+// SourceMapping is a membership rule of the role tied to the source.
+// Match is the condition (ANY, ALL) of the group containing the rule.
+type SourceMapping struct {
+	Source  string `json:"source"`
+	Type    string `json:"type"`
+	Pattern string `json:"search_string"`
+	Match   string `json:"match"`
+}
+
+// Mappings flattens the rule tree to the list of source mappings
+func (rule *SourceRule) Mappings() []SourceMapping {
+	seq := []SourceMapping{}
+	if rule == nil {
+		return seq
+	}
+	for _, r := range rule.Rules {
+		if r.Source != "" {
+			seq = append(seq, SourceMapping{
+				Source:  r.Source,
+				Type:    r.Type,
+				Pattern: r.Pattern,
+				Match:   rule.Match,
+			})
+		}
+		seq = append(seq, r.Mappings()...)
+	}
+	return seq
+}
+
+// RuleTypeRole is type of source rule, which matches members of another
+// role, the rule's search string is id of the role
+const RuleTypeRole = "ROLE"
+
+// RoleEdge is reference from role to another role, whose members it
+// inherits via RuleTypeRole source rule
+type RoleEdge struct {
+	From string
+	To   string
+}
+
+// RoleGraph is role hierarchy of the deployment. Nodes are sorted by name.
+// Cycles lists role ids of detected reference cycles, in reference order.
+type RoleGraph struct {
+	Nodes  []RoleRef
+	Edges  []RoleEdge
+	Cycles [][]string
+}
+
+// roleRefs returns ids of roles referenced by the rule tree
+func (rule *SourceRule) roleRefs() []string {
+	seq := []string{}
+	if rule == nil {
+		return seq
+	}
+	for _, r := range rule.Rules {
+		if r.Type == RuleTypeRole && r.Pattern != "" {
+			seq = append(seq, r.Pattern)
+		}
+		seq = append(seq, r.roleRefs()...)
+	}
+	return seq
+}
+
 // SourceRuleNone creates an empty mapping source for the role
-func SourceRuleNone() SourceRule {
-	return SourceRule{
+func SourceRuleNone() *SourceRule {
+	return &SourceRule{
 		Type:  "GROUP",
 		Match: "ANY",
 	}
@@ -330,3 +549,87 @@ type IdentityProviderResolveUserRequest struct {
 type IdentityProviderCreateResponse struct {
 	ID string `json:"id"`
 }
+
+// ExportKind is type of objects in export envelope
+type ExportKind string
+
+// ExportKind values
+const (
+	ExportRoles   = ExportKind("roles")
+	ExportUsers   = ExportKind("users")
+	ExportSources = ExportKind("sources")
+)
+
+// exportVersion is version of envelope produced by MarshalExport
+const exportVersion = 1
+
+// Export is envelope of objects exported from admin UI, it wraps the
+// objects with metadata of the export
+type Export struct {
+	Kind       ExportKind      `json:"type"`
+	Version    int             `json:"version"`
+	Exported   string          `json:"exported,omitempty"`
+	ExportedBy string          `json:"exported_by,omitempty"`
+	Items      json.RawMessage `json:"items"`
+}
+
+// Exportable objects
+type Exportable interface {
+	Role | User | Source
+}
+
+func exportKind[T Exportable]() ExportKind {
+	switch any(*new(T)).(type) {
+	case Role:
+		return ExportRoles
+	case User:
+		return ExportUsers
+	default:
+		return ExportSources
+	}
+}
+
+// ParseExport decodes admin UI export of roles, users or sources. It
+// fails if the export contains other kind of objects.
+//
+//	meta, roles, err := rolestore.ParseExport[rolestore.Role](data)
+func ParseExport[T Exportable](data []byte) (*Export, []T, error) {
+	kind := exportKind[T]()
+
+	export := &Export{}
+	if err := json.Unmarshal(data, export); err != nil {
+		return nil, nil, fmt.Errorf("invalid export: %w", err)
+	}
+	if export.Kind != kind {
+		return nil, nil, fmt.Errorf("export contains %q, expected %q", export.Kind, kind)
+	}
+
+	items := []T{}
+	if len(export.Items) > 0 && string(export.Items) != "null" {
+		if err := json.Unmarshal(export.Items, &items); err != nil {
+			return nil, nil, fmt.Errorf("invalid export of %s: %w", kind, err)
+		}
+	}
+
+	return export, items, nil
+}
+
+// MarshalExport wraps roles, users or sources into admin UI export
+// envelope, which is accepted by the import of admin UI
+func MarshalExport[T Exportable](items []T) ([]byte, error) {
+	if items == nil {
+		items = []T{}
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(Export{
+		Kind:     exportKind[T](),
+		Version:  exportVersion,
+		Exported: time.Now().UTC().Format(time.RFC3339),
+		Items:    data,
+	})
+}
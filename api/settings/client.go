@@ -8,6 +8,7 @@ package settings
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/url"
 
 	"github.com/SSHcom/privx-sdk-go/restapi"
@@ -86,3 +87,29 @@ func (store *Settings) SectionSchema(scope, section string) (*json.RawMessage, e
 
 	return schema, err
 }
+
+// EffectiveScopeSettings returns settings of the scope merged with defaults
+// of the scope schema, keyed by dot separated path (section.setting).
+// Settings API does not tell explicit values from defaults, a value is
+// explicit if it differs from the default.
+func (store *Settings) EffectiveScopeSettings(scope string) (map[string]SettingValue, error) {
+	settings, err := store.ScopeSettings(scope, "")
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := store.ScopeSchema(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &schemaNode{}
+	if err := json.Unmarshal(*raw, schema); err != nil {
+		return nil, fmt.Errorf("invalid schema of scope %s: %w", scope, err)
+	}
+
+	seq := map[string]SettingValue{}
+	effective("", schema, *settings, seq)
+
+	return seq, nil
+}
@@ -0,0 +1,89 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package settings_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SSHcom/privx-sdk-go/api/settings"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+func TestEffectiveScopeSettings(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/settings/api/v1/settings/auth":
+				w.Write([]byte(`{
+					"session": {"timeout": 60, "max_sessions": 5},
+					"mfa": {"enabled": true, "methods": ["totp"]},
+					"legacy": {"flag": "on"}
+				}`))
+			case "/settings/api/v1/schema/auth":
+				w.Write([]byte(`{
+					"type": "object",
+					"properties": {
+						"session": {
+							"type": "object",
+							"properties": {
+								"timeout": {"type": "integer", "default": 30},
+								"max_sessions": {"type": "integer", "default": 5},
+								"idle_logout": {"type": "boolean", "default": false}
+							}
+						},
+						"mfa": {
+							"type": "object",
+							"properties": {
+								"enabled": {"type": "boolean", "default": false},
+								"methods": {"type": "array", "default": ["totp"]}
+							}
+						}
+					}
+				}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := settings.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	seq, err := store.EffectiveScopeSettings("auth")
+	if err != nil {
+		t.Fatalf("settings fail: %v", err)
+	}
+
+	for key, expect := range map[string]struct {
+		value    string
+		explicit bool
+	}{
+		"session.timeout":      {`60`, true},
+		"session.max_sessions": {`5`, false},
+		"session.idle_logout":  {`false`, false},
+		"mfa.enabled":          {`true`, true},
+		"mfa.methods":          {`["totp"]`, false},
+		"legacy":               {`{"flag": "on"}`, true},
+	} {
+		setting, ok := seq[key]
+		if !ok || string(setting.Value) != expect.value || setting.Explicit != expect.explicit {
+			t.Errorf("%s: unexpected setting: %s, %v", key, setting.Value, setting.Explicit)
+		}
+	}
+	if len(seq) != 6 {
+		t.Errorf("unexpected settings: %v", seq)
+	}
+	if string(seq["session.timeout"].Default) != "30" {
+		t.Errorf("unexpected default: %s", seq["session.timeout"].Default)
+	}
+
+	if _, err := store.EffectiveScopeSettings("unknown"); err == nil {
+		t.Errorf("unknown scope is accepted")
+	}
+}
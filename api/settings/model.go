@@ -6,7 +6,72 @@
 
 package settings
 
+import (
+	"encoding/json"
+	"reflect"
+)
+
 // Params query parameter definition
 type Params struct {
 	Merge string `json:"merge,omitempty"`
 }
+
+// SettingValue is effective value of a setting. Explicit is true if the
+// value differs from default of the schema, a setting explicitly set to
+// its default value is not told apart from the default.
+type SettingValue struct {
+	Value    json.RawMessage
+	Default  json.RawMessage
+	Explicit bool
+}
+
+// schemaNode is the part of JSON schema describing settings and defaults
+type schemaNode struct {
+	Default    json.RawMessage        `json:"default,omitempty"`
+	Properties map[string]*schemaNode `json:"properties,omitempty"`
+}
+
+// effective collects settings of the object described by the schema, keys
+// are dot separated paths of the settings
+func effective(path string, schema *schemaNode, value json.RawMessage, seq map[string]SettingValue) {
+	if schema != nil && len(schema.Properties) > 0 {
+		var object map[string]json.RawMessage
+		json.Unmarshal(value, &object)
+
+		for key, node := range schema.Properties {
+			effective(join(path, key), node, object[key], seq)
+		}
+		for key, value := range object {
+			if _, known := schema.Properties[key]; !known {
+				seq[join(path, key)] = SettingValue{Value: value, Explicit: true}
+			}
+		}
+		return
+	}
+
+	setting := SettingValue{Value: value}
+	if schema != nil {
+		setting.Default = schema.Default
+	}
+	if len(value) == 0 {
+		setting.Value = setting.Default
+	} else {
+		setting.Explicit = !sameJSON(value, setting.Default)
+	}
+	seq[path] = setting
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
@@ -7,15 +7,25 @@
 package userstore
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/common"
 	"github.com/SSHcom/privx-sdk-go/restapi"
 )
 
+// updateAttempts limits read-modify-write cycles of conditional updates
+const updateAttempts = 3
+
 // UserStore is a role-store client instance.
 type UserStore struct {
-	api restapi.Connector
+	api    restapi.Connector
+	policy *PasswordPolicy
 }
 
 type usersResult struct {
@@ -58,12 +68,70 @@ func (store *UserStore) LocalUsers(offset, limit int, userID, username string) (
 	return result.Items, err
 }
 
+// UsePasswordPolicy enables validation of passwords against the policy
+// before local users are created. Nil disables the validation.
+func (store *UserStore) UsePasswordPolicy(policy *PasswordPolicy) {
+	store.policy = policy
+}
+
+// PasswordPolicy returns password policy of local users
+func (store *UserStore) PasswordPolicy() (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{}
+
+	_, err := store.api.
+		URL("/settings/api/v1/settings/local-user-store/password_policy").
+		Get(policy)
+
+	return policy, err
+}
+
+// PasswordPolicies returns password policies configured for local users.
+// Servers with a single policy report it as the only item.
+func (store *UserStore) PasswordPolicies() ([]PasswordPolicy, error) {
+	policies := passwordPolicies{}
+
+	_, err := store.api.
+		URL("/settings/api/v1/settings/local-user-store/password_policy").
+		Get(&policies)
+
+	return policies, err
+}
+
+// LocalUsersIter iterates over all local users, fetching them page by
+// page, 100 users at once by default
+func (store *UserStore) LocalUsersIter(opts ...Option) *common.Pager[LocalUser] {
+	filters := &FilterUser{Params: Params{Limit: 100}}
+	for _, opt := range opts {
+		filters = opt(filters)
+	}
+
+	return common.NewPager(filters.Limit, func(offset, limit int) ([]LocalUser, int, error) {
+		result := usersResult{}
+		page := *filters
+		page.Offset = offset
+		page.Limit = limit
+
+		header, err := store.api.
+			URL("/local-user-store/api/v1/users").
+			Query(&page).
+			Get(&result)
+
+		return result.Items, restapi.TotalCount(header, result.Count), err
+	})
+}
+
 // CreateLocalUser create a new local PrivX user
 func (store *UserStore) CreateLocalUser(newUser LocalUser) (string, error) {
 	var object struct {
 		ID string `json:"id"`
 	}
 
+	if store.policy != nil {
+		if err := ValidatePassword(store.policy, newUser.Password.Password); err != nil {
+			return "", err
+		}
+	}
+
 	_, err := store.api.
 		URL("/local-user-store/api/v1/users").
 		Post(newUser, &object)
@@ -129,6 +197,107 @@ func (store *UserStore) LocalUserTags(offset, limit int, sortdir, query string)
 	return result.Items, err
 }
 
+// AddLocalUserTags adds tags to the local user. Tags are compared
+// case-insensitively, the user keeps a single copy of each tag.
+func (store *UserStore) AddLocalUserTags(userID string, tags ...string) error {
+	return store.updateLocalUser(userID, func(user *LocalUser) bool {
+		return user.setTags(uniqueTags(append(user.Tags, tags...)))
+	})
+}
+
+// RemoveLocalUserTags removes tags from the local user. Tags are compared
+// case-insensitively.
+func (store *UserStore) RemoveLocalUserTags(userID string, tags ...string) error {
+	remove := map[string]bool{}
+	for _, tag := range tags {
+		remove[strings.ToLower(tag)] = true
+	}
+
+	return store.updateLocalUser(userID, func(user *LocalUser) bool {
+		seq := []string{}
+		for _, tag := range uniqueTags(user.Tags) {
+			if !remove[strings.ToLower(tag)] {
+				seq = append(seq, tag)
+			}
+		}
+		return user.setTags(seq)
+	})
+}
+
+// SetLocalUserEnabled enables or disables the local user. Nothing is
+// written if the user is already in the requested state.
+func (store *UserStore) SetLocalUserEnabled(userID string, enabled bool) error {
+	return store.updateLocalUser(userID, func(user *LocalUser) bool {
+		disabled := !enabled
+		if user.IsDisabled() == disabled {
+			return false
+		}
+		user.Disabled = &disabled
+		return true
+	})
+}
+
+// UnlockLocalUser unlocks the local user locked out by failed logins.
+func (store *UserStore) UnlockLocalUser(userID string) error {
+	return store.updateLocalUser(userID, func(user *LocalUser) bool {
+		if !user.IsLocked() {
+			return false
+		}
+		locked := false
+		user.Locked = &locked
+		return true
+	})
+}
+
+// updateLocalUser does read-modify-write of the local user, the update
+// function reports if the user is changed. The write is conditional to
+// ETag of the read if endpoint supports it, concurrent modification of
+// the user restarts the cycle.
+func (store *UserStore) updateLocalUser(userID string, update func(*LocalUser) bool) error {
+	var err error
+
+	for i := 0; i < updateAttempts; i++ {
+		var head http.Header
+		user := &LocalUser{}
+		head, err = store.api.
+			URL("/local-user-store/api/v1/users/%s", url.PathEscape(userID)).
+			Get(user)
+		if err != nil {
+			return err
+		}
+
+		if !update(user) {
+			return nil
+		}
+
+		curl := store.api.
+			URL("/local-user-store/api/v1/users/%s", url.PathEscape(userID))
+		if etag := head.Get("ETag"); etag != "" {
+			curl = curl.Header("If-Match", etag)
+		}
+
+		_, err = curl.Put(user)
+		if !errors.Is(err, restapi.ErrPreconditionFailed) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func uniqueTags(tags []string) []string {
+	seen := map[string]bool{}
+	seq := []string{}
+	for _, tag := range tags {
+		key := strings.ToLower(tag)
+		if !seen[key] {
+			seen[key] = true
+			seq = append(seq, tag)
+		}
+	}
+	return seq
+}
+
 // TrustedClients fetches all known trusted clients
 func (store *UserStore) TrustedClients() ([]TrustedClient, error) {
 	var object struct {
@@ -170,6 +339,31 @@ func (store *UserStore) TrustedClient(clientID string) (*TrustedClient, error) {
 	return client, nil
 }
 
+// TrustedClientStatus returns registration status of the client
+func (store *UserStore) TrustedClientStatus(clientID string) (*TrustedClientStatus, error) {
+	status := &TrustedClientStatus{}
+
+	_, err := store.api.
+		URL("/local-user-store/api/v1/trusted-clients/%s", url.PathEscape(clientID)).
+		Get(status)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
+
+// RevokeTrustedClient invalidates the registration secret of the client,
+// the client record is kept.
+func (store *UserStore) RevokeTrustedClient(clientID string) error {
+	_, err := store.api.
+		URL("/local-user-store/api/v1/trusted-clients/%s/revoke", url.PathEscape(clientID)).
+		Post(nil)
+
+	return err
+}
+
 // DeleteTrustedClient removes the client
 func (store *UserStore) DeleteTrustedClient(clientID string) error {
 	_, err := store.api.
@@ -249,13 +443,14 @@ func (store *UserStore) APIClient(clientID string) (*APIClient, error) {
 	return client, nil
 }
 
-// DeleteAPIClient removes existing API client
+// DeleteAPIClient removes existing API client. If the client is referenced
+// by extenders or directory sources, the *DependencyError is returned.
 func (store *UserStore) DeleteAPIClient(clientID string) error {
 	_, err := store.api.
 		URL("/local-user-store/api/v1/api-clients/%s", clientID).
 		Delete()
 
-	return err
+	return dependencyError(clientID, err)
 }
 
 // UpdateAPIClient update existing api client
@@ -266,3 +461,177 @@ func (store *UserStore) UpdateAPIClient(clientID string, client *APIClient) erro
 
 	return err
 }
+
+// WhoAmI returns identity of the configured credentials. API client is
+// looked up first, credentials of a user are resolved via role-store.
+func (store *UserStore) WhoAmI() (*Identity, error) {
+	client := APIClient{}
+	_, err := store.api.
+		URL("/local-user-store/api/v1/api-clients/current").
+		Get(&client)
+
+	switch {
+	case err == nil:
+		return &Identity{
+			ID:        client.ID,
+			Type:      IdentityAPIClient,
+			Principal: client.Name,
+			Roles:     client.Roles,
+		}, nil
+	case !errors.Is(err, restapi.ErrNotFound):
+		return nil, err
+	}
+
+	user := rolestore.User{}
+	_, err = store.api.
+		URL("/role-store/api/v1/users/current").
+		Get(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make([]rolestore.RoleRef, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		roles = append(roles, rolestore.RoleRef{ID: role.ID, Name: role.Name})
+	}
+
+	return &Identity{
+		ID:        user.ID,
+		Type:      IdentityUser,
+		Principal: user.Principal,
+		Roles:     roles,
+	}, nil
+}
+
+// APIClientRoles returns roles granted to the api client
+func (store *UserStore) APIClientRoles(clientID string) ([]rolestore.RoleRef, error) {
+	client, err := store.APIClient(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Roles, nil
+}
+
+// AddAPIClientRole grants the role to the api client. If the client
+// already has the role, this function does nothing.
+func (store *UserStore) AddAPIClientRole(clientID, roleID string) error {
+	client, err := store.APIClient(clientID)
+	if err != nil {
+		return err
+	}
+
+	roles, granted := rolestore.GrantRole(client.Roles, rolestore.RoleRef{ID: roleID})
+	if !granted {
+		return nil
+	}
+	client.Roles = roles
+
+	return store.UpdateAPIClient(clientID, client)
+}
+
+// RemoveAPIClientRole revokes the role from the api client. If the client
+// does not have the role, this function does nothing.
+func (store *UserStore) RemoveAPIClientRole(clientID, roleID string) error {
+	client, err := store.APIClient(clientID)
+	if err != nil {
+		return err
+	}
+
+	roles, revoked := rolestore.RevokeRole(client.Roles, roleID)
+	if !revoked {
+		return nil
+	}
+	client.Roles = roles
+
+	return store.UpdateAPIClient(clientID, client)
+}
+
+// ImportLocalUsers creates local users. The import continues on error,
+// the report lists outcome per principal (username). The error is
+// returned if any of users failed.
+func (store *UserStore) ImportLocalUsers(users []LocalUser, opts ImportOptions) (ImportReport, error) {
+	report := ImportReport{
+		Created: map[string]string{},
+		Updated: map[string]string{},
+		Skipped: []string{},
+		Failed:  map[string]error{},
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	// rows are validated before import, duplicate username fails all its rows
+	count := map[string]int{}
+	for _, user := range users {
+		count[user.Username]++
+	}
+	valid := []LocalUser{}
+	for i, user := range users {
+		switch {
+		case user.Username == "":
+			report.Failed[fmt.Sprintf("#%d", i)] = errors.New("username is not defined")
+		case count[user.Username] > 1:
+			report.Failed[user.Username] = errors.New("duplicate username in the import")
+		default:
+			valid = append(valid, user)
+		}
+	}
+
+	// outcome of each user is recorded to the report
+	var mu sync.Mutex
+	common.ParallelDo(valid, concurrency, func(user LocalUser) error {
+		id, created, err := store.importLocalUser(user, opts.OnCollision)
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case err != nil:
+			report.Failed[user.Username] = err
+		case id == "":
+			report.Skipped = append(report.Skipped, user.Username)
+		case created:
+			report.Created[user.Username] = id
+		default:
+			report.Updated[user.Username] = id
+		}
+
+		return nil
+	})
+
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("%d of %d users failed to import", len(report.Failed), len(users))
+	}
+
+	return report, nil
+}
+
+// importLocalUser creates the user or resolves collision with existing
+// one. It returns id of the user, the empty id means skipped user.
+func (store *UserStore) importLocalUser(user LocalUser, policy CollisionPolicy) (string, bool, error) {
+	existing, err := store.LocalUsers(0, 0, "", user.Username)
+	if err != nil {
+		return "", false, err
+	}
+
+	for _, found := range existing {
+		if found.Username != user.Username {
+			continue
+		}
+
+		switch policy {
+		case CollisionSkip:
+			return "", false, nil
+		case CollisionUpdate:
+			user.ID = found.ID
+			return found.ID, false, store.UpdateLocalUser(found.ID, &user)
+		default:
+			return "", false, fmt.Errorf("user %s already exists", user.Username)
+		}
+	}
+
+	id, err := store.CreateLocalUser(user)
+	return id, true, err
+}
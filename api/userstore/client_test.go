@@ -0,0 +1,809 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package userstore_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/api/userstore"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+// mockUser is a single local user kept by mock server, the version is
+// exposed as ETag and checked against If-Match
+type mockUser struct {
+	sync.Mutex
+	user    userstore.LocalUser
+	version int
+	puts    int
+	// onPut is called before the conditional check, it emulates
+	// concurrent modification of the user
+	onPut func(*mockUser)
+}
+
+func (mock *mockUser) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.Lock()
+	defer mock.Unlock()
+
+	if r.URL.Path != "/local-user-store/api/v1/users/"+mock.user.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, mock.version))
+		json.NewEncoder(w).Encode(mock.user)
+	case http.MethodPut:
+		mock.puts++
+		if mock.onPut != nil {
+			mock.onPut(mock)
+			mock.onPut = nil
+		}
+		if r.Header.Get("If-Match") != fmt.Sprintf(`"%d"`, mock.version) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&mock.user)
+		mock.version++
+	}
+}
+
+func TestAddLocalUserTagsDedup(t *testing.T) {
+	mock := &mockUser{
+		user: userstore.LocalUser{ID: "1", Username: "alice", Tags: []string{"contractor", "Contractor"}},
+	}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	err := store.AddLocalUserTags("1", "CONTRACTOR", "expires-2025Q1", "Expires-2025q1")
+	if err != nil {
+		t.Errorf("add tags fails: %v", err)
+	}
+
+	expect := []string{"contractor", "expires-2025Q1"}
+	if !reflect.DeepEqual(mock.user.Tags, expect) {
+		t.Errorf("unexpected tags: %v", mock.user.Tags)
+	}
+	if mock.user.Username != "alice" {
+		t.Errorf("unrelated fields are not preserved: %v", mock.user)
+	}
+
+	err = store.RemoveLocalUserTags("1", "EXPIRES-2025Q1")
+	if err != nil {
+		t.Errorf("remove tags fails: %v", err)
+	}
+
+	expect = []string{"contractor"}
+	if !reflect.DeepEqual(mock.user.Tags, expect) {
+		t.Errorf("unexpected tags: %v", mock.user.Tags)
+	}
+}
+
+func TestAddLocalUserTagsConflict(t *testing.T) {
+	mock := &mockUser{
+		user: userstore.LocalUser{ID: "1", Tags: []string{"a"}},
+		onPut: func(mock *mockUser) {
+			mock.user.Tags = append(mock.user.Tags, "b")
+			mock.version++
+		},
+	}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if err := store.AddLocalUserTags("1", "c"); err != nil {
+		t.Errorf("add tags fails: %v", err)
+	}
+
+	expect := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(mock.user.Tags, expect) {
+		t.Errorf("concurrent tags are lost: %v", mock.user.Tags)
+	}
+}
+
+func TestSetLocalUserEnabled(t *testing.T) {
+	mock := &mockUser{user: userstore.LocalUser{ID: "1"}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	// enabled -> disabled
+	if err := store.SetLocalUserEnabled("1", false); err != nil {
+		t.Errorf("disable fails: %v", err)
+	}
+	if !mock.user.IsDisabled() || mock.puts != 1 {
+		t.Errorf("user is not disabled: %v", mock.user)
+	}
+
+	// disabled -> disabled is quiet
+	if err := store.SetLocalUserEnabled("1", false); err != nil {
+		t.Errorf("disable of disabled user fails: %v", err)
+	}
+	if mock.puts != 1 {
+		t.Errorf("disabled user is updated")
+	}
+
+	// disabled -> enabled
+	if err := store.SetLocalUserEnabled("1", true); err != nil {
+		t.Errorf("enable fails: %v", err)
+	}
+	if mock.user.IsDisabled() || mock.puts != 2 {
+		t.Errorf("user is not enabled: %v", mock.user)
+	}
+
+	// unknown user
+	err := store.SetLocalUserEnabled("2", false)
+	if !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUnlockLocalUser(t *testing.T) {
+	locked := true
+	mock := &mockUser{user: userstore.LocalUser{ID: "1", Locked: &locked}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if err := store.UnlockLocalUser("1"); err != nil {
+		t.Errorf("unlock fails: %v", err)
+	}
+	if mock.user.IsLocked() {
+		t.Errorf("user is not unlocked: %v", mock.user)
+	}
+
+	if err := store.UnlockLocalUser("1"); err != nil || mock.puts != 1 {
+		t.Errorf("unlock of unlocked user fails: %v", err)
+	}
+}
+
+func TestUpdateLocalUserPartial(t *testing.T) {
+	var body map[string]json.RawMessage
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&body)
+		}),
+	)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	err := store.UpdateLocalUser("1", &userstore.LocalUser{Comment: "on leave"})
+	if err != nil {
+		t.Errorf("update fails: %v", err)
+	}
+
+	for _, key := range []string{"disabled", "locked"} {
+		if _, has := body[key]; has {
+			t.Errorf("partial update sends %s: %v", key, body)
+		}
+	}
+	if string(body["comment"]) != `"on leave"` {
+		t.Errorf("unexpected comment: %s", body["comment"])
+	}
+}
+
+func TestAPIClientRolesIdempotent(t *testing.T) {
+	client := userstore.APIClient{
+		ID:    "1",
+		Roles: []rolestore.RoleRef{{ID: "a", Name: "admins"}},
+	}
+	puts := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet:
+				json.NewEncoder(w).Encode(client)
+			case http.MethodPut:
+				puts++
+				json.NewDecoder(r.Body).Decode(&client)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	for i := 0; i < 2; i++ {
+		if err := store.AddAPIClientRole("1", "b"); err != nil {
+			t.Errorf("add role fails: %v", err)
+		}
+	}
+	roles, err := store.APIClientRoles("1")
+	if err != nil || len(roles) != 2 || roles[1].ID != "b" || puts != 1 {
+		t.Errorf("unexpected roles: %v, %v", roles, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := store.RemoveAPIClientRole("1", "a"); err != nil {
+			t.Errorf("remove role fails: %v", err)
+		}
+	}
+	roles, err = store.APIClientRoles("1")
+	if err != nil || len(roles) != 1 || roles[0].ID != "b" || puts != 2 {
+		t.Errorf("unexpected roles: %v, %v", roles, err)
+	}
+}
+
+// mockUsers is a local users collection, creation of user "broken" fails
+func mockUsers(users map[string]userstore.LocalUser) *httptest.Server {
+	var mu sync.Mutex
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			var user userstore.LocalUser
+			switch r.Method {
+			case http.MethodGet:
+				items := []userstore.LocalUser{}
+				if found, ok := users[r.URL.Query().Get("username")]; ok {
+					items = append(items, found)
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"count": len(items), "items": items})
+			case http.MethodPost:
+				json.NewDecoder(r.Body).Decode(&user)
+				if user.Username == "broken" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				user.ID = "id-" + user.Username
+				users[user.Username] = user
+				json.NewEncoder(w).Encode(map[string]string{"id": user.ID})
+			case http.MethodPut:
+				json.NewDecoder(r.Body).Decode(&user)
+				users[user.Username] = user
+			}
+		}),
+	)
+}
+
+func TestImportLocalUsers(t *testing.T) {
+	for policy, expect := range map[userstore.CollisionPolicy]struct {
+		created, updated, skipped, failed int
+	}{
+		userstore.CollisionSkip:   {created: 1, skipped: 1},
+		userstore.CollisionUpdate: {created: 1, updated: 1},
+		userstore.CollisionError:  {created: 1, failed: 1},
+	} {
+		users := map[string]userstore.LocalUser{
+			"alice": {ID: "id-alice", Username: "alice"},
+		}
+		ts := mockUsers(users)
+		store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+		report, err := store.ImportLocalUsers(
+			[]userstore.LocalUser{
+				{Username: "alice", FullName: "Alice"},
+				{Username: "bob"},
+			},
+			userstore.ImportOptions{OnCollision: policy},
+		)
+		ts.Close()
+
+		if (err != nil) != (expect.failed > 0) {
+			t.Errorf("policy %d: unexpected error: %v", policy, err)
+		}
+		if len(report.Created) != expect.created || report.Created["bob"] != "id-bob" ||
+			len(report.Updated) != expect.updated ||
+			len(report.Skipped) != expect.skipped ||
+			len(report.Failed) != expect.failed {
+			t.Errorf("policy %d: unexpected report: %+v", policy, report)
+		}
+
+		updated := users["alice"].FullName == "Alice"
+		if updated != (policy == userstore.CollisionUpdate) {
+			t.Errorf("policy %d: unexpected user: %+v", policy, users["alice"])
+		}
+	}
+}
+
+func TestImportLocalUsersPartialFailure(t *testing.T) {
+	users := map[string]userstore.LocalUser{}
+	ts := mockUsers(users)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	input := []userstore.LocalUser{{Username: "broken"}, {Username: "bob"}, {Username: "bob"}, {}}
+	for i := 0; i < 10; i++ {
+		input = append(input, userstore.LocalUser{Username: fmt.Sprintf("user%d", i)})
+	}
+
+	report, err := store.ImportLocalUsers(input, userstore.ImportOptions{Concurrency: 3})
+	if err == nil {
+		t.Errorf("partial failure is not reported")
+	}
+
+	if len(report.Created) != 10 || len(users) != 10 {
+		t.Errorf("unexpected created users: %v", report.Created)
+	}
+	for _, key := range []string{"broken", "bob", "#3"} {
+		if report.Failed[key] == nil {
+			t.Errorf("failure of %s is not reported: %v", key, report.Failed)
+		}
+	}
+}
+
+func TestImportLocalUsersDuplicate(t *testing.T) {
+	users := map[string]userstore.LocalUser{}
+	ts := mockUsers(users)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	report, err := store.ImportLocalUsers(
+		[]userstore.LocalUser{{Username: "bob"}, {Username: "alice"}, {Username: "bob"}},
+		userstore.ImportOptions{},
+	)
+	if err == nil {
+		t.Errorf("duplicate is not reported")
+	}
+
+	if report.Failed["bob"] == nil || len(report.Failed) != 1 {
+		t.Errorf("unexpected failures: %v", report.Failed)
+	}
+	if _, ok := report.Created["bob"]; ok || len(report.Created) != 1 || report.Created["alice"] == "" {
+		t.Errorf("unexpected created users: %v", report.Created)
+	}
+	if _, ok := users["bob"]; ok {
+		t.Errorf("duplicate user is imported")
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet ||
+				r.URL.Path != "/settings/api/v1/settings/local-user-store/password_policy" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{
+				"password_min_length": 12,
+				"password_max_length": 64,
+				"password_require_uppercase": true,
+				"password_require_digits": true,
+				"password_history_size": 5
+			}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	policy, err := store.PasswordPolicy()
+	expect := &userstore.PasswordPolicy{
+		MinLength:        12,
+		MaxLength:        64,
+		RequireUppercase: true,
+		RequireDigits:    true,
+		HistorySize:      5,
+	}
+	if err != nil || !reflect.DeepEqual(policy, expect) {
+		t.Errorf("unexpected policy: %+v, %v", policy, err)
+	}
+}
+
+func TestPasswordPolicies(t *testing.T) {
+	for name, fixture := range map[string]string{
+		"single": `{
+			"password_min_length": 12,
+			"password_require_special": true,
+			"password_rotation_days": 90,
+			"password_rotation_warning_days": 14
+		}`,
+		"list": `[{
+			"password_min_length": 12,
+			"password_require_special": true,
+			"password_rotation_days": 90,
+			"password_rotation_warning_days": 14
+		}]`,
+	} {
+		ts := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/settings/api/v1/settings/local-user-store/password_policy" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Write([]byte(fixture))
+			}),
+		)
+
+		store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+		policies, err := store.PasswordPolicies()
+		expect := []userstore.PasswordPolicy{{
+			MinLength:           12,
+			RequireSpecial:      true,
+			RotationDays:        90,
+			RotationWarningDays: 14,
+		}}
+		if err != nil || !reflect.DeepEqual(policies, expect) {
+			t.Errorf("%s: unexpected policies: %+v, %v", name, policies, err)
+		}
+
+		ts.Close()
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	policy := &userstore.PasswordPolicy{}
+	fixture := `{
+		"password_min_length": 8,
+		"password_max_length": 16,
+		"password_require_uppercase": true,
+		"password_require_lowercase": true,
+		"password_require_digits": true,
+		"password_require_special": true
+	}`
+	if err := json.Unmarshal([]byte(fixture), policy); err != nil {
+		t.Fatal(err)
+	}
+
+	for password, violations := range map[string]int{
+		"Passw0rd!":           0,
+		"Pässw0rd!":           0,
+		"Pa0!":                1,
+		"Passw0rd!Passw0rd!1": 1,
+		"passw0rd!":           1,
+		"PASSW0RD!":           1,
+		"Password!":           1,
+		"Passw0rdd":           1,
+		"password":            3,
+		"":                    5,
+	} {
+		err := userstore.ValidatePassword(policy, password)
+
+		var policyError *userstore.PasswordPolicyError
+		switch {
+		case violations == 0 && err != nil:
+			t.Errorf("%q: unexpected error: %v", password, err)
+		case violations == 0:
+		case !errors.As(err, &policyError):
+			t.Errorf("%q: unexpected error: %v", password, err)
+		case len(policyError.Violations) != violations:
+			t.Errorf("%q: unexpected violations: %v", password, policyError.Violations)
+		}
+	}
+}
+
+func TestCreateLocalUserWithPolicy(t *testing.T) {
+	users := map[string]userstore.LocalUser{}
+	ts := mockUsers(users)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+	store.UsePasswordPolicy(&userstore.PasswordPolicy{MinLength: 8})
+
+	_, err := store.CreateLocalUser(userstore.LocalUser{
+		Username: "alice",
+		Password: userstore.Password{Password: "short"},
+	})
+	if err == nil || len(users) != 0 {
+		t.Errorf("password is not validated: %v", err)
+	}
+
+	_, err = store.CreateLocalUser(userstore.LocalUser{
+		Username: "alice",
+		Password: userstore.Password{Password: "long enough"},
+	})
+	if err != nil || len(users) != 1 {
+		t.Errorf("create user fails: %v", err)
+	}
+}
+
+func TestTrustedClientStatus(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/local-user-store/api/v1/trusted-clients/registered":
+				w.Write([]byte(`{
+					"id": "registered",
+					"name": "extender",
+					"registered": true,
+					"enabled": true,
+					"last_seen": "2021-03-01T10:20:30Z",
+					"version": "20.0.1"
+				}`))
+			case "/local-user-store/api/v1/trusted-clients/pending":
+				w.Write([]byte(`{
+					"id": "pending",
+					"name": "extender",
+					"registered": false,
+					"enabled": true,
+					"last_seen": null
+				}`))
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	status, err := store.TrustedClientStatus("registered")
+	if err != nil {
+		t.Fatalf("status fails: %v", err)
+	}
+	if !status.Registered || status.Version != "20.0.1" ||
+		!status.LastSeen.Equal(time.Date(2021, 3, 1, 10, 20, 30, 0, time.UTC)) {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	status, err = store.TrustedClientStatus("pending")
+	if err != nil {
+		t.Fatalf("status fails: %v", err)
+	}
+	if status.Registered || !status.LastSeen.IsZero() {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestTrustedClientLastSeenFormats(t *testing.T) {
+	expect := time.Date(2021, 3, 1, 10, 20, 30, 500000000, time.UTC)
+	for _, lastSeen := range []string{
+		`"2021-03-01T10:20:30.5Z"`,
+		`"2021-03-01T12:20:30.5+02:00"`,
+		`1614594030500`,
+		`"1614594030500"`,
+	} {
+		var status userstore.TrustedClientStatus
+		if err := json.Unmarshal([]byte(`{"last_seen": `+lastSeen+`}`), &status); err != nil {
+			t.Errorf("%s: unexpected error %v", lastSeen, err)
+			continue
+		}
+		if !status.LastSeen.Equal(expect) {
+			t.Errorf("%s: unexpected time %v", lastSeen, status.LastSeen)
+		}
+
+		data, err := json.Marshal(status)
+		if err != nil || !strings.Contains(string(data), `"last_seen":"2021-03-01T10:20:30.5Z"`) {
+			t.Errorf("%s: unexpected encoding %s, %v", lastSeen, data, err)
+		}
+	}
+
+	for _, lastSeen := range []string{`""`, `"yesterday"`, `true`} {
+		var status userstore.TrustedClientStatus
+		err := json.Unmarshal([]byte(`{"last_seen": `+lastSeen+`}`), &status)
+		if (err == nil) != (lastSeen == `""`) {
+			t.Errorf("%s: unexpected error %v", lastSeen, err)
+		}
+	}
+}
+
+// mockPages serves 7 users in pages, the page starting at failAt fails
+func mockPages(failAt int) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			offset, _ := strconv.Atoi(q.Get("offset"))
+			limit, _ := strconv.Atoi(q.Get("limit"))
+
+			if q.Get("sortkey") != "username" || q.Get("sortdir") != "DESC" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if offset == failAt {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			items := []userstore.LocalUser{}
+			for i := offset; i < offset+limit && i < 7; i++ {
+				items = append(items, userstore.LocalUser{ID: strconv.Itoa(i)})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"count": 7,
+				"items": items,
+			})
+		}),
+	)
+}
+
+func TestLocalUsersIter(t *testing.T) {
+	ts := mockPages(-1)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	seq := []string{}
+	iter := store.LocalUsersIter(userstore.PageSize(3), userstore.Sort("username", "DESC"))
+	for iter.Next() {
+		seq = append(seq, iter.Value().ID)
+	}
+
+	if err := iter.Err(); err != nil {
+		t.Errorf("iterator fails: %v", err)
+	}
+	if !reflect.DeepEqual(seq, []string{"0", "1", "2", "3", "4", "5", "6"}) {
+		t.Errorf("unexpected users: %v", seq)
+	}
+	if iter.TotalCount() != 7 {
+		t.Errorf("unexpected total count: %d", iter.TotalCount())
+	}
+}
+
+func TestLocalUsersIterError(t *testing.T) {
+	ts := mockPages(3)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	seq := []string{}
+	iter := store.LocalUsersIter(userstore.PageSize(3), userstore.Sort("username", "DESC"))
+	for iter.Next() {
+		seq = append(seq, iter.Value().ID)
+	}
+
+	if iter.Err() == nil {
+		t.Errorf("error of second page is not reported")
+	}
+	if !reflect.DeepEqual(seq, []string{"0", "1", "2"}) {
+		t.Errorf("unexpected users: %v", seq)
+	}
+	if iter.Next() {
+		t.Errorf("iterator continues after error")
+	}
+}
+
+func mockConflict(t *testing.T, fixture string) *httptest.Server {
+	body, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write(body)
+		}),
+	)
+}
+
+func TestDeleteAPIClientDependency(t *testing.T) {
+	for fixture, expect := range map[string]map[userstore.ReferenceType][]string{
+		"api-client-conflict-extender.json": {
+			userstore.ReferenceExtender: {
+				"5a1b7f1e-7e38-4f55-6a05-1a5e5d3c8c11",
+				"b21c08a9-3f4e-4c36-5cd1-66b0e9c5d0a2",
+			},
+		},
+		"api-client-conflict-source.json": {
+			userstore.ReferenceSource: {"0e4c3bb2-29d1-4a44-77c0-2e7f6a8d1b9f"},
+		},
+	} {
+		ts := mockConflict(t, fixture)
+		store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+		err := store.DeleteAPIClient("1")
+
+		var dependency *userstore.DependencyError
+		switch {
+		case !errors.As(err, &dependency):
+			t.Errorf("%s: unexpected error: %v", fixture, err)
+		case dependency.ClientID != "1" || !reflect.DeepEqual(dependency.References, expect):
+			t.Errorf("%s: unexpected references: %+v", fixture, dependency)
+		case !errors.Is(err, restapi.ErrConflict):
+			t.Errorf("%s: error is not conflict: %v", fixture, err)
+		}
+
+		ts.Close()
+	}
+}
+
+func TestDeleteAPIClientNotFound(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}),
+	)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	err := store.DeleteAPIClient("1")
+
+	var dependency *userstore.DependencyError
+	if errors.As(err, &dependency) || !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestWhoAmIAPIClient(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/local-user-store/api/v1/api-clients/current":
+				w.Write([]byte(`{
+					"id": "c1",
+					"name": "deployer",
+					"oauth_client_id": "privx-external",
+					"roles": [{"id": "r1", "name": "deploy"}]
+				}`))
+			default:
+				t.Errorf("unexpected request: %s", r.URL.Path)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	identity, err := store.WhoAmI()
+	if err != nil {
+		t.Fatalf("who am i fails: %v", err)
+	}
+
+	expect := &userstore.Identity{
+		ID:        "c1",
+		Type:      userstore.IdentityAPIClient,
+		Principal: "deployer",
+		Roles:     []rolestore.RoleRef{{ID: "r1", Name: "deploy"}},
+	}
+	if !reflect.DeepEqual(identity, expect) {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+}
+
+func TestWhoAmIUser(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/role-store/api/v1/users/current":
+				w.Write([]byte(`{
+					"id": "u1",
+					"principal": "alice",
+					"source": "local",
+					"roles": [
+						{"id": "r1", "name": "admin", "explicit": true},
+						{"id": "r2", "name": "dev", "implicit": true}
+					]
+				}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := userstore.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	identity, err := store.WhoAmI()
+	if err != nil {
+		t.Fatalf("who am i fails: %v", err)
+	}
+
+	expect := &userstore.Identity{
+		ID:        "u1",
+		Type:      userstore.IdentityUser,
+		Principal: "alice",
+		Roles:     []rolestore.RoleRef{{ID: "r1", Name: "admin"}, {ID: "r2", Name: "dev"}},
+	}
+	if !reflect.DeepEqual(identity, expect) {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+}
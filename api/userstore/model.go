@@ -6,7 +6,20 @@
 
 package userstore
 
-import "github.com/SSHcom/privx-sdk-go/api/rolestore"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/common"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
 
 // ClientType is a type of trusted clients
 type ClientType string
@@ -21,6 +34,7 @@ const (
 type Params struct {
 	Offset  int    `json:"offset,omitempty"`
 	Limit   int    `json:"limit,omitempty"`
+	Sortkey string `json:"sortkey,omitempty"`
 	Sortdir string `json:"sortdir,omitempty"`
 	Query   string `json:"query,omitempty"`
 }
@@ -32,6 +46,34 @@ type FilterUser struct {
 	Username string `json:"username,omitempty"`
 }
 
+// Option configures listing of local users
+type Option func(*FilterUser) *FilterUser
+
+// PageSize defines number of users fetched at once
+func PageSize(n int) Option {
+	return func(filter *FilterUser) *FilterUser {
+		filter.Limit = n
+		return filter
+	}
+}
+
+// Sort defines the sort key and direction (ASC, DESC) of users
+func Sort(key, dir string) Option {
+	return func(filter *FilterUser) *FilterUser {
+		filter.Sortkey = key
+		filter.Sortdir = dir
+		return filter
+	}
+}
+
+// Username filters users by username
+func Username(username string) Option {
+	return func(filter *FilterUser) *FilterUser {
+		filter.Username = username
+		return filter
+	}
+}
+
 // TrustedClient definition
 type TrustedClient struct {
 	ID              string     `json:"id,omitempty"`
@@ -48,6 +90,17 @@ type TrustedClient struct {
 	AccessGroupId   string     `json:"access_group_id,omitempty"`
 }
 
+// TrustedClientStatus is registration status of the trusted client,
+// LastSeen is zero if the client has never connected
+type TrustedClientStatus struct {
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	Registered bool        `json:"registered"`
+	Enabled    bool        `json:"enabled"`
+	LastSeen   common.Time `json:"last_seen"`
+	Version    string      `json:"version,omitempty"`
+}
+
 // Extender creates new trusted client
 func Extender(name string) TrustedClient {
 	return TrustedClient{
@@ -78,6 +131,86 @@ type APIClient struct {
 	Author           string              `json:"author,omitempty"`
 }
 
+// IdentityType is a type of the authenticated principal
+type IdentityType string
+
+// IdentityType supported values
+const (
+	IdentityUser      = IdentityType("user")
+	IdentityAPIClient = IdentityType("api-client")
+)
+
+// Identity is the principal the configured credentials resolve to
+type Identity struct {
+	ID        string
+	Type      IdentityType
+	Principal string
+	Roles     []rolestore.RoleRef
+}
+
+// ReferenceType is a type of object referencing the API client
+type ReferenceType string
+
+// ReferenceType supported values
+const (
+	ReferenceExtender = ReferenceType("EXTENDER")
+	ReferenceSource   = ReferenceType("SOURCE")
+)
+
+// error codes of conflict response, each detail carries ID of the
+// referencing object in the property
+var referenceCodes = map[string]ReferenceType{
+	"API_CLIENT_USED_BY_EXTENDER": ReferenceExtender,
+	"API_CLIENT_USED_BY_SOURCE":   ReferenceSource,
+}
+
+// DependencyError is returned when API client cannot be deleted because
+// other objects reference it. It unwraps to restapi.APIError.
+type DependencyError struct {
+	ClientID   string
+	References map[ReferenceType][]string
+	err        *restapi.APIError
+}
+
+func (e *DependencyError) Error() string {
+	refs := []string{}
+	for kind, ids := range e.References {
+		refs = append(refs, fmt.Sprintf("%s %s", kind, strings.Join(ids, ", ")))
+	}
+	sort.Strings(refs)
+
+	return fmt.Sprintf("api client %s is referenced by %s", e.ClientID, strings.Join(refs, "; "))
+}
+
+// Unwrap returns the underlying api error
+func (e *DependencyError) Unwrap() error {
+	return e.err
+}
+
+// dependencyError maps conflict response to DependencyError, other errors
+// are returned as is
+func dependencyError(clientID string, err error) error {
+	var apiError *restapi.APIError
+	if !errors.As(err, &apiError) || !errors.Is(err, restapi.ErrConflict) {
+		return err
+	}
+
+	refs := map[ReferenceType][]string{}
+	for _, detail := range apiError.Details {
+		kind, ok := referenceCodes[detail.ErrorCode]
+		if !ok {
+			kind = ReferenceType(detail.ErrorCode)
+		}
+		refs[kind] = append(refs[kind], detail.Property)
+	}
+
+	if len(refs) == 0 {
+		return err
+	}
+
+	return &DependencyError{ClientID: clientID, References: refs, err: apiError}
+}
+
 // LocalUser definition
 type LocalUser struct {
 	ID         string   `json:"id,omitempty"`
@@ -96,10 +229,147 @@ type LocalUser struct {
 	Email      string   `json:"email,omitempty"`
 	Telephone  string   `json:"telephone,omitempty"`
 	Locale     string   `json:"locale,omitempty"`
+	Disabled   *bool    `json:"disabled,omitempty"`
+	Locked     *bool    `json:"locked,omitempty"`
 	Password   Password `json:"password,omitempty"`
 }
 
+// IsDisabled reports if the user is disabled
+func (user *LocalUser) IsDisabled() bool {
+	return user.Disabled != nil && *user.Disabled
+}
+
+// IsLocked reports if the user is locked out
+func (user *LocalUser) IsLocked() bool {
+	return user.Locked != nil && *user.Locked
+}
+
+// setTags replaces user's tags, it reports if tags are changed
+func (user *LocalUser) setTags(tags []string) bool {
+	changed := len(user.Tags) != len(tags)
+	for i := 0; !changed && i < len(tags); i++ {
+		changed = user.Tags[i] != tags[i]
+	}
+	user.Tags = tags
+	return changed
+}
+
 // Password definition
 type Password struct {
 	Password string `json:"password,omitempty"`
 }
+
+// CollisionPolicy defines how import handles users which principal
+// already exists
+type CollisionPolicy int
+
+// CollisionPolicy supported values
+const (
+	CollisionError = CollisionPolicy(iota)
+	CollisionSkip
+	CollisionUpdate
+)
+
+// ImportOptions controls import of local users
+type ImportOptions struct {
+	// Concurrency is number of users imported in parallel, defaults to 4
+	Concurrency int
+	OnCollision CollisionPolicy
+}
+
+// ImportReport is outcome of the import, users are keyed by principal
+type ImportReport struct {
+	Created map[string]string
+	Updated map[string]string
+	Skipped []string
+	Failed  map[string]error
+}
+
+// PasswordPolicy defines requirements for local user passwords
+type PasswordPolicy struct {
+	MinLength        int  `json:"password_min_length"`
+	MaxLength        int  `json:"password_max_length"`
+	RequireUppercase bool `json:"password_require_uppercase"`
+	RequireLowercase bool `json:"password_require_lowercase"`
+	RequireDigits    bool `json:"password_require_digits"`
+	RequireSpecial   bool `json:"password_require_special"`
+	// HistorySize is number of previous passwords which cannot be reused,
+	// it is enforced by server only
+	HistorySize int `json:"password_history_size"`
+	// Rotation of passwords is enforced by server only. Passwords expire
+	// after RotationDays, users are warned RotationWarningDays before it.
+	// Zero rotation days disables expiry.
+	RotationDays        int `json:"password_rotation_days"`
+	RotationWarningDays int `json:"password_rotation_warning_days"`
+}
+
+// passwordPolicies decodes list of policies, or the single policy
+// reported by servers without multiple policies
+type passwordPolicies []PasswordPolicy
+
+func (seq *passwordPolicies) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return json.Unmarshal(data, (*[]PasswordPolicy)(seq))
+	}
+
+	var policy PasswordPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return err
+	}
+	*seq = passwordPolicies{policy}
+	return nil
+}
+
+// PasswordPolicyError lists violations of the password policy
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password violates policy: " + strings.Join(e.Violations, ", ")
+}
+
+// ValidatePassword checks the password against rules of the policy
+// which can be checked locally.
+func ValidatePassword(policy *PasswordPolicy, password string) error {
+	var upper, lower, digit, special bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			special = true
+		}
+	}
+
+	violations := []string{}
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		violations = append(violations, fmt.Sprintf("shorter than %d characters", policy.MinLength))
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, fmt.Sprintf("longer than %d characters", policy.MaxLength))
+	}
+	if policy.RequireUppercase && !upper {
+		violations = append(violations, "no uppercase letters")
+	}
+	if policy.RequireLowercase && !lower {
+		violations = append(violations, "no lowercase letters")
+	}
+	if policy.RequireDigits && !digit {
+		violations = append(violations, "no digits")
+	}
+	if policy.RequireSpecial && !special {
+		violations = append(violations, "no special characters")
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
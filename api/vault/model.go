@@ -8,8 +8,12 @@ package vault
 
 import (
 	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/common"
+	"github.com/SSHcom/privx-sdk-go/restapi"
 )
 
 // Params struct for pagination queries.
@@ -32,6 +36,99 @@ type Secret struct {
 	Data       json.RawMessage     `json:"data,omitempty"`
 }
 
+// SecretMetadata is secret without its data, it has no field to retain
+// the sensitive payload
+type SecretMetadata struct {
+	ID         string              `json:"name"`
+	Author     string              `json:"author,omitempty"`
+	Editor     string              `json:"updated_by,omitempty"`
+	Created    string              `json:"created,omitempty"`
+	Updated    string              `json:"updated,omitempty"`
+	AllowRead  []rolestore.RoleRef `json:"read_roles,omitempty"`
+	AllowWrite []rolestore.RoleRef `json:"write_roles,omitempty"`
+}
+
+// Clock is source of time for polling helpers, it is replaceable in tests
+type Clock = common.Clock
+
+// ConflictError is returned by conditional update when the secret was
+// modified since it was read. It matches restapi.ErrConflict.
+type ConflictError struct {
+	Name     string
+	Expected time.Time
+	Actual   time.Time
+}
+
+func (e *ConflictError) Error() string {
+	if e.Actual.IsZero() {
+		return fmt.Sprintf("secret %s is modified concurrently", e.Name)
+	}
+	return fmt.Sprintf("secret %s is modified at %s, expected %s",
+		e.Name, e.Actual.Format(time.RFC3339), e.Expected.Format(time.RFC3339))
+}
+
+// Is matches ConflictError against restapi.ErrConflict
+func (e *ConflictError) Is(target error) bool {
+	return target == restapi.ErrConflict
+}
+
+// RenameError is returned when rename fails after the new secret is
+// created, both the old and the new secret exist.
+type RenameError struct {
+	OldName string
+	NewName string
+	Err     error
+}
+
+func (e *RenameError) Error() string {
+	return fmt.Sprintf("rename of secret %s to %s is incomplete, both secrets exist: %v",
+		e.OldName, e.NewName, e.Err)
+}
+
+// Unwrap returns cause of the failure
+func (e *RenameError) Unwrap() error {
+	return e.Err
+}
+
+// CollisionPolicy defines how import handles secrets which name already
+// exists
+type CollisionPolicy int
+
+// CollisionPolicy supported values
+const (
+	CollisionError = CollisionPolicy(iota)
+	CollisionSkip
+	CollisionOverwrite
+)
+
+// ImportOptions controls import of secrets
+type ImportOptions struct {
+	OnCollision CollisionPolicy
+	// RemapRole maps read and write roles of exported secret to roles of
+	// the target instance, the roles are imported as is if not defined
+	RemapRole func(rolestore.RoleRef) (rolestore.RoleRef, error)
+}
+
+// ImportReport is outcome of the import, secrets are listed by name
+type ImportReport struct {
+	Created []string
+	Updated []string
+	Skipped []string
+	Failed  map[string]error
+}
+
+// Schema is JSON schema of well-known secret layout
+type Schema struct {
+	Name   string
+	Schema json.RawMessage
+}
+
+// Credentials is common shape of secret data
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
 // Search criteria for secrets
 type SecretSearchRequest struct {
 	Keywords string   `json:"keywords"`
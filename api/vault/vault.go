@@ -7,17 +7,34 @@
 package vault
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/url"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/common"
 	"github.com/SSHcom/privx-sdk-go/restapi"
 )
 
+const (
+	// updateAttempts limits read-modify-write cycles of conditional updates
+	updateAttempts = 3
+	// accessCheckConcurrency limits parallel requests of CheckSecretAccess
+	accessCheckConcurrency = 4
+)
+
 // Vault is client instance.
 type Vault struct {
-	api restapi.Connector
+	api   restapi.Connector
+	clock Clock
 }
 
 type secretResult struct {
@@ -25,6 +42,11 @@ type secretResult struct {
 	Items []Secret `json:"items"`
 }
 
+type secretMetadataResult struct {
+	Count int              `json:"count"`
+	Items []SecretMetadata `json:"items"`
+}
+
 type SecretID struct {
 	OwnerID string
 	Name    string
@@ -42,7 +64,12 @@ type tVaultReq struct {
 // New creates a new Vault client instance, using the argument
 // SDK API client.
 func New(api restapi.Connector) *Vault {
-	return &Vault{api: api}
+	return &Vault{api: api, clock: common.SystemClock{}}
+}
+
+// UseClock replaces the system clock used by polling helpers
+func (vault *Vault) UseClock(clock Clock) {
+	vault.clock = clock
 }
 
 // CreateSecret create new secret to PrivX Vault
@@ -71,18 +98,18 @@ func (vault *Vault) CreateUserSecret(
 ) error {
 	req := vault.mkVaultReq(allowReadBy, allowWriteBy, secret)
 	req.Name = secretID.Name
-	req.OwnerID = url.PathEscape(secretID.OwnerID)
+	req.OwnerID = secretID.OwnerID
 
 	_, err := vault.api.
-		URL("/vault/api/v1/user/%s/secrets", req.OwnerID).
+		URL("/vault/api/v1/user/%s/secrets", url.PathEscape(secretID.OwnerID)).
 		Post(req)
 
 	return err
 }
 
-// Secrets returns secrets client has access to
-func (vault *Vault) Secrets(offset, limit int) ([]Secret, error) {
-	result := secretResult{}
+// Secrets returns metadata of secrets client has access to
+func (vault *Vault) Secrets(offset, limit int) ([]SecretMetadata, error) {
+	result := secretMetadataResult{}
 	filters := Params{
 		Offset: offset,
 		Limit:  limit,
@@ -96,6 +123,25 @@ func (vault *Vault) Secrets(offset, limit int) ([]Secret, error) {
 	return result.Items, err
 }
 
+// AllSecrets iterates over metadata of all secrets client has access to,
+// the list endpoint does not return secret data
+func (vault *Vault) AllSecrets() *common.Pager[SecretMetadata] {
+	return common.NewPager(100, func(offset, limit int) ([]SecretMetadata, int, error) {
+		result := secretMetadataResult{}
+		filters := Params{
+			Offset: offset,
+			Limit:  limit,
+		}
+
+		header, err := vault.api.
+			URL("/vault/api/v1/secrets").
+			Query(&filters).
+			Get(&result)
+
+		return result.Items, restapi.TotalCount(header, result.Count), err
+	})
+}
+
 // UserSecrets returns user secrets client has access to
 func (vault *Vault) UserSecrets(secretID SecretID, offset, limit int) ([]Secret, error) {
 	result := secretResult{}
@@ -142,12 +188,108 @@ func (vault *Vault) UpdateSecret(
 	req := vault.mkVaultReq(allowReadTo, allowWriteTo, secret)
 
 	_, err := vault.api.
-		URL("/vault/api/v1/secrets/%s", name).
+		URL("/vault/api/v1/secrets/%s", url.PathEscape(name)).
 		Put(req)
 
 	return err
 }
 
+// UpdateSecretIfUnchanged updates the secret only if it was not modified
+// after expectedUpdated, *ConflictError is returned otherwise. The write is
+// conditional on ETag of the secret. If vault does not return ETag, the
+// update time is checked before the write only, modification made between
+// the check and the write is not detected.
+func (vault *Vault) UpdateSecretIfUnchanged(name string, expectedUpdated time.Time, secret Secret) error {
+	current, etag, err := vault.readSecret(name)
+	if err != nil {
+		return err
+	}
+
+	updated, err := parseTime(current.Updated)
+	if err != nil {
+		return fmt.Errorf("secret %s: %w", name, err)
+	}
+	if !updated.Equal(expectedUpdated) {
+		return &ConflictError{Name: name, Expected: expectedUpdated, Actual: updated}
+	}
+
+	req := tVaultReq{
+		Data:       secret.Data,
+		AllowRead:  secret.AllowRead,
+		AllowWrite: secret.AllowWrite,
+	}
+
+	curl := vault.api.URL("/vault/api/v1/secrets/%s", url.PathEscape(name))
+	if etag != "" {
+		curl = curl.Header("If-Match", etag)
+	}
+
+	_, err = curl.Put(req)
+	if errors.Is(err, restapi.ErrPreconditionFailed) {
+		return &ConflictError{Name: name, Expected: expectedUpdated}
+	}
+
+	return err
+}
+
+// UpdateSecretWith applies read-modify-write cycle to the secret, the cycle
+// is repeated few times if the secret is modified concurrently
+func (vault *Vault) UpdateSecretWith(name string, update func(old Secret) (Secret, error)) error {
+	var err error
+
+	for i := 0; i < updateAttempts; i++ {
+		var current *Secret
+		current, err = vault.Secret(name)
+		if err != nil {
+			return err
+		}
+
+		var secret Secret
+		secret, err = update(*current)
+		if err != nil {
+			return err
+		}
+
+		var updated time.Time
+		updated, err = parseTime(current.Updated)
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", name, err)
+		}
+
+		err = vault.UpdateSecretIfUnchanged(name, updated, secret)
+		if !errors.Is(err, restapi.ErrConflict) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (vault *Vault) readSecret(name string) (*Secret, string, error) {
+	bag := &Secret{}
+	head, err := vault.api.
+		URL("/vault/api/v1/secrets/%s", url.PathEscape(name)).
+		Get(bag)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return bag, head.Get("ETag"), nil
+}
+
+// parseTime parses update time of the secret, empty time is zero
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid update time %q", s)
+	}
+	return t, nil
+}
+
 // UpdateUserSecret existing secret at PrivX Vault
 func (vault *Vault) UpdateUserSecret(
 	secretID SecretID,
@@ -156,10 +298,11 @@ func (vault *Vault) UpdateUserSecret(
 	secret interface{},
 ) error {
 	req := vault.mkVaultReq(allowReadTo, allowWriteTo, secret)
-	req.Name = url.PathEscape(secretID.Name)
-	req.OwnerID = url.PathEscape(secretID.OwnerID)
+	req.Name = secretID.Name
+	req.OwnerID = secretID.OwnerID
 	_, err := vault.api.
-		URL("/vault/api/v1/user/%s/secrets/%s", req.OwnerID, req.Name).
+		URL("/vault/api/v1/user/%s/secrets/%s",
+			url.PathEscape(secretID.OwnerID), url.PathEscape(secretID.Name)).
 		Put(req)
 
 	return err
@@ -168,7 +311,7 @@ func (vault *Vault) UpdateUserSecret(
 // DeleteSecret delete existing secret from PrivX vault
 func (vault *Vault) DeleteSecret(name string) error {
 	_, err := vault.api.
-		URL("/vault/api/v1/secrets/%s", name).
+		URL("/vault/api/v1/secrets/%s", url.PathEscape(name)).
 		Delete()
 
 	return err
@@ -197,6 +340,59 @@ func (vault *Vault) SecretMetadata(name string) (*Secret, error) {
 	return metadata, err
 }
 
+// SecretMetadataOnly returns secret metadata. It uses the metadata
+// endpoint, which never serves the data, and decodes the response into
+// SecretMetadata, so data is dropped even if the server includes it.
+func (vault *Vault) SecretMetadataOnly(name string) (*SecretMetadata, error) {
+	metadata := &SecretMetadata{}
+
+	_, err := vault.api.
+		URL("/vault/api/v1/metadata/secrets/%s", url.PathEscape(name)).
+		Get(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// CanReadSecret checks if the client can read the secret, only metadata of
+// the secret is fetched. Missing secret is reported as restapi.ErrNotFound.
+func (vault *Vault) CanReadSecret(name string) (bool, error) {
+	_, err := vault.SecretMetadata(name)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, restapi.ErrForbidden):
+		return false, nil
+	}
+
+	return false, fmt.Errorf("secret %s: %w", name, err)
+}
+
+// CheckSecretAccess checks read access to the secrets concurrently. Secrets
+// which access cannot be determined are omitted from the result, their
+// errors are joined to the returned error.
+func (vault *Vault) CheckSecretAccess(names []string) (map[string]bool, error) {
+	var mu sync.Mutex
+	access := map[string]bool{}
+
+	_, err := common.ParallelDo(names, accessCheckConcurrency, func(name string) error {
+		ok, err := vault.CanReadSecret(name)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		access[name] = ok
+
+		return nil
+	})
+
+	return access, err
+}
+
 // SecretMetadata returns secret metadata
 func (vault *Vault) UserSecretMetadata(secretID SecretID) (*Secret, error) {
 	metadata := &Secret{}
@@ -256,6 +452,340 @@ func (vault *Vault) VaultSchemas() (*json.RawMessage, error) {
 	return schemas, err
 }
 
+// SecretSchemas returns JSON schemas of well-known secret layouts ordered
+// by name, the schema documents are preserved byte-for-byte
+func (vault *Vault) SecretSchemas() ([]Schema, error) {
+	schemas := map[string]json.RawMessage{}
+
+	_, err := vault.api.
+		URL("/vault/api/v1/schemas").
+		Get(&schemas)
+	if err != nil {
+		return nil, err
+	}
+
+	seq := make([]Schema, 0, len(schemas))
+	for name, schema := range schemas {
+		seq = append(seq, Schema{Name: name, Schema: schema})
+	}
+	sort.Slice(seq, func(i, j int) bool { return seq[i].Name < seq[j].Name })
+
+	return seq, nil
+}
+
+// WatchSecret polls metadata of the secret every interval, jittered by
+// up to 10%, and calls onChange with the secret when it is updated. The
+// current secret is delivered first. Failures are retried with exponential
+// backoff, except auth failures and missing secret which stop watching.
+// It returns nil when the context is cancelled.
+func (vault *Vault) WatchSecret(
+	ctx context.Context,
+	name string,
+	interval time.Duration,
+	onChange func(Secret),
+) error {
+	const maxBackoff = 16
+
+	var (
+		updated string
+		backoff = 1
+	)
+
+	for {
+		metadata, err := vault.SecretMetadata(name)
+		if err == nil && metadata.Updated != updated {
+			var secret *Secret
+			if secret, err = vault.Secret(name); err == nil {
+				updated = metadata.Updated
+				onChange(*secret)
+			}
+		}
+
+		switch {
+		case errors.Is(err, restapi.ErrUnauthorized),
+			errors.Is(err, restapi.ErrForbidden),
+			errors.Is(err, restapi.ErrNotFound):
+			return fmt.Errorf("watch secret %s: %w", name, err)
+		case err != nil:
+			if backoff < maxBackoff {
+				backoff *= 2
+			}
+		default:
+			backoff = 1
+		}
+
+		delay := time.Duration(backoff) * interval
+		delay += time.Duration(rand.Int63n(int64(delay)/10 + 1))
+
+		select {
+		case <-vault.clock.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// RenameSecret renames the secret preserving its data and roles. The new
+// secret is created and verified before the old one is deleted, failures
+// after the creation are reported with *RenameError.
+func (vault *Vault) RenameSecret(oldName, newName string) error {
+	if oldName == newName {
+		return fmt.Errorf("secret %s cannot be renamed to itself", oldName)
+	}
+	if newName == "" {
+		return errors.New("new name of the secret is not defined")
+	}
+
+	secret, err := vault.Secret(oldName)
+	if err != nil {
+		return err
+	}
+
+	req := tVaultReq{
+		Name:       newName,
+		Data:       secret.Data,
+		AllowRead:  secret.AllowRead,
+		AllowWrite: secret.AllowWrite,
+	}
+	_, err = vault.api.
+		URL("/vault/api/v1/secrets").
+		Post(req)
+	if err != nil {
+		return err
+	}
+
+	created, err := vault.Secret(newName)
+	if err == nil && !bytes.Equal(compactJSON(created.Data), compactJSON(secret.Data)) {
+		err = errors.New("data of the new secret does not match")
+	}
+	if err != nil {
+		return &RenameError{OldName: oldName, NewName: newName, Err: err}
+	}
+
+	if err = vault.DeleteSecret(oldName); err != nil {
+		return &RenameError{OldName: oldName, NewName: newName, Err: err}
+	}
+
+	return nil
+}
+
+func compactJSON(data json.RawMessage) []byte {
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, data); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// ExportSecrets writes secrets matching the filter (see SearchSecrets) as
+// JSON lines, each line is the secret with its data. Secrets are streamed
+// page by page.
+func (vault *Vault) ExportSecrets(w io.Writer, filter string) error {
+	if err := validateFilter(filter); err != nil {
+		return err
+	}
+
+	secrets := common.NewPager(100, func(offset, limit int) ([]Secret, int, error) {
+		result := secretResult{}
+		filters := Params{Offset: offset, Limit: limit, Sortkey: "name"}
+
+		header, err := vault.api.
+			URL("/vault/api/v1/search/secrets").
+			Query(&filters).
+			Post(SecretSearchRequest{Filter: filter}, &result)
+
+		return result.Items, restapi.TotalCount(header, result.Count), err
+	})
+
+	encoder := json.NewEncoder(w)
+	for secrets.Next() {
+		secret, err := vault.Secret(secrets.Value().ID)
+		if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(secret); err != nil {
+			return err
+		}
+	}
+
+	return secrets.Err()
+}
+
+// ImportSecrets reads secrets written by ExportSecrets and creates them.
+// Failure of a secret is recorded in the report, the import continues
+// with next one. Malformed input stops the import.
+func (vault *Vault) ImportSecrets(r io.Reader, opts ImportOptions) (ImportReport, error) {
+	report := ImportReport{
+		Created: []string{},
+		Updated: []string{},
+		Skipped: []string{},
+		Failed:  map[string]error{},
+	}
+
+	total := 0
+	decoder := json.NewDecoder(r)
+	for {
+		var secret Secret
+		err := decoder.Decode(&secret)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("invalid import: %w", err)
+		}
+		total++
+
+		created, updated, err := vault.importSecret(secret, opts)
+		switch {
+		case err != nil:
+			report.Failed[secret.ID] = err
+		case created:
+			report.Created = append(report.Created, secret.ID)
+		case updated:
+			report.Updated = append(report.Updated, secret.ID)
+		default:
+			report.Skipped = append(report.Skipped, secret.ID)
+		}
+	}
+
+	if len(report.Failed) > 0 {
+		return report, fmt.Errorf("%d of %d secrets failed to import", len(report.Failed), total)
+	}
+
+	return report, nil
+}
+
+// importSecret creates the secret or resolves collision with existing one
+func (vault *Vault) importSecret(secret Secret, opts ImportOptions) (bool, bool, error) {
+	remap := func(roles []rolestore.RoleRef) ([]rolestore.RoleRef, error) {
+		if opts.RemapRole == nil {
+			return roles, nil
+		}
+
+		seq := make([]rolestore.RoleRef, 0, len(roles))
+		for _, role := range roles {
+			mapped, err := opts.RemapRole(role)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, mapped)
+		}
+		return seq, nil
+	}
+
+	var err error
+	req := tVaultReq{Name: secret.ID, Data: secret.Data}
+	if req.AllowRead, err = remap(secret.AllowRead); err != nil {
+		return false, false, err
+	}
+	if req.AllowWrite, err = remap(secret.AllowWrite); err != nil {
+		return false, false, err
+	}
+
+	_, err = vault.api.
+		URL("/vault/api/v1/secrets").
+		Post(req)
+	if !errors.Is(err, restapi.ErrConflict) {
+		return err == nil, false, err
+	}
+
+	switch opts.OnCollision {
+	case CollisionSkip:
+		return false, false, nil
+	case CollisionOverwrite:
+		req.Name = ""
+		_, err = vault.api.
+			URL("/vault/api/v1/secrets/%s", url.PathEscape(secret.ID)).
+			Put(req)
+		return false, err == nil, err
+	}
+
+	return false, false, fmt.Errorf("secret %s already exists", secret.ID)
+}
+
+// DecodeOption configures decoding of secret data
+type DecodeOption func(*json.Decoder)
+
+// DisallowUnknownFields fails decoding of secret data if it contains
+// fields unknown to the target struct
+func DisallowUnknownFields() DecodeOption {
+	return func(decoder *json.Decoder) {
+		decoder.DisallowUnknownFields()
+	}
+}
+
+// GetSecretData reads the secret and decodes its data
+func GetSecretData[T any](vault *Vault, name string, opts ...DecodeOption) (T, error) {
+	var data T
+
+	secret, err := vault.Secret(name)
+	if err != nil {
+		return data, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(secret.Data))
+	for _, opt := range opts {
+		opt(decoder)
+	}
+
+	if err := decoder.Decode(&data); err != nil {
+		return data, fmt.Errorf("secret %s: invalid data: %w", name, err)
+	}
+
+	return data, nil
+}
+
+// PutSecretData updates the secret data, the secret is created if it
+// does not exist
+func PutSecretData[T any](
+	vault *Vault,
+	name string,
+	data T,
+	readRoles []rolestore.RoleRef,
+	writeRoles []rolestore.RoleRef,
+) error {
+	req := tVaultReq{
+		Data:       data,
+		AllowRead:  readRoles,
+		AllowWrite: writeRoles,
+	}
+
+	_, err := vault.api.
+		URL("/vault/api/v1/secrets/%s", url.PathEscape(name)).
+		Put(req)
+	if !errors.Is(err, restapi.ErrNotFound) {
+		return err
+	}
+
+	req.Name = name
+	_, err = vault.api.
+		URL("/vault/api/v1/secrets").
+		Post(req)
+
+	return err
+}
+
+// Credentials reads the secret of common username/password shape
+func (vault *Vault) Credentials(name string) (*Credentials, error) {
+	data, err := GetSecretData[Credentials](vault, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+// PutCredentials stores username/password secret
+func (vault *Vault) PutCredentials(
+	name string,
+	credentials Credentials,
+	readRoles []rolestore.RoleRef,
+	writeRoles []rolestore.RoleRef,
+) error {
+	return PutSecretData(vault, name, credentials, readRoles, writeRoles)
+}
+
 func (vault *Vault) mkVaultReq(
 	allowReadBy []string,
 	allowWriteBy []string,
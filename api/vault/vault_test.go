@@ -0,0 +1,1085 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package vault_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/rolestore"
+	"github.com/SSHcom/privx-sdk-go/api/vault"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+// mockVault keeps secrets in memory, names are taken from escaped path
+type mockVault struct {
+	sync.Mutex
+	secrets    map[string]vault.Secret
+	failDelete bool
+}
+
+func (mock *mockVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.Lock()
+	defer mock.Unlock()
+
+	const prefix = "/vault/api/v1/secrets"
+	path := r.URL.EscapedPath()
+	if path == "/vault/api/v1/search/secrets" {
+		mock.search(w, r)
+		return
+	}
+	if !strings.HasPrefix(path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// the name must be a single escaped path segment
+	segment := strings.TrimPrefix(strings.TrimPrefix(path, prefix), "/")
+	name, err := url.PathUnescape(segment)
+	if err != nil || strings.Contains(segment, "/") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		secret := vault.Secret{}
+		json.NewDecoder(r.Body).Decode(&secret)
+		if _, ok := mock.secrets[secret.ID]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		secret.Author = "alice"
+		mock.secrets[secret.ID] = secret
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		secret, ok := mock.secrets[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(secret)
+	case http.MethodPut:
+		if _, ok := mock.secrets[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		secret := vault.Secret{}
+		json.NewDecoder(r.Body).Decode(&secret)
+		secret.ID = name
+		secret.Author = mock.secrets[name].Author
+		secret.Editor = "bob"
+		mock.secrets[name] = secret
+	case http.MethodDelete:
+		if mock.failDelete {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		delete(mock.secrets, name)
+	}
+}
+
+// search lists metadata of secrets ordered by name
+func (mock *mockVault) search(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	names := []string{}
+	for name := range mock.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := []vault.Secret{}
+	for i := offset; i < offset+limit && i < len(names); i++ {
+		secret := mock.secrets[names[i]]
+		secret.Data = nil
+		items = append(items, secret)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"count": len(names), "items": items})
+}
+
+func TestSecretRoundTrip(t *testing.T) {
+	mock := &mockVault{secrets: map[string]vault.Secret{}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+	name := "pipelines/deploy/db"
+
+	data := map[string]interface{}{
+		"database": map[string]interface{}{
+			"hosts":    []interface{}{"db1", "db2"},
+			"password": "secret",
+			"port":     5432.0,
+		},
+	}
+	err := client.CreateSecret(name, []string{"r1"}, []string{"r2"}, data)
+	if err != nil {
+		t.Fatalf("create secret fails: %v", err)
+	}
+
+	secret, err := client.Secret(name)
+	if err != nil {
+		t.Fatalf("read secret fails: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	json.Unmarshal(secret.Data, &decoded)
+	if !reflect.DeepEqual(decoded, data) {
+		t.Errorf("unexpected data: %s", secret.Data)
+	}
+	if secret.ID != name || secret.Author != "alice" ||
+		!reflect.DeepEqual(secret.AllowRead, []rolestore.RoleRef{{ID: "r1"}}) ||
+		!reflect.DeepEqual(secret.AllowWrite, []rolestore.RoleRef{{ID: "r2"}}) {
+		t.Errorf("unexpected secret: %+v", secret)
+	}
+
+	data["database"].(map[string]interface{})["password"] = "rotated"
+	err = client.UpdateSecret(name, []string{"r1"}, []string{"r2"}, data)
+	if err != nil {
+		t.Fatalf("update secret fails: %v", err)
+	}
+
+	secret, err = client.Secret(name)
+	if err != nil {
+		t.Fatalf("read secret fails: %v", err)
+	}
+	json.Unmarshal(secret.Data, &decoded)
+	if !reflect.DeepEqual(decoded, data) || secret.Editor != "bob" {
+		t.Errorf("unexpected secret: %+v", secret)
+	}
+
+	if err = client.DeleteSecret(name); err != nil {
+		t.Fatalf("delete secret fails: %v", err)
+	}
+	if _, ok := mock.secrets[name]; ok {
+		t.Errorf("secret is not deleted")
+	}
+}
+
+// mockSecrets lists n secrets without data
+func mockSecrets(n int) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+			items := []vault.Secret{}
+			for i := offset; i < offset+limit && i < n; i++ {
+				items = append(items, vault.Secret{
+					ID:         fmt.Sprintf("secret-%d", i),
+					Author:     "alice",
+					Created:    "2021-03-01T10:20:30Z",
+					AllowRead:  []rolestore.RoleRef{{ID: "r1", Name: "readers"}},
+					AllowWrite: []rolestore.RoleRef{{ID: "r2", Name: "writers"}},
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"count": n,
+				"items": items,
+			})
+		}),
+	)
+}
+
+func TestAllSecrets(t *testing.T) {
+	ts := mockSecrets(250)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	secrets, err := client.AllSecrets().All()
+	if err != nil {
+		t.Fatalf("list secrets fails: %v", err)
+	}
+	if len(secrets) != 250 || secrets[249].ID != "secret-249" {
+		t.Errorf("unexpected secrets: %d", len(secrets))
+	}
+
+	secret := secrets[123]
+	if secret.Author != "alice" ||
+		!reflect.DeepEqual(secret.AllowRead, []rolestore.RoleRef{{ID: "r1", Name: "readers"}}) ||
+		!reflect.DeepEqual(secret.AllowWrite, []rolestore.RoleRef{{ID: "r2", Name: "writers"}}) {
+		t.Errorf("unexpected metadata: %+v", secret)
+	}
+}
+
+func TestAllSecretsEmpty(t *testing.T) {
+	ts := mockSecrets(0)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	iter := client.AllSecrets()
+	if iter.Next() {
+		t.Errorf("unexpected secret: %+v", iter.Value())
+	}
+	if iter.Err() != nil || iter.TotalCount() != 0 {
+		t.Errorf("unexpected result: %v, %d", iter.Err(), iter.TotalCount())
+	}
+}
+
+func TestSearchSecrets(t *testing.T) {
+	requests := []map[string]interface{}{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/vault/api/v1/search/secrets" || r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.URL.Query().Get("offset") != "10" || r.URL.Query().Get("limit") != "5" {
+				t.Errorf("unexpected query: %s", r.URL.RawQuery)
+			}
+
+			body := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&body)
+			requests = append(requests, body)
+
+			w.Write([]byte(`{
+				"count": 1,
+				"items": [{
+					"name": "db/password",
+					"author": "alice",
+					"created": "2021-03-01T10:20:30Z",
+					"read_roles": [{"id": "r1", "name": "readers"}]
+				}]
+			}`))
+		}),
+	)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	secrets, err := client.SearchSecrets(10, 5, "", "",
+		vault.SecretSearchRequest{Keywords: "db", Filter: "readable"})
+	if err != nil {
+		t.Fatalf("search fails: %v", err)
+	}
+
+	expect := []vault.Secret{{
+		ID:        "db/password",
+		Author:    "alice",
+		Created:   "2021-03-01T10:20:30Z",
+		AllowRead: []rolestore.RoleRef{{ID: "r1", Name: "readers"}},
+	}}
+	if !reflect.DeepEqual(secrets, expect) {
+		t.Errorf("unexpected secrets: %+v", secrets)
+	}
+
+	// empty keywords lists all secrets
+	_, err = client.SearchSecrets(10, 5, "", "", vault.SecretSearchRequest{})
+	if err != nil {
+		t.Fatalf("search fails: %v", err)
+	}
+
+	if len(requests) != 2 ||
+		requests[0]["keywords"] != "db" || requests[0]["filter"] != "readable" ||
+		requests[1]["keywords"] != "" || requests[1]["filter"] != "" {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+
+	_, err = client.SearchSecrets(0, 5, "", "", vault.SecretSearchRequest{Filter: "unknown"})
+	if err == nil {
+		t.Errorf("invalid filter is accepted")
+	}
+}
+
+// mockUserVault keeps personal secrets of a single owner, other owners
+// are forbidden
+type mockUserVault struct {
+	sync.Mutex
+	owner   string
+	secrets map[string]vault.Secret
+	bodies  []map[string]interface{}
+}
+
+func (mock *mockUserVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.Lock()
+	defer mock.Unlock()
+
+	// /vault/api/v1/user/{owner}/secrets[/{name}]
+	path := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/vault/api/v1/user/"), "/")
+	if len(path) < 2 || len(path) > 3 || path[1] != "secrets" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	owner, _ := url.PathUnescape(path[0])
+	if owner != mock.owner {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error_code": "FORBIDDEN"}`))
+		return
+	}
+
+	name := ""
+	if len(path) == 3 {
+		name, _ = url.PathUnescape(path[2])
+	}
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		items := []vault.Secret{}
+		for _, secret := range mock.secrets {
+			secret.Data = nil
+			items = append(items, secret)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": len(items), "items": items})
+	case r.Method == http.MethodGet:
+		secret, ok := mock.secrets[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(secret)
+	case r.Method == http.MethodPost || r.Method == http.MethodPut:
+		raw, _ := io.ReadAll(r.Body)
+		body := map[string]interface{}{}
+		json.Unmarshal(raw, &body)
+		mock.bodies = append(mock.bodies, body)
+
+		secret := vault.Secret{}
+		json.Unmarshal(raw, &secret)
+		if name != "" {
+			secret.ID = name
+		}
+		mock.secrets[secret.ID] = secret
+	case r.Method == http.MethodDelete:
+		delete(mock.secrets, name)
+	}
+}
+
+func TestUserSecretRoundTrip(t *testing.T) {
+	mock := &mockUserVault{owner: "user/1", secrets: map[string]vault.Secret{}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+	id := vault.SecretID{OwnerID: "user/1", Name: "ssh/key"}
+
+	data := map[string]interface{}{
+		"key": map[string]interface{}{"type": "ed25519", "tags": []interface{}{"a", "b"}},
+	}
+	if err := client.CreateUserSecret(id, nil, nil, data); err != nil {
+		t.Fatalf("create secret fails: %v", err)
+	}
+
+	secret, err := client.UserSecret(id)
+	if err != nil {
+		t.Fatalf("read secret fails: %v", err)
+	}
+	var decoded map[string]interface{}
+	json.Unmarshal(secret.Data, &decoded)
+	if secret.ID != "ssh/key" || !reflect.DeepEqual(decoded, data) {
+		t.Errorf("unexpected secret: %+v", secret)
+	}
+
+	secrets, err := client.UserSecrets(id, 0, 10)
+	if err != nil || len(secrets) != 1 || secrets[0].ID != "ssh/key" {
+		t.Errorf("unexpected secrets: %+v, %v", secrets, err)
+	}
+
+	data["key"].(map[string]interface{})["type"] = "rsa"
+	if err = client.UpdateUserSecret(id, nil, nil, data); err != nil {
+		t.Fatalf("update secret fails: %v", err)
+	}
+	secret, _ = client.UserSecret(id)
+	json.Unmarshal(secret.Data, &decoded)
+	if !reflect.DeepEqual(decoded, data) {
+		t.Errorf("secret is not updated: %s", secret.Data)
+	}
+
+	for _, body := range mock.bodies {
+		if body["name"] != "ssh/key" || body["owner_id"] != "user/1" {
+			t.Errorf("ids are escaped in request body: %v", body)
+		}
+	}
+
+	if err = client.DeleteUserSecret(id); err != nil {
+		t.Fatalf("delete secret fails: %v", err)
+	}
+	if len(mock.secrets) != 0 {
+		t.Errorf("secret is not deleted")
+	}
+}
+
+func TestUserSecretForbidden(t *testing.T) {
+	mock := &mockUserVault{owner: "user/1", secrets: map[string]vault.Secret{}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	_, err := client.UserSecret(vault.SecretID{OwnerID: "user/2", Name: "ssh/key"})
+	if !errors.Is(err, restapi.ErrForbidden) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type dbSecret struct {
+	Host  string   `json:"host"`
+	Port  int      `json:"port"`
+	Users []string `json:"users"`
+}
+
+func TestSecretDataStruct(t *testing.T) {
+	mock := &mockVault{secrets: map[string]vault.Secret{}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+	readers := []rolestore.RoleRef{{ID: "r1"}}
+
+	data := dbSecret{Host: "db1", Port: 5432, Users: []string{"app"}}
+	if err := vault.PutSecretData(client, "db/app", data, readers, nil); err != nil {
+		t.Fatalf("put fails: %v", err)
+	}
+
+	data.Port = 5433
+	if err := vault.PutSecretData(client, "db/app", data, readers, nil); err != nil {
+		t.Fatalf("put fails: %v", err)
+	}
+
+	stored, err := vault.GetSecretData[dbSecret](client, "db/app", vault.DisallowUnknownFields())
+	if err != nil {
+		t.Fatalf("get fails: %v", err)
+	}
+	if !reflect.DeepEqual(stored, data) {
+		t.Errorf("unexpected data: %+v", stored)
+	}
+	if !reflect.DeepEqual(mock.secrets["db/app"].AllowRead, readers) {
+		t.Errorf("unexpected roles: %+v", mock.secrets["db/app"])
+	}
+}
+
+func TestSecretDataMap(t *testing.T) {
+	mock := &mockVault{secrets: map[string]vault.Secret{}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	err := client.PutCredentials("ldap", vault.Credentials{Username: "bind", Password: "secret"}, nil, nil)
+	if err != nil {
+		t.Fatalf("put fails: %v", err)
+	}
+
+	data, err := vault.GetSecretData[map[string]string](client, "ldap")
+	if err != nil {
+		t.Fatalf("get fails: %v", err)
+	}
+	if !reflect.DeepEqual(data, map[string]string{"username": "bind", "password": "secret"}) {
+		t.Errorf("unexpected data: %v", data)
+	}
+
+	credentials, err := client.Credentials("ldap")
+	if err != nil || credentials.Username != "bind" || credentials.Password != "secret" {
+		t.Errorf("unexpected credentials: %+v, %v", credentials, err)
+	}
+}
+
+func TestSecretDataDecodeFailure(t *testing.T) {
+	mock := &mockVault{secrets: map[string]vault.Secret{
+		"db/app": {ID: "db/app", Data: json.RawMessage(`{"host": "db1", "port": 5432, "tls": true}`)},
+		"broken": {ID: "broken", Data: json.RawMessage(`{"host": 1}`)},
+	}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if _, err := vault.GetSecretData[dbSecret](client, "db/app"); err != nil {
+		t.Errorf("unknown fields are not ignored by default: %v", err)
+	}
+
+	if _, err := vault.GetSecretData[dbSecret](client, "db/app", vault.DisallowUnknownFields()); err == nil {
+		t.Errorf("unknown fields are accepted")
+	}
+
+	if _, err := vault.GetSecretData[dbSecret](client, "broken"); err == nil {
+		t.Errorf("invalid data is accepted")
+	}
+}
+
+func TestSecretSchemas(t *testing.T) {
+	fixture, err := os.ReadFile(filepath.Join("testdata", "schemas.json"))
+	if err != nil {
+		t.Fatalf("fixture: %v", err)
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/vault/api/v1/schemas" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(fixture)
+		}),
+	)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	schemas, err := client.SecretSchemas()
+	if err != nil {
+		t.Fatalf("schemas fails: %v", err)
+	}
+	if len(schemas) != 2 || schemas[0].Name != "api_key" || schemas[1].Name != "password" {
+		t.Fatalf("unexpected schemas: %+v", schemas)
+	}
+
+	for _, schema := range schemas {
+		if !bytes.Contains(fixture, schema.Schema) {
+			t.Errorf("schema %s is not preserved: %s", schema.Name, schema.Schema)
+		}
+	}
+}
+
+// mockVersioned keeps single secret, the version is exposed as ETag and
+// updated timestamp
+type mockVersioned struct {
+	sync.Mutex
+	data    json.RawMessage
+	version int
+	puts    int
+	// onGet emulates concurrent modification after the secret is read
+	onGet func(*mockVersioned)
+}
+
+func (mock *mockVersioned) updated() time.Time {
+	return time.Date(2021, 3, 1, 10, 0, mock.version, 0, time.UTC)
+}
+
+func (mock *mockVersioned) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.Lock()
+	defer mock.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, mock.version))
+		json.NewEncoder(w).Encode(vault.Secret{
+			ID:      "db",
+			Updated: mock.updated().Format(time.RFC3339),
+			Data:    mock.data,
+		})
+		if mock.onGet != nil {
+			mock.onGet(mock)
+		}
+	case http.MethodPut:
+		mock.puts++
+		if r.Header.Get("If-Match") != fmt.Sprintf(`"%d"`, mock.version) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		secret := vault.Secret{}
+		json.NewDecoder(r.Body).Decode(&secret)
+		mock.data = secret.Data
+		mock.version++
+	}
+}
+
+// modify emulates single concurrent modification
+func (mock *mockVersioned) modify(mod *mockVersioned) {
+	mod.data = json.RawMessage(`{"password": "concurrent"}`)
+	mod.version++
+	mod.onGet = nil
+}
+
+func TestUpdateSecretIfUnchanged(t *testing.T) {
+	mock := &mockVersioned{data: json.RawMessage(`{"password": "old"}`)}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+	secret := vault.Secret{Data: json.RawMessage(`{"password": "new"}`)}
+
+	err := client.UpdateSecretIfUnchanged("db", mock.updated().Add(-time.Second), secret)
+	var conflict *vault.ConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, restapi.ErrConflict) {
+		t.Errorf("stale timestamp is accepted: %v", err)
+	}
+	if mock.puts != 0 {
+		t.Errorf("stale secret is written")
+	}
+
+	// the secret is modified between the check and the write
+	mock.onGet = mock.modify
+	err = client.UpdateSecretIfUnchanged("db", mock.updated(), secret)
+	if !errors.Is(err, restapi.ErrConflict) {
+		t.Errorf("concurrent modification is not detected: %v", err)
+	}
+	if string(mock.data) != `{"password": "concurrent"}` {
+		t.Errorf("concurrent modification is overwritten: %s", mock.data)
+	}
+
+	err = client.UpdateSecretIfUnchanged("db", mock.updated(), secret)
+	if err != nil {
+		t.Errorf("update fails: %v", err)
+	}
+	if string(mock.data) != `{"password":"new"}` {
+		t.Errorf("secret is not updated: %s", mock.data)
+	}
+}
+
+func TestUpdateSecretIfUnchangedInvalidTime(t *testing.T) {
+	puts := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut {
+				puts++
+				return
+			}
+			w.Write([]byte(`{"name": "db", "updated": "yesterday"}`))
+		}),
+	)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	err := client.UpdateSecretIfUnchanged("db", time.Time{}, vault.Secret{})
+	if err == nil || errors.Is(err, restapi.ErrConflict) {
+		t.Errorf("invalid update time is accepted: %v", err)
+	}
+	if puts != 0 {
+		t.Errorf("secret is written")
+	}
+}
+
+func TestUpdateSecretWith(t *testing.T) {
+	mock := &mockVersioned{data: json.RawMessage(`{"password": "old"}`)}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	mock.onGet = func(mod *mockVersioned) {
+		mod.onGet = mod.modify
+	}
+
+	seen := []string{}
+	err := client.UpdateSecretWith("db", func(old vault.Secret) (vault.Secret, error) {
+		seen = append(seen, string(old.Data))
+		old.Data = json.RawMessage(`{"password": "rotated"}`)
+		return old, nil
+	})
+	if err != nil {
+		t.Fatalf("update fails: %v", err)
+	}
+
+	if len(seen) != 2 || seen[1] != `{"password":"concurrent"}` {
+		t.Errorf("update is not repeated on fresh data: %v", seen)
+	}
+	if string(mock.data) != `{"password":"rotated"}` {
+		t.Errorf("secret is not updated: %s", mock.data)
+	}
+}
+
+func TestUpdateSecretWithExhausted(t *testing.T) {
+	mock := &mockVersioned{data: json.RawMessage(`{}`)}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	// every read is followed by concurrent modification
+	mock.onGet = func(mod *mockVersioned) { mod.version++ }
+
+	err := client.UpdateSecretWith("db", func(old vault.Secret) (vault.Secret, error) {
+		return old, nil
+	})
+	if !errors.Is(err, restapi.ErrConflict) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestExportImportSecrets(t *testing.T) {
+	staging := &mockVault{secrets: map[string]vault.Secret{}}
+	for i := 0; i < 150; i++ {
+		name := fmt.Sprintf("app/%03d", i)
+		staging.secrets[name] = vault.Secret{
+			ID:        name,
+			Data:      json.RawMessage(fmt.Sprintf(`{"n":%d,"nested":{"a":[1,2]}}`, i)),
+			AllowRead: []rolestore.RoleRef{{ID: "staging-readers", Name: "readers"}},
+		}
+	}
+	ts := httptest.NewServer(staging)
+	defer ts.Close()
+
+	buf := &bytes.Buffer{}
+	err := vault.New(restapi.New(restapi.BaseURL(ts.URL))).ExportSecrets(buf, "")
+	if err != nil {
+		t.Fatalf("export fails: %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 150 {
+		t.Fatalf("unexpected export: %d lines", lines)
+	}
+
+	prod := &mockVault{secrets: map[string]vault.Secret{
+		"app/000": {ID: "app/000", Data: json.RawMessage(`{"n":-1}`)},
+	}}
+	tp := httptest.NewServer(prod)
+	defer tp.Close()
+
+	report, err := vault.New(restapi.New(restapi.BaseURL(tp.URL))).ImportSecrets(buf,
+		vault.ImportOptions{
+			OnCollision: vault.CollisionSkip,
+			RemapRole: func(role rolestore.RoleRef) (rolestore.RoleRef, error) {
+				if role.ID != "staging-readers" {
+					return role, fmt.Errorf("unknown role %s", role.ID)
+				}
+				return rolestore.RoleRef{ID: "prod-readers", Name: role.Name}, nil
+			},
+		})
+	if err != nil {
+		t.Fatalf("import fails: %v", err)
+	}
+
+	if len(report.Created) != 149 || !reflect.DeepEqual(report.Skipped, []string{"app/000"}) {
+		t.Errorf("unexpected report: %d created, skipped %v", len(report.Created), report.Skipped)
+	}
+	if string(prod.secrets["app/000"].Data) != `{"n":-1}` {
+		t.Errorf("existing secret is overwritten")
+	}
+
+	secret := prod.secrets["app/042"]
+	if string(secret.Data) != `{"n":42,"nested":{"a":[1,2]}}` ||
+		!reflect.DeepEqual(secret.AllowRead, []rolestore.RoleRef{{ID: "prod-readers", Name: "readers"}}) {
+		t.Errorf("unexpected secret: %+v", secret)
+	}
+}
+
+func TestImportSecretsCollision(t *testing.T) {
+	input := `{"name":"db","data":{"password":"new"}}
+{"name":"api","data":{"key":"k"}}
+`
+	for policy, expect := range map[vault.CollisionPolicy]string{
+		vault.CollisionError:     `{"password":"old"}`,
+		vault.CollisionOverwrite: `{"password":"new"}`,
+	} {
+		mock := &mockVault{secrets: map[string]vault.Secret{
+			"db": {ID: "db", Data: json.RawMessage(`{"password":"old"}`)},
+		}}
+		ts := httptest.NewServer(mock)
+
+		report, err := vault.New(restapi.New(restapi.BaseURL(ts.URL))).
+			ImportSecrets(strings.NewReader(input), vault.ImportOptions{OnCollision: policy})
+
+		switch policy {
+		case vault.CollisionError:
+			if err == nil || report.Failed["db"] == nil || !reflect.DeepEqual(report.Created, []string{"api"}) {
+				t.Errorf("collision is not reported: %+v, %v", report, err)
+			}
+		case vault.CollisionOverwrite:
+			if err != nil || !reflect.DeepEqual(report.Updated, []string{"db"}) {
+				t.Errorf("unexpected report: %+v, %v", report, err)
+			}
+		}
+		if string(mock.secrets["db"].Data) != expect {
+			t.Errorf("unexpected secret: %s", mock.secrets["db"].Data)
+		}
+
+		ts.Close()
+	}
+
+	_, err := vault.New(restapi.New()).ImportSecrets(strings.NewReader("{broken"), vault.ImportOptions{})
+	if err == nil {
+		t.Errorf("malformed input is accepted")
+	}
+}
+
+func TestRenameSecret(t *testing.T) {
+	roles := []rolestore.RoleRef{{ID: "r1"}}
+	mock := &mockVault{secrets: map[string]vault.Secret{
+		"old/db": {ID: "old/db", Data: json.RawMessage(`{"password":"p"}`), AllowRead: roles},
+	}}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if err := client.RenameSecret("old/db", "old/db"); err == nil {
+		t.Errorf("rename to the same name is accepted")
+	}
+
+	if err := client.RenameSecret("old/db", "new/db"); err != nil {
+		t.Fatalf("rename fails: %v", err)
+	}
+
+	secret, ok := mock.secrets["new/db"]
+	if _, exists := mock.secrets["old/db"]; exists || !ok {
+		t.Errorf("secret is not renamed: %v", mock.secrets)
+	}
+	if string(secret.Data) != `{"password":"p"}` || !reflect.DeepEqual(secret.AllowRead, roles) {
+		t.Errorf("unexpected secret: %+v", secret)
+	}
+}
+
+func TestRenameSecretPartial(t *testing.T) {
+	mock := &mockVault{
+		secrets:    map[string]vault.Secret{"old/db": {ID: "old/db", Data: json.RawMessage(`{}`)}},
+		failDelete: true,
+	}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	err := client.RenameSecret("old/db", "new/db")
+
+	var partial *vault.RenameError
+	if !errors.As(err, &partial) || partial.OldName != "old/db" || partial.NewName != "new/db" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := mock.secrets["old/db"]; !ok {
+		t.Errorf("old secret is lost")
+	}
+	if _, ok := mock.secrets["new/db"]; !ok {
+		t.Errorf("new secret is lost")
+	}
+}
+
+func mockAccess() *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/vault/api/v1/metadata/secrets/"))
+			switch {
+			case strings.HasPrefix(name, "readable"):
+				w.Write([]byte(`{"name": "` + name + `", "read_roles": [{"id": "r1"}]}`))
+			case strings.HasPrefix(name, "forbidden"):
+				w.WriteHeader(http.StatusForbidden)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+}
+
+func TestCanReadSecret(t *testing.T) {
+	ts := mockAccess()
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	if ok, err := client.CanReadSecret("readable/db"); !ok || err != nil {
+		t.Errorf("readable secret: %v, %v", ok, err)
+	}
+
+	if ok, err := client.CanReadSecret("forbidden/db"); ok || err != nil {
+		t.Errorf("forbidden secret: %v, %v", ok, err)
+	}
+
+	if ok, err := client.CanReadSecret("missing/db"); ok || !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("missing secret: %v, %v", ok, err)
+	}
+}
+
+func TestCheckSecretAccess(t *testing.T) {
+	ts := mockAccess()
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	names := []string{"missing/1", "missing/2"}
+	expect := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		names = append(names, fmt.Sprintf("readable/%d", i), fmt.Sprintf("forbidden/%d", i))
+		expect[fmt.Sprintf("readable/%d", i)] = true
+		expect[fmt.Sprintf("forbidden/%d", i)] = false
+	}
+
+	access, err := client.CheckSecretAccess(names)
+	if !reflect.DeepEqual(access, expect) {
+		t.Errorf("unexpected access: %v", access)
+	}
+	if !errors.Is(err, restapi.ErrNotFound) ||
+		!strings.Contains(err.Error(), "missing/1") || !strings.Contains(err.Error(), "missing/2") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	access, err = client.CheckSecretAccess([]string{"readable/1"})
+	if err != nil || !access["readable/1"] {
+		t.Errorf("unexpected access: %v, %v", access, err)
+	}
+}
+
+// mockClock hands requested delays to the test, which fires them.
+// The current time is fixed.
+type mockClock struct {
+	now   time.Time
+	waits chan time.Duration
+	ticks chan time.Time
+}
+
+func (clock *mockClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *mockClock) After(d time.Duration) <-chan time.Time {
+	clock.waits <- d
+	return clock.ticks
+}
+
+// mockWatched serves metadata and data of single secret
+type mockWatched struct {
+	sync.Mutex
+	updated string
+	data    string
+	fail    bool
+	reads   int
+}
+
+func (mock *mockWatched) set(updated, data string, fail bool) {
+	mock.Lock()
+	defer mock.Unlock()
+	mock.updated, mock.data, mock.fail = updated, data, fail
+}
+
+func (mock *mockWatched) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mock.Lock()
+	defer mock.Unlock()
+
+	if mock.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/vault/api/v1/metadata/secrets/db":
+		w.Write([]byte(`{"name": "db", "updated": "` + mock.updated + `"}`))
+	case "/vault/api/v1/secrets/db":
+		mock.reads++
+		w.Write([]byte(`{"name": "db", "updated": "` + mock.updated + `", "data": ` + mock.data + `}`))
+	}
+}
+
+func TestWatchSecret(t *testing.T) {
+	mock := &mockWatched{updated: "2021-03-01T10:00:00Z", data: `{"v":1}`}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	clock := &mockClock{waits: make(chan time.Duration), ticks: make(chan time.Time)}
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+	client.UseClock(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- client.WatchSecret(ctx, "db", time.Second, func(secret vault.Secret) {
+			changes <- string(secret.Data)
+		})
+	}()
+
+	delays := []time.Duration{}
+	step := func(updated, data string, fail bool) {
+		delays = append(delays, <-clock.waits)
+		mock.set(updated, data, fail)
+		clock.ticks <- time.Now()
+	}
+
+	step("2021-03-01T10:00:00Z", `{"v":1}`, false) // unchanged
+	step("2021-03-01T10:05:00Z", `{"v":2}`, false) // changed
+	step("", "", true)                             // failure
+	step("", "", true)                             // failure
+	step("2021-03-01T10:05:00Z", `{"v":2}`, false) // recovered, unchanged
+	delays = append(delays, <-clock.waits)
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Errorf("watch is not stopped cleanly: %v", err)
+	}
+	close(changes)
+
+	seq := []string{}
+	for change := range changes {
+		seq = append(seq, change)
+	}
+	if !reflect.DeepEqual(seq, []string{`{"v":1}`, `{"v":2}`}) {
+		t.Errorf("unexpected changes: %v", seq)
+	}
+	if mock.reads != 2 {
+		t.Errorf("secret data is fetched without change: %d", mock.reads)
+	}
+
+	// base, base, base, 2x, 4x, base; jitter is up to 10%
+	expect := []time.Duration{1, 1, 1, 2, 4, 1}
+	for i, delay := range delays {
+		base := expect[i] * time.Second
+		if delay < base || delay > base+base/10 {
+			t.Errorf("unexpected delay #%d: %v", i, delay)
+		}
+	}
+}
+
+func TestWatchSecretDeleted(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}),
+	)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	err := client.WatchSecret(context.Background(), "db", time.Second, func(vault.Secret) {})
+	if !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSecretMetadataOnly(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.EscapedPath() != "/vault/api/v1/metadata/secrets/app%2Fdb" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{
+				"name": "app/db",
+				"updated": "2021-03-01T10:00:00Z",
+				"read_roles": [{"id": "r1", "name": "ops"}],
+				"data": {"password": "secret"}
+			}`))
+		}),
+	)
+	defer ts.Close()
+
+	client := vault.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	metadata, err := client.SecretMetadataOnly("app/db")
+	if err != nil {
+		t.Fatalf("metadata fails: %v", err)
+	}
+	if metadata.ID != "app/db" || metadata.Updated != "2021-03-01T10:00:00Z" || len(metadata.AllowRead) != 1 {
+		t.Errorf("unexpected metadata: %+v", metadata)
+	}
+
+	bytes, _ := json.Marshal(metadata)
+	if strings.Contains(string(bytes), "secret") {
+		t.Errorf("metadata carries data: %s", bytes)
+	}
+
+	if _, err := client.SecretMetadataOnly("missing"); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
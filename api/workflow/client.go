@@ -7,6 +7,8 @@
 package workflow
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
 
 	"github.com/SSHcom/privx-sdk-go/restapi"
@@ -76,7 +78,7 @@ func (store *Engine) Workflow(workflowID string) (*Workflow, error) {
 // DeleteWorkflow delete a workflow by ID
 func (store *Engine) DeleteWorkflow(workflowID string) error {
 	_, err := store.api.
-		URL("/workflow-engine/api/v1/workflows/%s", workflowID).
+		URL("/workflow-engine/api/v1/workflows/%s", url.PathEscape(workflowID)).
 		Delete()
 
 	return err
@@ -91,13 +93,14 @@ func (store *Engine) UpdateWorkflow(workflowID string, workflow *Workflow) error
 	return err
 }
 
-// Requests get the request queue for the user
-func (store *Engine) Requests(offset, limit int, filter string) ([]Request, error) {
+// Requests get the request queue for the user, filter is one of
+// RequestsAll, RequestsByMe or RequestsToMe
+func (store *Engine) Requests(offset, limit int, filter RequestFilter) ([]Request, error) {
 	result := requestsResult{}
 	filters := Params{
 		Offset: offset,
 		Limit:  limit,
-		Filter: filter,
+		Filter: string(filter),
 	}
 
 	_, err := store.api.
@@ -121,6 +124,36 @@ func (store *Engine) CreateRequest(request *Request) (string, error) {
 	return object.ID, err
 }
 
+// CreateAccessRequest files access request to the role and returns id of
+// the request. Missing justification required by the workflow is reported
+// as ErrJustificationRequired.
+func (store *Engine) CreateAccessRequest(input RequestInput) (string, error) {
+	request, err := input.request()
+	if err != nil {
+		return "", err
+	}
+
+	if request.TargetUser.ID == "" {
+		var user User
+		_, err := store.api.
+			URL("/role-store/api/v1/users/current").
+			Get(&user)
+		if err != nil {
+			return "", err
+		}
+		request.TargetUser.ID = user.ID
+	}
+
+	id, err := store.CreateRequest(request)
+
+	var apiErr *restapi.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode == errorJustificationRequired {
+		return "", fmt.Errorf("%w: %w", ErrJustificationRequired, err)
+	}
+
+	return id, err
+}
+
 // Request return a request object by ID.
 func (store *Engine) Request(requestID string) (*Request, error) {
 	request := &Request{}
@@ -159,6 +192,29 @@ func (store *Engine) MakeDecisionOnRequest(requestID string, request Decision) e
 	return err
 }
 
+// DecideRequest approves or rejects the step of request. Deciding request
+// of other approvers fails with restapi.ErrForbidden, deciding already
+// decided request with restapi.ErrConflict.
+func (store *Engine) DecideRequest(requestID string, decision Decision) error {
+	if decision.Decision != DecisionApprove && decision.Decision != DecisionReject {
+		return fmt.Errorf("unknown decision %q", decision.Decision)
+	}
+
+	err := store.MakeDecisionOnRequest(requestID, decision)
+
+	var apiErr *restapi.APIError
+	switch {
+	case errors.Is(err, restapi.ErrForbidden):
+		return fmt.Errorf("user is not approver of request %s: %w", requestID, err)
+	case errors.Is(err, restapi.ErrConflict):
+		return fmt.Errorf("request %s is already decided: %w", requestID, err)
+	case errors.As(err, &apiErr) && apiErr.ErrorCode == errorRequestDecided:
+		return fmt.Errorf("request %s is already decided: %w: %w", requestID, restapi.ErrConflict, err)
+	}
+
+	return err
+}
+
 // SearchRequests search access requests
 func (store *Engine) SearchRequests(
 	offset, limit int, sortdir, sortkey, filter string, searchObject *Search) ([]Request, error) {
@@ -179,6 +235,24 @@ func (store *Engine) SearchRequests(
 	return result.Items, err
 }
 
+// FindRequests searches access requests matching the typed filter
+func (store *Engine) FindRequests(params RequestSearchParams) ([]Request, error) {
+	result := requestsResult{}
+	filters := Params{
+		Offset:  params.Offset,
+		Limit:   params.Limit,
+		Sortkey: params.Sortkey,
+		Sortdir: params.Sortdir,
+	}
+
+	_, err := store.api.
+		URL("/workflow-engine/api/v1/requests/search").
+		Query(&filters).
+		Post(params.body(), &result)
+
+	return result.Items, err
+}
+
 // Settings get settings for the microservice
 func (store *Engine) Settings() (*Settings, error) {
 	settings := &Settings{}
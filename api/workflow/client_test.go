@@ -0,0 +1,425 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package workflow_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/api/workflow"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+const workflowsPath = "/workflow-engine/api/v1/workflows"
+
+// mockWorkflows keeps workflows in memory, they are stored as JSON as is
+func mockWorkflows() *httptest.Server {
+	var mu sync.Mutex
+	workflows := map[string]json.RawMessage{}
+	order := []string{}
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, workflowsPath), "/")
+
+			switch {
+			case r.Method == http.MethodPost && id == "":
+				var data json.RawMessage
+				json.NewDecoder(r.Body).Decode(&data)
+				id = "wf-" + string(rune('a'+len(order)))
+				workflows[id] = data
+				order = append(order, id)
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"id": "` + id + `"}`))
+			case r.Method == http.MethodGet && id == "":
+				items := []json.RawMessage{}
+				for _, id := range order {
+					if data, ok := workflows[id]; ok {
+						items = append(items, data)
+					}
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"count": len(items), "items": items})
+			case workflows[id] == nil:
+				w.WriteHeader(http.StatusNotFound)
+			case r.Method == http.MethodGet:
+				w.Write(workflows[id])
+			case r.Method == http.MethodPut:
+				var data json.RawMessage
+				json.NewDecoder(r.Body).Decode(&data)
+				workflows[id] = data
+			case r.Method == http.MethodDelete:
+				delete(workflows, id)
+			}
+		}),
+	)
+}
+
+func TestWorkflowRoundTrip(t *testing.T) {
+	ts := mockWorkflows()
+	defer ts.Close()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "workflow-two-step.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := workflow.Workflow{}
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	if len(fixture.Steps) != 2 || len(fixture.Steps[1].Approvers) != 2 ||
+		fixture.MaxTimeRestriction != 24 || !fixture.TimeRestrictionRequired {
+		t.Fatalf("unexpected fixture: %+v", fixture)
+	}
+
+	store := workflow.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	id, err := store.CreateWorkflow(&fixture)
+	if err != nil {
+		t.Fatalf("create fails: %v", err)
+	}
+
+	created, err := store.Workflow(id)
+	if err != nil || !reflect.DeepEqual(*created, fixture) {
+		t.Errorf("unexpected workflow: %+v, %v", created, err)
+	}
+
+	created.Steps[0].Approvers = append(created.Steps[0].Approvers,
+		workflow.StepApprover{Role: workflow.Role{ID: "r-ops", Name: "ops"}})
+	created.MaxTimeRestriction = 12
+	if err := store.UpdateWorkflow(id, created); err != nil {
+		t.Fatalf("update fails: %v", err)
+	}
+
+	workflows, err := store.Workflows(0, 10)
+	if err != nil || len(workflows) != 1 || !reflect.DeepEqual(workflows[0], *created) {
+		t.Errorf("unexpected workflows: %+v, %v", workflows, err)
+	}
+
+	if err := store.DeleteWorkflow(id); err != nil {
+		t.Fatalf("delete fails: %v", err)
+	}
+	if _, err := store.Workflow(id); !errors.Is(err, restapi.ErrNotFound) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDeleteWorkflowEscapesID(t *testing.T) {
+	var path string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.EscapedPath()
+		}),
+	)
+	defer ts.Close()
+
+	store := workflow.New(restapi.New(restapi.BaseURL(ts.URL)))
+	if err := store.DeleteWorkflow("a/b"); err != nil {
+		t.Fatalf("delete fails: %v", err)
+	}
+	if path != workflowsPath+"/a%2Fb" {
+		t.Errorf("unexpected path: %s", path)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	fixtures := map[string][]byte{}
+	for _, id := range []string{"pending", "approved", "rejected"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "request-"+id+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fixtures[id] = data
+	}
+
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := strings.TrimPrefix(r.URL.Path, "/workflow-engine/api/v1/requests")
+			switch {
+			case id == "" && r.URL.Query().Get("filter") == string(workflow.RequestsToMe):
+				fmt.Fprintf(w, `{"count": 1, "items": [%s]}`, fixtures["pending"])
+			case id == "":
+				fmt.Fprintf(w, `{"count": 3, "items": [%s, %s, %s]}`,
+					fixtures["pending"], fixtures["approved"], fixtures["rejected"])
+			case fixtures[id[1:]] != nil:
+				w.Write(fixtures[id[1:]])
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := workflow.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	pending, err := store.Request("pending")
+	if err != nil {
+		t.Fatalf("request fails: %v", err)
+	}
+	if pending.Status != "PENDING" || pending.RequestJustification != "deploy hotfix" ||
+		pending.GrantStart != "2021-03-01T12:00:00Z" || pending.GrantEnd != "2021-03-01T20:00:00Z" ||
+		pending.RequestedRole.Name != "production" || pending.TargetUser.ID != "u1" ||
+		len(pending.Steps) != 1 || pending.Steps[0].Approvers[0].Decision != "" {
+		t.Errorf("unexpected request: %+v", pending)
+	}
+
+	approved, err := store.Request("approved")
+	if err != nil {
+		t.Fatalf("request fails: %v", err)
+	}
+	approver := approved.Steps[0].Approvers[0]
+	if approved.Status != "ACCEPTED" || approved.FloatingLength != 8 ||
+		approver.Decision != "ACCEPTED" || approver.User.ID != "u3" ||
+		approver.DecisionTime != "2021-03-01T10:05:00Z" {
+		t.Errorf("unexpected request: %+v", approved)
+	}
+
+	rejected, err := store.Request("rejected")
+	if err != nil {
+		t.Fatalf("request fails: %v", err)
+	}
+	approver = rejected.Steps[0].Approvers[0]
+	if rejected.Status != "DENIED" || approver.Decision != "DENIED" ||
+		approver.Comment != "no justification" {
+		t.Errorf("unexpected request: %+v", rejected)
+	}
+
+	for filter, count := range map[workflow.RequestFilter]int{
+		workflow.RequestsAll:  3,
+		workflow.RequestsToMe: 1,
+	} {
+		requests, err := store.Requests(0, 10, filter)
+		if err != nil || len(requests) != count {
+			t.Errorf("filter %q: unexpected requests %d, %v", filter, len(requests), err)
+		}
+	}
+}
+
+func TestCreateAccessRequest(t *testing.T) {
+	var requests []map[string]interface{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/role-store/api/v1/users/current":
+				w.Write([]byte(`{"id": "me"}`))
+			case "/workflow-engine/api/v1/requests":
+				request := map[string]interface{}{}
+				json.NewDecoder(r.Body).Decode(&request)
+				if request["request_justification"] == nil {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"error_code": "REQUEST_JUSTIFICATION_REQUIRED"}`))
+					return
+				}
+				requests = append(requests, request)
+				fmt.Fprintf(w, `{"id": "req-%d"}`, len(requests))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := workflow.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	id, err := store.CreateAccessRequest(workflow.RequestInput{
+		RoleID:        "r-prod",
+		GrantType:     workflow.GrantFloating,
+		Duration:      90 * time.Minute,
+		Justification: "incident 42",
+	})
+	if err != nil || id != "req-1" {
+		t.Fatalf("unexpected request: %s, %v", id, err)
+	}
+
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	id, err = store.CreateAccessRequest(workflow.RequestInput{
+		RoleID:        "r-prod",
+		TargetUserID:  "u2",
+		GrantType:     workflow.GrantTimeRestricted,
+		Start:         start,
+		End:           start.Add(8 * time.Hour),
+		Justification: "deploy hotfix",
+	})
+	if err != nil || id != "req-2" {
+		t.Fatalf("unexpected request: %s, %v", id, err)
+	}
+
+	expect := []map[string]interface{}{
+		{
+			"grant_type":            "FLOATING",
+			"floating_length":       float64(2),
+			"request_justification": "incident 42",
+			"target_user":           map[string]interface{}{"id": "me"},
+			"requester":             map[string]interface{}{},
+			"requested_role":        map[string]interface{}{"id": "r-prod"},
+		},
+		{
+			"grant_type":            "TIME_RESTRICTED",
+			"grant_start":           "2021-03-01T12:00:00Z",
+			"grant_end":             "2021-03-01T20:00:00Z",
+			"request_justification": "deploy hotfix",
+			"target_user":           map[string]interface{}{"id": "u2"},
+			"requester":             map[string]interface{}{},
+			"requested_role":        map[string]interface{}{"id": "r-prod"},
+		},
+	}
+	if !reflect.DeepEqual(requests, expect) {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+
+	_, err = store.CreateAccessRequest(workflow.RequestInput{
+		RoleID:    "r-prod",
+		GrantType: workflow.GrantPermanent,
+	})
+	if !errors.Is(err, workflow.ErrJustificationRequired) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, input := range []workflow.RequestInput{
+		{GrantType: workflow.GrantPermanent},
+		{RoleID: "r-prod", GrantType: workflow.GrantFloating},
+		{RoleID: "r-prod", GrantType: workflow.GrantTimeRestricted, Start: start, End: start},
+		{RoleID: "r-prod", GrantType: "FOREVER"},
+	} {
+		if _, err := store.CreateAccessRequest(input); err == nil {
+			t.Errorf("invalid request is accepted: %+v", input)
+		}
+	}
+	if len(requests) != 2 {
+		t.Errorf("invalid requests are sent: %d", len(requests))
+	}
+}
+
+func TestDecideRequest(t *testing.T) {
+	decisions := map[string]workflow.Decision{}
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/workflow-engine/api/v1/requests/"), "/decision")
+			switch id {
+			case "others":
+				w.WriteHeader(http.StatusForbidden)
+			case "closed":
+				w.WriteHeader(http.StatusConflict)
+			case "decided":
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error_code": "REQUEST_ALREADY_DECIDED"}`))
+			default:
+				decision := workflow.Decision{}
+				json.NewDecoder(r.Body).Decode(&decision)
+				decisions[id] = decision
+			}
+		}),
+	)
+	defer ts.Close()
+
+	store := workflow.New(restapi.New(restapi.BaseURL(ts.URL)))
+
+	approve := workflow.Decision{Step: 1, Decision: workflow.DecisionApprove}
+	if err := store.DecideRequest("req-1", approve); err != nil {
+		t.Errorf("approve fails: %v", err)
+	}
+	reject := workflow.Decision{Decision: workflow.DecisionReject, Comment: "no justification"}
+	if err := store.DecideRequest("req-2", reject); err != nil {
+		t.Errorf("reject fails: %v", err)
+	}
+	expect := map[string]workflow.Decision{"req-1": approve, "req-2": reject}
+	if !reflect.DeepEqual(decisions, expect) {
+		t.Errorf("unexpected decisions: %+v", decisions)
+	}
+
+	if err := store.DecideRequest("others", approve); !errors.Is(err, restapi.ErrForbidden) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, id := range []string{"closed", "decided"} {
+		if err := store.DecideRequest(id, approve); !errors.Is(err, restapi.ErrConflict) {
+			t.Errorf("unexpected error for %s: %v", id, err)
+		}
+	}
+
+	if err := store.DecideRequest("req-3", workflow.Decision{Decision: "MAYBE"}); err == nil {
+		t.Errorf("unknown decision is accepted")
+	}
+	if len(decisions) != 2 {
+		t.Errorf("unknown decision is sent")
+	}
+}
+
+func TestFindRequests(t *testing.T) {
+	var body string
+	var query string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || r.URL.Path != "/workflow-engine/api/v1/requests/search" {
+				t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+			}
+			data, _ := io.ReadAll(r.Body)
+			body = strings.TrimSpace(string(data))
+			query = r.URL.RawQuery
+			w.Write([]byte(`{"count": 1, "items": [{"id": "req-1", "status": "PENDING"}]}`))
+		}),
+	)
+	defer ts.Close()
+
+	store := workflow.New(restapi.New(restapi.BaseURL(ts.URL)))
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.FixedZone("EET", 2*3600))
+
+	for _, tc := range []struct {
+		params workflow.RequestSearchParams
+		body   string
+		query  string
+	}{
+		{
+			params: workflow.RequestSearchParams{},
+			body:   `{}`,
+		},
+		{
+			params: workflow.RequestSearchParams{RoleIDs: []string{"r1", "r2"}},
+			body:   `{"role_id":["r1","r2"]}`,
+		},
+		{
+			params: workflow.RequestSearchParams{RequesterIDs: []string{"u1"}},
+			body:   `{"requester_id":["u1"]}`,
+		},
+		{
+			params: workflow.RequestSearchParams{Statuses: []workflow.RequestStatus{workflow.StatusPending, workflow.StatusDenied}},
+			body:   `{"status":["PENDING","DENIED"]}`,
+		},
+		{
+			params: workflow.RequestSearchParams{Start: start, End: start.AddDate(0, 0, 7)},
+			body:   `{"start_time":"2021-03-01T10:00:00Z","end_time":"2021-03-08T10:00:00Z"}`,
+		},
+		{
+			params: workflow.RequestSearchParams{Keywords: "prod", Offset: 10, Limit: 5, Sortkey: "created", Sortdir: "DESC"},
+			body:   `{"keywords":"prod"}`,
+			query:  "limit=5&offset=10&sortdir=DESC&sortkey=created",
+		},
+	} {
+		requests, err := store.FindRequests(tc.params)
+		if err != nil || len(requests) != 1 || requests[0].Status != workflow.StatusPending {
+			t.Errorf("unexpected requests: %+v, %v", requests, err)
+		}
+		if body != tc.body {
+			t.Errorf("unexpected body: %s, expected %s", body, tc.body)
+		}
+		if query != tc.query {
+			t.Errorf("unexpected query: %s, expected %s", query, tc.query)
+		}
+	}
+}
@@ -6,6 +6,19 @@
 
 package workflow
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrJustificationRequired is returned when request lacks justification
+// required by the workflow
+var ErrJustificationRequired = errors.New("workflow requires justification of the request")
+
+// errorJustificationRequired is error code of ErrJustificationRequired
+const errorJustificationRequired = "REQUEST_JUSTIFICATION_REQUIRED"
+
 // Params struct for pagination queries
 type Params struct {
 	Offset  int    `json:"offset,omitempty"`
@@ -80,11 +93,14 @@ type Workflow struct {
 	Comment              string `json:"comment,omitempty"`
 	WorkflowID           string `json:"workflow,omitempty"`
 	FloatingLength       int    `json:"floating_length,omitempty"`
-	TargetRoles          []Role `json:"target_roles,omitempty"`
-	Steps                []Step `json:"steps,omitempty"`
-	TargetUser           User   `json:"target_user,omitempty"`
-	Requester            User   `json:"requester,omitempty"`
-	RequestedRole        Role   `json:"requested_role,omitempty"`
+	// MaxTimeRestriction limits duration of the grant in hours
+	MaxTimeRestriction      int    `json:"max_time_restriction,omitempty"`
+	TimeRestrictionRequired bool   `json:"time_restriction_required,omitempty"`
+	TargetRoles             []Role `json:"target_roles,omitempty"`
+	Steps                   []Step `json:"steps,omitempty"`
+	TargetUser              User   `json:"target_user,omitempty"`
+	Requester               User   `json:"requester,omitempty"`
+	RequestedRole           Role   `json:"requested_role,omitempty"`
 }
 
 // Search request search definition
@@ -94,13 +110,75 @@ type Search struct {
 	EndTime   string `json:"end_time,omitempty"`
 }
 
-// Decision request decision definition
+// RequestStatus is status of access request
+type RequestStatus string
+
+// RequestStatus values
+const (
+	StatusPending  = RequestStatus("PENDING")
+	StatusAccepted = RequestStatus("ACCEPTED")
+	StatusDenied   = RequestStatus("DENIED")
+	StatusRevoked  = RequestStatus("REVOKED")
+	StatusExpired  = RequestStatus("EXPIRED")
+)
+
+// RequestSearchParams is typed filter of access requests. Start and End
+// limit creation time of requests.
+type RequestSearchParams struct {
+	Keywords     string
+	RoleIDs      []string
+	RequesterIDs []string
+	Statuses     []RequestStatus
+	Start        time.Time
+	End          time.Time
+	Offset       int
+	Limit        int
+	Sortkey      string
+	Sortdir      string
+}
+
+type requestSearchBody struct {
+	Keywords     string          `json:"keywords,omitempty"`
+	RoleIDs      []string        `json:"role_id,omitempty"`
+	RequesterIDs []string        `json:"requester_id,omitempty"`
+	Statuses     []RequestStatus `json:"status,omitempty"`
+	StartTime    string          `json:"start_time,omitempty"`
+	EndTime      string          `json:"end_time,omitempty"`
+}
+
+func (params *RequestSearchParams) body() requestSearchBody {
+	body := requestSearchBody{
+		Keywords:     params.Keywords,
+		RoleIDs:      params.RoleIDs,
+		RequesterIDs: params.RequesterIDs,
+		Statuses:     params.Statuses,
+	}
+	if !params.Start.IsZero() {
+		body.StartTime = params.Start.UTC().Format(time.RFC3339)
+	}
+	if !params.End.IsZero() {
+		body.EndTime = params.End.UTC().Format(time.RFC3339)
+	}
+	return body
+}
+
+// Decision request decision definition, Step is index of the decided step
+// and Decision is either DecisionApprove or DecisionReject
 type Decision struct {
 	Step     int    `json:"step"`
 	Decision string `json:"decision"`
 	Comment  string `json:"comment,omitempty"`
 }
 
+// Decisions of request step
+const (
+	DecisionApprove = "ACCEPTED"
+	DecisionReject  = "DENIED"
+)
+
+// errorRequestDecided is error code of decision on already decided request
+const errorRequestDecided = "REQUEST_ALREADY_DECIDED"
+
 // RequestStepApprover request step approver definition
 type RequestStepApprover struct {
 	ID           string `json:"id,omitempty"`
@@ -119,6 +197,37 @@ type RequestStep struct {
 	Approvers []RequestStepApprover `json:"approvers,omitempty"`
 }
 
+// RequestFilter selects requests of the request queue, see Engine.Requests
+type RequestFilter string
+
+// RequestFilter values
+const (
+	RequestsAll  = RequestFilter("")
+	RequestsByMe = RequestFilter("byMe")
+	RequestsToMe = RequestFilter("toMe")
+)
+
+// Grant types of access request
+const (
+	GrantPermanent      = "PERMANENT"
+	GrantTimeRestricted = "TIME_RESTRICTED"
+	GrantFloating       = "FLOATING"
+)
+
+// RequestInput is access request to a role. The request is made for the
+// calling user if TargetUserID is not defined. Time restricted grant is
+// valid from Start to End, floating grant for Duration from its first use,
+// rounded up to full hours.
+type RequestInput struct {
+	RoleID        string
+	TargetUserID  string
+	GrantType     string
+	Start         time.Time
+	End           time.Time
+	Duration      time.Duration
+	Justification string
+}
+
 // Request request response definition
 type Request struct {
 	ID                   string        `json:"id,omitempty"`
@@ -132,7 +241,7 @@ type Request struct {
 	GrantStart           string        `json:"grant_start,omitempty"`
 	GrantEnd             string        `json:"grant_end,omitempty"`
 	Action               string        `json:"action,omitempty"`
-	Status               string        `json:"status,omitempty"`
+	Status               RequestStatus `json:"status,omitempty"`
 	Comment              string        `json:"comment,omitempty"`
 	WorkflowID           string        `json:"workflow,omitempty"`
 	FloatingLength       int           `json:"floating_length,omitempty"`
@@ -142,3 +251,35 @@ type Request struct {
 	Requester            User          `json:"requester,omitempty"`
 	RequestedRole        Role          `json:"requested_role,omitempty"`
 }
+
+func (input *RequestInput) request() (*Request, error) {
+	if input.RoleID == "" {
+		return nil, errors.New("role id is required")
+	}
+
+	request := &Request{
+		GrantType:            input.GrantType,
+		RequestJustification: input.Justification,
+		TargetUser:           User{ID: input.TargetUserID},
+		RequestedRole:        Role{ID: input.RoleID},
+	}
+
+	switch input.GrantType {
+	case GrantPermanent:
+	case GrantTimeRestricted:
+		if input.Start.IsZero() || !input.End.After(input.Start) {
+			return nil, errors.New("time restricted grant requires start before end")
+		}
+		request.GrantStart = input.Start.UTC().Format(time.RFC3339)
+		request.GrantEnd = input.End.UTC().Format(time.RFC3339)
+	case GrantFloating:
+		if input.Duration <= 0 {
+			return nil, errors.New("floating grant requires duration")
+		}
+		request.FloatingLength = int((input.Duration + time.Hour - 1) / time.Hour)
+	default:
+		return nil, fmt.Errorf("unknown grant type %q", input.GrantType)
+	}
+
+	return request, nil
+}
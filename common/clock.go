@@ -0,0 +1,28 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package common
+
+import "time"
+
+// Clock is source of time for polling helpers, it is replaceable in tests
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+// SystemClock is Clock backed by the time package
+type SystemClock struct{}
+
+// Now returns the current time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for the duration to elapse
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
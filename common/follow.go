@@ -0,0 +1,97 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package common
+
+import (
+	"context"
+	"time"
+)
+
+// Follower polls items created since the given time. Polls overlap and
+// items are de-duplicated by key, the poll window follows creation time
+// reported by server so client clock skew does not cause misses. Failed
+// polls are retried with exponential backoff.
+type Follower[T any] struct {
+	Clock    Clock
+	Interval time.Duration
+	// MaxBackoff limits delay after failures, it is at least Interval
+	MaxBackoff time.Duration
+	// Overlap is how far each poll reaches before the newest item seen,
+	// it covers items indexed late
+	Overlap time.Duration
+	// Poll lists items created from the given time, oldest first
+	Poll func(from time.Time) *Pager[T]
+	// Key identifies the item, Time is its creation time
+	Key  func(T) string
+	Time func(T) time.Time
+	// Fatal errors stop following, if not defined all errors are retried
+	Fatal func(error) bool
+	// OnError receives failures which are retried, it is optional
+	OnError func(error)
+}
+
+// Run calls handler for each item created since the time, until the
+// context is cancelled. Handler error and fatal failures stop following,
+// it returns nil when the context is cancelled.
+func (f Follower[T]) Run(ctx context.Context, since time.Time, handler func(T) error) error {
+	cursor := since
+	seen := map[string]time.Time{}
+	delay := f.Interval
+	maxBackoff := f.MaxBackoff
+	if maxBackoff < f.Interval {
+		maxBackoff = f.Interval
+	}
+
+	for {
+		items := f.Poll(cursor.Add(-f.Overlap))
+		for ctx.Err() == nil && items.Next() {
+			item := items.Value()
+			created := f.Time(item)
+			key := f.Key(item)
+			if _, ok := seen[key]; ok || created.Before(since) {
+				continue
+			}
+
+			seen[key] = created
+			if created.After(cursor) {
+				cursor = created
+			}
+			if err := handler(item); err != nil {
+				return err
+			}
+		}
+
+		err := items.Err()
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil && f.Fatal != nil && f.Fatal(err):
+			return err
+		case err != nil:
+			if f.OnError != nil {
+				f.OnError(err)
+			}
+			if delay *= 2; delay > maxBackoff {
+				delay = maxBackoff
+			}
+		default:
+			delay = f.Interval
+		}
+
+		for key, created := range seen {
+			if created.Before(cursor.Add(-f.Overlap)) {
+				delete(seen, key)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-f.Clock.After(delay):
+		}
+	}
+}
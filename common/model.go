@@ -1,7 +1,5 @@
 package common
 
-import "time"
-
 // KeyValue key value definition
 type KeyValue struct {
 	Key   string `json:"k"`
@@ -18,5 +16,5 @@ type ServiceStatus struct {
 	ApplicationID string     `json:"app_id,omitempty"`
 	ServerMode    string     `json:"server-mode,omitempty"`
 	StatusDetails []KeyValue `json:"status_details,omitempty"`
-	StartTime     time.Time  `json:"start_time,omitempty"`
+	StartTime     Time       `json:"start_time,omitempty"`
 }
@@ -0,0 +1,115 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package common
+
+// PageFetcher fetches a page of items, it returns items and total count
+// of items reported by the list endpoint
+type PageFetcher[T any] func(offset, limit int) ([]T, int, error)
+
+// Pager iterates over paged list results, fetching pages on demand
+//
+//	pager := common.NewPager(100, fetch)
+//	for pager.Next() {
+//		item := pager.Value()
+//	}
+//	if err := pager.Err(); err != nil {
+//		...
+//	}
+type Pager[T any] struct {
+	fetch    PageFetcher[T]
+	pageSize int
+	offset   int
+	page     []T
+	index    int
+	total    int
+	done     bool
+	err      error
+	keep     func(T) bool
+}
+
+// NewPager creates a pager, fetching pageSize items at once
+func NewPager[T any](pageSize int, fetch PageFetcher[T]) *Pager[T] {
+	return &Pager[T]{
+		fetch:    fetch,
+		pageSize: pageSize,
+		index:    -1,
+	}
+}
+
+// Filter skips items for which keep returns false, paging is not affected
+func (pager *Pager[T]) Filter(keep func(T) bool) *Pager[T] {
+	pager.keep = keep
+	return pager
+}
+
+// Next advances to the next item. It returns false when items are
+// exhausted or fetching of the page fails, see Err.
+func (pager *Pager[T]) Next() bool {
+	for pager.advance() {
+		if pager.keep == nil || pager.keep(pager.page[pager.index]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (pager *Pager[T]) advance() bool {
+	if pager.err != nil {
+		return false
+	}
+
+	pager.index++
+	if pager.index < len(pager.page) {
+		return true
+	}
+
+	if pager.done {
+		return false
+	}
+
+	items, total, err := pager.fetch(pager.offset, pager.pageSize)
+	if err != nil {
+		pager.err = err
+		return false
+	}
+
+	pager.page = items
+	pager.index = 0
+	pager.total = total
+	pager.offset += len(items)
+	pager.done = len(items) < pager.pageSize ||
+		(total > 0 && pager.offset >= total)
+
+	return len(items) > 0
+}
+
+// Value returns the current item
+func (pager *Pager[T]) Value() T {
+	return pager.page[pager.index]
+}
+
+// Err returns the error occurred during the iteration
+func (pager *Pager[T]) Err() error {
+	return pager.err
+}
+
+// TotalCount returns total count of items reported by the list endpoint,
+// it is available after the first call of Next.
+func (pager *Pager[T]) TotalCount() int {
+	return pager.total
+}
+
+// All collects remaining items
+func (pager *Pager[T]) All() ([]T, error) {
+	seq := []T{}
+	for pager.Next() {
+		seq = append(seq, pager.Value())
+	}
+
+	return seq, pager.Err()
+}
@@ -0,0 +1,113 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package common_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/SSHcom/privx-sdk-go/common"
+)
+
+type mockList struct {
+	items    []int
+	total    int
+	failAt   int
+	requests [][2]int
+}
+
+func (list *mockList) fetch(offset, limit int) ([]int, int, error) {
+	list.requests = append(list.requests, [2]int{offset, limit})
+	if list.failAt > 0 && offset >= list.failAt {
+		return nil, 0, errors.New("broken page")
+	}
+
+	end := offset + limit
+	if end > len(list.items) {
+		end = len(list.items)
+	}
+	return list.items[offset:end], list.total, nil
+}
+
+func seq(n int) []int {
+	items := make([]int, n)
+	for i := range items {
+		items[i] = i
+	}
+	return items
+}
+
+func TestPager(t *testing.T) {
+	list := &mockList{items: seq(25), total: 25}
+	pager := common.NewPager(10, list.fetch)
+
+	items, err := pager.All()
+	if err != nil || !reflect.DeepEqual(items, seq(25)) {
+		t.Errorf("unexpected items: %v, %v", items, err)
+	}
+	if pager.TotalCount() != 25 {
+		t.Errorf("unexpected total count: %d", pager.TotalCount())
+	}
+
+	expect := [][2]int{{0, 10}, {10, 10}, {20, 10}}
+	if !reflect.DeepEqual(list.requests, expect) {
+		t.Errorf("unexpected requests: %v", list.requests)
+	}
+}
+
+func TestPagerExactPages(t *testing.T) {
+	// total count stops paging, without it an empty page is requested
+	list := &mockList{items: seq(20), total: 20}
+	if items, _ := common.NewPager(10, list.fetch).All(); len(items) != 20 || len(list.requests) != 2 {
+		t.Errorf("unexpected paging: %d items, %v", len(items), list.requests)
+	}
+
+	list = &mockList{items: seq(20)}
+	if items, _ := common.NewPager(10, list.fetch).All(); len(items) != 20 || len(list.requests) != 3 {
+		t.Errorf("unexpected paging: %d items, %v", len(items), list.requests)
+	}
+}
+
+func TestPagerEmpty(t *testing.T) {
+	list := &mockList{}
+	pager := common.NewPager(10, list.fetch)
+
+	if pager.Next() {
+		t.Errorf("unexpected item: %v", pager.Value())
+	}
+	if pager.Err() != nil || pager.TotalCount() != 0 {
+		t.Errorf("unexpected result: %v, %d", pager.Err(), pager.TotalCount())
+	}
+}
+
+func TestPagerFailure(t *testing.T) {
+	list := &mockList{items: seq(25), total: 25, failAt: 10}
+	pager := common.NewPager(10, list.fetch)
+
+	items, err := pager.All()
+	if err == nil || len(items) != 10 {
+		t.Errorf("unexpected result: %d items, %v", len(items), err)
+	}
+
+	if pager.Next() || len(list.requests) != 2 {
+		t.Errorf("failed pager is advanced: %v", list.requests)
+	}
+}
+
+func TestPagerFilter(t *testing.T) {
+	list := &mockList{items: seq(25), total: 25}
+	pager := common.NewPager(10, list.fetch).Filter(func(i int) bool { return i%10 == 9 })
+
+	items, err := pager.All()
+	if err != nil || !reflect.DeepEqual(items, []int{9, 19}) {
+		t.Errorf("unexpected items: %v, %v", items, err)
+	}
+	if len(list.requests) != 3 {
+		t.Errorf("filter affects paging: %v", list.requests)
+	}
+}
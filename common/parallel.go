@@ -0,0 +1,50 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package common
+
+import (
+	"errors"
+	"sync"
+)
+
+// ParallelDo applies f to items, running at most concurrency calls at
+// once. It returns the number of succeeded calls and the joined errors of
+// failed ones.
+func ParallelDo[T any](items []T, concurrency int, f func(T) error) (int, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		slot      = make(chan struct{}, concurrency)
+		succeeded int
+		errs      []error
+	)
+
+	for _, item := range items {
+		wg.Add(1)
+		slot <- struct{}{}
+		go func(item T) {
+			defer func() { <-slot; wg.Done() }()
+
+			err := f(item)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			succeeded++
+		}(item)
+	}
+	wg.Wait()
+
+	return succeeded, errors.Join(errs...)
+}
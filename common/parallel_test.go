@@ -0,0 +1,81 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package common_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/SSHcom/privx-sdk-go/common"
+)
+
+func TestParallelDo(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		running int
+		peak    int
+		seen    = map[int]bool{}
+	)
+
+	succeeded, err := common.ParallelDo(seq(20), 3, func(i int) error {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		seen[i] = true
+		mu.Unlock()
+
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		if i%5 == 0 {
+			return fmt.Errorf("item %d fails", i)
+		}
+		return nil
+	})
+
+	if succeeded != 16 || len(seen) != 20 {
+		t.Errorf("unexpected result: %d succeeded, %d called", succeeded, len(seen))
+	}
+	if peak > 3 {
+		t.Errorf("concurrency is not bounded: %d", peak)
+	}
+	for _, i := range []int{0, 5, 10, 15} {
+		if !strings.Contains(err.Error(), fmt.Sprintf("item %d fails", i)) {
+			t.Errorf("error of item %d is not joined: %v", i, err)
+		}
+	}
+}
+
+func TestParallelDoSequential(t *testing.T) {
+	order := []int{}
+	succeeded, err := common.ParallelDo(seq(5), 0, func(i int) error {
+		order = append(order, i)
+		return nil
+	})
+
+	if err != nil || succeeded != 5 || len(order) != 5 {
+		t.Errorf("unexpected result: %d, %v, %v", succeeded, order, err)
+	}
+}
+
+func TestParallelDoEmpty(t *testing.T) {
+	succeeded, err := common.ParallelDo(nil, 4, func(int) error {
+		return errors.New("unexpected call")
+	})
+
+	if err != nil || succeeded != 0 {
+		t.Errorf("unexpected result: %d, %v", succeeded, err)
+	}
+}
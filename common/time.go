@@ -0,0 +1,63 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Time is timestamp of REST response. It is decoded from RFC3339 string or
+// epoch milliseconds, given as number or numeric string. Null and empty
+// string are decoded to zero time. It is always encoded as RFC3339.
+type Time struct {
+	time.Time
+}
+
+// UnmarshalJSON decodes RFC3339 or epoch milliseconds timestamp
+func (t *Time) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		if text == "" {
+			t.Time = time.Time{}
+			return nil
+		}
+		if _, err := strconv.ParseFloat(text, 64); err != nil {
+			at, err := time.Parse(time.RFC3339Nano, text)
+			if err != nil {
+				return err
+			}
+			t.Time = at
+			return nil
+		}
+		data = []byte(text)
+	}
+
+	millis, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", data)
+	}
+	t.Time = time.UnixMilli(int64(millis)).UTC()
+	return nil
+}
+
+// MarshalJSON encodes the time as RFC3339 string
+func (t Time) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(time.RFC3339Nano))
+}
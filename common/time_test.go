@@ -0,0 +1,62 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package common_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/SSHcom/privx-sdk-go/common"
+)
+
+func TestTimeUnmarshal(t *testing.T) {
+	at := time.Date(2021, 3, 1, 10, 20, 30, 0, time.UTC)
+
+	for input, expect := range map[string]time.Time{
+		`null`:                        {},
+		`""`:                          {},
+		`"1614594030000"`:             at,
+		`1614594030000`:               at,
+		`1614594030000.0`:             at,
+		`"2021-03-01T10:20:30Z"`:      at,
+		`"2021-03-01T12:20:30+02:00"`: at,
+		`"2021-03-01T10:20:30.5Z"`:    at.Add(500 * time.Millisecond),
+	} {
+		var value common.Time
+		if err := json.Unmarshal([]byte(input), &value); err != nil {
+			t.Errorf("%s fails: %v", input, err)
+			continue
+		}
+		if !value.Equal(expect) {
+			t.Errorf("%s is decoded to %v", input, value.Time)
+		}
+	}
+}
+
+func TestTimeUnmarshalInvalid(t *testing.T) {
+	for _, input := range []string{`"yesterday"`, `"2021-03-01"`, `true`, `{}`, `"10:20"`} {
+		var value common.Time
+		if err := json.Unmarshal([]byte(input), &value); err == nil {
+			t.Errorf("%s is accepted: %v", input, value.Time)
+		}
+	}
+}
+
+func TestTimeMarshal(t *testing.T) {
+	value := common.Time{Time: time.Date(2021, 3, 1, 12, 20, 30, 0, time.FixedZone("EET", 2*3600))}
+
+	data, err := json.Marshal(value)
+	if err != nil || string(data) != `"2021-03-01T10:20:30Z"` {
+		t.Errorf("unexpected encoding: %s, %v", data, err)
+	}
+
+	var decoded common.Time
+	if err := json.Unmarshal(data, &decoded); err != nil || !decoded.Equal(value.Time) {
+		t.Errorf("unexpected round trip: %v, %v", decoded.Time, err)
+	}
+}
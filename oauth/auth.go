@@ -1,6 +1,7 @@
 package oauth
 
 import (
+	"errors"
 	"strings"
 
 	"github.com/SSHcom/privx-sdk-go/restapi"
@@ -26,8 +27,27 @@ of access/secret key is provided. It allows usage of username and password
 
 */
 func With(client restapi.Connector, opts ...Option) restapi.Authorizer {
+	return strategy(newAuth(client, opts...))
+}
+
+// ErrNoCredentials is returned by New if credentials are not configured
+var ErrNoCredentials = errors.New(
+	"no api client credentials, use oauth options or PRIVX_API_CLIENT_ID and PRIVX_API_CLIENT_SECRET",
+)
+
+// New is With, failing with ErrNoCredentials if neither access/secret key
+// pair nor explicit token is configured
+func New(client restapi.Connector, opts ...Option) (restapi.Authorizer, error) {
 	auth := newAuth(client, opts...)
 
+	if auth.secret == "" || (auth.access == "" && !strings.HasPrefix(auth.secret, "Bearer")) {
+		return nil, ErrNoCredentials
+	}
+
+	return strategy(auth), nil
+}
+
+func strategy(auth *tAuth) restapi.Authorizer {
 	if strings.HasPrefix(auth.secret, "Bearer") {
 		return &tAuthExplicit{auth.secret}
 	}
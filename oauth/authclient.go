@@ -60,7 +60,7 @@ func (auth *tAuthPassword) grantPasswordCredentials() error {
 		Header("Authorization", "Basic "+auth.digest).
 		Post(request, &token)
 
-	if err != nil {
+	if err == nil {
 		token.notAfter = time.Now().Add(
 			time.Duration(token.ExpiresIn) * time.Second)
 	}
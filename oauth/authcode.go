@@ -155,7 +155,7 @@ func (auth *tAuth) authAccessToken(code string, cv pkce.CodeVerifier) (*AccessTo
 		Header("Content-Type", "application/x-www-form-urlencoded").
 		Post(request, &token)
 
-	if err != nil {
+	if err == nil {
 		token.notAfter = time.Now().Add(
 			time.Duration(token.ExpiresIn) * time.Second)
 	}
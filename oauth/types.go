@@ -72,6 +72,14 @@ func (auth *tAuth) synchronized(f func() error) (err error) {
 	return
 }
 
+// Refresh discards access token, the new one is obtained on next request
+func (auth *tAuth) Refresh() {
+	auth.L.Lock()
+	defer auth.L.Unlock()
+
+	auth.token = nil
+}
+
 // tClientID is a pair of unique client id and redirect uri
 type tClientID struct {
 	ID          string `json:"client_id"`
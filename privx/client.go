@@ -0,0 +1,86 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+// Package privx builds ready to use, authenticated PrivX API client
+//
+//	client, err := privx.NewClient("https://privx.example.com")
+//	if err != nil {
+//		...
+//	}
+//	roles := rolestore.New(client)
+package privx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/SSHcom/privx-sdk-go/oauth"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+// ErrNoBaseURL is returned if PrivX address is not given
+var ErrNoBaseURL = errors.New("no base url, give it explicitly or use PRIVX_API_BASE_URL")
+
+// Config of authenticated connector
+type Config struct {
+	// BaseURL of PrivX, PRIVX_API_BASE_URL is used if empty
+	BaseURL string
+	// API options are applied to the connector and to the token requests,
+	// e.g. restapi.TrustAnchor or restapi.Proxy
+	API []restapi.Option
+	// Auth options are applied after credentials from environment
+	Auth []oauth.Option
+}
+
+// NewClient creates authenticated connector. Base URL and credentials are
+// read from environment, explicit base URL and options take precedence.
+// Missing base URL or credentials are reported as error, so are invalid
+// config files.
+func NewClient(baseURL string, opts ...oauth.Option) (restapi.Connector, error) {
+	return New(Config{BaseURL: baseURL, Auth: opts})
+}
+
+// New creates authenticated connector from config, see NewClient
+func New(config Config) (client restapi.Connector, err error) {
+	baseURL := config.BaseURL
+	if baseURL == "" {
+		baseURL = os.Getenv("PRIVX_API_BASE_URL")
+	}
+	if baseURL == "" {
+		return nil, ErrNoBaseURL
+	}
+
+	// config file and proxy options panic on invalid input
+	defer recoverOption(&err)
+
+	api := append(append([]restapi.Option{}, config.API...), restapi.BaseURL(baseURL))
+	auth, err := oauth.New(restapi.New(api...),
+		append([]oauth.Option{oauth.UseEnvironment()}, config.Auth...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return restapi.New(append(api, restapi.Auth(auth))...), nil
+}
+
+// recoverOption turns error raised by option into config error, other
+// panics are not related to config and are propagated
+func recoverOption(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	cause, ok := r.(error)
+	var rt runtime.Error
+	if !ok || errors.As(cause, &rt) {
+		panic(r)
+	}
+
+	*err = fmt.Errorf("privx client config: %w", cause)
+}
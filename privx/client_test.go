@@ -0,0 +1,111 @@
+//
+// Copyright (c) 2021 SSH Communications Security Inc.
+//
+// All rights reserved.
+//
+
+package privx_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SSHcom/privx-sdk-go/oauth"
+	"github.com/SSHcom/privx-sdk-go/privx"
+	"github.com/SSHcom/privx-sdk-go/restapi"
+)
+
+func TestNewClient(t *testing.T) {
+	var token string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token = r.Header.Get("Authorization")
+			w.Write([]byte(`{}`))
+		}),
+	)
+	defer ts.Close()
+
+	client, err := privx.NewClient(ts.URL, oauth.Secret("Bearer explicit"))
+	if err != nil {
+		t.Fatalf("client fails: %v", err)
+	}
+
+	if _, err := client.URL("/role-store/api/v1/roles").Get(&struct{}{}); err != nil {
+		t.Errorf("request fails: %v", err)
+	}
+	if token != "Bearer explicit" {
+		t.Errorf("request is not authenticated: %q", token)
+	}
+}
+
+func TestNewClientMissingConfig(t *testing.T) {
+	t.Setenv("PRIVX_API_BASE_URL", "")
+	t.Setenv("PRIVX_API_CLIENT_ID", "")
+	t.Setenv("PRIVX_API_CLIENT_SECRET", "")
+
+	if _, err := privx.NewClient(""); !errors.Is(err, privx.ErrNoBaseURL) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err := privx.NewClient("https://privx.example.com")
+	if !errors.Is(err, oauth.ErrNoCredentials) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = privx.NewClient("https://privx.example.com", oauth.Access("id"))
+	if !errors.Is(err, oauth.ErrNoCredentials) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = privx.NewClient("https://privx.example.com", oauth.UseConfigFile("missing.toml"))
+	if err == nil {
+		t.Errorf("missing config file is accepted")
+	}
+}
+
+func TestNewWithAPIOptions(t *testing.T) {
+	var host string
+	proxy := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host = r.URL.Host
+			w.Write([]byte(`{}`))
+		}),
+	)
+	defer proxy.Close()
+
+	client, err := privx.New(privx.Config{
+		BaseURL: "http://privx.example.com",
+		API:     []restapi.Option{restapi.Proxy(proxy.URL)},
+		Auth:    []oauth.Option{oauth.Secret("Bearer explicit")},
+	})
+	if err != nil {
+		t.Fatalf("client fails: %v", err)
+	}
+
+	if _, err := client.URL("/role-store/api/v1/roles").Get(&struct{}{}); err != nil {
+		t.Errorf("request fails: %v", err)
+	}
+	if host != "privx.example.com" {
+		t.Errorf("request is not proxied: %q", host)
+	}
+
+	_, err = privx.New(privx.Config{
+		BaseURL: "http://privx.example.com",
+		API:     []restapi.Option{restapi.Proxy("invalid")},
+	})
+	if err == nil {
+		t.Errorf("invalid proxy is accepted")
+	}
+}
+
+func TestNewClientPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("runtime error is recovered")
+		}
+	}()
+
+	privx.NewClient("https://privx.example.com", nil)
+}
@@ -8,10 +8,11 @@ package restapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
@@ -26,11 +27,14 @@ import (
 //
 // tClient is an HTTP client instance.
 type tClient struct {
-	auth    Authorizer
-	baseURL string
-	verbose bool
-	retry   int
-	http    *http.Client
+	auth      Authorizer
+	baseURL   string
+	verbose   bool
+	useNumber bool
+	retry     RetryPolicy
+	budget    time.Duration
+	maxBytes  int64
+	http      *http.Client
 }
 
 //
@@ -54,7 +58,7 @@ func New(opts ...Option) Connector {
 				return http.ErrUseLastResponse
 			},
 		},
-		retry: 2,
+		retry: RetryPolicy{Attempts: 2},
 	}
 
 	for _, opt := range opts {
@@ -64,22 +68,116 @@ func New(opts ...Option) Connector {
 	return client
 }
 
-//
-func (client *tClient) doWithRetry(req *http.Request) (*http.Response, error) {
-	for i := 0; i < client.retry; i++ {
+// doWithRetry executes the request. Transport failures are retried as
+// defined by the policy, non-idempotent requests only if they have not
+// reached the server. Auth failures are never retried, except a
+// single refresh of expired access token if authorizer supports it.
+// Request budget bounds all attempts, backoffs and reading of the body.
+func (client *tClient) doWithRetry(req *http.Request, policy RetryPolicy) (*http.Response, error) {
+	if client.budget <= 0 {
+		return client.doWithPolicy(req, policy)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), client.budget)
+	in, err := client.doWithPolicy(req.WithContext(ctx), policy)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	in.Body = &budgetBody{ReadCloser: in.Body, cancel: cancel}
+	return in, nil
+}
+
+func (client *tClient) doWithPolicy(req *http.Request, policy RetryPolicy) (*http.Response, error) {
+	refreshed := false
+
+	for i := 0; ; i++ {
+		if i > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
 		in, err := client.do(req)
 		if err != nil {
+			if retryable(req, err) && i+1 < policy.Attempts && !expires(req, policy.Backoff) {
+				if err := backoff(req.Context(), policy.Backoff); err != nil {
+					return nil, err
+				}
+				continue
+			}
 			return nil, err
 		}
 
-		if in.StatusCode == http.StatusUnauthorized {
-			continue
+		if in.StatusCode == http.StatusUnauthorized && !refreshed {
+			if refresher, ok := client.auth.(Refresher); ok {
+				io.Copy(io.Discard, in.Body)
+				in.Body.Close()
+				refresher.Refresh()
+				refreshed = true
+				continue
+			}
 		}
 
 		return in, nil
 	}
+}
+
+// retryable checks if the transport failure can be retried. Idempotent
+// requests are retried on any network error, others only if connection
+// was not established, server might have received the request otherwise.
+func retryable(req *http.Request, err error) bool {
+	var netError net.Error
+	if !errors.As(err, &netError) {
+		return false
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
 
-	return nil, fmt.Errorf("request failed after %d tries", client.retry)
+	var opError *net.OpError
+	return errors.As(err, &opError) && opError.Op == "dial"
+}
+
+// backoff waits before the next attempt, it fails if the context is
+// cancelled meanwhile
+func backoff(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// expires checks if request deadline passes before the backoff is over,
+// there is no point to retry such request
+func expires(req *http.Request, backoff time.Duration) bool {
+	if req.Context().Err() != nil {
+		return true
+	}
+
+	deadline, ok := req.Context().Deadline()
+	return ok && time.Until(deadline) <= backoff
+}
+
+// budgetBody releases request budget when response body is closed
+type budgetBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *budgetBody) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
 }
 
 func (client *tClient) do(req *http.Request) (*http.Response, error) {
@@ -95,6 +193,24 @@ func (client *tClient) do(req *http.Request) (*http.Response, error) {
 	return client.http.Do(req)
 }
 
+// readAll reads response body, failing with ErrResponseTooLarge if the
+// body exceeds the limit of the client
+func (client *tClient) readAll(body io.Reader) ([]byte, error) {
+	if client.maxBytes <= 0 {
+		return io.ReadAll(body)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, client.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > client.maxBytes {
+		return nil, ErrResponseTooLarge
+	}
+
+	return data, nil
+}
+
 // URL creates a connector to specified endpoint. It is either absolute
 // URL or relative path to base url
 func (client *tClient) URL(templatePath string, args ...interface{}) CURL {
@@ -114,6 +230,7 @@ func (client *tClient) URL(templatePath string, args ...interface{}) CURL {
 // CURL is a builder type, constructs HTTP request
 type tCURL struct {
 	client  *tClient
+	retry   *RetryPolicy
 	method  string
 	url     string
 	header  http.Header
@@ -140,7 +257,9 @@ func (curl *tCURL) encodeURL(query interface{}) (url.Values, error) {
 	}
 
 	var params map[string]interface{}
-	if err = json.Unmarshal(bin, &params); err != nil {
+	decoder := json.NewDecoder(bytes.NewReader(bin))
+	decoder.UseNumber()
+	if err = decoder.Decode(&params); err != nil {
 		return nil, err
 	}
 
@@ -148,10 +267,8 @@ func (curl *tCURL) encodeURL(query interface{}) (url.Values, error) {
 	for key, param := range params {
 		var val string
 		switch v := param.(type) {
-		case int:
-			val = strconv.Itoa(v)
-		case float64:
-			val = fmt.Sprintf("%g", v)
+		case json.Number:
+			val = v.String()
 		case string:
 			val = v
 		case bool:
@@ -172,6 +289,25 @@ func (curl *tCURL) Header(head, value string) CURL {
 	return curl
 }
 
+// NoRetry executes the request once, it takes precedence over the
+// client-wide retry policy
+func (curl *tCURL) NoRetry() CURL {
+	return curl.Retry(RetryPolicy{Attempts: 1})
+}
+
+// Retry overrides the client-wide retry policy for the request
+func (curl *tCURL) Retry(policy RetryPolicy) CURL {
+	curl.retry = &policy
+	return curl
+}
+
+func (curl *tCURL) retryPolicy() RetryPolicy {
+	if curl.retry != nil {
+		return *curl.retry
+	}
+	return curl.client.retry
+}
+
 //
 // Status payload from target URL and discards it.
 func (curl *tCURL) Status(status ...int) (http.Header, error) {
@@ -186,7 +322,7 @@ func (curl *tCURL) status(status ...int) (http.Header, error) {
 	}
 
 	defer curl.output.Body.Close()
-	body, err := io.ReadAll(curl.output.Body)
+	body, err := curl.client.readAll(curl.output.Body)
 	if err != nil {
 		return nil, err
 	}
@@ -198,11 +334,11 @@ func (curl *tCURL) status(status ...int) (http.Header, error) {
 func (curl *tCURL) isSuccess(body []byte, status ...int) error {
 	if len(status) == 1 {
 		if curl.output.StatusCode != status[0] {
-			return ErrorFromResponse(curl.output, body)
+			return newAPIError(curl.output, body)
 		}
 	} else {
 		if curl.output.StatusCode >= http.StatusBadRequest {
-			return ErrorFromResponse(curl.output, body)
+			return newAPIError(curl.output, body)
 		}
 	}
 
@@ -257,14 +393,15 @@ func (curl *tCURL) Download(filename string) error {
 		return err
 	}
 
-	resp, err := curl.client.do(req)
+	resp, err := curl.client.doWithRetry(req, curl.retryPolicy())
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		log.Fatal(resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := curl.client.readAll(resp.Body)
+		return newAPIError(resp, body)
 	}
 
 	err = writeToFile(filename, resp)
@@ -275,6 +412,30 @@ func (curl *tCURL) Download(filename string) error {
 	return nil
 }
 
+//
+// DownloadTo streams response body of the endpoint to w, response header
+// is returned for content type and disposition
+func (curl *tCURL) DownloadTo(w io.Writer) (http.Header, error) {
+	curl.method = http.MethodGet
+	curl = curl.unsafeIO()
+
+	if curl.fail != nil {
+		return nil, curl.fail
+	}
+	defer curl.output.Body.Close()
+
+	if curl.output.StatusCode != http.StatusOK {
+		body, _ := curl.client.readAll(curl.output.Body)
+		return nil, newAPIError(curl.output, body)
+	}
+
+	if _, err := io.Copy(w, curl.output.Body); err != nil {
+		return curl.output.Header, err
+	}
+
+	return curl.output.Header, nil
+}
+
 //
 // Get fetches content from endpoint
 func (curl *tCURL) Get(in interface{}) (http.Header, error) {
@@ -364,7 +525,7 @@ func (curl *tCURL) recv(data interface{}) (http.Header, error) {
 	}
 
 	defer curl.output.Body.Close()
-	body, err := io.ReadAll(curl.output.Body)
+	body, err := curl.client.readAll(curl.output.Body)
 	if err != nil {
 		return nil, err
 	}
@@ -384,7 +545,7 @@ func (curl *tCURL) Fetch() ([]byte, error) {
 	}
 
 	defer curl.output.Body.Close()
-	body, err := io.ReadAll(curl.output.Body)
+	body, err := curl.client.readAll(curl.output.Body)
 	if err != nil {
 		return nil, err
 	}
@@ -407,7 +568,7 @@ func (curl *tCURL) unsafeIO() *tCURL {
 		req.Header.Set(head, curl.header.Get(head))
 	}
 
-	curl.output, curl.fail = curl.client.doWithRetry(req)
+	curl.output, curl.fail = curl.client.doWithRetry(req, curl.retryPolicy())
 	return curl
 }
 
@@ -420,13 +581,23 @@ func (curl *tCURL) unWrap() (http.Header, error) {
 	return curl.output.Header, nil
 }
 
-// unWrap tCURL object to results and decodes JSON
+// unWrap tCURL object to results and decodes JSON, empty body
+// (e.g. 204 No Content) leaves data untouched
 func (curl *tCURL) unWrapWithData(body []byte, data interface{}) (http.Header, error) {
 	if curl.fail != nil {
 		return nil, curl.fail
 	}
 
-	err := json.Unmarshal(body, &data)
+	if len(bytes.TrimSpace(body)) == 0 {
+		return curl.output.Header, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if curl.client.useNumber {
+		decoder.UseNumber()
+	}
+
+	err := decoder.Decode(&data)
 	if err != nil {
 		return nil, err
 	}
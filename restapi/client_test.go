@@ -7,12 +7,17 @@
 package restapi_test
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/SSHcom/privx-sdk-go/restapi"
 )
@@ -86,6 +91,57 @@ func TestPost(t *testing.T) {
 	}
 }
 
+func TestRecvNoContent(t *testing.T) {
+	ts := mockStatus()
+	defer ts.Close()
+
+	in := T{ID: "id"}
+
+	_, err := restapi.New(restapi.BaseURL(ts.URL)).
+		URL("/nocontent").Delete(&in)
+
+	if err != nil {
+		t.Errorf("client fails: %v", err)
+	}
+
+	if in.ID != "id" {
+		t.Errorf("unexpected response: %v", in)
+	}
+}
+
+func TestLargeNumbers(t *testing.T) {
+	ts := mockStatus()
+	defer ts.Close()
+
+	var typed struct {
+		Count int64  `json:"count"`
+		Query string `json:"query"`
+	}
+	_, err := restapi.New(restapi.BaseURL(ts.URL)).
+		URL("/count").
+		Query(map[string]int64{"offset": 9007199254740993}).
+		Get(&typed)
+
+	if err != nil {
+		t.Errorf("client fails: %v", err)
+	}
+	if typed.Count != 9007199254740993 || typed.Query != "offset=9007199254740993" {
+		t.Errorf("unexpected response: %v", typed)
+	}
+
+	var untyped map[string]interface{}
+	_, err = restapi.New(restapi.BaseURL(ts.URL), restapi.UseNumber()).
+		URL("/count").
+		Get(&untyped)
+
+	if err != nil {
+		t.Errorf("client fails: %v", err)
+	}
+	if untyped["count"] != json.Number("9007199254740993") {
+		t.Errorf("unexpected response: %v", untyped)
+	}
+}
+
 func TestRecvNoIdP(t *testing.T) {
 	ts := mock()
 	defer ts.Close()
@@ -138,6 +194,12 @@ func mockStatus() *httptest.Server {
 				})
 				w.Write(body)
 
+			case r.URL.Path == "/count":
+				w.Write([]byte(`{"count": 9007199254740993, "query": "` + r.URL.RawQuery + `"}`))
+
+			case r.URL.Path == "/nocontent":
+				w.WriteHeader(http.StatusNoContent)
+
 			case r.URL.Path == "/echo":
 				b, _ := io.ReadAll(r.Body)
 				w.Write(b)
@@ -145,3 +207,334 @@ func mockStatus() *httptest.Server {
 		}),
 	)
 }
+
+// mockAuth issues tokens "token-1", "token-2", ... refreshing on demand
+type mockAuth struct {
+	issued    int
+	refreshed int
+}
+
+func (auth *mockAuth) AccessToken() (string, error) {
+	if auth.issued == auth.refreshed {
+		auth.issued++
+	}
+	return fmt.Sprintf("Bearer token-%d", auth.issued), nil
+}
+
+func (auth *mockAuth) Refresh() { auth.refreshed++ }
+
+// mockExplicit is authorizer with fixed token, it cannot be refreshed
+type mockExplicit struct{}
+
+func (mockExplicit) AccessToken() (string, error) { return "Bearer token", nil }
+
+// mockAuthServer accepts only given token, counting requests
+func mockAuthServer(status int, token string, requests *int) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+			body, _ := io.ReadAll(r.Body)
+			if r.Header.Get("Authorization") != "Bearer "+token {
+				w.WriteHeader(status)
+				return
+			}
+			w.Write(body)
+		}),
+	)
+}
+
+func TestAuthRefreshOnce(t *testing.T) {
+	requests := 0
+	ts := mockAuthServer(http.StatusUnauthorized, "token-2", &requests)
+	defer ts.Close()
+
+	auth := &mockAuth{}
+	in := T{}
+	_, err := restapi.New(restapi.BaseURL(ts.URL), restapi.Auth(auth)).
+		URL("/echo").Post(T{ID: "id"}, &in)
+
+	if err != nil {
+		t.Errorf("expired token is not refreshed: %v", err)
+	}
+	if in.ID != "id" {
+		t.Errorf("request body is not replayed: %v", in)
+	}
+	if requests != 2 || auth.refreshed != 1 {
+		t.Errorf("unexpected requests %d, refreshes %d", requests, auth.refreshed)
+	}
+}
+
+func TestAuthBadCredentials(t *testing.T) {
+	requests := 0
+	ts := mockAuthServer(http.StatusUnauthorized, "unknown", &requests)
+	defer ts.Close()
+
+	auth := &mockAuth{}
+	_, err := restapi.New(restapi.BaseURL(ts.URL), restapi.Auth(auth), restapi.Retry(5)).
+		URL("/echo").Status()
+
+	if !errors.Is(err, restapi.ErrUnauthorized) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if requests != 2 || auth.refreshed != 1 {
+		t.Errorf("unexpected requests %d, refreshes %d", requests, auth.refreshed)
+	}
+}
+
+func TestAuthNoRefresher(t *testing.T) {
+	requests := 0
+	ts := mockAuthServer(http.StatusUnauthorized, "unknown", &requests)
+	defer ts.Close()
+
+	_, err := restapi.New(restapi.BaseURL(ts.URL), restapi.Auth(mockExplicit{}), restapi.Retry(5)).
+		URL("/echo").Status()
+
+	if !errors.Is(err, restapi.ErrUnauthorized) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("unauthorized request is retried: %d", requests)
+	}
+}
+
+func TestAuthForbidden(t *testing.T) {
+	requests := 0
+	ts := mockAuthServer(http.StatusForbidden, "unknown", &requests)
+	defer ts.Close()
+
+	auth := &mockAuth{}
+	_, err := restapi.New(restapi.BaseURL(ts.URL), restapi.Auth(auth), restapi.Retry(5)).
+		URL("/echo").Status()
+
+	if !errors.Is(err, restapi.ErrForbidden) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if requests != 1 || auth.refreshed != 0 {
+		t.Errorf("forbidden request is retried: %d", requests)
+	}
+}
+
+func TestForceHTTPVersion(t *testing.T) {
+	ts := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(fmt.Sprintf(`{"id": "%d"}`, r.ProtoMajor)))
+		}),
+	)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	for expect, opt := range map[string]restapi.Option{
+		"1": restapi.ForceHTTP1(),
+		"2": restapi.ForceHTTP2(),
+	} {
+		in := T{}
+		_, err := restapi.New(
+			restapi.BaseURL(ts.URL),
+			restapi.TrustAnchor(ts.Certificate()),
+			opt,
+		).URL("/proto").Get(&in)
+
+		if err != nil {
+			t.Errorf("client fails: %v", err)
+		}
+		if in.ID != expect {
+			t.Errorf("unexpected protocol: HTTP/%s, expected HTTP/%s", in.ID, expect)
+		}
+	}
+}
+
+// mockBroken drops connections, counting attempts
+func mockBroken(attempts *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts.Add(1)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}),
+	)
+}
+
+func TestRetryNonIdempotent(t *testing.T) {
+	var attempts atomic.Int32
+	ts := mockBroken(&attempts)
+	defer ts.Close()
+
+	client := restapi.New(restapi.BaseURL(ts.URL), restapi.Retry(3))
+
+	if _, err := client.URL("/create").Post(map[string]string{"name": "x"}); err == nil {
+		t.Errorf("broken connection is not reported")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("post is resent: %d attempts", n)
+	}
+}
+
+func TestRetryOverride(t *testing.T) {
+	var attempts atomic.Int32
+	ts := mockBroken(&attempts)
+	defer ts.Close()
+
+	client := restapi.New(restapi.BaseURL(ts.URL), restapi.Retry(3))
+
+	for expect, curl := range map[int]restapi.CURL{
+		3: client.URL("/delete"),
+		1: client.URL("/delete").NoRetry(),
+		2: client.URL("/delete").Retry(restapi.RetryPolicy{Attempts: 2}),
+	} {
+		attempts.Store(0)
+		if _, err := curl.Delete(); err == nil {
+			t.Errorf("broken connection is not reported")
+		}
+		if n := int(attempts.Load()); n != expect {
+			t.Errorf("unexpected attempts %d, expected %d", n, expect)
+		}
+	}
+}
+
+func TestDownloadTo(t *testing.T) {
+	ts := mockStatus()
+	defer ts.Close()
+
+	client := restapi.New(restapi.BaseURL(ts.URL))
+
+	out := &strings.Builder{}
+	_, err := client.URL("/echo").DownloadTo(out)
+	if err != nil {
+		t.Errorf("download fails: %v", err)
+	}
+
+	out.Reset()
+	_, err = client.URL("/users/%v", 2).DownloadTo(out)
+	var apiErr *restapi.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode != "error42" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("error response is written: %s", out)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var requested, credentials string
+	proxy := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = r.RequestURI
+			credentials = r.Header.Get("Proxy-Authorization")
+			w.Write([]byte(`{"id": "proxied"}`))
+		}),
+	)
+	defer proxy.Close()
+
+	client := restapi.New(
+		restapi.BaseURL("http://privx.example"),
+		restapi.Proxy(strings.Replace(proxy.URL, "http://", "http://alice:secret@", 1)),
+		restapi.TrustAnchor(proxy.Certificate()),
+	)
+
+	var data T
+	if _, err := client.URL("/users/1").Get(&data); err != nil {
+		t.Fatalf("proxied request fails: %v", err)
+	}
+	if data.ID != "proxied" || requested != "http://privx.example/users/1" {
+		t.Errorf("request is not proxied: %s", requested)
+	}
+	if credentials != "Basic YWxpY2U6c2VjcmV0" {
+		t.Errorf("unexpected proxy credentials: %s", credentials)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	ts := mockStatus()
+	defer ts.Close()
+
+	client := restapi.New(restapi.BaseURL(ts.URL), restapi.MaxResponseBytes(16))
+
+	_, err := client.URL("/echo").Post(map[string]string{"id": "1"})
+	if err != nil {
+		t.Errorf("small response fails: %v", err)
+	}
+
+	var out T
+	_, err = client.URL("/echo").Post(map[string]string{"id": strings.Repeat("x", 64)}, &out)
+	if !errors.Is(err, restapi.ErrResponseTooLarge) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = client.URL("/count").Fetch()
+	if !errors.Is(err, restapi.ErrResponseTooLarge) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	var attempts atomic.Int32
+	ts := mockBroken(&attempts)
+	defer ts.Close()
+
+	client := restapi.New(
+		restapi.BaseURL(ts.URL),
+		restapi.RetryWith(restapi.RetryPolicy{Attempts: 100, Backoff: 50 * time.Millisecond}),
+		restapi.RequestBudget(200*time.Millisecond),
+	)
+
+	start := time.Now()
+	if _, err := client.URL("/delete").Delete(); err == nil {
+		t.Errorf("broken connection is not reported")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("budget is exceeded: %v", elapsed)
+	}
+	if n := attempts.Load(); n < 2 || n > 4 {
+		t.Errorf("unexpected attempts %d", n)
+	}
+}
+
+func TestRequestBudgetSlowServer(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}),
+	)
+	defer ts.Close()
+
+	client := restapi.New(
+		restapi.BaseURL(ts.URL),
+		restapi.Retry(5),
+		restapi.RequestBudget(100*time.Millisecond),
+	)
+
+	start := time.Now()
+	_, err := client.URL("/slow").Get(&T{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("budget is exceeded: %v", elapsed)
+	}
+}
+
+func TestTotalCount(t *testing.T) {
+	for header, expect := range map[string]int{
+		"":     5,
+		"42":   42,
+		"0":    0,
+		"-1":   5,
+		"lots": 5,
+	} {
+		h := http.Header{}
+		if header != "" {
+			h.Set("X-Total-Count", header)
+		}
+		if count := restapi.TotalCount(h, 5); count != expect {
+			t.Errorf("%q: unexpected count %d", header, count)
+		}
+	}
+
+	if count := restapi.TotalCount(nil, 5); count != 5 {
+		t.Errorf("unexpected count %d", count)
+	}
+}
@@ -65,3 +65,84 @@ func ErrorFromResponse(r *http.Response, responseBody []byte) error {
 
 	return errors.New(msg)
 }
+
+// Sentinel errors matched by APIError, use errors.Is to check the
+// class of failure reported by REST endpoint.
+var (
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("forbidden")
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// RequestID returns X-Request-ID of the failed request, it is empty if
+// err is not APIError or server did not assign the id
+func RequestID(err error) string {
+	var apiError *APIError
+	if errors.As(err, &apiError) {
+		return apiError.RequestID
+	}
+	return ""
+}
+
+// IgnoreNotFound returns nil if err matches ErrNotFound, other errors are
+// returned as is. It is used for optional resources missing from older
+// versions of PrivX.
+func IgnoreNotFound(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// ErrResponseTooLarge is returned when response body exceeds the limit
+// defined by MaxResponseBytes
+var ErrResponseTooLarge = errors.New("response body exceeds limit")
+
+// APIError is returned by the client when REST endpoint responds with
+// error status. It carries HTTP status code and the decoded error response.
+type APIError struct {
+	ErrorResponse
+	StatusCode int
+	// RequestID is X-Request-ID of the response, it correlates the failure
+	// with server side audit events
+	RequestID string
+	err       error
+}
+
+func newAPIError(r *http.Response, responseBody []byte) error {
+	apiError := &APIError{
+		StatusCode: r.StatusCode,
+		RequestID:  r.Header.Get("X-Request-ID"),
+		err:        ErrorFromResponse(r, responseBody),
+	}
+
+	// body is optional, the message is already built by ErrorFromResponse
+	_ = json.Unmarshal(responseBody, &apiError.ErrorResponse)
+
+	return apiError
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	return e.err.Error()
+}
+
+// Is matches APIError against sentinel errors using HTTP status code.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrPreconditionFailed:
+		return e.StatusCode == http.StatusPreconditionFailed
+	}
+
+	return false
+}
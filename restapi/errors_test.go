@@ -69,3 +69,50 @@ func mockResponse() (*http.Response, []byte) {
 
 	return resp, body
 }
+
+func TestAPIErrorIs(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Request-ID", "req-1")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error_code": "NOT_FOUND", "error_message": "no such user"}`)
+		}),
+	)
+	defer ts.Close()
+
+	_, err := New(BaseURL(ts.URL)).URL("/users/1").Status()
+
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NotErrorIs(t, err, ErrConflict)
+
+	var apiError *APIError
+	if assert.ErrorAs(t, err, &apiError) {
+		assert.Equal(t, http.StatusNotFound, apiError.StatusCode)
+		assert.Equal(t, "NOT_FOUND", apiError.ErrorCode)
+		assert.Equal(t, "req-1", apiError.RequestID)
+	}
+	assert.Equal(t, "req-1", RequestID(fmt.Errorf("wrapped: %w", err)))
+	assert.Equal(t, "", RequestID(ErrNotFound))
+}
+
+func TestIgnoreNotFound(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/missing" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+		}),
+	)
+	defer ts.Close()
+
+	client := New(BaseURL(ts.URL))
+
+	_, err := client.URL("/missing").Status()
+	assert.NoError(t, IgnoreNotFound(err))
+
+	_, err = client.URL("/broken").NoRetry().Status()
+	assert.Error(t, IgnoreNotFound(err))
+	assert.NoError(t, IgnoreNotFound(nil))
+}
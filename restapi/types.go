@@ -10,7 +10,10 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // Connector is HTTP connector for api
@@ -25,6 +28,10 @@ type CURL interface {
 	Query(interface{}) CURL
 	// Header defines request header
 	Header(string, string) CURL
+	// NoRetry executes request once, regardless of client-wide policy
+	NoRetry() CURL
+	// Retry overrides client-wide retry policy for the request
+	Retry(RetryPolicy) CURL
 	// Status evalutes the request
 	Status(...int) (http.Header, error)
 	Get(interface{}) (http.Header, error)
@@ -33,6 +40,18 @@ type CURL interface {
 	Delete(...interface{}) (http.Header, error)
 	Fetch() ([]byte, error)
 	Download(string) error
+	// DownloadTo streams response body to writer without buffering it
+	DownloadTo(io.Writer) (http.Header, error)
+}
+
+// RetryPolicy defines how HTTP I/O failures are retried. Only transport
+// failures are retried, error responses are returned as is. Single
+// refresh of expired access token is made regardless of the policy.
+type RetryPolicy struct {
+	// Attempts is max number of attempts, including the first one
+	Attempts int
+	// Backoff is delay between attempts
+	Backoff time.Duration
 }
 
 // Authorizer provides access token for REST API client
@@ -40,6 +59,13 @@ type Authorizer interface {
 	AccessToken() (string, error)
 }
 
+// Refresher is optionally implemented by Authorizer, it discards cached
+// access token so that next call of AccessToken obtains a new one. The
+// client refreshes the token once when the request is rejected with 401.
+type Refresher interface {
+	Refresh()
+}
+
 const (
 	// UserAgent specifies the HTTP user-agent string for the SDK
 	// clients.
@@ -74,3 +100,13 @@ func (cert *Certificate) UnmarshalText(text []byte) error {
 	cert.X509 = c
 	return nil
 }
+
+// TotalCount returns total count of list response. Some endpoints report it
+// in X-Total-Count header instead of the body, the header is preferred and
+// the count of the body is returned if the header is missing or invalid.
+func TotalCount(header http.Header, count int) int {
+	if total, err := strconv.Atoi(header.Get("X-Total-Count")); err == nil && total >= 0 {
+		return total
+	}
+	return count
+}